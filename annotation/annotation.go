@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
 
 	"github.com/google/uuid"
 )
@@ -26,6 +27,7 @@ type Annotation struct {
 	TaskID      string                 `json:"task_id,omitempty"`
 	StudyID     string                 `json:"study_id,omitempty"`
 	CreatorName string                 `json:"creator_name"`
+	entities.Revision
 }
 type Point2D struct {
 	X float64 `json:"x"`
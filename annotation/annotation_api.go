@@ -1,6 +1,7 @@
 package annotation
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -15,18 +16,20 @@ import (
 )
 
 type AnnotationAPI struct {
-	antnStore     *AnnotationES
-	labelStore    *LabelES
-	keycloakStore *account.KeycloakStore
-	Logger        *zap.Logger
+	antnStore        AnnotationStore
+	antnHistoryStore AnnotationHistoryStore
+	labelStore       LabelStore
+	keycloakStore    *account.KeycloakStore
+	Logger           *zap.Logger
 }
 
-func NewAnnotationAPI(antnStore *AnnotationES, labelStore *LabelES, keycloakStore *account.KeycloakStore, logger *zap.Logger) (app *AnnotationAPI) {
+func NewAnnotationAPI(antnStore AnnotationStore, antnHistoryStore AnnotationHistoryStore, labelStore LabelStore, keycloakStore *account.KeycloakStore, logger *zap.Logger) (app *AnnotationAPI) {
 	app = &AnnotationAPI{
-		antnStore:     antnStore,
-		labelStore:    labelStore,
-		keycloakStore: keycloakStore,
-		Logger:        logger,
+		antnStore:        antnStore,
+		antnHistoryStore: antnHistoryStore,
+		labelStore:       labelStore,
+		keycloakStore:    keycloakStore,
+		Logger:           logger,
 	}
 	return app
 }
@@ -37,6 +40,7 @@ func (app *AnnotationAPI) InitRoute(engine *gin.Engine, path string) {
 	g.POST("", mw.ValidPerms(path, mw.PERM_C), app.createNewAnnotation)
 	g.PUT("/:id", mw.ValidPerms(path, mw.PERM_U), app.updateAnnotation)
 	g.DELETE("/:id", mw.ValidPerms(path, mw.PERM_D), app.deleteAnnotation)
+	g.GET("/:id/history", mw.ValidPerms(path, mw.PERM_R), app.getAnnotationHistory)
 }
 
 func (app *AnnotationAPI) fetchAnnotations(c *gin.Context) {
@@ -143,6 +147,7 @@ func (app *AnnotationAPI) createNewAnnotation(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
+	app.recordHistory(authInfo.ID, nil, &antn)
 
 	resp.Data = kvStr2Inf{
 		constants.ParamID: antn.ID,
@@ -162,12 +167,45 @@ func (app *AnnotationAPI) updateAnnotation(c *gin.Context) {
 
 	updateMap := make(map[string]interface{})
 	err1 := c.ShouldBind(&updateMap)
-	if err1 != nil {
+	rev, err2 := entities.ParseRevision(c.GetHeader("If-Match"))
+	if err1 != nil || err2 != nil {
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
-	app.antnStore.Update(Annotation{ID: antnID}, updateMap)
+	delete(updateMap, "seq_no")
+	delete(updateMap, "primary_term")
+
+	before, _, err := app.antnStore.Get(nil, fmt.Sprintf("_id:%s", antnID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	err = app.antnStore.Update(Annotation{ID: antnID, Revision: rev}, updateMap)
+	if errors.Is(err, utils.ErrVersionConflict) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	after, _, err := app.antnStore.Get(nil, fmt.Sprintf("_id:%s", antnID))
+	if err == nil {
+		app.recordHistory(mw.GetAuthInfoFromGin(c).ID, before, after)
+	}
 
 	c.JSON(http.StatusOK, resp)
 }
@@ -182,7 +220,60 @@ func (app *AnnotationAPI) deleteAnnotation(c *gin.Context) {
 		return
 	}
 
-	err := app.antnStore.Delete(nil, fmt.Sprintf("_id:%s", antnID))
+	rev, err := entities.ParseRevision(c.GetHeader("If-Match"))
+	if err != nil {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	before, _, err := app.antnStore.Get(nil, fmt.Sprintf("_id:%s", antnID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	// delete by query has no precondition, the revision is compared beforehand
+	if !rev.Matches(before.Revision) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+
+	err = app.antnStore.Delete(nil, fmt.Sprintf("_id:%s", antnID))
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	app.recordHistory(mw.GetAuthInfoFromGin(c).ID, before, nil)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// getAnnotationHistory returns the changes of an annotation, oldest first
+func (app *AnnotationAPI) getAnnotationHistory(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	antnID := c.Param(constants.ParamID)
+	if antnID == "" {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	histories := make([]AnnotationHistory, 0)
+	err := app.antnHistoryStore.Query(map[string][]string{"annotation_id.keyword": {antnID}}, "", 0, constants.DefaultLimit, "created",
+		func(items []AnnotationHistory, es entities.ESReturn) {
+			histories = append(histories, items...)
+		})
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -190,5 +281,14 @@ func (app *AnnotationAPI) deleteAnnotation(c *gin.Context) {
 		return
 	}
 
+	resp.Data = histories
 	c.JSON(http.StatusOK, resp)
 }
+
+// recordHistory the annotation is already changed, a failure is only logged
+func (app *AnnotationAPI) recordHistory(actorID string, before, after *Annotation) {
+	err := app.antnHistoryStore.BulkCreate([]AnnotationHistory{NewAnnotationHistory(actorID, before, after)})
+	if err != nil {
+		utils.LogError(err)
+	}
+}
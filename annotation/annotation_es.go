@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -86,6 +87,7 @@ func (store *AnnotationES) GetSlice(queries map[string][]string, qs string, from
 		es.Search.WithIndex(getIndexWildcard(store.indexPrefix)),
 		es.Search.WithBody(&buf),
 		es.Search.WithTrackTotalHits(true),
+		es.Search.WithSeqNoPrimaryTerm(true),
 		es.Search.WithPretty(),
 	)
 	if err != nil {
@@ -118,6 +120,7 @@ func (store *AnnotationES) GetSlice(queries map[string][]string, qs string, from
 		bytesData, _ := json.Marshal(mapData)
 		err := json.Unmarshal(bytesData, &antn)
 		if err == nil {
+			antn.Revision = entities.NewRevision(hit)
 			antns = append(antns, antn)
 		}
 	}
@@ -134,11 +137,12 @@ func (store *AnnotationES) Get(queries map[string][]string, qs string) (*Annotat
 	if len(studies) > 0 {
 		return &studies[0], esReturn, nil
 	}
-	return nil, esReturn, nil
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // Create function
 func (store *AnnotationES) Create(antn Annotation) error {
+	antn.Revision = entities.Revision{}
 	// utils.LogDebug(antn.String())
 	req := esapi.IndexRequest{
 		Index:      getIndexName(store.indexPrefix, antn),
@@ -181,13 +185,12 @@ func (store *AnnotationES) BulkCreate(objects []Annotation) error {
 		raw map[string]interface{}
 		blk *entities.ESBulkResponse
 
-		indexName = getIndexName(store.indexPrefix, objects[0])
-
-		numItems   int
-		numErrors  int
-		numIndexed int
-		numBatches int
-		currBatch  int
+		numItems     int
+		numErrors    int
+		numConflicts int
+		numIndexed   int
+		numBatches   int
+		currBatch    int
 	)
 
 	count := len(objects)
@@ -218,7 +221,8 @@ func (store *AnnotationES) BulkCreate(objects []Annotation) error {
 
 		// Prepare the metadata payload
 		//
-		meta := []byte(fmt.Sprintf(`{ "index" : { "_id" : "%s" } }%s`, object.ID, "\n"))
+		meta := utils.BulkIndexMeta(getIndexName(store.indexPrefix, object), object.ID, object.Revision)
+		object.Revision = entities.Revision{}
 
 		// Prepare the data payload: encode article to JSON
 		//
@@ -242,7 +246,7 @@ func (store *AnnotationES) BulkCreate(objects []Annotation) error {
 		if i > 0 && i%batch == 0 || i == count-1 {
 			utils.LogDebug("[%d/%d] ", currBatch, numBatches)
 
-			res, err = es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithIndex(indexName), es.Bulk.WithRefresh("true"))
+			res, err = es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithRefresh("true"))
 			if err != nil {
 				log.Fatalf("Failure indexing batch %d: %s", currBatch, err)
 				return err
@@ -269,6 +273,9 @@ func (store *AnnotationES) BulkCreate(objects []Annotation) error {
 					for _, d := range blk.Items {
 						// ... so for any HTTP status above 201 ...
 						//
+						if d.Index.Status == http.StatusConflict {
+							numConflicts++
+						}
 						if d.Index.Status > 201 {
 							// ... increment the error counter ...
 							//
@@ -313,6 +320,9 @@ func (store *AnnotationES) BulkCreate(objects []Annotation) error {
 			dur.Truncate(time.Millisecond),
 			humanize.Comma(int64(1000.0/float64(dur/time.Millisecond)*float64(numIndexed))))
 	}
+	if numConflicts > 0 {
+		return fmt.Errorf("%w: %d documents", utils.ErrVersionConflict, numConflicts)
+	}
 	return nil
 }
 
@@ -340,6 +350,10 @@ func (store *AnnotationES) Update(antn Annotation, update map[string]interface{}
 		Refresh:    "true",
 		Body:       &buf,
 	}
+	if antn.Revision.IsSet() {
+		req.IfSeqNo = antn.SeqNo
+		req.IfPrimaryTerm = antn.PrimaryTerm
+	}
 
 	// Return an API response object from request
 	ctx := context.Background()
@@ -349,6 +363,9 @@ func (store *AnnotationES) Update(antn Annotation, update map[string]interface{}
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusConflict {
+		return utils.ErrVersionConflict
+	}
 	if res.IsError() {
 		return fmt.Errorf("%s ERROR updating document ID=%s", res.Status(), antn.ID)
 	}
@@ -411,54 +428,7 @@ func (store *AnnotationES) Delete(queries map[string][]string, qs string) error
 }
 
 func (store *AnnotationES) PutIndexTemplate() error {
-
-	file := strings.Join([]string{"templates", store.indexTemplate + ".json"}, "/")
-	dat, err := ioutil.ReadFile(file)
-	m := make(map[string]interface{})
-	json.Unmarshal(dat, &m)
-
-	var buf bytes.Buffer
-
-	if err := json.NewEncoder(&buf).Encode(m); err != nil {
-		return fmt.Errorf("Error encoding query: %s", err)
-	}
-
-	create := true
-
-	req := esapi.IndicesPutIndexTemplateRequest{
-		Name:   store.indexTemplate,
-		Body:   &buf,
-		Create: &create,
-		Human:  true,
-		Pretty: true,
-	}
-
-	// Return an API response object from request
-	ctx := context.Background()
-	res, err := req.Do(ctx, store.esClient)
-	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("PutTemplate ERROR: %s", err))
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		return fmt.Errorf("%s ERROR putting template %s", res.Status(), store.indexTemplate)
-	}
-
-	// Deserialize the response into a map.
-	var resMap map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&resMap); err != nil {
-		return fmt.Errorf("Error parsing the response body: %s", err)
-	}
-
-	// Print the response status and indexed document version.
-	// fmt.Println("Status:", res.Status(), "Result:", resMap["result"], "Version:", int(resMap["_version"].(float64)), resMap)
-
-	if resMap["result"] == "created" {
-		return nil
-	}
-
-	return err
+	return utils.PutIndexTemplate(store.esClient, store.indexTemplate)
 }
 
 func (store *AnnotationES) PutMapping() error {
@@ -0,0 +1,94 @@
+package annotation
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"vindr-lab-api/constants"
+
+	"github.com/google/uuid"
+)
+
+// AnnotationHistory one change of an annotation, Before is empty for a created
+// annotation and After for a deleted one. RestoredAt is set on the changes made
+// by a restore, to the timestamp the task was restored to
+type AnnotationHistory struct {
+	ID           string      `json:"id"`
+	AnnotationID string      `json:"annotation_id"`
+	TaskID       string      `json:"task_id,omitempty"`
+	ProjectID    string      `json:"project_id,omitempty"`
+	StudyID      string      `json:"study_id,omitempty"`
+	ObjectID     string      `json:"object_id,omitempty"`
+	Event        string      `json:"event"`
+	ActorID      string      `json:"actor_id"`
+	Created      int64       `json:"created"`
+	RestoredAt   int64       `json:"restored_at,omitempty"`
+	Before       *Annotation `json:"before,omitempty"`
+	After        *Annotation `json:"after,omitempty"`
+}
+
+func NewAnnotationHistory(actorID string, before, after *Annotation) AnnotationHistory {
+	history := AnnotationHistory{
+		ID:      uuid.New().String(),
+		ActorID: actorID,
+		Created: time.Now().UnixNano() / int64(time.Millisecond),
+		Before:  before,
+		After:   after,
+	}
+
+	antn := after
+	switch {
+	case before == nil:
+		history.Event = constants.EventCreate
+	case after == nil:
+		history.Event = constants.EventDelete
+		antn = before
+	default:
+		history.Event = constants.EventUpdate
+	}
+	history.AnnotationID = antn.ID
+	history.TaskID = antn.TaskID
+	history.ProjectID = antn.ProjectID
+	history.StudyID = antn.StudyID
+	history.ObjectID = antn.ObjectID
+
+	return history
+}
+
+func (history *AnnotationHistory) String() string {
+	b, _ := json.Marshal(history)
+
+	return string(b)
+}
+
+// AnnotationsAt replays the histories up to a timestamp. It returns the
+// annotations which existed then, and every annotation ID the histories know.
+// Annotations without history were not changed since it was introduced
+func AnnotationsAt(histories []AnnotationHistory, at int64) (map[string]Annotation, map[string]bool) {
+	sorted := append([]AnnotationHistory{}, histories...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created < sorted[j].Created
+	})
+
+	alive := make(map[string]Annotation)
+	known := make(map[string]bool)
+	for _, history := range sorted {
+		first := !known[history.AnnotationID]
+		known[history.AnnotationID] = true
+		if history.Created > at {
+			// changed for the first time after the timestamp, it was as before
+			if first && history.Before != nil {
+				alive[history.AnnotationID] = *history.Before
+			}
+			continue
+		}
+		if history.After == nil {
+			delete(alive, history.AnnotationID)
+		} else {
+			alive[history.AnnotationID] = *history.After
+		}
+	}
+
+	return alive, known
+}
@@ -0,0 +1,147 @@
+package annotation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"go.uber.org/zap"
+)
+
+// AnnotationHistoryES is append only, histories are never updated or deleted
+type AnnotationHistoryES struct {
+	esClient      *elasticsearch.Client
+	indexPrefix   string
+	indexTemplate string
+	logger        *zap.Logger
+}
+
+func NewAnnotationHistoryStore(client *elasticsearch.Client, indexPrefix, indexTemplate string, logger *zap.Logger) *AnnotationHistoryES {
+	return &AnnotationHistoryES{
+		client, indexPrefix, indexTemplate, logger,
+	}
+}
+
+func (store *AnnotationHistoryES) getIndexName(history AnnotationHistory) string {
+	indexTime := utils.ConvertTimeStampToTime(history.Created)
+	return fmt.Sprintf("%s_%d%02d", store.indexPrefix, indexTime.Year(), indexTime.Month())
+}
+
+// BulkCreate indexes the histories in one request
+func (store *AnnotationHistoryES) BulkCreate(histories []AnnotationHistory) error {
+	if len(histories) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, history := range histories {
+		meta := fmt.Sprintf(`{ "index" : { "_index" : "%s", "_id" : "%s" } }%s`, store.getIndexName(history), history.ID, "\n")
+		buf.WriteString(meta)
+		buf.WriteString(history.String())
+		buf.WriteString("\n")
+	}
+
+	es := store.esClient
+	res, err := es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithContext(context.Background()), es.Bulk.WithRefresh("true"))
+	if err != nil {
+		return fmt.Errorf("BulkRequest ERROR: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR indexing annotation histories", res.Status())
+	}
+
+	var blk entities.ESBulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		return fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	if blk.Errors {
+		for _, d := range blk.Items {
+			if d.Index.Status > 201 {
+				return fmt.Errorf("[%d] %s: %s", d.Index.Status, d.Index.Error.Type, d.Index.Error.Reason)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Query function
+func (store *AnnotationHistoryES) Query(queries map[string][]string, qs string, from, size int, sort string, f func([]AnnotationHistory, entities.ESReturn)) error {
+	for {
+		histories, esReturn, err := store.GetSlice(queries, qs, from, size, sort)
+		if err != nil {
+			return err
+		}
+
+		f(histories, *esReturn)
+
+		if len(histories) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *AnnotationHistoryES) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]AnnotationHistory, *entities.ESReturn, error) {
+	es := store.esClient
+
+	var (
+		esReturn entities.ESReturn
+		esError  entities.ESError
+		buf      bytes.Buffer
+	)
+
+	body := utils.ConvertInputsToESQueryBody(queries, qs, from, size, sort, nil)
+	utils.LogDebug(utils.ConvertMapToString(*body))
+
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, nil, fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(fmt.Sprintf("%s_*", store.indexPrefix)),
+		es.Search.WithBody(&buf),
+		es.Search.WithTrackTotalHits(true),
+		es.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if err := json.NewDecoder(res.Body).Decode(&esError); err != nil {
+			return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+		}
+		return nil, nil, fmt.Errorf("[%s] %s: %s", res.Status(), esError.Error.Type, esError.Error.Reason)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&esReturn); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	histories := make([]AnnotationHistory, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var history AnnotationHistory
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &history); err == nil {
+			histories = append(histories, history)
+		}
+	}
+
+	return histories, &esReturn, nil
+}
+
+func (store *AnnotationHistoryES) PutIndexTemplate() error {
+	return utils.PutIndexTemplate(store.esClient, store.indexTemplate)
+}
@@ -0,0 +1,63 @@
+package annotation
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// AnnotationHistoryMemory keeps annotation histories in memory
+type AnnotationHistoryMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewAnnotationHistoryMemory() *AnnotationHistoryMemory {
+	return &AnnotationHistoryMemory{utils.NewMemoryIndex("annotation_history")}
+}
+
+// BulkCreate function
+func (store *AnnotationHistoryMemory) BulkCreate(histories []AnnotationHistory) error {
+	for _, history := range histories {
+		if err := store.index.Index(history.ID, history, entities.Revision{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query function
+func (store *AnnotationHistoryMemory) Query(queries map[string][]string, qs string, from, size int, sort string, f func([]AnnotationHistory, entities.ESReturn)) error {
+	for {
+		histories, esReturn, err := store.GetSlice(queries, qs, from, size, sort)
+		if err != nil {
+			return err
+		}
+
+		f(histories, *esReturn)
+
+		if len(histories) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *AnnotationHistoryMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]AnnotationHistory, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	histories := make([]AnnotationHistory, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var history AnnotationHistory
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &history); err == nil {
+			histories = append(histories, history)
+		}
+	}
+	return histories, esReturn, nil
+}
@@ -0,0 +1,104 @@
+package annotation
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// AnnotationMemory keeps annotations in memory, for running without a cluster and in tests
+type AnnotationMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewAnnotationMemory() *AnnotationMemory {
+	return &AnnotationMemory{utils.NewMemoryIndex("annotation")}
+}
+
+// Query function
+func (store *AnnotationMemory) Query(queries map[string][]string, qs string, from int, size int, sort string, aggs []string, f func([]Annotation, entities.ESReturn)) error {
+	for {
+		antns, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(antns, *esReturn)
+
+		if len(antns) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *AnnotationMemory) GetSlice(queries map[string][]string, qs string, from int, size int, sort string, aggs []string) ([]Annotation, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	antns := make([]Annotation, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var antn Annotation
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &antn); err == nil {
+			antn.Revision = entities.NewRevision(hit)
+			antns = append(antns, antn)
+		}
+	}
+	return antns, esReturn, nil
+}
+
+// Get get one ESReturn
+func (store *AnnotationMemory) Get(queries map[string][]string, qs string) (*Annotation, *entities.ESReturn, error) {
+	antns, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(antns) > 0 {
+		return &antns[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Create function
+func (store *AnnotationMemory) Create(antn Annotation) error {
+	antn.Revision = entities.Revision{}
+	return store.index.Index(antn.ID, antn, entities.Revision{})
+}
+
+// BulkCreate every document is written, the stale ones are counted like AnnotationES does
+func (store *AnnotationMemory) BulkCreate(objects []Annotation) error {
+	numConflicts := 0
+	for _, object := range objects {
+		rev := object.Revision
+		object.Revision = entities.Revision{}
+		err := store.index.Index(object.ID, object, rev)
+		if err == utils.ErrVersionConflict {
+			numConflicts++
+		} else if err != nil {
+			return err
+		}
+	}
+	if numConflicts > 0 {
+		return fmt.Errorf("%w: %d documents", utils.ErrVersionConflict, numConflicts)
+	}
+	return nil
+}
+
+// Update function
+func (store *AnnotationMemory) Update(antn Annotation, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(antn.ID, update, antn.Revision)
+}
+
+// Delete function
+func (store *AnnotationMemory) Delete(queries map[string][]string, qs string) error {
+	return store.index.Delete(queries, qs)
+}
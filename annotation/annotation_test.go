@@ -269,3 +269,65 @@ func TestValidData(t *testing.T) {
 		assert.Equal(t, false, annotation.IsValidData())
 	}
 }
+
+func TestShapeIoU(t *testing.T) {
+	a := []Point2D{{X: 0, Y: 0}, {X: 10, Y: 10}}
+	b := []Point2D{{X: 5, Y: 0}, {X: 15, Y: 10}}
+	{
+		ret := ShapeIoU(constants.AntnTypeBox, a, constants.AntnTypeBox, b)
+		assert.InDelta(t, 1.0/3, ret, 1e-9)
+	}
+	{
+		square := []Point2D{{X: 0, Y: 0}, {X: 10, Y: 0}, {X: 10, Y: 10}, {X: 0, Y: 10}}
+		ret := ShapeIoU(constants.AntnTypePolygon, square, constants.AntnTypeBox, a)
+		assert.InDelta(t, 1.0, ret, 0.02)
+	}
+	{
+		c := []Point2D{{X: 20, Y: 20}, {X: 30, Y: 30}}
+		ret := ShapeIoU(constants.AntnTypeBox, a, constants.AntnTypeBox, c)
+		assert.Equal(t, 0.0, ret)
+	}
+}
+
+func TestAnnotationsAt(t *testing.T) {
+	a1 := Annotation{ID: "a1", TaskID: "task", Description: "v1"}
+	a1v2 := Annotation{ID: "a1", TaskID: "task", Description: "v2"}
+	a2 := Annotation{ID: "a2", TaskID: "task"}
+	a3 := Annotation{ID: "a3", TaskID: "task"}
+
+	at := func(h AnnotationHistory, created int64) AnnotationHistory {
+		h.Created = created
+		return h
+	}
+	histories := []AnnotationHistory{
+		at(NewAnnotationHistory("u1", nil, &a1), 10),
+		at(NewAnnotationHistory("u1", &a1, &a1v2), 20),
+		at(NewAnnotationHistory("u2", &a1v2, nil), 30),
+		at(NewAnnotationHistory("u1", nil, &a2), 25),
+		// a3 existed before the history, it is deleted later
+		at(NewAnnotationHistory("u2", &a3, nil), 40),
+	}
+	assert.Equal(t, constants.EventDelete, histories[2].Event)
+	assert.Equal(t, "a1", histories[2].AnnotationID)
+
+	{
+		alive, known := AnnotationsAt(histories, 15)
+		assert.Equal(t, 3, len(known))
+		assert.Equal(t, 2, len(alive))
+		assert.Equal(t, "v1", alive["a1"].Description)
+		_, found := alive["a3"]
+		assert.True(t, found)
+	}
+	{
+		alive, _ := AnnotationsAt(histories, 25)
+		assert.Equal(t, "v2", alive["a1"].Description)
+		_, found := alive["a2"]
+		assert.True(t, found)
+	}
+	{
+		alive, _ := AnnotationsAt(histories, 50)
+		assert.Equal(t, 1, len(alive))
+		_, found := alive["a2"]
+		assert.True(t, found)
+	}
+}
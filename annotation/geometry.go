@@ -0,0 +1,114 @@
+package annotation
+
+import (
+	"math"
+
+	"vindr-lab-api/constants"
+)
+
+// IoU of polygons is estimated on a grid of this many cells along the longer side
+const iouGridSize = 128
+
+// ParsePoints reads the data of a BOUNDING_BOX or POLYGON annotation
+func ParsePoints(data interface{}) ([]Point2D, bool) {
+	items, ok := data.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	points := make([]Point2D, 0, len(items))
+	for _, item := range items {
+		pair, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		x, okX := pair["x"].(float64)
+		y, okY := pair["y"].(float64)
+		if !okX || !okY {
+			return nil, false
+		}
+		points = append(points, Point2D{X: x, Y: y})
+	}
+	return points, true
+}
+
+func BoundsOf(points []Point2D) (xMin, yMin, xMax, yMax float64) {
+	xMin, yMin = math.Inf(1), math.Inf(1)
+	xMax, yMax = math.Inf(-1), math.Inf(-1)
+	for _, p := range points {
+		xMin = math.Min(xMin, p.X)
+		yMin = math.Min(yMin, p.Y)
+		xMax = math.Max(xMax, p.X)
+		yMax = math.Max(yMax, p.Y)
+	}
+	return
+}
+
+// PolygonArea shoelace formula
+func PolygonArea(points []Point2D) float64 {
+	area := 0.0
+	for i := range points {
+		j := (i + 1) % len(points)
+		area += points[i].X*points[j].Y - points[j].X*points[i].Y
+	}
+	return math.Abs(area) / 2
+}
+
+// InsidePolygon even-odd rule
+func InsidePolygon(points []Point2D, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		pi, pj := points[i], points[j]
+		if (pi.Y > y) != (pj.Y > y) && x < pj.X+(y-pj.Y)*(pi.X-pj.X)/(pi.Y-pj.Y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ShapeIoU of two BOUNDING_BOX or POLYGON shapes, exact for two boxes,
+// polygons are compared on a grid
+func ShapeIoU(typeA string, a []Point2D, typeB string, b []Point2D) float64 {
+	ax0, ay0, ax1, ay1 := BoundsOf(a)
+	bx0, by0, bx1, by1 := BoundsOf(b)
+	ix0, iy0 := math.Max(ax0, bx0), math.Max(ay0, by0)
+	ix1, iy1 := math.Min(ax1, bx1), math.Min(ay1, by1)
+	if ix1 <= ix0 || iy1 <= iy0 {
+		return 0
+	}
+
+	if typeA == constants.AntnTypeBox && typeB == constants.AntnTypeBox {
+		inter := (ix1 - ix0) * (iy1 - iy0)
+		union := (ax1-ax0)*(ay1-ay0) + (bx1-bx0)*(by1-by0) - inter
+		return inter / union
+	}
+
+	polyA, polyB := shapePolygon(typeA, a), shapePolygon(typeB, b)
+	x0, y0 := math.Min(ax0, bx0), math.Min(ay0, by0)
+	x1, y1 := math.Max(ax1, bx1), math.Max(ay1, by1)
+	step := math.Max(x1-x0, y1-y0) / iouGridSize
+	inter, union := 0, 0
+	for y := y0 + step/2; y < y1; y += step {
+		for x := x0 + step/2; x < x1; x += step {
+			inA, inB := InsidePolygon(polyA, x, y), InsidePolygon(polyB, x, y)
+			if inA && inB {
+				inter++
+			}
+			if inA || inB {
+				union++
+			}
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(inter) / float64(union)
+}
+
+func shapePolygon(antnType string, points []Point2D) []Point2D {
+	if antnType != constants.AntnTypeBox {
+		return points
+	}
+	x0, y0, x1, y1 := BoundsOf(points)
+	return []Point2D{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}}
+}
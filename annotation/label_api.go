@@ -1,6 +1,7 @@
 package annotation
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -20,14 +21,14 @@ import (
 )
 
 type LabelAPI struct {
-	labelStore   *LabelES
-	antnStore    *AnnotationES
-	projectStore *project.ProjectES
-	objectStore  *object.ObjectES
+	labelStore   LabelStore
+	antnStore    AnnotationStore
+	projectStore project.ProjectStore
+	objectStore  object.ObjectStore
 	logger       *zap.Logger
 }
 
-func NewLabelAPI(labelStore *LabelES, antnStore *AnnotationES, projectStore *project.ProjectES, logger *zap.Logger) (app *LabelAPI) {
+func NewLabelAPI(labelStore LabelStore, antnStore AnnotationStore, projectStore project.ProjectStore, logger *zap.Logger) (app *LabelAPI) {
 	app = &LabelAPI{
 		labelStore:   labelStore,
 		antnStore:    antnStore,
@@ -125,6 +126,11 @@ func (app *LabelAPI) CreateLabel(c *gin.Context) {
 
 	if label.ParentLabelID != "" {
 		parentLabel, _, err := app.labelStore.Get(nil, fmt.Sprintf("_id:%s", label.ParentLabelID))
+		if errors.Is(err, utils.ErrNotFound) {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
 		if err != nil {
 			resp.ErrorCode = constants.ServerError
 			c.JSON(http.StatusInternalServerError, resp)
@@ -190,17 +196,17 @@ func (app *LabelAPI) DeleteLabel(c *gin.Context) {
 		return
 	}
 
-	_, esReturn, err := app.antnStore.Get(nil, fmt.Sprintf("label_id:%s", labelID))
-	if err != nil {
-		utils.LogError(err)
+	// the label cannot be deleted while annotations use it
+	_, _, err := app.antnStore.Get(nil, fmt.Sprintf("label_id:%s", labelID))
+	if err == nil {
 		resp.ErrorCode = constants.ServerError
-		c.JSON(http.StatusInternalServerError, resp)
+		c.JSON(http.StatusNotAcceptable, resp)
 		return
 	}
-
-	if esReturn != nil && esReturn.Hits.Total.Value > 0 {
+	if !errors.Is(err, utils.ErrNotFound) {
+		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
-		c.JSON(http.StatusNotAcceptable, resp)
+		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
 
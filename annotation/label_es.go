@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -51,7 +50,7 @@ func (store *LabelES) Get(queries map[string][]string, qs string) (*Label, *enti
 	if len(projects) > 0 {
 		return &projects[0], esReturn, nil
 	}
-	return nil, esReturn, errors.New("Return is empty")
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // Create function
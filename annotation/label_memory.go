@@ -0,0 +1,82 @@
+package annotation
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// LabelMemory keeps labels in memory
+type LabelMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewLabelMemory() *LabelMemory {
+	return &LabelMemory{utils.NewMemoryIndex("label")}
+}
+
+// Get get one ESReturn
+func (store *LabelMemory) Get(queries map[string][]string, qs string) (*Label, *entities.ESReturn, error) {
+	labels, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(labels) > 0 {
+		return &labels[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Create function
+func (store *LabelMemory) Create(label Label) error {
+	return store.index.Index(label.ID, label, entities.Revision{})
+}
+
+// GetSlice function
+func (store *LabelMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Label, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels := make([]Label, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var label Label
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &label); err == nil {
+			labels = append(labels, label)
+		}
+	}
+	return labels, esReturn, nil
+}
+
+// Query function
+func (store *LabelMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func([]Label, entities.ESReturn)) error {
+	for {
+		labels, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(labels, *esReturn)
+
+		if len(labels) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Delete function
+func (store *LabelMemory) Delete(queries map[string][]string, qs string) error {
+	return store.index.Delete(queries, qs)
+}
+
+// Update function
+func (store *LabelMemory) Update(label Label, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(label.ID, update, entities.Revision{})
+}
@@ -0,0 +1,42 @@
+package annotation
+
+import (
+	"vindr-lab-api/entities"
+)
+
+// AnnotationStore is implemented by AnnotationES and AnnotationMemory
+type AnnotationStore interface {
+	Query(queries map[string][]string, qs string, from int, size int, sort string, aggs []string, f func([]Annotation, entities.ESReturn)) error
+	GetSlice(queries map[string][]string, qs string, from int, size int, sort string, aggs []string) ([]Annotation, *entities.ESReturn, error)
+	Get(queries map[string][]string, qs string) (*Annotation, *entities.ESReturn, error)
+	Create(antn Annotation) error
+	BulkCreate(objects []Annotation) error
+	Update(antn Annotation, update map[string]interface{}) error
+	Delete(queries map[string][]string, qs string) error
+}
+
+// AnnotationHistoryStore is implemented by AnnotationHistoryES and AnnotationHistoryMemory
+type AnnotationHistoryStore interface {
+	BulkCreate(histories []AnnotationHistory) error
+	Query(queries map[string][]string, qs string, from, size int, sort string, f func([]AnnotationHistory, entities.ESReturn)) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]AnnotationHistory, *entities.ESReturn, error)
+}
+
+// LabelStore is implemented by LabelES and LabelMemory
+type LabelStore interface {
+	Get(queries map[string][]string, qs string) (*Label, *entities.ESReturn, error)
+	Create(label Label) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Label, *entities.ESReturn, error)
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func([]Label, entities.ESReturn)) error
+	Delete(queries map[string][]string, qs string) error
+	Update(label Label, update map[string]interface{}) error
+}
+
+var (
+	_ AnnotationStore        = (*AnnotationES)(nil)
+	_ AnnotationStore        = (*AnnotationMemory)(nil)
+	_ AnnotationHistoryStore = (*AnnotationHistoryES)(nil)
+	_ AnnotationHistoryStore = (*AnnotationHistoryMemory)(nil)
+	_ LabelStore             = (*LabelES)(nil)
+	_ LabelStore             = (*LabelMemory)(nil)
+)
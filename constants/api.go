@@ -14,6 +14,9 @@ const (
 	ParamLabelGroupID = "label_group_id"
 	ParamStudyStatus  = "study_status"
 	ParamTaskStatus   = "task_status"
+	ParamTaskType     = "type"
+	ParamIoUThreshold = "iou_threshold"
+	ParamAtRiskHours  = "at_risk_hours"
 	ParamAuth         = "Authorization"
 
 	ParamLimit       = "_limit"
@@ -33,9 +36,12 @@ const (
 	TaskStatusNew       = "NEW"
 	TaskStatusDoing     = "DOING"
 	TaskStatusCompleted = "COMPLETED"
+	TaskStatusRejected  = "REJECTED"
+	TaskStatusReturned  = "RETURNED"
 
-	TaskTypeAnnotate = "ANNOTATE"
-	TaskTypeReview   = "REVIEW"
+	TaskTypeAnnotate  = "ANNOTATE"
+	TaskTypeReview    = "REVIEW"
+	TaskTypeArbitrate = "ARBITRATE"
 
 	StudyStatusUnassigned = "UNASSIGNED"
 	StudyStatusAssigned   = "ASSIGNED"
@@ -63,22 +69,94 @@ const (
 
 	ProjWorkflowSingle   = "SINGLE"
 	ProjWorkflowTriangle = "TRIANGLE"
+	ProjWorkflowCustom   = "CUSTOM"
+
+	WorkflowStageAnnotate  = "annotate"
+	WorkflowStageReview    = "review"
+	WorkflowStageArbitrate = "arbitrate"
 
 	ProjRoleAnnotator    = "ANNOTATOR"
 	ProjRoleReviewer     = "REVIEWER"
+	ProjRoleArbitrator   = "ARBITRATOR"
 	ProjRoleProjectOwner = "PROJECT_OWNER"
 
 	LabelSelectTypeNone     = ""
 	LabelSelectTypeRadio    = "RADIO"
 	LabelSelectTypeCheckbox = "CHECKBOX"
 
-	ExportStatusPending = "PENDING"
-	ExportStatusDone    = "DONE"
-
-	ASSIGN_STRATEGY_ALL     = "ALL"
-	ASSIGN_STRATEGY_EQUALLY = "EQUALLY"
+	ExportStatusPending  = "PENDING"
+	ExportStatusQueued   = "QUEUED"
+	ExportStatusRunning  = "RUNNING"
+	ExportStatusFailed   = "FAILED"
+	ExportStatusCanceled = "CANCELED"
+	ExportStatusDone     = "DONE"
+
+	ExportFormatJSON   = "JSON"
+	ExportFormatNDJSON = "NDJSON"
+	ExportFormatCOCO   = "COCO"
+	ExportFormatVOC    = "VOC"
+	ExportFormatDICOM  = "DICOM"
+
+	IngestStatusRunning = "RUNNING"
+	IngestStatusDone    = "DONE"
+	IngestStatusFailed  = "FAILED"
+
+	DeidActionKeep   = "KEEP"
+	DeidActionRemove = "REMOVE"
+	DeidActionEmpty  = "EMPTY"
+	DeidActionHash   = "HASH"
+	DeidActionUID    = "UID"
+
+	DeidOptionRetainUIDs                   = "RETAIN_UIDS"
+	DeidOptionRetainDeviceIdentity         = "RETAIN_DEVICE_IDENTITY"
+	DeidOptionRetainInstitutionIdentity    = "RETAIN_INSTITUTION_IDENTITY"
+	DeidOptionRetainPatientCharacteristics = "RETAIN_PATIENT_CHARACTERISTICS"
+	DeidOptionRetainLongitudinalFullDates  = "RETAIN_LONGITUDINAL_FULL_DATES"
+
+	PHIReasonPresent   = "PRESENT"
+	PHIReasonNotMasked = "NOT_MASKED"
+
+	ReconcileMissingDICOM      = "MISSING_DICOM"
+	ReconcileMissingObjects    = "MISSING_OBJECTS"
+	ReconcileUnreferencedDICOM = "UNREFERENCED_DICOM"
+
+	ASSIGN_STRATEGY_ALL          = "ALL"
+	ASSIGN_STRATEGY_EQUALLY      = "EQUALLY"
+	ASSIGN_STRATEGY_RANDOM       = "RANDOM"
+	ASSIGN_STRATEGY_NONE         = "NONE"
+	ASSIGN_STRATEGY_LEAST_LOADED = "LEAST_LOADED"
+	ASSIGN_STRATEGY_WEIGHTED     = "WEIGHTED"
+	ASSIGN_STRATEGY_SKILL        = "SKILL"
+	ASSIGN_STRATEGY_POOL         = "POOL"
 
 	ASSIGN_SOURCE_SELECTED = "SELECTED"
 	ASSIGN_SOURCE_FILE     = "FILE"
 	ASSIGN_SOURCE_SEARCH   = "SEARCH"
+
+	StaleActionReset = "RESET"
+	StaleActionPool  = "POOL"
+
+	TaskEventIdle       = "IDLE"
+	TaskEventReleased   = "RELEASED"
+	TaskEventReassigned = "REASSIGNED"
+
+	ReassignKeepAnnotations    = "KEEP"
+	ReassignDiscardAnnotations = "DISCARD"
+
+	// MetaOverdue the count of overdue tasks next to the status counts of a project
+	MetaOverdue = "OVERDUE"
+
+	ASSIGN_DUPLICATE_SKIP   = "SKIP"
+	ASSIGN_DUPLICATE_REJECT = "REJECT"
+
+	AssignConflictDuplicate     = "DUPLICATE_TASK"
+	AssignConflictStudyAssigned = "STUDY_ASSIGNED"
+	AssignConflictMissingRole   = "MISSING_ROLE"
+
+	StorageElasticsearch = "elasticsearch"
+	StorageMemory        = "memory"
+	StoragePostgres      = "postgres"
+
+	// PACSOrthanc the name of the default PACS, the OrthanC of orthanc.uri
+	PACSOrthanc = "orthanc"
 )
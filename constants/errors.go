@@ -5,4 +5,5 @@ const (
 	ServerFailed      = -1
 	ServerInvalidData = -2
 	ServerError       = -3
+	ServerConflict    = -4
 )
@@ -0,0 +1,107 @@
+package entities
+
+// DICOMAttribute the tag and VR of an attribute of the DICOM dictionary
+type DICOMAttribute struct {
+	Tag uint32
+	VR  string
+}
+
+// DICOMDictionary the attributes the API reads or de-identifies, by keyword
+var DICOMDictionary = map[string]DICOMAttribute{
+	"AccessionNumber":                    {0x00080050, "SH"},
+	"AcquisitionDate":                    {0x00080022, "DA"},
+	"AcquisitionDateTime":                {0x0008002A, "DT"},
+	"AcquisitionTime":                    {0x00080032, "TM"},
+	"AdditionalPatientHistory":           {0x001021B0, "LT"},
+	"BitsAllocated":                      {0x00280100, "US"},
+	"BitsStored":                         {0x00280101, "US"},
+	"BodyPartExamined":                   {0x00180015, "CS"},
+	"Columns":                            {0x00280011, "US"},
+	"ContentDate":                        {0x00080023, "DA"},
+	"ContentTime":                        {0x00080033, "TM"},
+	"ConversionType":                     {0x00080064, "CS"},
+	"DeidentificationMethod":             {0x00120063, "LO"},
+	"DeviceSerialNumber":                 {0x00181000, "LO"},
+	"EthnicGroup":                        {0x00102160, "SH"},
+	"Exposure":                           {0x00181152, "IS"},
+	"ExposureTime":                       {0x00181150, "IS"},
+	"FrameOfReferenceUID":                {0x00200052, "UI"},
+	"HighBit":                            {0x00280102, "US"},
+	"ImageAndFluoroscopyAreaDoseProduct": {0x0018115E, "DS"},
+	"ImageComments":                      {0x00204000, "LT"},
+	"ImageType":                          {0x00080008, "CS"},
+	"ImagerPixelSpacing":                 {0x00181164, "DS"},
+	"InstanceCreationDate":               {0x00080012, "DA"},
+	"InstanceCreationTime":               {0x00080013, "TM"},
+	"InstanceNumber":                     {0x00200013, "IS"},
+	"InstitutionAddress":                 {0x00080081, "ST"},
+	"InstitutionName":                    {0x00080080, "LO"},
+	"InstitutionalDepartmentName":        {0x00081040, "LO"},
+	"KVP":                                {0x00180060, "DS"},
+	"Manufacturer":                       {0x00080070, "LO"},
+	"MedicalRecordLocator":               {0x00101090, "LO"},
+	"MilitaryRank":                       {0x00101080, "LO"},
+	"Modality":                           {0x00080060, "CS"},
+	"NameOfPhysiciansReadingStudy":       {0x00081060, "PN"},
+	"NumberOfFrames":                     {0x00280008, "IS"},
+	"Occupation":                         {0x00102180, "SH"},
+	"OperatorsName":                      {0x00081070, "PN"},
+	"OtherPatientIDs":                    {0x00101000, "LO"},
+	"OtherPatientNames":                  {0x00101001, "PN"},
+	"PatientAddress":                     {0x00101040, "LO"},
+	"PatientAge":                         {0x00101010, "AS"},
+	"PatientBirthDate":                   {0x00100030, "DA"},
+	"PatientBirthTime":                   {0x00100032, "TM"},
+	"PatientBreedDescription":            {0x00102292, "LO"},
+	"PatientID":                          {0x00100020, "LO"},
+	"PatientIdentityRemoved":             {0x00120062, "CS"},
+	"PatientName":                        {0x00100010, "PN"},
+	"PatientSex":                         {0x00100040, "CS"},
+	"PatientSize":                        {0x00101020, "DS"},
+	"PatientSpeciesDescription":          {0x00102201, "LO"},
+	"PatientTelephoneNumbers":            {0x00102154, "SH"},
+	"PatientWeight":                      {0x00101030, "DS"},
+	"PerformedProcedureStepDescription":  {0x00400254, "LO"},
+	"PerformedProcedureStepStartDate":    {0x00400244, "DA"},
+	"PerformedProcedureStepStartTime":    {0x00400245, "TM"},
+	"PerformingPhysicianName":            {0x00081050, "PN"},
+	"PhotometricInterpretation":          {0x00280004, "CS"},
+	"PixelRepresentation":                {0x00280103, "US"},
+	"PixelSpacing":                       {0x00280030, "DS"},
+	"ProtocolName":                       {0x00181030, "LO"},
+	"ReferringPhysicianName":             {0x00080090, "PN"},
+	"RequestedProcedureDescription":      {0x00321060, "LO"},
+	"RequestingPhysician":                {0x00321032, "PN"},
+	"RescaleIntercept":                   {0x00281052, "DS"},
+	"RescaleSlope":                       {0x00281053, "DS"},
+	"RescaleType":                        {0x00281054, "LO"},
+	"Rows":                               {0x00280010, "US"},
+	"SOPClassUID":                        {0x00080016, "UI"},
+	"SOPInstanceUID":                     {0x00080018, "UI"},
+	"SamplesPerPixel":                    {0x00280002, "US"},
+	"SeriesDate":                         {0x00080021, "DA"},
+	"SeriesDescription":                  {0x0008103E, "LO"},
+	"SeriesInstanceUID":                  {0x0020000E, "UI"},
+	"SeriesNumber":                       {0x00200011, "IS"},
+	"SeriesTime":                         {0x00080031, "TM"},
+	"SpecificCharacterSet":               {0x00080005, "CS"},
+	"StationName":                        {0x00081010, "SH"},
+	"StudyDate":                          {0x00080020, "DA"},
+	"StudyDescription":                   {0x00081030, "LO"},
+	"StudyID":                            {0x00200010, "SH"},
+	"StudyInstanceUID":                   {0x0020000D, "UI"},
+	"StudyTime":                          {0x00080030, "TM"},
+	"WindowCenter":                       {0x00281050, "DS"},
+	"WindowCenterWidthExplanation":       {0x00281055, "LO"},
+	"WindowWidth":                        {0x00281051, "DS"},
+	"XRayTubeCurrent":                    {0x00181151, "IS"},
+}
+
+// DICOMKeywords the keywords of DICOMDictionary by tag
+var DICOMKeywords = make(map[uint32]string)
+
+func init() {
+	for keyword, attribute := range DICOMDictionary {
+		DICOMKeywords[attribute.Tag] = keyword
+	}
+}
@@ -1,7 +1,7 @@
 package entities
 
 type ESReturn struct {
-	ScrollID     string                  `json:"_scroll_id`
+	ScrollID     string                  `json:"_scroll_id"`
 	Took         int                     `json:"took"`
 	TimedOut     bool                    `json:"timed_out"`
 	Shards       Shards                  `json:"_shards"`
@@ -40,11 +40,13 @@ type Source struct {
 	Meta      Meta   `json:"meta"`
 }
 type HitsLocal struct {
-	Index  string                 `json:"_index"`
-	Type   string                 `json:"_type"`
-	ID     string                 `json:"_id"`
-	Score  float64                `json:"_score"`
-	Source map[string]interface{} `json:"_source"`
+	Index       string                 `json:"_index"`
+	Type        string                 `json:"_type"`
+	ID          string                 `json:"_id"`
+	Score       float64                `json:"_score"`
+	SeqNo       *int                   `json:"_seq_no,omitempty"`
+	PrimaryTerm *int                   `json:"_primary_term,omitempty"`
+	Source      map[string]interface{} `json:"_source"`
 }
 type HitsGLobal struct {
 	Total    Total       `json:"total"`
@@ -0,0 +1,61 @@
+package entities
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Revision is the _seq_no and _primary_term a document was read with. A write
+// carrying it is rejected by Elasticsearch when the document changed since
+type Revision struct {
+	SeqNo       *int `json:"seq_no,omitempty"`
+	PrimaryTerm *int `json:"primary_term,omitempty"`
+}
+
+func NewRevision(hit HitsLocal) Revision {
+	return Revision{SeqNo: hit.SeqNo, PrimaryTerm: hit.PrimaryTerm}
+}
+
+func (rev Revision) IsSet() bool {
+	return rev.SeqNo != nil && rev.PrimaryTerm != nil
+}
+
+// Matches a set revision against the revision of the stored document
+func (rev Revision) Matches(stored Revision) bool {
+	if !rev.IsSet() {
+		return true
+	}
+	return stored.IsSet() && *rev.SeqNo == *stored.SeqNo && *rev.PrimaryTerm == *stored.PrimaryTerm
+}
+
+// ETag formats the revision as "<seq_no>-<primary_term>"
+func (rev Revision) ETag() string {
+	if !rev.IsSet() {
+		return ""
+	}
+	return fmt.Sprintf(`"%d-%d"`, *rev.SeqNo, *rev.PrimaryTerm)
+}
+
+// ParseRevision reads an If-Match header written by ETag, an empty header is
+// an empty revision
+func ParseRevision(etag string) (Revision, error) {
+	etag = strings.Trim(strings.TrimSpace(etag), `"`)
+	if etag == "" {
+		return Revision{}, nil
+	}
+
+	parts := strings.Split(etag, "-")
+	if len(parts) != 2 {
+		return Revision{}, fmt.Errorf("Invalid revision %s", etag)
+	}
+	seqNo, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Revision{}, fmt.Errorf("Invalid revision %s", etag)
+	}
+	primaryTerm, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Revision{}, fmt.Errorf("Invalid revision %s", etag)
+	}
+	return Revision{SeqNo: &seqNo, PrimaryTerm: &primaryTerm}, nil
+}
@@ -14,6 +14,8 @@ require (
 	github.com/gojektech/heimdall/v6 v6.1.0
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.1.2
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.14
 	github.com/minio/minio-go/v7 v7.0.5
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.6.1
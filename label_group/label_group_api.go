@@ -21,12 +21,12 @@ import (
 )
 
 type LabelGroupAPI struct {
-	labelGroupStore *LabelGroupES
-	labelStore      *annotation.LabelES
+	labelGroupStore LabelGroupStore
+	labelStore      annotation.LabelStore
 	logger          *zap.Logger
 }
 
-func NewLabelGroupAPI(labelGroupStore *LabelGroupES, labelStore *annotation.LabelES, logger *zap.Logger) (app *LabelGroupAPI) {
+func NewLabelGroupAPI(labelGroupStore LabelGroupStore, labelStore annotation.LabelStore, logger *zap.Logger) (app *LabelGroupAPI) {
 	app = &LabelGroupAPI{
 		labelGroupStore: labelGroupStore,
 		labelStore:      labelStore,
@@ -96,7 +96,7 @@ func (store *LabelGroupES) Get(queries map[string][]string, qs string) (*LabelGr
 	if len(studies) > 0 {
 		return &studies[0], esReturn, nil
 	}
-	return nil, esReturn, nil
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // GetSlice function
@@ -0,0 +1,73 @@
+package label_group
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// LabelGroupMemory keeps label groups in memory, for running without a cluster and in tests
+type LabelGroupMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewLabelGroupMemory() *LabelGroupMemory {
+	return &LabelGroupMemory{utils.NewMemoryIndex("label_group")}
+}
+
+// CreateLabelGroup function
+func (store *LabelGroupMemory) CreateLabelGroup(labelGroup LabelGroup) error {
+	return store.index.Index(labelGroup.ID, labelGroup, entities.Revision{})
+}
+
+// GetSliceByMap function
+func (store *LabelGroupMemory) GetSliceByMap(queries map[string][]string, qs string, from, size int, sort string, aggs []string) (*map[string]LabelGroup, error) {
+	labelGroups, _, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+	mapLabelGroups := make(map[string]LabelGroup)
+	for _, v := range labelGroups {
+		mapLabelGroups[v.ID] = v
+	}
+	return &mapLabelGroups, err
+}
+
+func (store *LabelGroupMemory) Get(queries map[string][]string, qs string) (*LabelGroup, *entities.ESReturn, error) {
+	labelGroups, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(labelGroups) > 0 {
+		return &labelGroups[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// GetSlice function
+func (store *LabelGroupMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]LabelGroup, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labelGroups := make([]LabelGroup, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var labelGroup LabelGroup
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &labelGroup); err == nil {
+			labelGroups = append(labelGroups, labelGroup)
+		}
+	}
+	return labelGroups, esReturn, nil
+}
+
+// Delete function
+func (store *LabelGroupMemory) Delete(labelGroup LabelGroup) error {
+	return store.index.Delete(map[string][]string{"id": {labelGroup.ID}}, "")
+}
+
+// Update function
+func (store *LabelGroupMemory) Update(labelGroup LabelGroup, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(labelGroup.ID, update, entities.Revision{})
+}
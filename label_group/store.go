@@ -0,0 +1,20 @@
+package label_group
+
+import (
+	"vindr-lab-api/entities"
+)
+
+// LabelGroupStore is implemented by LabelGroupES and LabelGroupMemory
+type LabelGroupStore interface {
+	CreateLabelGroup(labelGroup LabelGroup) error
+	GetSliceByMap(queries map[string][]string, qs string, from, size int, sort string, aggs []string) (*map[string]LabelGroup, error)
+	Get(queries map[string][]string, qs string) (*LabelGroup, *entities.ESReturn, error)
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]LabelGroup, *entities.ESReturn, error)
+	Delete(labelGroup LabelGroup) error
+	Update(labelGroup LabelGroup, update map[string]interface{}) error
+}
+
+var (
+	_ LabelGroupStore = (*LabelGroupES)(nil)
+	_ LabelGroupStore = (*LabelGroupMemory)(nil)
+)
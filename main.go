@@ -1,11 +1,11 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"os"
 	"strings"
-	"time"
 
 	"vindr-lab-api/account"
 	"vindr-lab-api/annotation"
@@ -25,6 +25,7 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	_ "github.com/lib/pq"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/spf13/viper"
@@ -66,6 +67,26 @@ func getMapEnvVars() *map[string]string {
 	return &ret
 }
 
+func newElasticsearchClient() *elasticsearch.Client {
+	var esAddresses []string
+	esSingleNode := viper.GetString("elasticsearch.uri")
+	if esSingleNode != "" {
+		esAddresses = []string{esSingleNode}
+	} else {
+		esAddresses = viper.GetStringSlice("elasticsearch.uris")
+	}
+	utils.LogInfo("%v", esAddresses)
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: esAddresses,
+	})
+	_, err = es.Info()
+	if err != nil {
+		panic("Cannot connect to ES")
+	}
+	return es
+}
+
 func main() {
 
 	envVars := getMapEnvVars()
@@ -87,23 +108,6 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	var esAddresses []string
-	esSingleNode := viper.GetString("elasticsearch.uri")
-	if esSingleNode != "" {
-		esAddresses = []string{esSingleNode}
-	} else {
-		esAddresses = viper.GetStringSlice("elasticsearch.uris")
-	}
-	utils.LogInfo("%v", esAddresses)
-
-	es, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: esAddresses,
-	})
-	_, err = es.Info()
-	if err != nil {
-		panic("Cannot connect to ES")
-	}
-
 	clientRedis := redis.NewClient(&redis.Options{
 		Network:    "tcp",
 		Addr:       viper.GetString("redis.uri"),
@@ -120,19 +124,94 @@ func main() {
 	// route.Use(mw.WrapAuthInfo(logger))
 	route.Static("/docs/", "vindr-lab-api.html")
 
-	labelStore := annotation.NewLabelStore(es, viper.GetString("elasticsearch.label_index_prefix"), logger)
-	antnStore := annotation.NewAnnotationStore(es, viper.GetString("elasticsearch.annotation_index_prefix"), "es_template_annotation", logger)
-	studyStore := study.NewStudyStore(es, viper.GetString("elasticsearch.study_index_prefix"), logger)
-	projectStore := project.NewProjectStore(es, viper.GetString("elasticsearch.project_index_prefix"), logger)
-	sessionStore := session.NewSessionStore(es, viper.GetString("elasticsearch.session_index_alias"), logger)
-	objectStore := object.NewObjectStore(es, viper.GetString("elasticsearch.object_index_prefix"), logger)
-	labelExportStore := stats.NewLabelExportStore(es, viper.GetString("elasticsearch.label_export_index_prefix"), logger)
-	labelGroupStore := label_group.NewLabelGroupStore(es, viper.GetString("elasticsearch.label_group_index_prefix"), logger)
-	taskStore := study.NewTaskStore(es, viper.GetString("elasticsearch.task_index_prefix"), logger)
+	var (
+		labelStore       annotation.LabelStore
+		antnStore        annotation.AnnotationStore
+		antnHistoryStore annotation.AnnotationHistoryStore
+		studyStore       study.StudyStore
+		projectStore     project.ProjectStore
+		sessionStore     session.SessionStore
+		objectStore      object.ObjectStore
+		labelExportStore stats.LabelExportStore
+		labelGroupStore  label_group.LabelGroupStore
+		taskStore        study.TaskStore
+		taskEventStore   study.TaskEventStore
+		ingestJobStore   study.IngestJobStore
+		deidStore        study.DeidentificationStore
+	)
+
+	switch backend := viper.GetString("storage.backend"); backend {
+	case constants.StorageMemory:
+		// nothing survives a restart, for local runs without a cluster
+		utils.LogInfo("Storage backend is [%s]", backend)
+		labelStore = annotation.NewLabelMemory()
+		antnStore = annotation.NewAnnotationMemory()
+		antnHistoryStore = annotation.NewAnnotationHistoryMemory()
+		studyStore = study.NewStudyMemory()
+		projectStore = project.NewProjectMemory()
+		sessionStore = session.NewSessionMemory()
+		objectStore = object.NewObjectMemory()
+		labelExportStore = stats.NewLabelExportMemory()
+		labelGroupStore = label_group.NewLabelGroupMemory()
+		taskStore = study.NewTaskMemory()
+		taskEventStore = study.NewTaskEventMemory()
+		ingestJobStore = study.NewIngestJobMemory()
+		deidStore = study.NewDeidentificationMemory()
+	case constants.StorageElasticsearch, "":
+		es := newElasticsearchClient()
+		antnESStore := annotation.NewAnnotationStore(es, viper.GetString("elasticsearch.annotation_index_prefix"), "es_template_annotation", logger)
+		antnHistoryESStore := annotation.NewAnnotationHistoryStore(es, viper.GetString("elasticsearch.annotation_history_index_prefix"), "es_template_annotation_history", logger)
+
+		//put template
+		utils.LogError(antnESStore.PutMapping())
+		utils.LogError(antnESStore.PutIndexTemplate())
+		utils.LogError(antnHistoryESStore.PutIndexTemplate())
+
+		labelStore = annotation.NewLabelStore(es, viper.GetString("elasticsearch.label_index_prefix"), logger)
+		antnStore = antnESStore
+		antnHistoryStore = antnHistoryESStore
+		studyStore = study.NewStudyStore(es, viper.GetString("elasticsearch.study_index_prefix"), logger)
+		projectStore = project.NewProjectStore(es, viper.GetString("elasticsearch.project_index_prefix"), logger)
+		sessionStore = session.NewSessionStore(es, viper.GetString("elasticsearch.session_index_alias"), logger)
+		objectStore = object.NewObjectStore(es, viper.GetString("elasticsearch.object_index_prefix"), logger)
+		labelExportStore = stats.NewLabelExportStore(es, viper.GetString("elasticsearch.label_export_index_prefix"), logger)
+		labelGroupStore = label_group.NewLabelGroupStore(es, viper.GetString("elasticsearch.label_group_index_prefix"), logger)
+		taskESStore := study.NewTaskStore(es, viper.GetString("elasticsearch.task_index_prefix"), logger)
+		utils.LogError(taskESStore.PutIndexTemplate())
+		taskStore = taskESStore
+		taskEventStore = study.NewTaskEventStore(es, viper.GetString("elasticsearch.task_event_index_prefix"), logger)
+		ingestJobStore = study.NewIngestJobStore(es, viper.GetString("elasticsearch.ingest_job_index_prefix"), logger)
+		deidStore = study.NewDeidentificationStore(es, viper.GetString("elasticsearch.deidentification_index"), logger)
+	default:
+		log.Fatalf("Unknown storage backend [%s]", backend)
+	}
+
+	// projects, studies and tasks can move to a relational database while the other documents stay in the storage backend
+	var transactor study.Transactor
+	switch relational := viper.GetString("storage.relational_backend"); relational {
+	case constants.StoragePostgres:
+		utils.LogInfo("Relational backend is [%s]", relational)
+		db, err := sql.Open("postgres", viper.GetString("postgres.uri"))
+		if err != nil {
+			log.Fatalf("Error creating the database client: %s", err)
+		}
+		projectSQL := project.NewProjectSQL(db)
+		studySQL := study.NewStudySQL(db)
+		taskSQL := study.NewTaskSQL(db)
+		for _, table := range []interface{ CreateTable() error }{projectSQL, studySQL, taskSQL} {
+			if err := table.CreateTable(); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
 
-	//put template
-	utils.LogError(antnStore.PutMapping())
-	utils.LogError(antnStore.PutIndexTemplate())
+		projectStore = projectSQL
+		studyStore = studySQL
+		taskStore = taskSQL
+		transactor = study.NewSQLTransactor(db)
+	case "":
+	default:
+		log.Fatalf("Unknown relational backend [%s]", relational)
+	}
 
 	kc := &keycloak.KeycloakConfig{
 		MasterRealm:   viper.GetString("keycloak.master_realm"),
@@ -154,29 +233,69 @@ func main() {
 	}
 	minioStorage := stats.NewMinIOStorage(minioClient, viper.GetString("minio.bucket_name"))
 
-	annotationAPI := annotation.NewAnnotationAPI(antnStore, labelStore, keycloakStore, logger)
+	annotationAPI := annotation.NewAnnotationAPI(antnStore, antnHistoryStore, labelStore, keycloakStore, logger)
 	annotationAPI.InitRoute(route, "annotations")
 
 	labelAPI := annotation.NewLabelAPI(labelStore, antnStore, projectStore, logger)
 	labelAPI.InitRoute(route, "labels")
 
+	pacsRegistry := study.NewPACSRegistry(orthancClient, projectStore)
+	for name, uri := range viper.GetStringMapString("pacs.dicomweb") {
+		pacsRegistry.Add(name, study.NewDICOMweb(uri))
+	}
+
 	studyAPI := study.NewStudyAPI(studyStore, taskStore, projectStore, objectStore, orthancClient, logger)
+	studyAPI.SetPACSRegistry(pacsRegistry)
+	studyAPI.SetIDGenerator(idGenerator)
+	studyAPI.SetIngestJobStore(ingestJobStore)
+	studyAPI.SetDeidentificationStore(deidStore)
+	studyAPI.SetDeidentificationKey(viper.GetString("deidentification.hash_key"))
+	if err := studyAPI.FailInterruptedIngestJobs(); err != nil {
+		utils.LogError(err)
+	}
+	studyAPI.SetLocker(lockerRedis)
+	if interval := viper.GetDuration("reconciliation.interval"); interval > 0 {
+		go studyAPI.RunReconciliation(interval, viper.GetBool("reconciliation.repair"))
+	}
 	studyAPI.InitRoute(route, "studies")
 
 	projectAPI := project.NewProjectAPI(projectStore, logger)
+	projectAPI.SetPACSNames(pacsRegistry.Names()...)
 	projectAPI.InitRoute(route, "projects")
 
-	taskAPI := study.NewTaskAPI(taskStore, studyStore, projectStore, objectStore, antnStore, labelStore, idGenerator, logger)
+	taskAPI := study.NewTaskAPI(taskStore, studyStore, projectStore, objectStore, antnStore, antnHistoryStore, labelStore, idGenerator, logger)
+	if transactor != nil {
+		taskAPI.SetTransactor(transactor)
+	}
+	switch strategy := viper.GetString("task.review_strategy"); strategy {
+	case constants.ASSIGN_STRATEGY_EQUALLY, constants.ASSIGN_STRATEGY_RANDOM, constants.ASSIGN_STRATEGY_NONE:
+		taskAPI.SetReviewStrategy(strategy)
+	case "":
+	default:
+		log.Fatalf("Unknown review strategy [%s]", strategy)
+	}
+	taskAPI.SetLocker(lockerRedis)
+	taskAPI.SetTaskEventStore(taskEventStore)
+	if uri := viper.GetString("notification.webhook_uri"); uri != "" {
+		taskAPI.SetNotifier(study.NewWebhookNotifier(uri))
+	}
+	if interval := viper.GetDuration("task.stale_check_interval"); interval > 0 {
+		go taskAPI.RunStaleTaskRelease(interval)
+	}
 	taskAPI.InitRoute(route, "tasks")
+	projectAPI.SetTaskHandover(taskAPI)
 
 	objectAPI := object.NewObjectAPI(objectStore, lockerRedis, logger)
+	if stream := viper.GetString("object_queue.stream"); stream != "" {
+		objectAPI.SetQueue(object.NewObjectQueueRedis(clientRedis, stream))
+	}
 	objectAPI.InitRoute(route, "objects")
-	go objectAPI.DequeueObjects()
-	time.Sleep(1 * time.Millisecond)
+	objectAPI.StartWorkers(viper.GetInt("object_queue.workers"))
 
 	stats := stats.NewLabelExportAPI(labelExportStore, labelGroupStore, labelStore, projectStore, antnStore, objectStore, studyStore, taskStore,
-		minioStorage, keycloakStore, logger)
+		minioStorage, pacsRegistry, keycloakStore, logger)
 	stats.InitRoute(route, "stats")
+	stats.StartExportWorkers(viper.GetInt("stats.export_workers"))
 
 	sessionAPI := session.NewSessionAPI(sessionStore, logger)
 	sessionAPI.InitRoute(route, "sessions")
@@ -53,6 +53,13 @@ func (study *Object) IsValidType() bool {
 	return found
 }
 
+// IsValidObjectBig the payload has every list of UIDs, its objects cannot be
+// created otherwise
+func (objectBig *ObjectBig) IsValidObjectBig() bool {
+	return objectBig.ListStudyInstanceUID != nil && objectBig.ListSeriesInstanceUID != nil &&
+		objectBig.ListSOPInstanceUID != nil
+}
+
 func (objectBig *ObjectBig) String() string {
 	b, _ := json.Marshal(objectBig)
 	return string(b)
@@ -3,6 +3,7 @@ package object
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"vindr-lab-api/constants"
@@ -11,30 +12,37 @@ import (
 	"vindr-lab-api/utils"
 
 	"github.com/bsm/redislock"
-	"github.com/enriquebris/goconcurrentqueue"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 type ObjectAPI struct {
-	objectStore *ObjectES
+	objectStore ObjectStore
 	lockerRedis *redislock.Client
 	logger      *zap.Logger
+	queue       ObjectQueue
 }
 
-func NewObjectAPI(studyStore *ObjectES, lockerRedis *redislock.Client, logger *zap.Logger) (app *ObjectAPI) {
+func NewObjectAPI(studyStore ObjectStore, lockerRedis *redislock.Client, logger *zap.Logger) (app *ObjectAPI) {
 	app = &ObjectAPI{
 		objectStore: studyStore,
 		lockerRedis: lockerRedis,
 		logger:      logger,
+		queue:       NewObjectQueueMemory(),
 	}
 	return app
 }
 
+// SetQueue where CreateObject queues its payloads, in process by default
+func (app *ObjectAPI) SetQueue(queue ObjectQueue) {
+	app.queue = queue
+}
+
 func (app *ObjectAPI) InitRoute(engine *gin.Engine, path string) {
 	group := engine.Group(path, mw.WrapAuthInfo(app.logger))
 	group.GET("", mw.ValidPerms(path, mw.PERM_R), app.FetchObject)
+	group.GET("/queue", mw.ValidPerms(path, mw.PERM_R), app.GetQueueDepth)
 	group.POST("", mw.ValidPerms(path, mw.PERM_C), app.CreateObject)
 	group.PUT("/:id", mw.ValidPerms(path, mw.PERM_U), app.UpdateObject)
 	group.DELETE("/:id", mw.ValidPerms(path, mw.PERM_D), app.DeleteObject)
@@ -79,47 +87,72 @@ func (app *ObjectAPI) CreateObject(c *gin.Context) {
 	var objectBig ObjectBig
 	err := c.ShouldBindJSON(&objectBig)
 
-	if err != nil {
+	if err != nil || !objectBig.IsValidObjectBig() {
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
 
-	app.QueueObject(objectBig)
+	if err := app.QueueObject(objectBig); err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
 
 	c.JSON(http.StatusOK, resp)
 }
 
-var queue *goconcurrentqueue.FIFO
-
-func (app *ObjectAPI) DequeueObjects() {
-	for true {
-		if queue != nil && queue.GetLen() > 0 {
+// GetQueueDepth the payloads of CreateObject waiting, being processed and
+// dead-lettered
+func (app *ObjectAPI) GetQueueDepth(c *gin.Context) {
+	resp := entities.NewResponse()
 
-			objectBig, err := queue.Dequeue()
-			if err == nil && objectBig != nil {
-				err = ProcessCreateObject(*app.objectStore, app.lockerRedis, objectBig.(ObjectBig))
-				if err != nil {
-					utils.LogError(err)
-				}
-			}
-			time.Sleep(10 * time.Millisecond)
-		} else {
-			time.Sleep(1 * time.Second)
-		}
+	depth, err := app.queue.Depth()
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
 	}
+
+	resp.Data = depth
+	c.JSON(http.StatusOK, resp)
 }
 
-func (app *ObjectAPI) QueueObject(objectBig ObjectBig) {
-	if queue == nil {
-		queue = goconcurrentqueue.NewFIFO()
+// StartWorkers spawns the workers creating the objects of the queued payloads
+func (app *ObjectAPI) StartWorkers(size int) {
+	if size < 1 {
+		size = 1
+	}
+	hostname, _ := os.Hostname()
+	for i := 0; i < size; i++ {
+		go app.queue.Work(fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), i), app.processObject)
 	}
-	queue.Enqueue(objectBig)
 }
 
-func ProcessCreateObject(objectStore ObjectES, lockerRedis *redislock.Client, objectBig ObjectBig) error {
+func (app *ObjectAPI) QueueObject(objectBig ObjectBig) error {
+	return app.queue.Enqueue(objectBig)
+}
+
+// processObject creates the objects of the payload, a panic fails the payload
+// instead of stopping the worker
+func (app *ObjectAPI) processObject(objectBig ObjectBig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error creating the objects of study %s: %v", objectBig.StudyID, r)
+		}
+	}()
+	return ProcessCreateObject(app.objectStore, app.lockerRedis, objectBig)
+}
+
+func ProcessCreateObject(objectStore ObjectStore, lockerRedis *redislock.Client, objectBig ObjectBig) error {
 	now := time.Now().UnixNano() / int64(time.Millisecond)
 
+	if !objectBig.IsValidObjectBig() {
+		return fmt.Errorf("Error creating the objects of study %s: the payload is missing its lists", objectBig.StudyID)
+	}
+
 	projectID := objectBig.ProjectID
 	studyID := objectBig.StudyID
 
@@ -214,6 +214,21 @@ func (store *ObjectES) Query(queries map[string][]string, qs string, from, size
 	return nil
 }
 
+// Scroll get all with the scroll API, f stops it by returning an error
+func (store *ObjectES) Scroll(queries map[string][]string, qs string, size int, sort string, f func(objects []Object, es entities.ESReturn) error) error {
+	return utils.ScrollES(store.esClient, getIndexWildcard(store.indexPrefix), queries, qs, size, sort, func(esReturn entities.ESReturn) error {
+		objects := make([]Object, 0)
+		for _, hit := range esReturn.Hits.Hits {
+			var object Object
+			bytesData, _ := json.Marshal(hit.Source)
+			if err := json.Unmarshal(bytesData, &object); err == nil {
+				objects = append(objects, object)
+			}
+		}
+		return f(objects, esReturn)
+	})
+}
+
 // GetSlice function
 func (store *ObjectES) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Object, *entities.ESReturn, error) {
 	es := store.esClient
@@ -282,7 +297,7 @@ func (store *ObjectES) Get(queries map[string][]string, qs string) (*Object, *en
 	if len(objects) > 0 {
 		return &objects[0], esReturn, nil
 	}
-	return nil, esReturn, nil
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // Delete function
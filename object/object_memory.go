@@ -0,0 +1,107 @@
+package object
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// ObjectMemory keeps objects in memory, for running without a cluster and in tests
+type ObjectMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewObjectMemory() *ObjectMemory {
+	return &ObjectMemory{utils.NewMemoryIndex("object")}
+}
+
+// Create function
+func (store *ObjectMemory) Create(object Object) error {
+	return store.index.Index(object.ID, object, entities.Revision{})
+}
+
+// Bulk function
+func (store *ObjectMemory) Bulk(objects []Object) error {
+	for _, object := range objects {
+		if err := store.index.Index(object.ID, object, entities.Revision{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *ObjectMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(objects []Object, es entities.ESReturn)) error {
+	for {
+		objects, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(objects, *esReturn)
+
+		if len(objects) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Scroll pages through the hits, f stops it by returning an error
+func (store *ObjectMemory) Scroll(queries map[string][]string, qs string, size int, sort string, f func(objects []Object, es entities.ESReturn) error) error {
+	for from := 0; ; from += size {
+		objects, esReturn, err := store.GetSlice(queries, qs, from, size, sort, nil)
+		if err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			return nil
+		}
+		if err := f(objects, *esReturn); err != nil {
+			return err
+		}
+	}
+}
+
+// GetSlice function
+func (store *ObjectMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Object, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects := make([]Object, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var object Object
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &object); err == nil {
+			objects = append(objects, object)
+		}
+	}
+	return objects, esReturn, nil
+}
+
+// Get get one ESReturn
+func (store *ObjectMemory) Get(queries map[string][]string, qs string) (*Object, *entities.ESReturn, error) {
+	objects, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(objects) > 0 {
+		return &objects[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Delete function
+func (store *ObjectMemory) Delete(queries map[string][]string, qs string) error {
+	return store.index.Delete(queries, qs)
+}
+
+// Update function
+func (store *ObjectMemory) Update(object Object, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(object.ID, update, entities.Revision{})
+}
@@ -0,0 +1,136 @@
+package object
+
+import (
+	"sync"
+	"time"
+
+	"vindr-lab-api/utils"
+
+	"github.com/enriquebris/goconcurrentqueue"
+)
+
+// objectQueueMaxDeliveries times a payload is processed before it is dead-lettered
+const objectQueueMaxDeliveries = 5
+
+// ObjectQueue hands the payloads of CreateObject to the workers creating
+// their objects. A payload is delivered again until it is processed, or
+// dead-lettered after failing objectQueueMaxDeliveries times
+type ObjectQueue interface {
+	Enqueue(objectBig ObjectBig) error
+	// Work processes the payloads of the queue as the consumer, forever
+	Work(consumer string, process func(objectBig ObjectBig) error)
+	Depth() (*QueueDepth, error)
+}
+
+var (
+	_ ObjectQueue = (*ObjectQueueMemory)(nil)
+	_ ObjectQueue = (*ObjectQueueRedis)(nil)
+)
+
+// QueueDepth the payloads of the queue, Waiting ones are not delivered to a
+// worker yet, Pending ones are being processed or waiting to be retried
+type QueueDepth struct {
+	Waiting     int64 `json:"waiting"`
+	Pending     int64 `json:"pending"`
+	DeadLetters int64 `json:"dead_letters"`
+	Consumers   int64 `json:"consumers"`
+}
+
+// DeadObject a payload which failed every delivery
+type DeadObject struct {
+	Object     ObjectBig `json:"object"`
+	Error      string    `json:"error"`
+	Deliveries int64     `json:"deliveries"`
+	FailedAt   int64     `json:"failed_at"`
+}
+
+// ObjectQueueMemory an in-process queue, everything queued is lost on restart
+type ObjectQueueMemory struct {
+	queue       *goconcurrentqueue.FIFO
+	mu          sync.Mutex
+	pending     int64
+	consumers   map[string]bool
+	deadObjects []DeadObject
+}
+
+type queuedObject struct {
+	objectBig  ObjectBig
+	deliveries int64
+}
+
+func NewObjectQueueMemory() *ObjectQueueMemory {
+	return &ObjectQueueMemory{
+		queue:       goconcurrentqueue.NewFIFO(),
+		consumers:   make(map[string]bool),
+		deadObjects: make([]DeadObject, 0),
+	}
+}
+
+func (queue *ObjectQueueMemory) Enqueue(objectBig ObjectBig) error {
+	return queue.queue.Enqueue(queuedObject{objectBig: objectBig})
+}
+
+func (queue *ObjectQueueMemory) Work(consumer string, process func(objectBig ObjectBig) error) {
+	queue.mu.Lock()
+	queue.consumers[consumer] = true
+	queue.mu.Unlock()
+
+	for true {
+		item, err := queue.queue.DequeueOrWaitForNextElement()
+		if err != nil {
+			utils.LogError(err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		queued, ok := item.(queuedObject)
+		if !ok {
+			continue
+		}
+
+		queue.mu.Lock()
+		queue.pending++
+		queue.mu.Unlock()
+
+		queued.deliveries++
+		err = process(queued.objectBig)
+		if err != nil {
+			utils.LogError(err)
+		}
+
+		queue.mu.Lock()
+		queue.pending--
+		if err != nil && queued.deliveries >= objectQueueMaxDeliveries {
+			queue.deadObjects = append(queue.deadObjects, DeadObject{
+				Object:     queued.objectBig,
+				Error:      err.Error(),
+				Deliveries: queued.deliveries,
+				FailedAt:   time.Now().UnixNano() / int64(time.Millisecond),
+			})
+		}
+		queue.mu.Unlock()
+
+		if err != nil && queued.deliveries < objectQueueMaxDeliveries {
+			if err := queue.queue.Enqueue(queued); err != nil {
+				utils.LogError(err)
+			}
+		}
+	}
+}
+
+func (queue *ObjectQueueMemory) Depth() (*QueueDepth, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return &QueueDepth{
+		Waiting:     int64(queue.queue.GetLen()),
+		Pending:     queue.pending,
+		DeadLetters: int64(len(queue.deadObjects)),
+		Consumers:   int64(len(queue.consumers)),
+	}, nil
+}
+
+// DeadObjects the payloads dead-lettered so far
+func (queue *ObjectQueueMemory) DeadObjects() []DeadObject {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return append([]DeadObject{}, queue.deadObjects...)
+}
@@ -0,0 +1,243 @@
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"vindr-lab-api/utils"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// objectQueueGroup the consumer group of the workers of every server
+	objectQueueGroup = "object_workers"
+	// objectQueueClaimIdle how long a payload stays with a worker before
+	// another one delivers it again, a failed one is retried after it too
+	objectQueueClaimIdle = 1 * time.Minute
+	// objectQueueClaimPage pending entries read at a time by claim
+	objectQueueClaimPage = 10
+	// objectQueueDeadLettersMaxLen dead letters kept, the oldest are trimmed
+	objectQueueDeadLettersMaxLen = 10000
+)
+
+// ObjectQueueRedis a redis stream read by a consumer group, payloads survive
+// restarts and are shared by the workers of every server. A payload is
+// deleted from the stream once acknowledged, dead letters are moved to the
+// stream of the same name suffixed by :dead
+type ObjectQueueRedis struct {
+	client     *redis.Client
+	stream     string
+	deadStream string
+	claimIdle  time.Duration
+}
+
+func NewObjectQueueRedis(client *redis.Client, stream string) *ObjectQueueRedis {
+	return &ObjectQueueRedis{
+		client:     client,
+		stream:     stream,
+		deadStream: stream + ":dead",
+		claimIdle:  objectQueueClaimIdle,
+	}
+}
+
+func (queue *ObjectQueueRedis) Enqueue(objectBig ObjectBig) error {
+	payload, err := json.Marshal(objectBig)
+	if err != nil {
+		return err
+	}
+	return queue.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: queue.stream,
+		Values: map[string]interface{}{"payload": string(payload)},
+	}).Err()
+}
+
+func (queue *ObjectQueueRedis) Work(consumer string, process func(objectBig ObjectBig) error) {
+	ctx := context.Background()
+	for {
+		err := queue.client.XGroupCreateMkStream(ctx, queue.stream, objectQueueGroup, "0").Err()
+		if err == nil || strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			break
+		}
+		utils.LogError(err)
+		time.Sleep(1 * time.Second)
+	}
+
+	for true {
+		// payloads of workers which failed or stopped
+		queue.claim(ctx, consumer, process)
+
+		streams, err := queue.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    objectQueueGroup,
+			Consumer: consumer,
+			Streams:  []string{queue.stream, ">"},
+			Count:    10,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			utils.LogError(err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				queue.handle(ctx, message, 1, process)
+			}
+		}
+	}
+}
+
+// claim delivers again to the consumer the payloads idle for claimIdle,
+// the pending entries are paged so the ones behind busy payloads are reached
+func (queue *ObjectQueueRedis) claim(ctx context.Context, consumer string, process func(objectBig ObjectBig) error) {
+	start := "-"
+	for {
+		pending, err := queue.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: queue.stream,
+			Group:  objectQueueGroup,
+			Start:  start,
+			End:    "+",
+			Count:  objectQueueClaimPage,
+		}).Result()
+		if err != nil {
+			utils.LogError(err)
+			return
+		}
+
+		for _, p := range pending {
+			if p.Idle < queue.claimIdle {
+				continue
+			}
+			messages, err := queue.client.XClaim(ctx, &redis.XClaimArgs{
+				Stream:   queue.stream,
+				Group:    objectQueueGroup,
+				Consumer: consumer,
+				MinIdle:  queue.claimIdle,
+				Messages: []string{p.ID},
+			}).Result()
+			if err != nil {
+				utils.LogError(err)
+				continue
+			}
+			for _, message := range messages {
+				queue.handle(ctx, message, p.RetryCount+1, process)
+			}
+		}
+
+		if len(pending) < objectQueueClaimPage {
+			return
+		}
+		start, err = nextStreamID(pending[len(pending)-1].ID)
+		if err != nil {
+			utils.LogError(err)
+			return
+		}
+	}
+}
+
+// nextStreamID the smallest stream ID after id, XPENDING bounds are inclusive
+func nextStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Error parsing the stream ID %s", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing the stream ID %s: %s", id, err)
+	}
+	if seq == math.MaxUint64 {
+		ms, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Error parsing the stream ID %s: %s", id, err)
+		}
+		return fmt.Sprintf("%d-0", ms+1), nil
+	}
+	return fmt.Sprintf("%s-%d", parts[0], seq+1), nil
+}
+
+// handle processes the payload of the message delivered for the deliveries
+// time, a failed one stays pending until it is claimed again
+func (queue *ObjectQueueRedis) handle(ctx context.Context, message redis.XMessage, deliveries int64, process func(objectBig ObjectBig) error) {
+	payload, _ := message.Values["payload"].(string)
+	var objectBig ObjectBig
+	if err := json.Unmarshal([]byte(payload), &objectBig); err != nil {
+		queue.deadLetter(ctx, message.ID, payload, fmt.Errorf("Error parsing the payload: %s", err), deliveries)
+		return
+	}
+
+	err := process(objectBig)
+	if err == nil {
+		_, err = queue.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(ctx, queue.stream, objectQueueGroup, message.ID)
+			pipe.XDel(ctx, queue.stream, message.ID)
+			return nil
+		})
+		if err != nil {
+			utils.LogError(err)
+		}
+		return
+	}
+
+	utils.LogError(err)
+	if deliveries >= objectQueueMaxDeliveries {
+		queue.deadLetter(ctx, message.ID, payload, err, deliveries)
+	}
+}
+
+func (queue *ObjectQueueRedis) deadLetter(ctx context.Context, id, payload string, cause error, deliveries int64) {
+	_, err := queue.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream:       queue.deadStream,
+			MaxLenApprox: objectQueueDeadLettersMaxLen,
+			Values: map[string]interface{}{
+				"payload":    payload,
+				"error":      cause.Error(),
+				"deliveries": deliveries,
+				"failed_at":  time.Now().UnixNano() / int64(time.Millisecond),
+			},
+		})
+		pipe.XAck(ctx, queue.stream, objectQueueGroup, id)
+		pipe.XDel(ctx, queue.stream, id)
+		return nil
+	})
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+func (queue *ObjectQueueRedis) Depth() (*QueueDepth, error) {
+	ctx := context.Background()
+	depth := &QueueDepth{}
+
+	length, err := queue.client.XLen(ctx, queue.stream).Result()
+	if err != nil {
+		return nil, err
+	}
+	depth.DeadLetters, err = queue.client.XLen(ctx, queue.deadStream).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := queue.client.XInfoGroups(ctx, queue.stream).Result()
+	// no worker created the stream yet
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		return nil, err
+	}
+	for _, group := range groups {
+		if group.Name == objectQueueGroup {
+			depth.Pending = group.Pending
+			depth.Consumers = group.Consumers
+		}
+	}
+	// acknowledged payloads are deleted, the stream holds the others
+	depth.Waiting = length - depth.Pending
+	return depth, nil
+}
@@ -1,12 +1,23 @@
 package object
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"vindr-lab-api/constants"
 	"vindr-lab-api/entities"
 
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 var object = Object{
@@ -80,3 +91,153 @@ func TestToString(t *testing.T) {
 		assert.NotEqual(t, "{}", objectBig.String())
 	}
 }
+
+func TestObjectQueue(t *testing.T) {
+	app := NewObjectAPI(NewObjectMemory(), nil, zap.NewNop())
+	queue := NewObjectQueueMemory()
+	app.SetQueue(queue)
+	app.StartWorkers(2)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/objects", app.CreateObject)
+	engine.GET("/objects/queue", app.GetQueueDepth)
+
+	for body, code := range map[string]int{
+		`{"project_id": "p1", "study_id": "s1", "list_study_instance_uid": ["1.1"], "list_series_instance_uid": ["1.1.1"],
+			"list_sop_instance_uid": ["1.1.1.1", "1.1.1.2"]}`: http.StatusOK,
+		// no lists, it cannot be processed
+		`{"project_id": "p1", "study_id": "s3"}`: http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/objects", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code)
+	}
+	// queued by another server, its processing fails every delivery
+	assert.Nil(t, app.QueueObject(ObjectBig{ProjectID: "p1", StudyID: "s2"}))
+
+	var resp struct {
+		Data QueueDepth `json:"data"`
+	}
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/objects/queue", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		if resp.Data.DeadLetters > 0 && resp.Data.Waiting == 0 && resp.Data.Pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, QueueDepth{DeadLetters: 1, Consumers: 2}, resp.Data)
+
+	dead := queue.DeadObjects()
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, "s2", dead[0].Object.StudyID)
+	assert.Equal(t, int64(objectQueueMaxDeliveries), dead[0].Deliveries)
+
+	_, esReturn, err := app.objectStore.GetSlice(nil, "study_id.keyword:s1", 0, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, esReturn.Hits.Total.Value)
+}
+
+func TestNextStreamID(t *testing.T) {
+	id, err := nextStreamID("1526985054069-0")
+	assert.Nil(t, err)
+	assert.Equal(t, "1526985054069-1", id)
+	id, err = nextStreamID("1526985054069-18446744073709551615")
+	assert.Nil(t, err)
+	assert.Equal(t, "1526985054070-0", id)
+	_, err = nextStreamID("1526985054069")
+	assert.NotNil(t, err)
+}
+
+func TestObjectQueueRedis(t *testing.T) {
+	uri := os.Getenv("REDIS_URI")
+	if uri == "" {
+		t.Skip("REDIS_URI is not set")
+	}
+	options, err := redis.ParseURL(uri)
+	assert.Nil(t, err)
+	client := redis.NewClient(options)
+	defer client.Close()
+	ctx := context.Background()
+
+	queue := NewObjectQueueRedis(client, fmt.Sprintf("test_objects_%d", time.Now().UnixNano()))
+	queue.claimIdle = 100 * time.Millisecond
+	defer client.Del(ctx, queue.stream, queue.deadStream)
+	assert.Nil(t, client.XGroupCreateMkStream(ctx, queue.stream, objectQueueGroup, "0").Err())
+
+	// a page of payloads busy with a live worker, then one of a stopped worker
+	// and one which always fails
+	for i := 0; i < objectQueueClaimPage+2; i++ {
+		assert.Nil(t, queue.Enqueue(ObjectBig{ProjectID: "p1", StudyID: fmt.Sprintf("s%d", i)}))
+	}
+	streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    objectQueueGroup,
+		Consumer: "stopped",
+		Streams:  []string{queue.stream, ">"},
+		Count:    objectQueueClaimPage + 2,
+	}).Result()
+	assert.Nil(t, err)
+	ids := make([]string, 0)
+	for _, message := range streams[0].Messages {
+		ids = append(ids, message.ID)
+	}
+	assert.Equal(t, objectQueueClaimPage+2, len(ids))
+	time.Sleep(queue.claimIdle)
+	assert.Nil(t, client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   queue.stream,
+		Group:    objectQueueGroup,
+		Consumer: "busy",
+		Messages: ids[:objectQueueClaimPage],
+	}).Err())
+
+	failing := fmt.Sprintf("s%d", objectQueueClaimPage+1)
+	processed := make([]string, 0)
+	process := func(objectBig ObjectBig) error {
+		processed = append(processed, objectBig.StudyID)
+		if objectBig.StudyID == failing {
+			return fmt.Errorf("Error creating the objects of study %s", objectBig.StudyID)
+		}
+		return nil
+	}
+
+	// the payloads behind the busy page are claimed, the processed one is acknowledged
+	queue.claim(ctx, "c1", process)
+	assert.Equal(t, []string{fmt.Sprintf("s%d", objectQueueClaimPage), failing}, processed)
+	depth, err := queue.Depth()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(objectQueueClaimPage+1), depth.Pending)
+	assert.Equal(t, int64(0), depth.Waiting)
+	assert.Equal(t, int64(0), depth.DeadLetters)
+
+	// the failing payload is dead-lettered once delivered objectQueueMaxDeliveries times
+	for i := 0; i < objectQueueMaxDeliveries; i++ {
+		time.Sleep(queue.claimIdle)
+		assert.Nil(t, client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   queue.stream,
+			Group:    objectQueueGroup,
+			Consumer: "busy",
+			Messages: ids[:objectQueueClaimPage],
+		}).Err())
+		queue.claim(ctx, "c1", process)
+	}
+	// the other payload once, the failing one for every delivery but the
+	// first which went to the stopped worker
+	assert.Equal(t, objectQueueMaxDeliveries, len(processed))
+	depth, err = queue.Depth()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(objectQueueClaimPage), depth.Pending)
+	assert.Equal(t, int64(1), depth.DeadLetters)
+
+	dead, err := client.XRange(ctx, queue.deadStream, "-", "+").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, fmt.Sprint(objectQueueMaxDeliveries), dead[0].Values["deliveries"])
+	var objectBig ObjectBig
+	assert.Nil(t, json.Unmarshal([]byte(dead[0].Values["payload"].(string)), &objectBig))
+	assert.Equal(t, failing, objectBig.StudyID)
+}
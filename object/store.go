@@ -0,0 +1,22 @@
+package object
+
+import (
+	"vindr-lab-api/entities"
+)
+
+// ObjectStore is implemented by ObjectES and ObjectMemory
+type ObjectStore interface {
+	Create(object Object) error
+	Bulk(objects []Object) error
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(objects []Object, es entities.ESReturn)) error
+	Scroll(queries map[string][]string, qs string, size int, sort string, f func(objects []Object, es entities.ESReturn) error) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Object, *entities.ESReturn, error)
+	Get(queries map[string][]string, qs string) (*Object, *entities.ESReturn, error)
+	Delete(queries map[string][]string, qs string) error
+	Update(object Object, update map[string]interface{}) error
+}
+
+var (
+	_ ObjectStore = (*ObjectES)(nil)
+	_ ObjectStore = (*ObjectMemory)(nil)
+)
@@ -0,0 +1,153 @@
+package project
+
+import (
+	"strings"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+)
+
+var mapDeidAction = map[string]bool{
+	constants.DeidActionKeep:   true,
+	constants.DeidActionRemove: true,
+	constants.DeidActionEmpty:  true,
+	constants.DeidActionHash:   true,
+	constants.DeidActionUID:    true,
+}
+
+// basicProfile the attributes of the Basic Application Level Confidentiality
+// Profile of DICOM PS3.15 Annex E in entities.DICOMDictionary, the others are
+// kept.
+// Z attributes are EMPTY, or HASH when the value links the studies of a patient
+var basicProfile = map[string]string{
+	"AccessionNumber":                   constants.DeidActionEmpty,
+	"AcquisitionDate":                   constants.DeidActionRemove,
+	"AcquisitionDateTime":               constants.DeidActionRemove,
+	"AcquisitionTime":                   constants.DeidActionRemove,
+	"AdditionalPatientHistory":          constants.DeidActionRemove,
+	"ContentDate":                       constants.DeidActionEmpty,
+	"ContentTime":                       constants.DeidActionEmpty,
+	"DeviceSerialNumber":                constants.DeidActionRemove,
+	"EthnicGroup":                       constants.DeidActionRemove,
+	"FrameOfReferenceUID":               constants.DeidActionUID,
+	"ImageComments":                     constants.DeidActionRemove,
+	"InstanceCreationDate":              constants.DeidActionRemove,
+	"InstanceCreationTime":              constants.DeidActionRemove,
+	"InstitutionAddress":                constants.DeidActionRemove,
+	"InstitutionName":                   constants.DeidActionRemove,
+	"InstitutionalDepartmentName":       constants.DeidActionRemove,
+	"MedicalRecordLocator":              constants.DeidActionRemove,
+	"MilitaryRank":                      constants.DeidActionRemove,
+	"NameOfPhysiciansReadingStudy":      constants.DeidActionRemove,
+	"Occupation":                        constants.DeidActionRemove,
+	"OperatorsName":                     constants.DeidActionRemove,
+	"OtherPatientIDs":                   constants.DeidActionRemove,
+	"OtherPatientNames":                 constants.DeidActionRemove,
+	"PatientAddress":                    constants.DeidActionRemove,
+	"PatientAge":                        constants.DeidActionRemove,
+	"PatientBirthDate":                  constants.DeidActionEmpty,
+	"PatientBirthTime":                  constants.DeidActionRemove,
+	"PatientID":                         constants.DeidActionHash,
+	"PatientName":                       constants.DeidActionEmpty,
+	"PatientSex":                        constants.DeidActionEmpty,
+	"PatientSize":                       constants.DeidActionRemove,
+	"PatientTelephoneNumbers":           constants.DeidActionRemove,
+	"PatientWeight":                     constants.DeidActionRemove,
+	"PerformedProcedureStepDescription": constants.DeidActionRemove,
+	"PerformedProcedureStepStartDate":   constants.DeidActionRemove,
+	"PerformedProcedureStepStartTime":   constants.DeidActionRemove,
+	"PerformingPhysicianName":           constants.DeidActionRemove,
+	"ProtocolName":                      constants.DeidActionRemove,
+	"ReferringPhysicianName":            constants.DeidActionEmpty,
+	"RequestedProcedureDescription":     constants.DeidActionRemove,
+	"RequestingPhysician":               constants.DeidActionRemove,
+	"SOPInstanceUID":                    constants.DeidActionUID,
+	"SeriesDate":                        constants.DeidActionRemove,
+	"SeriesDescription":                 constants.DeidActionRemove,
+	"SeriesInstanceUID":                 constants.DeidActionUID,
+	"SeriesTime":                        constants.DeidActionRemove,
+	"StationName":                       constants.DeidActionRemove,
+	"StudyDate":                         constants.DeidActionEmpty,
+	"StudyDescription":                  constants.DeidActionRemove,
+	"StudyID":                           constants.DeidActionEmpty,
+	"StudyInstanceUID":                  constants.DeidActionUID,
+	"StudyTime":                         constants.DeidActionEmpty,
+}
+
+// deidOptions the attributes each option of PS3.15 Annex E keeps
+var deidOptions = map[string][]string{
+	constants.DeidOptionRetainUIDs: {
+		"FrameOfReferenceUID", "SOPInstanceUID", "SeriesInstanceUID", "StudyInstanceUID",
+	},
+	constants.DeidOptionRetainDeviceIdentity: {
+		"DeviceSerialNumber", "StationName",
+	},
+	constants.DeidOptionRetainInstitutionIdentity: {
+		"InstitutionAddress", "InstitutionName", "InstitutionalDepartmentName",
+	},
+	constants.DeidOptionRetainPatientCharacteristics: {
+		"EthnicGroup", "PatientAge", "PatientSex", "PatientSize", "PatientWeight",
+	},
+	constants.DeidOptionRetainLongitudinalFullDates: {
+		"AcquisitionDate", "AcquisitionDateTime", "AcquisitionTime", "ContentDate", "ContentTime",
+		"InstanceCreationDate", "InstanceCreationTime", "PerformedProcedureStepStartDate",
+		"PerformedProcedureStepStartTime", "SeriesDate", "SeriesTime", "StudyDate", "StudyTime",
+	},
+}
+
+// DeidentificationProfile how the DICOM files uploaded to the project are
+// de-identified before they are stored, the basic profile of PS3.15 with
+// Options, then Tags overriding the action of single attributes
+type DeidentificationProfile struct {
+	Options []string `json:"options,omitempty"`
+	// Tags the action of an attribute of entities.DICOMDictionary by its
+	// keyword, KEEP, REMOVE, EMPTY, HASH or UID
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// IsValid the options and actions are known
+func (profile *DeidentificationProfile) IsValid() bool {
+	for _, option := range profile.Options {
+		if _, found := deidOptions[option]; !found {
+			return false
+		}
+	}
+	for tag, action := range profile.Tags {
+		if _, found := entities.DICOMDictionary[tag]; !found || !mapDeidAction[action] {
+			return false
+		}
+	}
+	return true
+}
+
+// Actions the action of every attribute the profile does not keep as it is
+func (profile *DeidentificationProfile) Actions() map[string]string {
+	actions := make(map[string]string)
+	for tag, action := range basicProfile {
+		actions[tag] = action
+	}
+	for _, option := range profile.Options {
+		for _, tag := range deidOptions[option] {
+			delete(actions, tag)
+		}
+	}
+	for tag, action := range profile.Tags {
+		actions[tag] = action
+	}
+	for tag, action := range actions {
+		if action == constants.DeidActionKeep {
+			delete(actions, tag)
+		}
+	}
+	return actions
+}
+
+// DeidentificationMethod the value of the DeidentificationMethod attribute
+// of the files de-identified by the profile, one value per option
+func (profile *DeidentificationProfile) DeidentificationMethod() string {
+	values := append([]string{"PS3.15 BASIC PROFILE"}, profile.Options...)
+	if len(profile.Tags) > 0 {
+		values = append(values, "CUSTOM TAGS")
+	}
+	return strings.Join(values, "\\")
+}
@@ -2,6 +2,7 @@ package project
 
 import (
 	"encoding/json"
+	"strings"
 
 	"vindr-lab-api/constants"
 )
@@ -9,12 +10,14 @@ import (
 var mapWorkflow = map[string]bool{
 	constants.ProjWorkflowSingle:   true,
 	constants.ProjWorkflowTriangle: true,
+	constants.ProjWorkflowCustom:   true,
 }
 
 var mapProjectRole = map[string]bool{
 	constants.ProjRoleAnnotator:    true,
 	constants.ProjRoleProjectOwner: true,
 	constants.ProjRoleReviewer:     true,
+	constants.ProjRoleArbitrator:   true,
 }
 
 var mapLabelingType = map[string]bool{
@@ -26,6 +29,8 @@ type ProjectPerson struct {
 	ID       string   `json:"id"`
 	Username string   `json:"username"`
 	Roles    []string `json:"roles"`
+	// Skills DICOM attributes the person reads, as Attribute:Value like Modality:CT
+	Skills []string `json:"skills,omitempty"`
 }
 
 type Project struct {
@@ -42,6 +47,36 @@ type Project struct {
 	RolesMapping  *map[string][]string   `json:"roles_mapping,omitempty"`
 	Key           string                 `json:"key"`
 	LabelingType  string                 `json:"labeling_type"`
+
+	// WorkflowDefinition the stages of the tasks when Workflow is CUSTOM
+	WorkflowDefinition *WorkflowDefinition `json:"workflow_definition,omitempty"`
+	// StaleTaskPolicy what happens to DOING tasks nobody works on, nothing when nil
+	StaleTaskPolicy *StaleTaskPolicy `json:"stale_task_policy,omitempty"`
+	// DeidentificationProfile how the uploaded DICOM files are de-identified,
+	// only their UIDs are masked when nil
+	DeidentificationProfile *DeidentificationProfile `json:"deidentification_profile,omitempty"`
+	// PACS the name of the PACS of the server keeping the DICOM files, the
+	// default OrthanC when empty
+	PACS string `json:"pacs,omitempty"`
+}
+
+// StaleTaskPolicy the owners of the project are notified of a DOING task idle
+// for NotifyAfterHours, which is released by Action once idle for
+// ReleaseAfterHours. A task is idle since its last change or annotation save
+type StaleTaskPolicy struct {
+	NotifyAfterHours  int `json:"notify_after_hours"`
+	ReleaseAfterHours int `json:"release_after_hours"`
+	// Action RESET puts the task back to NEW for its assignee, POOL to NEW for
+	// anybody to claim. The annotations of the task are kept
+	Action string `json:"action"`
+}
+
+// IsValid the task is notified about before it is released
+func (policy *StaleTaskPolicy) IsValid() bool {
+	if policy.NotifyAfterHours <= 0 || policy.ReleaseAfterHours < policy.NotifyAfterHours {
+		return false
+	}
+	return policy.Action == constants.StaleActionReset || policy.Action == constants.StaleActionPool
 }
 
 func (project *Project) String() string {
@@ -50,15 +85,36 @@ func (project *Project) String() string {
 }
 
 func (project *Project) IsValidWorkflow() bool {
+	if project.Workflow == constants.ProjWorkflowCustom {
+		return project.WorkflowDefinition != nil && project.WorkflowDefinition.Validate() == nil
+	}
 	_, found := mapWorkflow[project.Workflow]
 	return found
 }
 
+// GetWorkflow the stages the tasks of the project go through
+func (project *Project) GetWorkflow() *WorkflowDefinition {
+	if project.Workflow == constants.ProjWorkflowCustom && project.WorkflowDefinition != nil {
+		return project.WorkflowDefinition
+	}
+	return DefaultWorkflow(project.Workflow)
+}
+
 func IsValidUserRole(role string) bool {
 	_, found := mapProjectRole[role]
 	return found
 }
 
+// ParseSkill splits a skill into its DICOM attribute and value
+func ParseSkill(skill string) (string, string, bool) {
+	parts := strings.SplitN(skill, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// IsValidProjectRole the roles and skills of the people are valid
 func (project *Project) IsValidProjectRole() bool {
 	for _, person := range project.People {
 		for _, role := range person.Roles {
@@ -66,6 +122,11 @@ func (project *Project) IsValidProjectRole() bool {
 				return false
 			}
 		}
+		for _, skill := range person.Skills {
+			if _, _, ok := ParseSkill(skill); !ok {
+				return false
+			}
+		}
 	}
 	return true
 }
@@ -75,7 +136,10 @@ func (project *Project) IsValidProject() bool {
 		!project.IsValidProjectRole() || !project.IsValidWorkflow() {
 		return false
 	}
-	return true
+	if project.DeidentificationProfile != nil && !project.DeidentificationProfile.IsValid() {
+		return false
+	}
+	return project.StaleTaskPolicy == nil || project.StaleTaskPolicy.IsValid()
 }
 
 func (project *Project) retrieveRolesMapFromPeople() {
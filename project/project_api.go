@@ -3,6 +3,7 @@ package project
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -19,12 +20,37 @@ import (
 )
 
 type ProjectAPI struct {
-	projectStore *ProjectES
+	projectStore ProjectStore
 	esClient     *elasticsearch.Client
 	logger       *zap.Logger
+	handover     TaskHandover
+	pacsNames    map[string]bool
 }
 
-func NewProjectAPI(storeProject *ProjectES, logger *zap.Logger) (app *ProjectAPI) {
+// TaskHandover moves the open tasks of a person leaving a project to another
+type TaskHandover interface {
+	HandOverTasks(projectID, fromID, toID, actorID string) error
+}
+
+// SetTaskHandover lets UpdatePeopleOfProject reassign the tasks of the people it removes
+func (app *ProjectAPI) SetTaskHandover(handover TaskHandover) {
+	app.handover = handover
+}
+
+// SetPACSNames the PACS a project may pick, any name is accepted until set
+func (app *ProjectAPI) SetPACSNames(names ...string) {
+	app.pacsNames = make(map[string]bool)
+	for _, name := range names {
+		app.pacsNames[name] = true
+	}
+}
+
+// isKnownPACS the empty name is the default PACS
+func (app *ProjectAPI) isKnownPACS(name string) bool {
+	return name == "" || app.pacsNames == nil || app.pacsNames[name]
+}
+
+func NewProjectAPI(storeProject ProjectStore, logger *zap.Logger) (app *ProjectAPI) {
 	app = &ProjectAPI{
 		projectStore: storeProject,
 		logger:       logger,
@@ -48,6 +74,11 @@ func (app *ProjectAPI) GetProject(c *gin.Context) {
 
 	projectID := c.Param(constants.ParamID)
 	project, _, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
@@ -97,7 +128,7 @@ func (app *ProjectAPI) CreateProject(c *gin.Context) {
 	})
 	project.retrieveRolesMapFromPeople()
 
-	if !project.IsValidProject() {
+	if !project.IsValidProject() || !app.isKnownPACS(project.PACS) {
 		utils.LogError(fmt.Errorf(project.String()))
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
@@ -140,6 +171,11 @@ func (app *ProjectAPI) UpdateProject(c *gin.Context) {
 	}
 
 	_, esReturn, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
@@ -160,6 +196,48 @@ func (app *ProjectAPI) UpdateProject(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
+
+	// the workflow is checked as it will be stored
+	_, foundWorkflow := updateMap["workflow"]
+	_, foundDefinition := updateMap["workflow_definition"]
+	if foundWorkflow || foundDefinition {
+		updated := project
+		bytesData, _ := json.Marshal(updateMap)
+		if err := json.Unmarshal(bytesData, &updated); err != nil || !updated.IsValidWorkflow() {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+	}
+
+	if policy, found := updateMap["stale_task_policy"]; found && policy != nil {
+		var updated StaleTaskPolicy
+		bytesData, _ := json.Marshal(policy)
+		if err := json.Unmarshal(bytesData, &updated); err != nil || !updated.IsValid() {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+	}
+
+	if profile, found := updateMap["deidentification_profile"]; found && profile != nil {
+		var updated DeidentificationProfile
+		bytesData, _ := json.Marshal(profile)
+		if err := json.Unmarshal(bytesData, &updated); err != nil || !updated.IsValid() {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+	}
+
+	if name, found := updateMap["pacs"]; found && name != nil {
+		if name, ok := name.(string); !ok || !app.isKnownPACS(name) {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+	}
+
 	err2 := app.projectStore.Update(project, updateMap)
 	if err2 != nil {
 		resp.ErrorCode = constants.ServerError
@@ -173,6 +251,8 @@ func (app *ProjectAPI) UpdateProject(c *gin.Context) {
 
 type AddProjectPeopleRequestBody struct {
 	People []ProjectPerson `json:"people"`
+	// ReassignTo who gets the open tasks of each removed person, when updating the people
+	ReassignTo map[string]string `json:"reassign_to,omitempty"`
 }
 
 func (app *ProjectAPI) AddPeopleToProject(c *gin.Context) {
@@ -186,7 +266,17 @@ func (app *ProjectAPI) AddPeopleToProject(c *gin.Context) {
 		return
 	}
 
-	project, esReturn, _ := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	project, esReturn, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.String(http.StatusNotFound, resp.String())
+		return
+	}
+	if err != nil {
+		resp.ErrorCode = constants.ServerError
+		c.String(http.StatusInternalServerError, resp.String())
+		return
+	}
 
 	currentPeople := project.People
 	if currentPeople == nil {
@@ -209,6 +299,9 @@ func (app *ProjectAPI) AddPeopleToProject(c *gin.Context) {
 					}
 				}
 				currentPeople[ith].Roles = newRoles
+				if len(newP.Skills) > 0 {
+					currentPeople[ith].Skills = newP.Skills
+				}
 				added = true
 				break
 			}
@@ -221,6 +314,12 @@ func (app *ProjectAPI) AddPeopleToProject(c *gin.Context) {
 	project.People = currentPeople
 	project.retrieveRolesMapFromPeople()
 
+	if !project.IsValidProjectRole() {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.String(http.StatusBadRequest, resp.String())
+		return
+	}
+
 	hit := esReturn.Hits.Hits[0]
 	update := ProjectUpdateRequest{
 		ID:      hit.ID,
@@ -246,12 +345,22 @@ func (app *ProjectAPI) UpdatePeopleOfProject(c *gin.Context) {
 	}
 
 	project, esReturn, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
-	if err != nil {
+	if errors.Is(err, utils.ErrNotFound) {
 		resp.ErrorCode = constants.ServerInvalidData
-		c.String(http.StatusBadRequest, resp.String())
+		c.String(http.StatusNotFound, resp.String())
+		return
+	}
+	if err != nil {
+		resp.ErrorCode = constants.ServerError
+		c.String(http.StatusInternalServerError, resp.String())
 		return
 	}
 
+	mapPreviousPeople := make(map[string]bool)
+	for _, person := range project.People {
+		mapPreviousPeople[person.ID] = true
+	}
+
 	newPeople := b.People
 	mapUserRoles := make(map[string]ProjectPerson)
 	for _, person := range newPeople {
@@ -266,6 +375,11 @@ func (app *ProjectAPI) UpdatePeopleOfProject(c *gin.Context) {
 				}
 			}
 			person1.Roles = roles1
+			for _, skill := range person.Skills {
+				if _, in := utils.FindInSlice(person1.Skills, skill); !in {
+					person1.Skills = append(person1.Skills, skill)
+				}
+			}
 			mapUserRoles[person.ID] = person1
 		}
 	}
@@ -284,6 +398,17 @@ func (app *ProjectAPI) UpdatePeopleOfProject(c *gin.Context) {
 		return
 	}
 
+	// tasks go from a removed person to one who stays
+	for fromID, toID := range b.ReassignTo {
+		_, removed := mapPreviousPeople[fromID]
+		_, staying := mapUserRoles[fromID]
+		if _, found := mapUserRoles[toID]; !found || !removed || staying || app.handover == nil {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.String(http.StatusBadRequest, resp.String())
+			return
+		}
+	}
+
 	hit := esReturn.Hits.Hits[0]
 	update := ProjectUpdateRequest{
 		ID:      hit.ID,
@@ -293,6 +418,16 @@ func (app *ProjectAPI) UpdatePeopleOfProject(c *gin.Context) {
 	ctx := context.TODO()
 	app.projectStore.Persist(ctx, &update)
 
+	authInfo := mw.GetAuthInfoFromGin(c)
+	for fromID, toID := range b.ReassignTo {
+		if err := app.handover.HandOverTasks(projectID, fromID, toID, authInfo.ID); err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.String(http.StatusInternalServerError, resp.String())
+			return
+		}
+	}
+
 	resp.Data = project.People
 	c.JSON(http.StatusOK, resp)
 }
@@ -171,7 +171,7 @@ func (store *ProjectES) Get(queries map[string][]string, qs string) (*Project, *
 	if len(projects) > 0 {
 		return &projects[0], esReturn, nil
 	}
-	return nil, esReturn, nil
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // Delete function
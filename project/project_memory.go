@@ -0,0 +1,88 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// ProjectMemory keeps projects in memory, for running without a cluster and in tests
+type ProjectMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewProjectMemory() *ProjectMemory {
+	return &ProjectMemory{utils.NewMemoryIndex("project")}
+}
+
+// Create function
+func (store *ProjectMemory) Create(project Project) error {
+	return store.index.Index(project.ID, project, entities.Revision{})
+}
+
+// GetSlice function
+func (store *ProjectMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Project, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	projects := make([]Project, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var project Project
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &project); err == nil {
+			projects = append(projects, project)
+		}
+	}
+	return projects, esReturn, nil
+}
+
+// Query get all
+func (store *ProjectMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(projects []Project, es entities.ESReturn)) error {
+	for {
+		projects, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(projects, *esReturn)
+
+		if len(projects) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Get get one ESReturn
+func (store *ProjectMemory) Get(queries map[string][]string, qs string) (*Project, *entities.ESReturn, error) {
+	projects, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(projects) > 0 {
+		return &projects[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Delete function
+func (store *ProjectMemory) Delete(project Project) error {
+	return store.index.Delete(map[string][]string{"id": {project.ID}}, "")
+}
+
+// Update function
+func (store *ProjectMemory) Update(project Project, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(project.ID, update, entities.Revision{})
+}
+
+// Persist the memory index has no per month indices, p.Index is not used
+func (store *ProjectMemory) Persist(ctx context.Context, p *ProjectUpdateRequest) error {
+	return store.index.Update(p.ID, p.Project, entities.Revision{})
+}
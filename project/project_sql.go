@@ -0,0 +1,98 @@
+package project
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// ProjectSQL keeps projects in a relational database, see utils.SQLTable
+type ProjectSQL struct {
+	table *utils.SQLTable
+}
+
+func NewProjectSQL(db utils.SQLExecutor) *ProjectSQL {
+	return &ProjectSQL{utils.NewSQLTable(db, "projects")}
+}
+
+// CreateTable creates the projects table when missing
+func (store *ProjectSQL) CreateTable() error {
+	return store.table.CreateTable()
+}
+
+// Create function
+func (store *ProjectSQL) Create(project Project) error {
+	return store.table.Index(project.ID, project, entities.Revision{})
+}
+
+// GetSlice function
+func (store *ProjectSQL) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Project, *entities.ESReturn, error) {
+	esReturn, err := store.table.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	projects := make([]Project, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var project Project
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &project); err == nil {
+			projects = append(projects, project)
+		}
+	}
+	return projects, esReturn, nil
+}
+
+// Query get all
+func (store *ProjectSQL) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(projects []Project, es entities.ESReturn)) error {
+	// a size of 0 would read the first page forever
+	if size <= 0 {
+		size = constants.DefaultLimit
+	}
+	for {
+		projects, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(projects, *esReturn)
+
+		if len(projects) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Get get one ESReturn
+func (store *ProjectSQL) Get(queries map[string][]string, qs string) (*Project, *entities.ESReturn, error) {
+	projects, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(projects) > 0 {
+		return &projects[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Delete function
+func (store *ProjectSQL) Delete(project Project) error {
+	return store.table.Delete(map[string][]string{"id": {project.ID}}, "")
+}
+
+// Update function
+func (store *ProjectSQL) Update(project Project, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.table.Update(project.ID, update, entities.Revision{})
+}
+
+// Persist the table has no per month indices, p.Index is not used
+func (store *ProjectSQL) Persist(ctx context.Context, p *ProjectUpdateRequest) error {
+	return store.table.Update(p.ID, p.Project, entities.Revision{})
+}
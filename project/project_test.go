@@ -20,3 +20,89 @@ func TestString(t *testing.T) {
 		assert.NotEqual(t, "{}", project.String())
 	}
 }
+
+func TestWorkflow(t *testing.T) {
+	assert.Nil(t, DefaultWorkflow("SINGLE").Validate())
+	assert.Nil(t, DefaultWorkflow("TRIANGLE").Validate())
+	assert.Equal(t, "REVIEWER", DefaultWorkflow("TRIANGLE").Stages[0].Next[0].Role)
+
+	project := Project{Workflow: "CUSTOM"}
+	assert.False(t, project.IsValidWorkflow())
+	assert.Equal(t, "annotate", project.GetWorkflow().Stages[0].Name)
+
+	project.WorkflowDefinition = &WorkflowDefinition{Stages: []WorkflowStage{
+		{Name: "annotate", TaskType: "ANNOTATE", Transitions: map[string][]string{"NEW": {"COMPLETED"}},
+			Next: []WorkflowRule{{Stage: "review", AssigneeIDs: []string{"u2"}}}},
+		{Name: "review", TaskType: "REVIEW", ReturnsTo: "annotate"},
+	}}
+	assert.True(t, project.IsValidWorkflow())
+	stage := project.GetWorkflow().StageOf("", "ANNOTATE")
+	assert.True(t, stage.CanTransition("NEW", "COMPLETED"))
+	assert.True(t, stage.CanTransition("NEW", "NEW"))
+	assert.False(t, stage.CanTransition("COMPLETED", "NEW"))
+
+	project.WorkflowDefinition.Stages[1].ReturnsTo = "arbitrate"
+	assert.NotNil(t, project.WorkflowDefinition.Validate())
+	project.WorkflowDefinition.Stages[1].ReturnsTo = ""
+	project.WorkflowDefinition.Stages[0].Transitions["DONE"] = []string{"NEW"}
+	assert.NotNil(t, project.WorkflowDefinition.Validate())
+	delete(project.WorkflowDefinition.Stages[0].Transitions, "DONE")
+	project.WorkflowDefinition.Stages[1].Name = "annotate"
+	assert.False(t, project.IsValidWorkflow())
+}
+
+func TestSkills(t *testing.T) {
+	attribute, value, ok := ParseSkill("Modality:CT")
+	assert.True(t, ok)
+	assert.Equal(t, "Modality", attribute)
+	assert.Equal(t, "CT", value)
+
+	p := Project{People: []ProjectPerson{{ID: "u1", Roles: []string{"ANNOTATOR"}, Skills: []string{"Modality:CT"}}}}
+	assert.True(t, p.IsValidProjectRole())
+	p.People[0].Skills = append(p.People[0].Skills, "CT")
+	assert.False(t, p.IsValidProjectRole())
+}
+
+func TestStaleTaskPolicy(t *testing.T) {
+	policy := StaleTaskPolicy{NotifyAfterHours: 24, ReleaseAfterHours: 72, Action: "RESET"}
+	assert.True(t, policy.IsValid())
+	policy.ReleaseAfterHours = 12
+	assert.False(t, policy.IsValid())
+	policy = StaleTaskPolicy{NotifyAfterHours: 24, ReleaseAfterHours: 24, Action: "ARCHIVE"}
+	assert.False(t, policy.IsValid())
+}
+
+func TestDeidentificationProfile(t *testing.T) {
+	profile := DeidentificationProfile{
+		Options: []string{"RETAIN_PATIENT_CHARACTERISTICS"},
+		Tags:    map[string]string{"AccessionNumber": "HASH", "StudyDate": "KEEP"},
+	}
+	assert.True(t, profile.IsValid())
+
+	actions := profile.Actions()
+	assert.Equal(t, "UID", actions["StudyInstanceUID"])
+	assert.Equal(t, "HASH", actions["PatientID"])
+	assert.Equal(t, "HASH", actions["AccessionNumber"])
+	_, found := actions["PatientSex"]
+	assert.False(t, found)
+	_, found = actions["StudyDate"]
+	assert.False(t, found)
+	assert.Equal(t, "PS3.15 BASIC PROFILE\\RETAIN_PATIENT_CHARACTERISTICS\\CUSTOM TAGS", profile.DeidentificationMethod())
+
+	profile.Tags["PatientName"] = "SCRAMBLE"
+	assert.False(t, profile.IsValid())
+	profile = DeidentificationProfile{Options: []string{"RETAIN_EVERYTHING"}}
+	assert.False(t, profile.IsValid())
+	// only the keywords the API knows can be changed
+	profile = DeidentificationProfile{Tags: map[string]string{"PatientNmae": "KEEP"}}
+	assert.False(t, profile.IsValid())
+}
+
+func TestPACSNames(t *testing.T) {
+	app := NewProjectAPI(NewProjectMemory(), nil)
+	assert.True(t, app.isKnownPACS("hospital"))
+	app.SetPACSNames("orthanc", "hospital")
+	assert.True(t, app.isKnownPACS(""))
+	assert.True(t, app.isKnownPACS("hospital"))
+	assert.False(t, app.isKnownPACS("clinic"))
+}
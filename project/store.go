@@ -0,0 +1,24 @@
+package project
+
+import (
+	"context"
+
+	"vindr-lab-api/entities"
+)
+
+// ProjectStore is implemented by ProjectES, ProjectMemory and ProjectSQL
+type ProjectStore interface {
+	Create(project Project) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Project, *entities.ESReturn, error)
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(projects []Project, es entities.ESReturn)) error
+	Get(queries map[string][]string, qs string) (*Project, *entities.ESReturn, error)
+	Delete(project Project) error
+	Update(project Project, update map[string]interface{}) error
+	Persist(ctx context.Context, p *ProjectUpdateRequest) error
+}
+
+var (
+	_ ProjectStore = (*ProjectES)(nil)
+	_ ProjectStore = (*ProjectMemory)(nil)
+	_ ProjectStore = (*ProjectSQL)(nil)
+)
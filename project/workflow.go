@@ -0,0 +1,207 @@
+package project
+
+import (
+	"fmt"
+
+	"vindr-lab-api/constants"
+)
+
+var mapWorkflowTaskType = map[string]bool{
+	constants.TaskTypeAnnotate:  true,
+	constants.TaskTypeReview:    true,
+	constants.TaskTypeArbitrate: true,
+}
+
+var mapWorkflowTaskStatus = map[string]bool{
+	constants.TaskStatusNew:       true,
+	constants.TaskStatusDoing:     true,
+	constants.TaskStatusCompleted: true,
+	constants.TaskStatusRejected:  true,
+	constants.TaskStatusReturned:  true,
+}
+
+// DefaultDisagreementIoU shapes of two reviews overlapping less disagree
+const DefaultDisagreementIoU = 0.5
+
+var mapWorkflowStrategy = map[string]bool{
+	constants.ASSIGN_STRATEGY_EQUALLY: true,
+	constants.ASSIGN_STRATEGY_RANDOM:  true,
+	constants.ASSIGN_STRATEGY_NONE:    true,
+}
+
+// DisagreementRule the completed tasks of a stage disagree when their TAG
+// labels on an object differ, or when one drew a BOUNDING_BOX or POLYGON that
+// another did not draw with the same labels and an IoU of at least MinIoU
+type DisagreementRule struct {
+	Tags   bool    `json:"tags"`
+	MinIoU float64 `json:"min_iou,omitempty"`
+}
+
+// WorkflowRule creates a task of Stage for each assignee, or for Count people
+// of the project having Role, picked following Strategy
+type WorkflowRule struct {
+	Stage       string   `json:"stage"`
+	AssigneeIDs []string `json:"assignee_ids,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	// Count 1 when not set
+	Count int `json:"count,omitempty"`
+	// Strategy EQUALLY picks who has the fewest open tasks of the stage, RANDOM
+	// anyone, NONE creates nothing. The server's default is used when empty
+	Strategy string `json:"strategy,omitempty"`
+	// Disagreement only creates the tasks when the tasks of the stage disagree
+	Disagreement *DisagreementRule `json:"disagreement,omitempty"`
+}
+
+// WorkflowStage one step of the labeling of a study, done by tasks of TaskType
+type WorkflowStage struct {
+	Name     string `json:"name"`
+	TaskType string `json:"task_type"`
+	// Transitions the statuses a task can be moved to from each status
+	Transitions map[string][]string `json:"transitions"`
+	// ReturnsTo the stage whose completed tasks are RETURNED when a task of
+	// this one is REJECTED, a stage without it cannot reject
+	ReturnsTo string `json:"returns_to,omitempty"`
+	// Next the tasks created once every task of the stage of a study is completed
+	Next []WorkflowRule `json:"next,omitempty"`
+}
+
+// WorkflowDefinition the stages of the tasks of a CUSTOM project
+type WorkflowDefinition struct {
+	Stages []WorkflowStage `json:"stages"`
+}
+
+// DefaultWorkflow the ANNOTATE then REVIEW stages SINGLE and TRIANGLE projects
+// follow, TRIANGLE ones get a REVIEW task once all ANNOTATE tasks are completed
+func DefaultWorkflow(name string) *WorkflowDefinition {
+	open := []string{constants.TaskStatusNew, constants.TaskStatusDoing, constants.TaskStatusCompleted}
+	workflow := &WorkflowDefinition{
+		Stages: []WorkflowStage{
+			{
+				Name:     constants.WorkflowStageAnnotate,
+				TaskType: constants.TaskTypeAnnotate,
+				Transitions: map[string][]string{
+					constants.TaskStatusNew:       open,
+					constants.TaskStatusDoing:     open,
+					constants.TaskStatusCompleted: open,
+					constants.TaskStatusReturned:  {constants.TaskStatusDoing, constants.TaskStatusCompleted},
+				},
+			},
+			{
+				Name:     constants.WorkflowStageReview,
+				TaskType: constants.TaskTypeReview,
+				Transitions: map[string][]string{
+					constants.TaskStatusNew:       append(open, constants.TaskStatusRejected),
+					constants.TaskStatusDoing:     append(open, constants.TaskStatusRejected),
+					constants.TaskStatusCompleted: append(open, constants.TaskStatusRejected),
+					constants.TaskStatusRejected:  {constants.TaskStatusDoing},
+				},
+				ReturnsTo: constants.WorkflowStageAnnotate,
+			},
+			{
+				Name:     constants.WorkflowStageArbitrate,
+				TaskType: constants.TaskTypeArbitrate,
+				Transitions: map[string][]string{
+					constants.TaskStatusNew:       open,
+					constants.TaskStatusDoing:     open,
+					constants.TaskStatusCompleted: open,
+				},
+			},
+		},
+	}
+
+	// reviews assigned by hand to several reviewers are arbitrated when they disagree
+	if name == constants.ProjWorkflowTriangle {
+		workflow.Stages[0].Next = []WorkflowRule{
+			{Stage: constants.WorkflowStageReview, Role: constants.ProjRoleReviewer},
+		}
+		workflow.Stages[1].Next = []WorkflowRule{
+			{Stage: constants.WorkflowStageArbitrate, Role: constants.ProjRoleArbitrator,
+				Disagreement: &DisagreementRule{Tags: true, MinIoU: DefaultDisagreementIoU}},
+		}
+	}
+	return workflow
+}
+
+// Stage the stage named name, nil when there is none
+func (workflow *WorkflowDefinition) Stage(name string) *WorkflowStage {
+	for i := range workflow.Stages {
+		if workflow.Stages[i].Name == name {
+			return &workflow.Stages[i]
+		}
+	}
+	return nil
+}
+
+// StageOf the stage of a task, tasks created before workflows have no stage
+// and belong to the first stage of their type
+func (workflow *WorkflowDefinition) StageOf(name, taskType string) *WorkflowStage {
+	if name != "" {
+		return workflow.Stage(name)
+	}
+	for i := range workflow.Stages {
+		if workflow.Stages[i].TaskType == taskType {
+			return &workflow.Stages[i]
+		}
+	}
+	return nil
+}
+
+// CanTransition keeping the same status is always allowed
+func (stage *WorkflowStage) CanTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, status := range stage.Transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate every stage is named once, and the transitions and rules only use
+// known statuses and stages
+func (workflow *WorkflowDefinition) Validate() error {
+	if len(workflow.Stages) == 0 {
+		return fmt.Errorf("Workflow has no stage")
+	}
+
+	names := make(map[string]bool)
+	for _, stage := range workflow.Stages {
+		if stage.Name == "" || names[stage.Name] {
+			return fmt.Errorf("Stage name [%s] is empty or duplicated", stage.Name)
+		}
+		names[stage.Name] = true
+		if !mapWorkflowTaskType[stage.TaskType] {
+			return fmt.Errorf("Stage [%s] has an invalid task type [%s]", stage.Name, stage.TaskType)
+		}
+		for from, tos := range stage.Transitions {
+			if !mapWorkflowTaskStatus[from] {
+				return fmt.Errorf("Stage [%s] has an invalid status [%s]", stage.Name, from)
+			}
+			for _, status := range tos {
+				if !mapWorkflowTaskStatus[status] {
+					return fmt.Errorf("Stage [%s] has an invalid status [%s]", stage.Name, status)
+				}
+			}
+		}
+	}
+
+	for _, stage := range workflow.Stages {
+		if stage.ReturnsTo != "" && !names[stage.ReturnsTo] {
+			return fmt.Errorf("Stage [%s] returns to an unknown stage [%s]", stage.Name, stage.ReturnsTo)
+		}
+		for _, rule := range stage.Next {
+			if !names[rule.Stage] || (len(rule.AssigneeIDs) == 0 && !IsValidUserRole(rule.Role)) {
+				return fmt.Errorf("Stage [%s] creates an unknown stage [%s] or has no assignee", stage.Name, rule.Stage)
+			}
+			if rule.Strategy != "" && !mapWorkflowStrategy[rule.Strategy] || rule.Count < 0 {
+				return fmt.Errorf("Stage [%s] has an invalid strategy [%s] or count", stage.Name, rule.Strategy)
+			}
+			if d := rule.Disagreement; d != nil && (!d.Tags && d.MinIoU == 0 || d.MinIoU < 0 || d.MinIoU > 1) {
+				return fmt.Errorf("Stage [%s] has an invalid disagreement rule", stage.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"vindr-lab-api/constants"
 	"vindr-lab-api/entities"
 	"vindr-lab-api/mw"
+	"vindr-lab-api/utils"
 
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/gin-gonic/gin"
@@ -16,12 +18,12 @@ import (
 )
 
 type SessionAPI struct {
-	store    *SessionES
+	store    SessionStore
 	esClient *elasticsearch.Client
 	logger   *zap.Logger
 }
 
-func NewSessionAPI(sessionS *SessionES, logger *zap.Logger) (app *SessionAPI) {
+func NewSessionAPI(sessionS SessionStore, logger *zap.Logger) (app *SessionAPI) {
 	app = &SessionAPI{
 		store:  sessionS,
 		logger: logger,
@@ -40,6 +42,11 @@ func (app *SessionAPI) GetSession(c *gin.Context) {
 
 	sessionID := c.Param(constants.ParamSessionID)
 	session, _, err := app.store.Get(nil, fmt.Sprintf("session_id.keyword:%s", sessionID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -39,7 +38,7 @@ func (store *SessionES) Get(queries map[string][]string, qs string) (*Session, *
 	if len(sessions) > 0 {
 		return &sessions[0], esReturn, nil
 	}
-	return nil, esReturn, errors.New("Return is empty")
+	return nil, esReturn, utils.ErrNotFound
 }
 
 func (store *SessionES) Create(session Session) error {
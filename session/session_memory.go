@@ -0,0 +1,50 @@
+package session
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// SessionMemory keeps sessions in memory, for running without a cluster and in tests
+type SessionMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewSessionMemory() *SessionMemory {
+	return &SessionMemory{utils.NewMemoryIndex("session")}
+}
+
+// Get get one ESReturn
+func (store *SessionMemory) Get(queries map[string][]string, qs string) (*Session, *entities.ESReturn, error) {
+	sessions, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sessions) > 0 {
+		return &sessions[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+func (store *SessionMemory) Create(session Session) error {
+	return store.index.Index(session.SessionID, session, entities.Revision{})
+}
+
+func (store *SessionMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Session, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessions := make([]Session, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var session Session
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &session); err == nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, esReturn, nil
+}
@@ -0,0 +1,17 @@
+package session
+
+import (
+	"vindr-lab-api/entities"
+)
+
+// SessionStore is implemented by SessionES and SessionMemory
+type SessionStore interface {
+	Get(queries map[string][]string, qs string) (*Session, *entities.ESReturn, error)
+	Create(session Session) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Session, *entities.ESReturn, error)
+}
+
+var (
+	_ SessionStore = (*SessionES)(nil)
+	_ SessionStore = (*SessionMemory)(nil)
+)
@@ -0,0 +1,551 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/study"
+	"vindr-lab-api/utils"
+)
+
+// DefaultIoUThreshold two shapes with a lower IoU are not the same finding
+const DefaultIoUThreshold = 0.5
+
+// agreementAntn the part of an annotation the agreement needs
+type agreementAntn struct {
+	StudyID   string
+	ObjectID  string
+	Annotator string
+	Type      string
+	LabelIDs  []string
+	Points    []annotation.Point2D
+}
+
+// agreementInput annotations of the completed ANNOTATE tasks of a project,
+// Annotators maps a study to the people who annotated it and Images to the
+// IDs of its IMAGE objects
+type agreementInput struct {
+	Labels       []annotation.Label
+	Annotators   map[string][]string
+	Images       map[string][]string
+	Antns        []agreementAntn
+	IoUThreshold float64
+}
+
+type Agreement struct {
+	ProjectID    string           `json:"project_id"`
+	IoUThreshold float64          `json:"iou_threshold"`
+	Studies      int              `json:"studies"`
+	Annotators   []string         `json:"annotators"`
+	Labels       []LabelAgreement `json:"labels"`
+	Pairs        []PairAgreement  `json:"pairs"`
+}
+
+// LabelAgreement kappa for TAG labels, IoU matching for BOUNDING_BOX and POLYGON
+type LabelAgreement struct {
+	LabelID        string          `json:"label_id"`
+	Name           string          `json:"name"`
+	Scope          string          `json:"scope"`
+	AnnotationType string          `json:"annotation_type"`
+	Items          int             `json:"items,omitempty"`
+	FleissKappa    *float64        `json:"fleiss_kappa,omitempty"`
+	Matched        int             `json:"matched,omitempty"`
+	Unmatched      int             `json:"unmatched,omitempty"`
+	MeanIoU        *float64        `json:"mean_iou,omitempty"`
+	MeanDice       *float64        `json:"mean_dice,omitempty"`
+	F1             *float64        `json:"f1,omitempty"`
+	Pairs          []PairAgreement `json:"pairs"`
+}
+
+type PairAgreement struct {
+	AnnotatorIDs      [2]string `json:"annotator_ids"`
+	Items             int       `json:"items,omitempty"`
+	ObservedAgreement *float64  `json:"observed_agreement,omitempty"`
+	CohenKappa        *float64  `json:"cohen_kappa,omitempty"`
+	Matched           int       `json:"matched,omitempty"`
+	OnlyFirst         int       `json:"only_first,omitempty"`
+	OnlySecond        int       `json:"only_second,omitempty"`
+	MeanIoU           *float64  `json:"mean_iou,omitempty"`
+	MeanDice          *float64  `json:"mean_dice,omitempty"`
+	F1                *float64  `json:"f1,omitempty"`
+}
+
+// tagCounts 2x2 table of two raters, 1 means the label was given
+type tagCounts struct {
+	n11, n10, n01, n00 int
+}
+
+type shapeCounts struct {
+	matched, onlyFirst, onlySecond int
+	sumIoU, sumDice                float64
+}
+
+type annotatorPair [2]string
+
+func newAnnotatorPair(a, b string) annotatorPair {
+	if b < a {
+		a, b = b, a
+	}
+	return annotatorPair{a, b}
+}
+
+func (counts *tagCounts) add(other tagCounts) {
+	counts.n11 += other.n11
+	counts.n10 += other.n10
+	counts.n01 += other.n01
+	counts.n00 += other.n00
+}
+
+// cohenKappa returns the observed agreement and the kappa, kappa is nil
+// when the expected agreement is 1
+func (counts tagCounts) cohenKappa() (*float64, *float64) {
+	n := float64(counts.n11 + counts.n10 + counts.n01 + counts.n00)
+	if n == 0 {
+		return nil, nil
+	}
+	po := float64(counts.n11+counts.n00) / n
+	pa := float64(counts.n11+counts.n10) / n
+	pb := float64(counts.n11+counts.n01) / n
+	pe := pa*pb + (1-pa)*(1-pb)
+	if pe >= 1 {
+		return &po, nil
+	}
+	kappa := (po - pe) / (1 - pe)
+	return &po, &kappa
+}
+
+func (counts *shapeCounts) add(other shapeCounts) {
+	counts.matched += other.matched
+	counts.onlyFirst += other.onlyFirst
+	counts.onlySecond += other.onlySecond
+	counts.sumIoU += other.sumIoU
+	counts.sumDice += other.sumDice
+}
+
+func (counts shapeCounts) scores() (meanIoU, meanDice, f1 *float64) {
+	if counts.matched > 0 {
+		iou := counts.sumIoU / float64(counts.matched)
+		dice := counts.sumDice / float64(counts.matched)
+		meanIoU, meanDice = &iou, &dice
+	}
+	if total := 2*counts.matched + counts.onlyFirst + counts.onlySecond; total > 0 {
+		v := float64(2*counts.matched) / float64(total)
+		f1 = &v
+	}
+	return
+}
+
+// fleissKappa for binary ratings, positives[i] raters out of raters[i] gave
+// the label to item i. Items may have different numbers of raters
+func fleissKappa(positives, raters []int) *float64 {
+	sumP, sumPositives, sumRaters, items := 0.0, 0, 0, 0
+	for i := range raters {
+		n := raters[i]
+		if n < 2 {
+			continue
+		}
+		pos, neg := positives[i], raters[i]-positives[i]
+		sumP += float64(pos*pos+neg*neg-n) / float64(n*(n-1))
+		sumPositives += pos
+		sumRaters += n
+		items++
+	}
+	if items == 0 {
+		return nil
+	}
+
+	pBar := sumP / float64(items)
+	p1 := float64(sumPositives) / float64(sumRaters)
+	pe := p1*p1 + (1-p1)*(1-p1)
+	if pe >= 1 {
+		return nil
+	}
+	kappa := (pBar - pe) / (1 - pe)
+	return &kappa
+}
+
+func computeAgreement(input agreementInput) *Agreement {
+	if input.IoUThreshold <= 0 {
+		input.IoUThreshold = DefaultIoUThreshold
+	}
+	ret := &Agreement{
+		IoUThreshold: input.IoUThreshold,
+		Annotators:   make([]string, 0),
+		Labels:       make([]LabelAgreement, 0),
+		Pairs:        make([]PairAgreement, 0),
+	}
+
+	mapAnnotator := make(map[string]bool)
+	for _, annotators := range input.Annotators {
+		if len(annotators) < 2 {
+			continue
+		}
+		ret.Studies++
+		for _, annotator := range annotators {
+			mapAnnotator[annotator] = true
+		}
+	}
+	for annotator := range mapAnnotator {
+		ret.Annotators = append(ret.Annotators, annotator)
+	}
+	sort.Strings(ret.Annotators)
+
+	mapLabel := make(map[string]annotation.Label)
+	for _, label := range input.Labels {
+		mapLabel[label.ID] = label
+	}
+
+	// study (STUDY scope) or object (other scopes) -> label -> annotator
+	mapTagItems := make(map[string]map[string]map[string]bool)
+	mapItemStudy := make(map[string]string)
+	mapScopeItems := make(map[string]map[string]bool)
+	// label -> study -> object -> annotator -> shapes
+	mapShapes := make(map[string]map[string]map[string]map[string][]agreementAntn)
+	for _, antn := range input.Antns {
+		if len(input.Annotators[antn.StudyID]) < 2 {
+			continue
+		}
+		for _, labelID := range antn.LabelIDs {
+			label, found := mapLabel[labelID]
+			if !found {
+				continue
+			}
+			switch antn.Type {
+			case constants.AntnTypeTag:
+				item := antn.StudyID
+				if label.Scope != constants.LabelScopeStudy {
+					item = antn.ObjectID
+				}
+				mapItemStudy[item] = antn.StudyID
+				if mapScopeItems[label.Scope] == nil {
+					mapScopeItems[label.Scope] = make(map[string]bool)
+				}
+				mapScopeItems[label.Scope][item] = true
+				if mapTagItems[item] == nil {
+					mapTagItems[item] = make(map[string]map[string]bool)
+				}
+				if mapTagItems[item][labelID] == nil {
+					mapTagItems[item][labelID] = make(map[string]bool)
+				}
+				mapTagItems[item][labelID][antn.Annotator] = true
+			case constants.AntnTypeBox, constants.AntnTypePolygon:
+				if len(antn.Points) == 0 {
+					continue
+				}
+				if mapShapes[labelID] == nil {
+					mapShapes[labelID] = make(map[string]map[string]map[string][]agreementAntn)
+				}
+				if mapShapes[labelID][antn.StudyID] == nil {
+					mapShapes[labelID][antn.StudyID] = make(map[string]map[string][]agreementAntn)
+				}
+				if mapShapes[labelID][antn.StudyID][antn.ObjectID] == nil {
+					mapShapes[labelID][antn.StudyID][antn.ObjectID] = make(map[string][]agreementAntn)
+				}
+				shapes := mapShapes[labelID][antn.StudyID][antn.ObjectID]
+				shapes[antn.Annotator] = append(shapes[antn.Annotator], antn)
+			}
+		}
+	}
+
+	// every study of the project is an item of STUDY scope labels and every
+	// image of its studies one of IMAGE scope labels, so images no annotator
+	// tagged count as agreeing. The items of SERIES scope labels are the
+	// objects tagged by at least one annotator
+	mapScopeItems[constants.LabelScopeStudy] = make(map[string]bool)
+	if mapScopeItems[constants.LabelScopeImage] == nil {
+		mapScopeItems[constants.LabelScopeImage] = make(map[string]bool)
+	}
+	for studyID, annotators := range input.Annotators {
+		if len(annotators) >= 2 {
+			mapScopeItems[constants.LabelScopeStudy][studyID] = true
+			mapItemStudy[studyID] = studyID
+			for _, objectID := range input.Images[studyID] {
+				mapScopeItems[constants.LabelScopeImage][objectID] = true
+				mapItemStudy[objectID] = studyID
+			}
+		}
+	}
+
+	allTags := make(map[annotatorPair]*tagCounts)
+	allShapes := make(map[annotatorPair]*shapeCounts)
+
+	labels := make([]annotation.Label, len(input.Labels))
+	copy(labels, input.Labels)
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].ID < labels[j].ID
+	})
+	for _, label := range labels {
+		labelRet := LabelAgreement{
+			LabelID:        label.ID,
+			Name:           label.Name,
+			Scope:          label.Scope,
+			AnnotationType: label.AnnotationType,
+			Pairs:          make([]PairAgreement, 0),
+		}
+
+		switch label.AnnotationType {
+		case constants.AntnTypeTag:
+			pairs := make(map[annotatorPair]*tagCounts)
+			positives, raters := make([]int, 0), make([]int, 0)
+			for item := range mapScopeItems[label.Scope] {
+				annotators := input.Annotators[mapItemStudy[item]]
+				given := mapTagItems[item][label.ID]
+				pos := 0
+				for i, a := range annotators {
+					if given[a] {
+						pos++
+					}
+					for _, b := range annotators[i+1:] {
+						pair := newAnnotatorPair(a, b)
+						if pairs[pair] == nil {
+							pairs[pair] = &tagCounts{}
+						}
+						first, second := given[pair[0]], given[pair[1]]
+						switch {
+						case first && second:
+							pairs[pair].n11++
+						case first:
+							pairs[pair].n10++
+						case second:
+							pairs[pair].n01++
+						default:
+							pairs[pair].n00++
+						}
+					}
+				}
+				positives = append(positives, pos)
+				raters = append(raters, len(annotators))
+			}
+
+			labelRet.Items = len(raters)
+			labelRet.FleissKappa = fleissKappa(positives, raters)
+			for pair, counts := range pairs {
+				if allTags[pair] == nil {
+					allTags[pair] = &tagCounts{}
+				}
+				allTags[pair].add(*counts)
+				labelRet.Pairs = append(labelRet.Pairs, newTagPairAgreement(pair, *counts))
+			}
+
+		case constants.AntnTypeBox, constants.AntnTypePolygon:
+			pairs := make(map[annotatorPair]*shapeCounts)
+			for studyID, objects := range mapShapes[label.ID] {
+				annotators := input.Annotators[studyID]
+				for _, shapes := range objects {
+					for i, a := range annotators {
+						for _, b := range annotators[i+1:] {
+							pair := newAnnotatorPair(a, b)
+							if pairs[pair] == nil {
+								pairs[pair] = &shapeCounts{}
+							}
+							pairs[pair].add(matchShapes(shapes[pair[0]], shapes[pair[1]], input.IoUThreshold))
+						}
+					}
+				}
+			}
+
+			total := shapeCounts{}
+			for pair, counts := range pairs {
+				if allShapes[pair] == nil {
+					allShapes[pair] = &shapeCounts{}
+				}
+				allShapes[pair].add(*counts)
+				total.add(*counts)
+				labelRet.Pairs = append(labelRet.Pairs, newShapePairAgreement(pair, *counts))
+			}
+			labelRet.Matched = total.matched
+			labelRet.Unmatched = total.onlyFirst + total.onlySecond
+			labelRet.MeanIoU, labelRet.MeanDice, labelRet.F1 = total.scores()
+
+		default:
+			continue
+		}
+
+		sortPairAgreements(labelRet.Pairs)
+		ret.Labels = append(ret.Labels, labelRet)
+	}
+
+	mapPairs := make(map[annotatorPair]*PairAgreement)
+	for pair, counts := range allTags {
+		p := newTagPairAgreement(pair, *counts)
+		mapPairs[pair] = &p
+	}
+	for pair, counts := range allShapes {
+		p := newShapePairAgreement(pair, *counts)
+		if mapPairs[pair] != nil {
+			p.Items = mapPairs[pair].Items
+			p.ObservedAgreement = mapPairs[pair].ObservedAgreement
+			p.CohenKappa = mapPairs[pair].CohenKappa
+		}
+		mapPairs[pair] = &p
+	}
+	for _, p := range mapPairs {
+		ret.Pairs = append(ret.Pairs, *p)
+	}
+	sortPairAgreements(ret.Pairs)
+
+	return ret
+}
+
+func newTagPairAgreement(pair annotatorPair, counts tagCounts) PairAgreement {
+	p := PairAgreement{
+		AnnotatorIDs: pair,
+		Items:        counts.n11 + counts.n10 + counts.n01 + counts.n00,
+	}
+	p.ObservedAgreement, p.CohenKappa = counts.cohenKappa()
+	return p
+}
+
+func newShapePairAgreement(pair annotatorPair, counts shapeCounts) PairAgreement {
+	p := PairAgreement{
+		AnnotatorIDs: pair,
+		Matched:      counts.matched,
+		OnlyFirst:    counts.onlyFirst,
+		OnlySecond:   counts.onlySecond,
+	}
+	p.MeanIoU, p.MeanDice, p.F1 = counts.scores()
+	return p
+}
+
+func sortPairAgreements(pairs []PairAgreement) {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].AnnotatorIDs[0] != pairs[j].AnnotatorIDs[0] {
+			return pairs[i].AnnotatorIDs[0] < pairs[j].AnnotatorIDs[0]
+		}
+		return pairs[i].AnnotatorIDs[1] < pairs[j].AnnotatorIDs[1]
+	})
+}
+
+// matchShapes pairs the shapes of two annotators greedily, highest IoU first
+func matchShapes(first, second []agreementAntn, threshold float64) shapeCounts {
+	type candidate struct {
+		i, j int
+		iou  float64
+	}
+	candidates := make([]candidate, 0)
+	for i := range first {
+		for j := range second {
+			if iou := annotation.ShapeIoU(first[i].Type, first[i].Points, second[j].Type, second[j].Points); iou >= threshold && iou > 0 {
+				candidates = append(candidates, candidate{i, j, iou})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].iou > candidates[b].iou
+	})
+
+	counts := shapeCounts{}
+	usedFirst := make(map[int]bool)
+	usedSecond := make(map[int]bool)
+	for _, c := range candidates {
+		if usedFirst[c.i] || usedSecond[c.j] {
+			continue
+		}
+		usedFirst[c.i], usedSecond[c.j] = true, true
+		counts.matched++
+		counts.sumIoU += c.iou
+		counts.sumDice += 2 * c.iou / (1 + c.iou)
+	}
+	counts.onlyFirst = len(first) - counts.matched
+	counts.onlySecond = len(second) - counts.matched
+	return counts
+}
+
+// getAgreementInput loads the completed ANNOTATE tasks of a project and their annotations
+func (app *StatsAPI) getAgreementInput(p *project.Project) (*agreementInput, error) {
+	input := &agreementInput{
+		Labels:     make([]annotation.Label, 0),
+		Annotators: make(map[string][]string),
+		Images:     make(map[string][]string),
+		Antns:      make([]agreementAntn, 0),
+	}
+
+	err := app.labelStore.Query(map[string][]string{"label_group_id.keyword": p.LabelGroupIDs}, "", 0, constants.DefaultLimit, "", nil,
+		func(labels []annotation.Label, es entities.ESReturn) {
+			input.Labels = append(input.Labels, labels...)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	mapTask := make(map[string]study.Task)
+	taskIDs := make([]string, 0)
+	err = app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND type.keyword:%s AND status.keyword:%s AND archived:%v",
+		p.ID, constants.TaskTypeAnnotate, constants.TaskStatusCompleted, false), 0, constants.DefaultLimit, "", nil,
+		func(tasks []study.Task, es entities.ESReturn) {
+			for _, task := range tasks {
+				mapTask[task.ID] = task
+				taskIDs = append(taskIDs, task.ID)
+				if _, found := utils.FindInSlice(input.Annotators[task.StudyID], task.AssigneeID); !found {
+					input.Annotators[task.StudyID] = append(input.Annotators[task.StudyID], task.AssigneeID)
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	for studyID := range input.Annotators {
+		sort.Strings(input.Annotators[studyID])
+	}
+
+	studyIDs := make([]string, 0)
+	for studyID, annotators := range input.Annotators {
+		if len(annotators) >= 2 {
+			studyIDs = append(studyIDs, studyID)
+		}
+	}
+	for i := 0; i < len(studyIDs); i += constants.DefaultLimit {
+		end := i + constants.DefaultLimit
+		if end > len(studyIDs) {
+			end = len(studyIDs)
+		}
+		err := app.objectStore.Scroll(map[string][]string{"study_id.keyword": studyIDs[i:end]},
+			fmt.Sprintf("type.keyword:%s", constants.ObjectTypeImage), constants.DefaultLimit, "",
+			func(objects []object.Object, es entities.ESReturn) error {
+				for _, o := range objects {
+					input.Images[o.StudyID] = append(input.Images[o.StudyID], o.ID)
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < len(taskIDs); i += constants.DefaultLimit {
+		end := i + constants.DefaultLimit
+		if end > len(taskIDs) {
+			end = len(taskIDs)
+		}
+		err := app.antnStore.Query(map[string][]string{"task_id.keyword": taskIDs[i:end]}, "", 0, constants.DefaultLimit, "", nil,
+			func(antns []annotation.Annotation, es entities.ESReturn) {
+				for _, antn := range antns {
+					task, found := mapTask[antn.TaskID]
+					if !found {
+						continue
+					}
+					item := agreementAntn{
+						StudyID:   task.StudyID,
+						ObjectID:  antn.ObjectID,
+						Annotator: task.AssigneeID,
+						Type:      antn.Type,
+						LabelIDs:  antn.LabelIDs,
+					}
+					if antn.Type == constants.AntnTypeBox || antn.Type == constants.AntnTypePolygon {
+						item.Points, _ = annotation.ParsePoints(antn.Data)
+					}
+					input.Antns = append(input.Antns, item)
+				}
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return input, nil
+}
@@ -4,19 +4,57 @@ import (
 	"encoding/json"
 	"time"
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
 
 	"github.com/google/uuid"
 )
 
+var mapExportStatus = map[string]bool{
+	constants.ExportStatusPending:  true,
+	constants.ExportStatusQueued:   true,
+	constants.ExportStatusRunning:  true,
+	constants.ExportStatusFailed:   true,
+	constants.ExportStatusCanceled: true,
+	constants.ExportStatusDone:     true,
+}
+
+var mapExportFormat = map[string]string{
+	constants.ExportFormatJSON:   ".json",
+	constants.ExportFormatNDJSON: ".ndjson",
+	constants.ExportFormatCOCO:   ".json",
+	constants.ExportFormatVOC:    ".zip",
+	constants.ExportFormatDICOM:  ".zip",
+}
+
 type LabelExport struct {
-	ID        string   `json:"id"`
-	Created   int64    `json:"created"`
-	FilePath  string   `json:"file_path"`
-	CreatorID string   `json:"creator_id"`
-	ProjectID string   `json:"project_id"`
-	Tag       string   `json:"tag"`
-	LabelIDs  []string `json:"label_ids"`
-	Status    string   `json:"status"`
+	ID            string          `json:"id"`
+	Created       int64           `json:"created"`
+	FilePath      string          `json:"file_path"`
+	CreatorID     string          `json:"creator_id"`
+	ProjectID     string          `json:"project_id"`
+	Tag           string          `json:"tag"`
+	LabelIDs      []string        `json:"label_ids"`
+	Status        string          `json:"status"`
+	Format        string          `json:"format,omitempty"`
+	PushToOrthanc bool            `json:"push_to_orthanc,omitempty"`
+	Modified      int64           `json:"modified,omitempty"`
+	StartedAt     int64           `json:"started_at,omitempty"`
+	FinishedAt    int64           `json:"finished_at,omitempty"`
+	Attempts      int             `json:"attempts,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	Progress      *ExportProgress `json:"progress,omitempty"`
+	// Owner the worker pool running the job, which saves Heartbeat while it runs
+	Owner     string `json:"owner,omitempty"`
+	Heartbeat int64  `json:"heartbeat,omitempty"`
+	entities.Revision
+}
+
+// ExportProgress counters of a running export job
+type ExportProgress struct {
+	TotalStudies     int `json:"total_studies"`
+	ProcessedStudies int `json:"processed_studies"`
+	Annotations      int `json:"annotations"`
+	Objects          int `json:"objects"`
 }
 
 func (labelExport *LabelExport) String() string {
@@ -27,6 +65,46 @@ func (labelExport *LabelExport) String() string {
 func (labelExport *LabelExport) New() {
 	labelExport.ID = uuid.New().String()
 	labelExport.Created = time.Now().UnixNano() / int64(time.Millisecond)
-	labelExport.FilePath = labelExport.Tag + ".json"
-	labelExport.Status = constants.ExportStatusPending
+	if labelExport.Format == "" {
+		labelExport.Format = constants.ExportFormatJSON
+	}
+	labelExport.FilePath = labelExport.Tag + mapExportFormat[labelExport.Format]
+	labelExport.Status = constants.ExportStatusQueued
+}
+
+func IsValidExportStatus(status string) bool {
+	_, found := mapExportStatus[status]
+	return found
+}
+
+func IsValidExportFormat(format string) bool {
+	_, found := mapExportFormat[format]
+	return found
+}
+
+// IsUnfinished jobs are the ones a worker has to pick up again after a restart,
+// PENDING is kept for exports created before the job queue existed
+func (labelExport *LabelExport) IsUnfinished() bool {
+	switch labelExport.Status {
+	case constants.ExportStatusPending, constants.ExportStatusQueued, constants.ExportStatusRunning:
+		return true
+	}
+	return false
+}
+
+func (labelExport *LabelExport) IsRetryable() bool {
+	switch labelExport.Status {
+	case constants.ExportStatusFailed, constants.ExportStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// lastBeat when the running job was last known alive, jobs started before
+// heartbeats were saved only have started_at
+func (labelExport *LabelExport) lastBeat() int64 {
+	if labelExport.Heartbeat > labelExport.StartedAt {
+		return labelExport.Heartbeat
+	}
+	return labelExport.StartedAt
 }
@@ -0,0 +1,394 @@
+package stats
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/label_group"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/study"
+	"vindr-lab-api/utils"
+)
+
+// how many studies are processed between two progress updates
+const exportProgressStep = 50
+
+// exportFile is the content of the JSON export, or of one study of it when it
+// is converted to another format
+type exportFile struct {
+	LabelGroups []label_group.LabelGroup `json:"label_groups"`
+	Impression  []annotation.Annotation  `json:"impression"`
+	Finding     []annotation.Annotation  `json:"finding"`
+	Labels      []annotation.Label       `json:"labels"`
+	Objects     []object.Object          `json:"objects"`
+	Studies     []map[string]interface{} `json:"studies"`
+	Comments    []map[string]interface{} `json:"comments"`
+	Archives    []string                 `json:"archives"`
+}
+
+// RunLabelExport builds the export file of a job and stores it to MinIO
+func (app *StatsAPI) RunLabelExport(ctx context.Context, labelExport *LabelExport) error {
+	projectID := labelExport.ProjectID
+	project, _, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if errors.Is(err, utils.ErrNotFound) {
+		return fmt.Errorf("Project %s is not existed", projectID)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, esReturn, err := app.studyStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s", projectID), 0, 0, "", nil)
+	if err != nil {
+		return err
+	}
+	progress := labelExport.Progress
+	if progress == nil {
+		progress = &ExportProgress{}
+		labelExport.Progress = progress
+	}
+	progress.TotalStudies = esReturn.Hits.Total.Value
+	app.reportExportProgress(labelExport)
+
+	switch labelExport.Format {
+	case constants.ExportFormatCOCO, constants.ExportFormatVOC, constants.ExportFormatDICOM:
+		return app.convertLabelExport(ctx, labelExport, project)
+	default:
+		return app.streamLabelExport(ctx, labelExport, project)
+	}
+}
+
+// convertLabelExport converts the export study by study while the project is
+// walked, the output is piped into the upload like streamLabelExport does
+func (app *StatsAPI) convertLabelExport(ctx context.Context, labelExport *LabelExport, project *project.Project) error {
+	contentType := "application/zip"
+	if labelExport.Format == constants.ExportFormatCOCO {
+		contentType = "application/json"
+	}
+
+	return app.storeExportStream(ctx, labelExport, contentType, func(out io.Writer) error {
+		var flush func(file *exportFile) error
+		var finish func(file *exportFile) error
+		switch labelExport.Format {
+		case constants.ExportFormatCOCO:
+			// images and annotations are spilled to temporary files until the
+			// categories complete the file
+			writer := newSectionsJSONWriter(out, cocoSections)
+			defer writer.Discard()
+			ids := &cocoIDs{}
+			flush = func(file *exportFile) error {
+				sizes, err := app.getImageSizes(ctx, project.ID, file)
+				if err != nil {
+					return err
+				}
+				coco := file.toCOCO(sizes, ids)
+				for _, image := range coco.Images {
+					if err := writer.Write("images", image); err != nil {
+						return err
+					}
+				}
+				for _, antn := range coco.Annotations {
+					if err := writer.Write("annotations", antn); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			finish = func(file *exportFile) error {
+				categories, _ := cocoCategories(file.Labels)
+				for _, category := range categories {
+					if err := writer.Write("categories", category); err != nil {
+						return err
+					}
+				}
+				return writer.Close()
+			}
+		case constants.ExportFormatVOC:
+			zipWriter := zip.NewWriter(out)
+			flush = func(file *exportFile) error {
+				sizes, err := app.getImageSizes(ctx, project.ID, file)
+				if err != nil {
+					return err
+				}
+				return file.toVOC(zipWriter, labelExport.Tag, sizes)
+			}
+			finish = func(file *exportFile) error {
+				return zipWriter.Close()
+			}
+		default:
+			zipWriter := zip.NewWriter(out)
+			if labelExport.PushToOrthanc {
+				utils.LogInfo("Push DICOM objects to the PACS")
+			}
+			flush = func(file *exportFile) error {
+				return app.writeDICOMStudy(ctx, labelExport, zipWriter, file)
+			}
+			finish = func(file *exportFile) error {
+				return zipWriter.Close()
+			}
+		}
+
+		collector := newExportCollector(flush)
+		if err := app.walkExport(ctx, labelExport, project, collector); err != nil {
+			return err
+		}
+		return finish(collector.file)
+	})
+}
+
+// streamLabelExport pipes the JSON or NDJSON export into a multipart upload
+// while the project is walked, so the file never sits in memory
+func (app *StatsAPI) streamLabelExport(ctx context.Context, labelExport *LabelExport, project *project.Project) error {
+	contentType := "application/json"
+	if labelExport.Format == constants.ExportFormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+
+	return app.storeExportStream(ctx, labelExport, contentType, func(out io.Writer) error {
+		var writer exportWriter
+		if labelExport.Format == constants.ExportFormatNDJSON {
+			writer = newNDJSONExportWriter(out)
+		} else {
+			writer = newJSONExportWriter(out)
+		}
+		defer writer.Discard()
+
+		if err := app.walkExport(ctx, labelExport, project, writer); err != nil {
+			return err
+		}
+		return writer.Close()
+	})
+}
+
+// storeExportStream uploads what write produces through a pipe, write runs
+// while the upload reads so the export file is never kept whole
+func (app *StatsAPI) storeExportStream(ctx context.Context, labelExport *LabelExport, contentType string, write func(out io.Writer) error) error {
+	reader, pipe := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		err := write(pipe)
+		pipe.CloseWithError(err)
+		done <- err
+	}()
+
+	utils.LogInfo("Stream file to minio")
+	err := app.minioClient.StoreStream(ctx, labelExport.Tag, reader, contentType)
+	// unblocks the write when the upload stopped early
+	reader.CloseWithError(err)
+	if errWrite := <-done; errWrite != nil {
+		return errWrite
+	}
+	return err
+}
+
+func (app *StatsAPI) reportExportProgress(labelExport *LabelExport) {
+	err := app.labelExportStore.Update(*labelExport, kvStr2Inf{
+		"progress": labelExport.Progress,
+	})
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+// walkExport sends every item of the export to the writer. Studies and their
+// objects are scrolled, everything else is loaded study by study so memory
+// does not grow with the size of the project
+func (app *StatsAPI) walkExport(ctx context.Context, labelExport *LabelExport, project *project.Project, writer exportWriter) error {
+	projectID := project.ID
+	progress := labelExport.Progress
+	labelGroupIDs := project.LabelGroupIDs
+
+	labelGroups, _, err := app.labelGroupStore.GetSlice(map[string][]string{
+		"_id": labelGroupIDs,
+	}, "", 0, constants.DefaultLimit, "", nil)
+	if err != nil {
+		return err
+	}
+	for _, labelGroup := range labelGroups {
+		if err := writer.Write(exportSectionLabelGroups, labelGroup); err != nil {
+			return err
+		}
+	}
+
+	mapLabelImps := make(map[string]bool)
+	mapLabelFind := make(map[string]bool)
+
+	utils.LogInfo("Get labels")
+	var errWrite error
+	err = app.labelStore.Query(map[string][]string{"label_group_id.keyword": labelGroupIDs}, "", 0, constants.DefaultLimit, "", nil,
+		func(labels []annotation.Label, esReturn entities.ESReturn) {
+			for _, label := range labels {
+				if _, found := utils.FindInSlice(labelGroupIDs, label.LabelGroupID); !found || errWrite != nil {
+					continue
+				}
+				errWrite = writer.Write(exportSectionLabels, label)
+				switch label.Type {
+				case constants.LabelTypeImpression:
+					mapLabelImps[label.ID] = true
+				case constants.LabelTypeFinding:
+					mapLabelFind[label.ID] = true
+				}
+			}
+		})
+	if err != nil {
+		return err
+	}
+	if errWrite != nil {
+		return errWrite
+	}
+
+	mapID2User, err := app.kcStore.GetAccountsAsMap("")
+	if err != nil {
+		utils.LogError(err)
+	}
+
+	utils.LogInfo("Get objects, annotations and comments of studies")
+	err = app.studyStore.Scroll(nil, fmt.Sprintf("project_id.keyword:%s", projectID), constants.DefaultLimit, "", func(studies []study.Study, es entities.ESReturn) error {
+		for _, s := range studies {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			studyObjectIDs := make([]string, 0)
+			err := app.objectStore.Scroll(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s", projectID, s.ID), constants.DefaultLimit, "",
+				func(objects []object.Object, es entities.ESReturn) error {
+					for _, o := range objects {
+						if err := writer.Write(exportSectionObjects, o); err != nil {
+							return err
+						}
+						progress.Objects++
+						if o.Type != constants.ObjectTypeStudy {
+							continue
+						}
+						studyObjectIDs = append(studyObjectIDs, o.ID)
+						err := writer.Write(exportSectionStudies, map[string]interface{}{
+							"object_id": o.ID,
+							"code":      s.Code,
+							"status":    s.Status,
+						})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			if err != nil {
+				return err
+			}
+
+			_, esReturn, err := app.taskStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND archived:%v", projectID, s.ID, true), 0, 0, "", nil)
+			if err != nil {
+				return err
+			}
+			if esReturn.Hits.Total.Value > 0 {
+				for _, objectID := range studyObjectIDs {
+					if err := writer.Write(exportSectionArchives, objectID); err != nil {
+						return err
+					}
+				}
+			}
+
+			// the decision of an arbitration replaces the reviews it was made on
+			finalType := constants.TaskTypeReview
+			_, esReturn, err = app.taskStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND type.keyword:%s AND status.keyword:%s",
+				projectID, s.ID, constants.TaskTypeArbitrate, constants.TaskStatusCompleted), 0, 0, "", nil)
+			if err != nil {
+				return err
+			}
+			if esReturn.Hits.Total.Value > 0 {
+				finalType = constants.TaskTypeArbitrate
+			}
+
+			err = app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND type.keyword:%s AND status.keyword:%s",
+				projectID, s.ID, finalType, constants.TaskStatusCompleted),
+				0, constants.DefaultLimit, "", nil, func(tasks []study.Task, es entities.ESReturn) {
+					taskIDs := make([]string, 0)
+					for _, task := range tasks {
+						taskIDs = append(taskIDs, task.ID)
+
+						if task.Comment == "" || errWrite != nil {
+							continue
+						}
+						objectID := ""
+						if len(studyObjectIDs) > 0 {
+							objectID = studyObjectIDs[0]
+						} else if o, _, err := app.objectStore.Get(nil, fmt.Sprintf("study_id.keyword:%s", task.StudyID)); err == nil {
+							objectID = o.ID
+						} else {
+							utils.LogError(err)
+							continue
+						}
+						errWrite = writer.Write(exportSectionComments, map[string]interface{}{
+							"id":         task.ID,
+							"object_id":  objectID,
+							"creator_id": task.AssigneeID,
+							"content":    task.Comment,
+						})
+					}
+
+					if len(taskIDs) == 0 || errWrite != nil {
+						return
+					}
+					err := app.antnStore.Query(map[string][]string{
+						"task_id.keyword": taskIDs,
+					}, "", 0, constants.DefaultLimit, "", nil,
+						func(antns []annotation.Annotation, e entities.ESReturn) {
+							for _, antn := range antns {
+								if errWrite != nil {
+									return
+								}
+								if mapID2User[antn.CreatorID] != nil && antn.CreatorName == "" {
+									antn.CreatorName = mapID2User[antn.CreatorID].Username
+								}
+
+								isImp, isFind := false, false
+								for _, labelID := range antn.LabelIDs {
+									isImp = isImp || mapLabelImps[labelID]
+									isFind = isFind || mapLabelFind[labelID]
+								}
+								if isImp {
+									errWrite = writer.Write(exportSectionImpression, antn)
+								}
+								if isFind && errWrite == nil {
+									errWrite = writer.Write(exportSectionFinding, antn)
+								}
+								if isImp || isFind {
+									progress.Annotations++
+								}
+							}
+						})
+					if err != nil {
+						utils.LogError(err)
+					}
+				})
+			if err != nil {
+				return err
+			}
+			if errWrite != nil {
+				return errWrite
+			}
+			if err := writer.EndStudy(); err != nil {
+				return err
+			}
+
+			progress.ProcessedStudies++
+			if progress.ProcessedStudies%exportProgressStep == 0 {
+				app.reportExportProgress(labelExport)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	app.reportExportProgress(labelExport)
+
+	return nil
+}
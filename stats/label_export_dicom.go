@@ -0,0 +1,663 @@
+package stats
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/object"
+	"vindr-lab-api/study"
+	"vindr-lab-api/utils"
+	"vindr-lab-api/utils/dicom"
+)
+
+var (
+	dcmCodeReport       = dicom.Code{Value: "126000", Scheme: "DCM", Meaning: "Imaging Measurement Report"}
+	dcmCodeQualitative  = dicom.Code{Value: "C0034375", Scheme: "UMLS", Meaning: "Qualitative Evaluations"}
+	dcmCodeFinding      = dicom.Code{Value: "121071", Scheme: "DCM", Meaning: "Finding"}
+	dcmCodeImpression   = dicom.Code{Value: "121073", Scheme: "DCM", Meaning: "Impression"}
+	dcmCodeSourceImage  = dicom.Code{Value: "121322", Scheme: "DCM", Meaning: "Source image for image processing operation"}
+	dcmCodeMorphology   = dicom.Code{Value: "49755003", Scheme: "SCT", Meaning: "Morphologically Abnormal Structure"}
+	dcmCodeLanguage     = dicom.Code{Value: "121049", Scheme: "DCM", Meaning: "Language of Content Item and Descendants"}
+	dcmCodeEnglish      = dicom.Code{Value: "en", Scheme: "RFC5646", Meaning: "English"}
+	dcmCodeObserverType = dicom.Code{Value: "121005", Scheme: "DCM", Meaning: "Observer Type"}
+	dcmCodeDevice       = dicom.Code{Value: "121007", Scheme: "DCM", Meaning: "Device"}
+	dcmCodeDeviceUID    = dicom.Code{Value: "121012", Scheme: "DCM", Meaning: "Device Observer UID"}
+	dcmCodeDeviceName   = dicom.Code{Value: "121013", Scheme: "DCM", Meaning: "Device Observer Name"}
+	dcmCodeProcedure    = dicom.Code{Value: "121058", Scheme: "DCM", Meaning: "Procedure reported"}
+	dcmCodeImaging      = dicom.Code{Value: "363679005", Scheme: "SCT", Meaning: "Imaging procedure"}
+	dcmPrivateScheme    = "99VINDR"
+	dcmManufacturer     = "VinDr Lab"
+	dcmSoftwareVersions = "1"
+)
+
+// exportPACSRequests how many images are read from the PACS at the same time
+const exportPACSRequests = 8
+
+// dicomImage is a source image with the tags which are copied to the derived objects
+type dicomImage struct {
+	object  object.Object
+	rows    int
+	columns int
+	tags    *entities.OrthancSimplfiedTags
+}
+
+// dicomExport keeps what the SEG and SR builders share. sourceUIDs are the
+// UIDs of the source objects, the PACS keeps them prefixed by the project ID
+type dicomExport struct {
+	file       *exportFile
+	projectID  string
+	images     map[string]*dicomImage
+	mapLabel   map[string]annotation.Label
+	sourceUIDs map[string]bool
+}
+
+// writeDICOMStudy adds one DICOM SEG per annotated image and one DICOM SR for
+// the study to the zip, then pushes the same objects to the PACS when the job
+// asks for it, with their references to the source objects prefixed
+func (app *StatsAPI) writeDICOMStudy(ctx context.Context, labelExport *LabelExport, zipWriter *zip.Writer, file *exportFile) error {
+	export := &dicomExport{
+		file:       file,
+		projectID:  labelExport.ProjectID,
+		images:     make(map[string]*dicomImage),
+		mapLabel:   make(map[string]annotation.Label),
+		sourceUIDs: make(map[string]bool),
+	}
+	for _, label := range file.Labels {
+		export.mapLabel[label.ID] = label
+	}
+
+	mapObject := make(map[string]object.Object)
+	for _, o := range file.Objects {
+		mapObject[o.ID] = o
+		if o.Meta != nil {
+			for _, uid := range []string{o.Meta.StudyInstanceUID, o.Meta.SeriesInstanceUID, o.Meta.SOPInstanceUID} {
+				if uid != "" {
+					export.sourceUIDs[uid] = true
+				}
+			}
+		}
+	}
+	annotated := make([]object.Object, 0)
+	mapAnnotated := make(map[string]bool)
+	for _, antns := range [][]annotation.Annotation{file.Finding, file.Impression} {
+		for _, antn := range antns {
+			o, found := mapObject[antn.ObjectID]
+			if !found || o.Type != constants.ObjectTypeImage || o.Meta == nil || mapAnnotated[o.ID] {
+				continue
+			}
+			mapAnnotated[o.ID] = true
+			annotated = append(annotated, o)
+		}
+	}
+	images, err := app.getDICOMImages(ctx, labelExport.ProjectID, annotated)
+	if err != nil {
+		return err
+	}
+	export.images = images
+
+	files, err := export.build()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := files[name].Encode(func(uid string) string { return uid })
+		if err != nil {
+			return err
+		}
+		w, err := zipWriter.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if labelExport.PushToOrthanc {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pacs, err := app.pacs.ForProject(export.projectID)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			b, err := files[name].Encode(export.mapPACSUID)
+			if err != nil {
+				return err
+			}
+			if err := pacs.StoreInstance(b); err != nil {
+				return fmt.Errorf("Push %s to the PACS: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getDICOMImages reads the size and tags of the source images from the PACS
+// of the project, exportPACSRequests at a time, by object ID. Masks still can
+// be exported without them
+func (app *StatsAPI) getDICOMImages(ctx context.Context, projectID string, objects []object.Object) (map[string]*dicomImage, error) {
+	images := make(map[string]*dicomImage)
+	for _, o := range objects {
+		images[o.ID] = &dicomImage{object: o}
+	}
+	if app.pacs == nil || len(objects) == 0 {
+		return images, nil
+	}
+
+	pacs, err := app.pacs.ForProject(projectID)
+	if err != nil {
+		utils.LogError(err)
+		return images, nil
+	}
+
+	var wg sync.WaitGroup
+	requests := make(chan struct{}, exportPACSRequests)
+	for _, o := range objects {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		requests <- struct{}{}
+		wg.Add(1)
+		go func(img *dicomImage) {
+			defer func() {
+				<-requests
+				wg.Done()
+			}()
+			readDICOMImage(pacs, projectID, img)
+		}(images[o.ID])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// readDICOMImage sets the size and tags of the image, they are left empty
+// when the PACS cannot read them
+func readDICOMImage(pacs study.PACS, projectID string, img *dicomImage) {
+	meta := img.object.Meta
+	values, err := pacs.GetInstanceTags(fmt.Sprintf("%s.%s", projectID, meta.StudyInstanceUID),
+		fmt.Sprintf("%s.%s", projectID, meta.SeriesInstanceUID), fmt.Sprintf("%s.%s", projectID, meta.SOPInstanceUID))
+	if err != nil {
+		utils.LogError(err)
+		return
+	}
+	tags := &entities.OrthancSimplfiedTags{}
+	b, _ := json.Marshal(values)
+	if err := json.Unmarshal(b, tags); err != nil {
+		utils.LogError(err)
+		return
+	}
+	img.tags = tags
+	img.rows, _ = strconv.Atoi(tags.Rows)
+	img.columns, _ = strconv.Atoi(tags.Columns)
+}
+
+// getImageSizes reads the size of the images of the export from the PACS of
+// the project, by SOP Instance UID
+func (app *StatsAPI) getImageSizes(ctx context.Context, projectID string, file *exportFile) (map[string]imageSize, error) {
+	objects := make([]object.Object, 0)
+	mapUID := make(map[string]bool)
+	for _, o := range file.Objects {
+		if o.Type != constants.ObjectTypeImage || o.Meta == nil || o.Meta.SOPInstanceUID == "" || mapUID[o.Meta.SOPInstanceUID] {
+			continue
+		}
+		mapUID[o.Meta.SOPInstanceUID] = true
+		objects = append(objects, o)
+	}
+
+	images, err := app.getDICOMImages(ctx, projectID, objects)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]imageSize)
+	for _, img := range images {
+		sizes[img.object.Meta.SOPInstanceUID] = imageSize{width: img.columns, height: img.rows}
+	}
+	return sizes, nil
+}
+
+// mapPACSUID the UID the PACS keeps for a source UID, others are left as is
+func (export *dicomExport) mapPACSUID(uid string) string {
+	if export.sourceUIDs[uid] {
+		return fmt.Sprintf("%s.%s", export.projectID, uid)
+	}
+	return uid
+}
+
+func (export *dicomExport) build() (map[string]*dicom.Instance, error) {
+	files := make(map[string]*dicom.Instance)
+
+	mapImageAntns := make(map[string][]annotation.Annotation)
+	mapStudyAntns := make(map[string][]annotation.Annotation)
+	for _, antns := range [][]annotation.Annotation{export.file.Finding, export.file.Impression} {
+		for _, antn := range antns {
+			mapStudyAntns[antn.StudyID] = append(mapStudyAntns[antn.StudyID], antn)
+			if antn.Type != constants.AntnTypeMask && antn.Type != constants.AntnTypePolygon {
+				continue
+			}
+			if _, found := export.images[antn.ObjectID]; found {
+				mapImageAntns[antn.ObjectID] = append(mapImageAntns[antn.ObjectID], antn)
+			}
+		}
+	}
+
+	for objectID, antns := range mapImageAntns {
+		img := export.images[objectID]
+		f, err := export.buildSEG(img, antns)
+		if err != nil {
+			utils.LogError(err)
+			continue
+		}
+		files[fmt.Sprintf("SEG/%s.dcm", img.object.Meta.SOPInstanceUID)] = f
+	}
+
+	for _, o := range export.file.Objects {
+		if o.Type != constants.ObjectTypeStudy || o.Meta == nil {
+			continue
+		}
+		antns := mapStudyAntns[o.StudyID]
+		if len(antns) == 0 {
+			continue
+		}
+		f, err := export.buildSR(o, antns)
+		if err != nil {
+			return nil, err
+		}
+		files[fmt.Sprintf("SR/%s.dcm", o.Meta.StudyInstanceUID)] = f
+	}
+
+	return files, nil
+}
+
+// buildSEG one BINARY segmentation of a source image, one segment per label
+func (export *dicomExport) buildSEG(img *dicomImage, antns []annotation.Annotation) (*dicom.Instance, error) {
+	meta := img.object.Meta
+	rows, columns := img.rows, img.columns
+
+	masks := make(map[string][]bool)
+	labelIDs := make([]string, 0)
+	for _, antn := range antns {
+		var pixels []bool
+		switch antn.Type {
+		case constants.AntnTypeMask:
+			m, err := decodeMask(antn.Data)
+			if err != nil {
+				utils.LogError(err)
+				continue
+			}
+			if rows == 0 || columns == 0 {
+				rows, columns = m.Bounds().Dy(), m.Bounds().Dx()
+			}
+			pixels = rasterizeMask(m, rows, columns)
+		case constants.AntnTypePolygon:
+			points, ok := annotation.ParsePoints(antn.Data)
+			if !ok || !annotation.IsPolytgon(points) || rows == 0 || columns == 0 {
+				continue
+			}
+			pixels = rasterizePolygon(points, rows, columns)
+		}
+
+		for _, labelID := range antn.LabelIDs {
+			if _, found := export.mapLabel[labelID]; !found {
+				continue
+			}
+			if len(masks[labelID]) != len(pixels) {
+				masks[labelID] = make([]bool, len(pixels))
+				labelIDs = append(labelIDs, labelID)
+			}
+			for i := range pixels {
+				masks[labelID][i] = masks[labelID][i] || pixels[i]
+			}
+		}
+	}
+	if len(labelIDs) == 0 {
+		return nil, fmt.Errorf("No segment for image %s", meta.SOPInstanceUID)
+	}
+	sort.Strings(labelIDs)
+
+	sourceClassUID := ""
+	if img.tags != nil {
+		sourceClassUID = img.tags.SOPClassUID
+	}
+	sourceImage := dicom.Dataset{
+		{Tag: dicom.Tag(0x0008, 0x1150), VR: "UI", Value: sourceClassUID},
+		{Tag: dicom.Tag(0x0008, 0x1155), VR: "UI", Value: meta.SOPInstanceUID},
+	}
+
+	segments := make([]dicom.Dataset, 0, len(labelIDs))
+	frames := make([]dicom.Dataset, 0, len(labelIDs))
+	pixelData := make([]byte, (len(labelIDs)*rows*columns+7)/8)
+	for i, labelID := range labelIDs {
+		label := export.mapLabel[labelID]
+		segmentNumber := uint16(i + 1)
+		segments = append(segments, dicom.Dataset{
+			{Tag: dicom.Tag(0x0062, 0x0003), VR: "SQ", Value: []dicom.Dataset{dcmCodeMorphology.Dataset()}},
+			{Tag: dicom.Tag(0x0062, 0x0004), VR: "US", Value: segmentNumber},
+			{Tag: dicom.Tag(0x0062, 0x0005), VR: "LO", Value: label.Name},
+			{Tag: dicom.Tag(0x0062, 0x0008), VR: "CS", Value: "MANUAL"},
+			{Tag: dicom.Tag(0x0062, 0x000F), VR: "SQ", Value: []dicom.Dataset{export.labelCode(label).Dataset()}},
+		})
+		frames = append(frames, dicom.Dataset{
+			{Tag: dicom.Tag(0x0008, 0x9124), VR: "SQ", Value: []dicom.Dataset{{
+				{Tag: dicom.Tag(0x0008, 0x2112), VR: "SQ", Value: []dicom.Dataset{append(dicom.Dataset{
+					{Tag: dicom.Tag(0x0040, 0xA170), VR: "SQ", Value: []dicom.Dataset{dcmCodeSourceImage.Dataset()}},
+				}, sourceImage...)}},
+			}}},
+			{Tag: dicom.Tag(0x0020, 0x9111), VR: "SQ", Value: []dicom.Dataset{{
+				{Tag: dicom.Tag(0x0020, 0x9157), VR: "UL", Value: uint32(segmentNumber)},
+			}}},
+			{Tag: dicom.Tag(0x0062, 0x000A), VR: "SQ", Value: []dicom.Dataset{{
+				{Tag: dicom.Tag(0x0062, 0x000B), VR: "US", Value: segmentNumber},
+			}}},
+		})
+
+		// frames of a 1 bit segmentation are packed back to back, LSB first
+		offset := i * rows * columns
+		for j, set := range masks[labelID] {
+			if set {
+				bit := offset + j
+				pixelData[bit/8] |= 1 << uint(bit%8)
+			}
+		}
+	}
+
+	sopInstanceUID := dicom.NewUID()
+	dataset := export.commonModules(img.tags, meta.StudyInstanceUID, sopInstanceUID, dicom.SegmentationStorage, "SEG", 100)
+	dataset = append(dataset,
+		dicom.Element{Tag: dicom.Tag(0x0008, 0x0008), VR: "CS", Value: []string{"DERIVED", "PRIMARY"}},
+		dicom.Element{Tag: dicom.Tag(0x0008, 0x1115), VR: "SQ", Value: []dicom.Dataset{{
+			{Tag: dicom.Tag(0x0008, 0x114A), VR: "SQ", Value: []dicom.Dataset{sourceImage}},
+			{Tag: dicom.Tag(0x0020, 0x000E), VR: "UI", Value: meta.SeriesInstanceUID},
+		}}},
+		dicom.Element{Tag: dicom.Tag(0x0020, 0x0052), VR: "UI", Value: export.frameOfReferenceUID(img.tags)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0002), VR: "US", Value: uint16(1)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0004), VR: "CS", Value: "MONOCHROME2"},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0008), VR: "IS", Value: strconv.Itoa(len(labelIDs))},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0010), VR: "US", Value: uint16(rows)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0011), VR: "US", Value: uint16(columns)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0100), VR: "US", Value: uint16(1)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0101), VR: "US", Value: uint16(1)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0102), VR: "US", Value: uint16(0)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x0103), VR: "US", Value: uint16(0)},
+		dicom.Element{Tag: dicom.Tag(0x0028, 0x2110), VR: "CS", Value: "00"},
+		dicom.Element{Tag: dicom.Tag(0x0062, 0x0001), VR: "CS", Value: "BINARY"},
+		dicom.Element{Tag: dicom.Tag(0x0062, 0x0002), VR: "SQ", Value: segments},
+		dicom.Element{Tag: dicom.Tag(0x0070, 0x0080), VR: "CS", Value: "VINDR_LAB"},
+		dicom.Element{Tag: dicom.Tag(0x0070, 0x0081), VR: "LO", Value: "VinDr Lab segmentation"},
+		dicom.Element{Tag: dicom.Tag(0x0070, 0x0084), VR: "PN", Value: ""},
+		dicom.Element{Tag: dicom.Tag(0x5200, 0x9229), VR: "SQ", Value: []dicom.Dataset{}},
+		dicom.Element{Tag: dicom.Tag(0x5200, 0x9230), VR: "SQ", Value: frames},
+		dicom.Element{Tag: dicom.Tag(0x7FE0, 0x0010), VR: "OB", Value: pixelData},
+	)
+
+	return &dicom.Instance{SOPClassUID: dicom.SegmentationStorage, SOPInstanceUID: sopInstanceUID, Dataset: dataset}, nil
+}
+
+// buildSR a TID 1500 report with the impression and finding labels of a study
+// as qualitative evaluations
+func (export *dicomExport) buildSR(study object.Object, antns []annotation.Annotation) (*dicom.Instance, error) {
+	mapFinding := make(map[string]bool)
+	for _, antn := range export.file.Finding {
+		mapFinding[antn.ID] = true
+	}
+
+	var tags *entities.OrthancSimplfiedTags
+	evidence := make(map[string][]*dicomImage)
+	items := make([]dicom.Dataset, 0)
+	mapItem := make(map[string]bool)
+	for _, antn := range antns {
+		if img, found := export.images[antn.ObjectID]; found && img.tags != nil {
+			if tags == nil {
+				tags = img.tags
+			}
+			series := img.object.Meta.SeriesInstanceUID
+			evidence[series] = append(evidence[series], img)
+		}
+
+		concept := dcmCodeImpression
+		if mapFinding[antn.ID] {
+			concept = dcmCodeFinding
+		}
+		for _, labelID := range antn.LabelIDs {
+			label, found := export.mapLabel[labelID]
+			key := concept.Value + labelID
+			if !found || mapItem[key] {
+				continue
+			}
+			mapItem[key] = true
+			items = append(items, dcmCodeItem("CONTAINS", concept, export.labelCode(label)))
+		}
+	}
+
+	now := time.Now()
+	sopInstanceUID := dicom.NewUID()
+	dataset := export.commonModules(tags, study.Meta.StudyInstanceUID, sopInstanceUID, dicom.ComprehensiveSRStorage, "SR", 101)
+	dataset = append(dataset,
+		dicom.Element{Tag: dicom.Tag(0x0008, 0x0023), VR: "DA", Value: now.Format("20060102")},
+		dicom.Element{Tag: dicom.Tag(0x0008, 0x0033), VR: "TM", Value: now.Format("150405")},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA040), VR: "CS", Value: "CONTAINER"},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA043), VR: "SQ", Value: []dicom.Dataset{dcmCodeReport.Dataset()}},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA050), VR: "CS", Value: "SEPARATE"},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA491), VR: "CS", Value: "COMPLETE"},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA493), VR: "CS", Value: "UNVERIFIED"},
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA504), VR: "SQ", Value: []dicom.Dataset{{
+			{Tag: dicom.Tag(0x0008, 0x0105), VR: "CS", Value: "DCMR"},
+			{Tag: dicom.Tag(0x0040, 0xDB00), VR: "CS", Value: "1500"},
+		}}},
+		// the language (TID 1204), the device observer context (TID 1001) and the
+		// procedure reported come before the content of the report
+		dicom.Element{Tag: dicom.Tag(0x0040, 0xA730), VR: "SQ", Value: []dicom.Dataset{
+			dcmCodeItem("HAS CONCEPT MOD", dcmCodeLanguage, dcmCodeEnglish),
+			dcmCodeItem("HAS OBS CONTEXT", dcmCodeObserverType, dcmCodeDevice),
+			{
+				{Tag: dicom.Tag(0x0040, 0xA010), VR: "CS", Value: "HAS OBS CONTEXT"},
+				{Tag: dicom.Tag(0x0040, 0xA040), VR: "CS", Value: "UIDREF"},
+				{Tag: dicom.Tag(0x0040, 0xA043), VR: "SQ", Value: []dicom.Dataset{dcmCodeDeviceUID.Dataset()}},
+				{Tag: dicom.Tag(0x0040, 0xA124), VR: "UI", Value: dicom.ImplementationClassUID},
+			},
+			{
+				{Tag: dicom.Tag(0x0040, 0xA010), VR: "CS", Value: "HAS OBS CONTEXT"},
+				{Tag: dicom.Tag(0x0040, 0xA040), VR: "CS", Value: "TEXT"},
+				{Tag: dicom.Tag(0x0040, 0xA043), VR: "SQ", Value: []dicom.Dataset{dcmCodeDeviceName.Dataset()}},
+				{Tag: dicom.Tag(0x0040, 0xA160), VR: "UT", Value: dcmManufacturer},
+			},
+			dcmCodeItem("HAS CONCEPT MOD", dcmCodeProcedure, dcmCodeImaging),
+			{
+				{Tag: dicom.Tag(0x0040, 0xA010), VR: "CS", Value: "CONTAINS"},
+				{Tag: dicom.Tag(0x0040, 0xA040), VR: "CS", Value: "CONTAINER"},
+				{Tag: dicom.Tag(0x0040, 0xA043), VR: "SQ", Value: []dicom.Dataset{dcmCodeQualitative.Dataset()}},
+				{Tag: dicom.Tag(0x0040, 0xA050), VR: "CS", Value: "SEPARATE"},
+				{Tag: dicom.Tag(0x0040, 0xA730), VR: "SQ", Value: items},
+			},
+		}},
+	)
+
+	if len(evidence) > 0 {
+		seriesUIDs := make([]string, 0, len(evidence))
+		for seriesUID := range evidence {
+			seriesUIDs = append(seriesUIDs, seriesUID)
+		}
+		sort.Strings(seriesUIDs)
+
+		series := make([]dicom.Dataset, 0, len(seriesUIDs))
+		for _, seriesUID := range seriesUIDs {
+			instances := make([]dicom.Dataset, 0)
+			for _, img := range evidence[seriesUID] {
+				instances = append(instances, dicom.Dataset{
+					{Tag: dicom.Tag(0x0008, 0x1150), VR: "UI", Value: img.tags.SOPClassUID},
+					{Tag: dicom.Tag(0x0008, 0x1155), VR: "UI", Value: img.object.Meta.SOPInstanceUID},
+				})
+			}
+			series = append(series, dicom.Dataset{
+				{Tag: dicom.Tag(0x0008, 0x1199), VR: "SQ", Value: instances},
+				{Tag: dicom.Tag(0x0020, 0x000E), VR: "UI", Value: seriesUID},
+			})
+		}
+		dataset = append(dataset, dicom.Element{Tag: dicom.Tag(0x0040, 0xA375), VR: "SQ", Value: []dicom.Dataset{{
+			{Tag: dicom.Tag(0x0008, 0x1115), VR: "SQ", Value: series},
+			{Tag: dicom.Tag(0x0020, 0x000D), VR: "UI", Value: study.Meta.StudyInstanceUID},
+		}}})
+	}
+
+	return &dicom.Instance{SOPClassUID: dicom.ComprehensiveSRStorage, SOPInstanceUID: sopInstanceUID, Dataset: dataset}, nil
+}
+
+// dcmCodeItem a CODE content item of an SR
+func dcmCodeItem(relationship string, concept, value dicom.Code) dicom.Dataset {
+	return dicom.Dataset{
+		{Tag: dicom.Tag(0x0040, 0xA010), VR: "CS", Value: relationship},
+		{Tag: dicom.Tag(0x0040, 0xA040), VR: "CS", Value: "CODE"},
+		{Tag: dicom.Tag(0x0040, 0xA043), VR: "SQ", Value: []dicom.Dataset{concept.Dataset()}},
+		{Tag: dicom.Tag(0x0040, 0xA168), VR: "SQ", Value: []dicom.Dataset{value.Dataset()}},
+	}
+}
+
+// commonModules patient, study, series, equipment and SOP common attributes,
+// the patient and study ones are copied from the source image when known
+func (export *dicomExport) commonModules(tags *entities.OrthancSimplfiedTags, studyInstanceUID, sopInstanceUID, sopClassUID, modality string, seriesNumber int) dicom.Dataset {
+	if tags == nil {
+		tags = &entities.OrthancSimplfiedTags{}
+	}
+	return dicom.Dataset{
+		{Tag: dicom.Tag(0x0008, 0x0016), VR: "UI", Value: sopClassUID},
+		{Tag: dicom.Tag(0x0008, 0x0018), VR: "UI", Value: sopInstanceUID},
+		{Tag: dicom.Tag(0x0008, 0x0020), VR: "DA", Value: tags.StudyDate},
+		{Tag: dicom.Tag(0x0008, 0x0030), VR: "TM", Value: tags.StudyTime},
+		{Tag: dicom.Tag(0x0008, 0x0050), VR: "SH", Value: tags.AccessionNumber},
+		{Tag: dicom.Tag(0x0008, 0x0060), VR: "CS", Value: modality},
+		{Tag: dicom.Tag(0x0008, 0x0070), VR: "LO", Value: dcmManufacturer},
+		{Tag: dicom.Tag(0x0008, 0x0090), VR: "PN", Value: tags.ReferringPhysicianName},
+		{Tag: dicom.Tag(0x0008, 0x1090), VR: "LO", Value: dcmManufacturer},
+		{Tag: dicom.Tag(0x0010, 0x0010), VR: "PN", Value: tags.PatientName},
+		{Tag: dicom.Tag(0x0010, 0x0020), VR: "LO", Value: tags.PatientID},
+		{Tag: dicom.Tag(0x0010, 0x0030), VR: "DA", Value: tags.PatientBirthDate},
+		{Tag: dicom.Tag(0x0010, 0x0040), VR: "CS", Value: tags.PatientSex},
+		{Tag: dicom.Tag(0x0018, 0x1000), VR: "LO", Value: "1"},
+		{Tag: dicom.Tag(0x0018, 0x1020), VR: "LO", Value: dcmSoftwareVersions},
+		{Tag: dicom.Tag(0x0020, 0x000D), VR: "UI", Value: studyInstanceUID},
+		{Tag: dicom.Tag(0x0020, 0x000E), VR: "UI", Value: dicom.NewUID()},
+		{Tag: dicom.Tag(0x0020, 0x0010), VR: "SH", Value: tags.StudyID},
+		{Tag: dicom.Tag(0x0020, 0x0011), VR: "IS", Value: strconv.Itoa(seriesNumber)},
+		{Tag: dicom.Tag(0x0020, 0x0013), VR: "IS", Value: "1"},
+	}
+}
+
+func (export *dicomExport) frameOfReferenceUID(tags *entities.OrthancSimplfiedTags) string {
+	if tags != nil && tags.FrameOfReferenceUID != "" {
+		return tags.FrameOfReferenceUID
+	}
+	return dicom.NewUID()
+}
+
+// labelCode labels have no standard code, they go to a private coding scheme,
+// SH allows 16 characters so the label ID is shortened
+func (export *dicomExport) labelCode(label annotation.Label) dicom.Code {
+	value := strings.ReplaceAll(label.ID, "-", "")
+	if len(value) > 16 {
+		value = value[:16]
+	}
+	meaning := label.Name
+	if len(meaning) > 64 {
+		meaning = meaning[:64]
+	}
+	return dicom.Code{Value: value, Scheme: dcmPrivateScheme, Meaning: meaning}
+}
+
+// decodeMask MASK data is a base64 image, either raw, as a data URL or as Media
+func decodeMask(data interface{}) (image.Image, error) {
+	encoded := ""
+	switch v := data.(type) {
+	case string:
+		encoded = v
+	case map[string]interface{}:
+		if b, ok := v["bytes"].(string); ok {
+			encoded = b
+		}
+	}
+	if strings.HasPrefix(encoded, "data:") {
+		if i := strings.Index(encoded, ","); i >= 0 {
+			encoded = encoded[i+1:]
+		}
+	}
+	if encoded == "" {
+		return nil, errors.New("Mask is empty")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	return img, err
+}
+
+// rasterizeMask scales the mask to the image with nearest neighbour, a pixel is
+// set when it is visible and not black
+func rasterizeMask(m image.Image, rows, columns int) []bool {
+	pixels := make([]bool, rows*columns)
+	bounds := m.Bounds()
+	for y := 0; y < rows; y++ {
+		my := bounds.Min.Y + y*bounds.Dy()/rows
+		for x := 0; x < columns; x++ {
+			mx := bounds.Min.X + x*bounds.Dx()/columns
+			r, g, b, a := m.At(mx, my).RGBA()
+			pixels[y*columns+x] = a > 0 && r+g+b > 0
+		}
+	}
+	return pixels
+}
+
+// rasterizePolygon even-odd scanline fill at the pixel centers
+func rasterizePolygon(points []annotation.Point2D, rows, columns int) []bool {
+	pixels := make([]bool, rows*columns)
+	xs := make([]float64, 0, len(points))
+	for y := 0; y < rows; y++ {
+		cy := float64(y) + 0.5
+		xs = xs[:0]
+		for i := range points {
+			p1, p2 := points[i], points[(i+1)%len(points)]
+			if (p1.Y <= cy) == (p2.Y <= cy) {
+				continue
+			}
+			xs = append(xs, p1.X+(cy-p1.Y)*(p2.X-p1.X)/(p2.Y-p1.Y))
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			from := int(math.Max(0, math.Ceil(xs[i]-0.5)))
+			to := int(math.Min(float64(columns-1), math.Floor(xs[i+1]-0.5)))
+			for x := from; x <= to; x++ {
+				pixels[y*columns+x] = true
+			}
+		}
+	}
+	return pixels
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
+	"time"
 
 	"vindr-lab-api/entities"
 	"vindr-lab-api/utils"
@@ -43,6 +45,7 @@ func (store *LabelExportES) getIndexWildcard(IndexPrefix string) string {
 
 // Create function
 func (store *LabelExportES) Create(exportLabel LabelExport) error {
+	exportLabel.Revision = entities.Revision{}
 	req := esapi.IndexRequest{
 		Index:      store.getIndexName(store.indexPrefix, exportLabel),
 		DocumentID: exportLabel.ID,
@@ -97,6 +100,7 @@ func (store *LabelExportES) GetSlice(queries map[string][]string, qs string, fro
 		es.Search.WithIndex(store.getIndexWildcard(store.indexPrefix)),
 		es.Search.WithBody(&buf),
 		es.Search.WithTrackTotalHits(true),
+		es.Search.WithSeqNoPrimaryTerm(true),
 		es.Search.WithPretty(),
 	)
 
@@ -130,6 +134,7 @@ func (store *LabelExportES) GetSlice(queries map[string][]string, qs string, fro
 		bytesData, _ := json.Marshal(mapData)
 		err := json.Unmarshal(bytesData, &label)
 		if err == nil {
+			label.Revision = entities.NewRevision(hit)
 			labels = append(labels, label)
 		}
 	}
@@ -137,6 +142,87 @@ func (store *LabelExportES) GetSlice(queries map[string][]string, qs string, fro
 	return labels, &esReturn, nil
 }
 
+// Get function
+func (store *LabelExportES) Get(queries map[string][]string, qs string) (*LabelExport, *entities.ESReturn, error) {
+	labelExports, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(labelExports) == 0 {
+		return nil, esReturn, utils.ErrNotFound
+	}
+	return &labelExports[0], esReturn, nil
+}
+
+// Query function
+func (store *LabelExportES) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(labelExports []LabelExport, es entities.ESReturn)) error {
+	from1 := from
+	size1 := size
+	for true {
+		labelExports, esReturn, err := store.GetSlice(queries, qs, from1, size1, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(labelExports, *esReturn)
+
+		if len(labelExports) < size1 {
+			break
+		}
+
+		from1 += size1
+	}
+	return nil
+}
+
+// Update function
+func (store *LabelExportES) Update(labelExport LabelExport, update map[string]interface{}) error {
+	_, esReturn, err := store.Get(nil, fmt.Sprintf("_id:%s", labelExport.ID))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	update["modified"] = now
+
+	indexName := esReturn.Hits.Hits[0].Index
+
+	var buf bytes.Buffer
+	body := kvStr2Inf{}
+	body["doc"] = update
+
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+	req := esapi.UpdateRequest{
+		Index:      indexName,
+		DocumentID: labelExport.ID,
+		Refresh:    "true",
+		Body:       &buf,
+	}
+	if labelExport.Revision.IsSet() {
+		req.IfSeqNo = labelExport.SeqNo
+		req.IfPrimaryTerm = labelExport.PrimaryTerm
+	}
+
+	// Return an API response object from request
+	ctx := context.Background()
+	res, err := req.Do(ctx, store.esClient)
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("UpdateRequest ERROR: %s", err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return utils.ErrVersionConflict
+	}
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR updating document ID=%s", res.Status(), labelExport.ID)
+	}
+
+	return nil
+}
+
 // Delete function
 func (store *LabelExportES) Delete(label LabelExport) error {
 	var buf bytes.Buffer
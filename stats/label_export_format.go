@@ -0,0 +1,297 @@
+package stats
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"sort"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+)
+
+type cocoFile struct {
+	Images      []cocoImage      `json:"images"`
+	Annotations []cocoAnnotation `json:"annotations"`
+	Categories  []cocoCategory   `json:"categories"`
+}
+
+type cocoImage struct {
+	ID                int    `json:"id"`
+	FileName          string `json:"file_name"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	StudyInstanceUID  string `json:"study_instance_uid,omitempty"`
+	SeriesInstanceUID string `json:"series_instance_uid,omitempty"`
+	SOPInstanceUID    string `json:"sop_instance_uid"`
+}
+
+type cocoAnnotation struct {
+	ID           int         `json:"id"`
+	ImageID      int         `json:"image_id"`
+	CategoryID   int         `json:"category_id"`
+	Bbox         []float64   `json:"bbox"`
+	Segmentation [][]float64 `json:"segmentation"`
+	Area         float64     `json:"area"`
+	IsCrowd      int         `json:"iscrowd"`
+	AnnotationID string      `json:"vindr_annotation_id"`
+}
+
+type cocoCategory struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Supercategory string `json:"supercategory"`
+	LabelID       string `json:"vindr_label_id"`
+}
+
+type vocAnnotation struct {
+	XMLName  xml.Name    `xml:"annotation"`
+	Folder   string      `xml:"folder"`
+	Filename string      `xml:"filename"`
+	Size     vocSize     `xml:"size"`
+	Objects  []vocObject `xml:"object"`
+}
+
+type vocSize struct {
+	Width  int `xml:"width"`
+	Height int `xml:"height"`
+	Depth  int `xml:"depth"`
+}
+
+type vocObject struct {
+	Name      string    `xml:"name"`
+	Pose      string    `xml:"pose"`
+	Truncated int       `xml:"truncated"`
+	Difficult int       `xml:"difficult"`
+	BndBox    vocBndBox `xml:"bndbox"`
+}
+
+type vocBndBox struct {
+	XMin float64 `xml:"xmin"`
+	YMin float64 `xml:"ymin"`
+	XMax float64 `xml:"xmax"`
+	YMax float64 `xml:"ymax"`
+}
+
+// imageSize the Columns and Rows of an image read from the PACS, zero when
+// they could not be read
+type imageSize struct {
+	width  int
+	height int
+}
+
+// shape is a BOUNDING_BOX or POLYGON annotation placed on one image
+type shape struct {
+	antn           annotation.Annotation
+	sopInstanceUID string
+	points         []annotation.Point2D
+}
+
+// shapes returns the 2D annotations of the export sorted by SOP Instance UID,
+// other annotation types have no meaning in COCO or VOC and are skipped
+func (file *exportFile) shapes() []shape {
+	mapObjectUID := make(map[string]string)
+	for _, o := range file.Objects {
+		if o.Type == constants.ObjectTypeImage && o.Meta != nil {
+			mapObjectUID[o.ID] = o.Meta.SOPInstanceUID
+		}
+	}
+
+	ret := make([]shape, 0)
+	for _, antns := range [][]annotation.Annotation{file.Finding, file.Impression} {
+		for _, antn := range antns {
+			if antn.Type != constants.AntnTypeBox && antn.Type != constants.AntnTypePolygon {
+				continue
+			}
+			points, ok := annotation.ParsePoints(antn.Data)
+			if !ok {
+				continue
+			}
+			if antn.Type == constants.AntnTypeBox && !annotation.IsBoundingBox(points) ||
+				antn.Type == constants.AntnTypePolygon && !annotation.IsPolytgon(points) {
+				continue
+			}
+
+			uid := mapObjectUID[antn.ObjectID]
+			if uid == "" && antn.Meta != nil {
+				if v, found := antn.Meta["sop_instance_uid"]; found && v != nil {
+					uid = fmt.Sprintf("%v", v)
+				}
+			}
+			if uid == "" {
+				continue
+			}
+
+			ret = append(ret, shape{antn: antn, sopInstanceUID: uid, points: points})
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].sopInstanceUID < ret[j].sopInstanceUID
+	})
+	return ret
+}
+
+// cocoSections the arrays of a COCO file, in the order of cocoFile
+var cocoSections = []string{"images", "annotations", "categories"}
+
+// cocoIDs the last image and annotation IDs given, the studies of an export
+// are converted one after another and share them
+type cocoIDs struct {
+	images      int
+	annotations int
+}
+
+// cocoCategories one category per label, with the category ID by label ID
+func cocoCategories(labels []annotation.Label) ([]cocoCategory, map[string]int) {
+	categories := make([]cocoCategory, 0)
+	mapCategoryID := make(map[string]int)
+	for _, label := range labels {
+		if _, found := mapCategoryID[label.ID]; found {
+			continue
+		}
+		mapCategoryID[label.ID] = len(categories) + 1
+		categories = append(categories, cocoCategory{
+			ID:            mapCategoryID[label.ID],
+			Name:          label.Name,
+			Supercategory: label.Type,
+			LabelID:       label.ID,
+		})
+	}
+	return categories, mapCategoryID
+}
+
+// toCOCO sizes are the images sizes by SOP Instance UID, the IDs of the images
+// and annotations follow the ones already given in ids
+func (file *exportFile) toCOCO(sizes map[string]imageSize, ids *cocoIDs) *cocoFile {
+	categories, mapCategoryID := cocoCategories(file.Labels)
+	coco := &cocoFile{
+		Images:      make([]cocoImage, 0),
+		Annotations: make([]cocoAnnotation, 0),
+		Categories:  categories,
+	}
+
+	mapImageID := make(map[string]int)
+	for _, o := range file.Objects {
+		if o.Type != constants.ObjectTypeImage || o.Meta == nil || o.Meta.SOPInstanceUID == "" {
+			continue
+		}
+		if _, found := mapImageID[o.Meta.SOPInstanceUID]; found {
+			continue
+		}
+		ids.images++
+		mapImageID[o.Meta.SOPInstanceUID] = ids.images
+		coco.Images = append(coco.Images, cocoImage{
+			ID:                mapImageID[o.Meta.SOPInstanceUID],
+			FileName:          o.Meta.SOPInstanceUID,
+			Width:             sizes[o.Meta.SOPInstanceUID].width,
+			Height:            sizes[o.Meta.SOPInstanceUID].height,
+			StudyInstanceUID:  o.Meta.StudyInstanceUID,
+			SeriesInstanceUID: o.Meta.SeriesInstanceUID,
+			SOPInstanceUID:    o.Meta.SOPInstanceUID,
+		})
+	}
+
+	for _, s := range file.shapes() {
+		imageID, found := mapImageID[s.sopInstanceUID]
+		if !found {
+			ids.images++
+			imageID = ids.images
+			mapImageID[s.sopInstanceUID] = imageID
+			coco.Images = append(coco.Images, cocoImage{
+				ID:             imageID,
+				FileName:       s.sopInstanceUID,
+				Width:          sizes[s.sopInstanceUID].width,
+				Height:         sizes[s.sopInstanceUID].height,
+				SOPInstanceUID: s.sopInstanceUID,
+			})
+		}
+
+		xMin, yMin, xMax, yMax := annotation.BoundsOf(s.points)
+		bbox := []float64{xMin, yMin, xMax - xMin, yMax - yMin}
+		segmentation := make([][]float64, 0)
+		area := bbox[2] * bbox[3]
+		if s.antn.Type == constants.AntnTypePolygon {
+			polygon := make([]float64, 0, len(s.points)*2)
+			for _, p := range s.points {
+				polygon = append(polygon, p.X, p.Y)
+			}
+			segmentation = append(segmentation, polygon)
+			area = annotation.PolygonArea(s.points)
+		}
+
+		for _, labelID := range s.antn.LabelIDs {
+			categoryID, found := mapCategoryID[labelID]
+			if !found {
+				continue
+			}
+			ids.annotations++
+			coco.Annotations = append(coco.Annotations, cocoAnnotation{
+				ID:           ids.annotations,
+				ImageID:      imageID,
+				CategoryID:   categoryID,
+				Bbox:         bbox,
+				Segmentation: segmentation,
+				Area:         area,
+				AnnotationID: s.antn.ID,
+			})
+		}
+	}
+
+	return coco
+}
+
+// toVOC adds one Pascal VOC XML file per SOP Instance UID to the zip, sizes
+// are the images sizes by SOP Instance UID
+func (file *exportFile) toVOC(zipWriter *zip.Writer, folder string, sizes map[string]imageSize) error {
+	mapLabelName := make(map[string]string)
+	for _, label := range file.Labels {
+		mapLabelName[label.ID] = label.Name
+	}
+
+	vocs := make([]*vocAnnotation, 0)
+	mapVOC := make(map[string]*vocAnnotation)
+	for _, s := range file.shapes() {
+		voc, found := mapVOC[s.sopInstanceUID]
+		if !found {
+			size := sizes[s.sopInstanceUID]
+			voc = &vocAnnotation{
+				Folder:   folder,
+				Filename: s.sopInstanceUID,
+				Size:     vocSize{Width: size.width, Height: size.height, Depth: 1},
+				Objects:  make([]vocObject, 0),
+			}
+			mapVOC[s.sopInstanceUID] = voc
+			vocs = append(vocs, voc)
+		}
+
+		xMin, yMin, xMax, yMax := annotation.BoundsOf(s.points)
+		for _, labelID := range s.antn.LabelIDs {
+			name, found := mapLabelName[labelID]
+			if !found {
+				continue
+			}
+			voc.Objects = append(voc.Objects, vocObject{
+				Name:   name,
+				Pose:   "Unspecified",
+				BndBox: vocBndBox{XMin: xMin, YMin: yMin, XMax: xMax, YMax: yMax},
+			})
+		}
+	}
+
+	for _, voc := range vocs {
+		w, err := zipWriter.Create(voc.Filename + ".xml")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(xml.Header)); err != nil {
+			return err
+		}
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		if err := encoder.Encode(voc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
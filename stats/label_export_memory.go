@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// LabelExportMemory keeps label exports in memory, for running without a cluster and in tests
+type LabelExportMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewLabelExportMemory() *LabelExportMemory {
+	return &LabelExportMemory{utils.NewMemoryIndex("label_export")}
+}
+
+// Create function
+func (store *LabelExportMemory) Create(exportLabel LabelExport) error {
+	exportLabel.Revision = entities.Revision{}
+	return store.index.Index(exportLabel.ID, exportLabel, entities.Revision{})
+}
+
+// GetSlice function
+func (store *LabelExportMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]LabelExport, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labelExports := make([]LabelExport, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var labelExport LabelExport
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &labelExport); err == nil {
+			labelExport.Revision = entities.NewRevision(hit)
+			labelExports = append(labelExports, labelExport)
+		}
+	}
+	return labelExports, esReturn, nil
+}
+
+// Get function
+func (store *LabelExportMemory) Get(queries map[string][]string, qs string) (*LabelExport, *entities.ESReturn, error) {
+	labelExports, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(labelExports) == 0 {
+		return nil, esReturn, utils.ErrNotFound
+	}
+	return &labelExports[0], esReturn, nil
+}
+
+// Query function
+func (store *LabelExportMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(labelExports []LabelExport, es entities.ESReturn)) error {
+	for {
+		labelExports, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(labelExports, *esReturn)
+
+		if len(labelExports) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Update function
+func (store *LabelExportMemory) Update(labelExport LabelExport, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(labelExport.ID, update, labelExport.Revision)
+}
+
+// Delete function
+func (store *LabelExportMemory) Delete(label LabelExport) error {
+	return store.index.Delete(map[string][]string{"id": {label.ID}}, "")
+}
@@ -3,6 +3,7 @@ package stats
 import (
 	"bytes"
 	"context"
+	"io"
 	"log"
 
 	"vindr-lab-api/utils"
@@ -23,36 +24,47 @@ func NewMinIOStorage(minioClient *minio.Client, bucketName string) *MinIOStorage
 	}
 }
 
-//StoreFile store
-func (storage *MinIOStorage) StoreFile(fileName string, fileData []byte) error {
-	ctx := context.Background()
+// exportPartSize bounds the buffer of a multipart upload, with 16MiB parts an
+// upload of unknown size can reach 160GiB
+const exportPartSize = 16 * 1024 * 1024
+
+func (storage *MinIOStorage) makeBucketIfNotExists(ctx context.Context) error {
 	err := storage.minioClient.MakeBucket(ctx, storage.bucketName, minio.MakeBucketOptions{})
 	if err != nil {
 		// Check to see if we already own this bucket (which happens if you run this twice)
 		exists, errBucketExists := storage.minioClient.BucketExists(ctx, storage.bucketName)
 		if errBucketExists == nil && exists {
 			log.Printf("We already own %s\n", storage.bucketName)
-		} else {
-			log.Fatalln(err)
-			return err
+			return nil
 		}
-	} else {
-		log.Printf("Successfully created %s\n", storage.bucketName)
+		return err
 	}
 
-	// Upload the zip file
-	objectName := fileName
-	// filePath := objectName
-	contentType := "application/json"
+	log.Printf("Successfully created %s\n", storage.bucketName)
+	return nil
+}
+
+//StoreFile store
+func (storage *MinIOStorage) StoreFile(fileName string, fileData []byte, contentType string) error {
+	return storage.StoreStream(context.Background(), fileName, bytes.NewReader(fileData), contentType)
+}
+
+// StoreStream uploads the reader until EOF in parts, the upload is aborted
+// when the reader fails or ctx is canceled
+func (storage *MinIOStorage) StoreStream(ctx context.Context, fileName string, reader io.Reader, contentType string) error {
+	if err := storage.makeBucketIfNotExists(ctx); err != nil {
+		return err
+	}
 
-	// Upload the zip file with FPutObject
-	info, err := storage.minioClient.PutObject(ctx, storage.bucketName, fileName, bytes.NewReader(fileData), -1, minio.PutObjectOptions{ContentType: contentType})
+	info, err := storage.minioClient.PutObject(ctx, storage.bucketName, fileName, reader, -1, minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    exportPartSize,
+	})
 	if err != nil {
-		log.Fatalln(err)
 		return err
 	}
 
-	utils.LogInfo("Successfully uploaded %s of size %d\n", objectName, info.Size)
+	utils.LogInfo("Successfully uploaded %s of size %d\n", fileName, info.Size)
 
 	return nil
 }
@@ -0,0 +1,278 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/enriquebris/goconcurrentqueue"
+	"github.com/google/uuid"
+)
+
+// exportHeartbeat how often a running job saves its heartbeat and checks it
+// was not canceled by another instance, a job missing exportStaleHeartbeats
+// of them is considered abandoned
+const (
+	exportHeartbeat       = 30 * time.Second
+	exportStaleHeartbeats = 3
+)
+
+// ExportRunner builds the export file of one job
+type ExportRunner func(ctx context.Context, labelExport *LabelExport) error
+
+// ExportWorkerPool runs label exports in the background. The state of every job
+// is kept in the label export index, the in-process queue only hands job IDs to
+// the workers, so anything unfinished can be queued again after a restart.
+type ExportWorkerPool struct {
+	store     LabelExportStore
+	run       ExportRunner
+	queue     *goconcurrentqueue.FIFO
+	mu        sync.Mutex
+	cancels   map[string]context.CancelFunc
+	owner     string
+	heartbeat time.Duration
+}
+
+func NewExportWorkerPool(store LabelExportStore, run ExportRunner) *ExportWorkerPool {
+	hostname, _ := os.Hostname()
+	return &ExportWorkerPool{
+		store:     store,
+		run:       run,
+		queue:     goconcurrentqueue.NewFIFO(),
+		cancels:   make(map[string]context.CancelFunc),
+		owner:     fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.New().String()[:8]),
+		heartbeat: exportHeartbeat,
+	}
+}
+
+// Start spawns the workers, queues the jobs which were interrupted then keeps
+// sweeping the running jobs whose owner stopped beating
+func (pool *ExportWorkerPool) Start(size int) {
+	if size < 1 {
+		size = 1
+	}
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+
+	if err := pool.Recover(); err != nil {
+		utils.LogError(err)
+	}
+	go pool.sweep()
+}
+
+// Recover puts the unfinished jobs back to the queue, oldest first. Running
+// jobs are left to their owner unless its heartbeat is stale
+func (pool *ExportWorkerPool) Recover() error {
+	return pool.requeue(fmt.Sprintf("status.keyword:(%s OR %s OR %s)",
+		constants.ExportStatusPending, constants.ExportStatusQueued, constants.ExportStatusRunning))
+}
+
+// sweep recovers the jobs of an instance which died after this one started,
+// or which restarted before its heartbeats went stale
+func (pool *ExportWorkerPool) sweep() {
+	ticker := time.NewTicker(pool.heartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pool.RecoverStale(); err != nil {
+			utils.LogError(err)
+		}
+	}
+}
+
+// RecoverStale puts the running jobs with a stale heartbeat back to the queue
+func (pool *ExportWorkerPool) RecoverStale() error {
+	return pool.requeue(fmt.Sprintf("status.keyword:%s", constants.ExportStatusRunning))
+}
+
+func (pool *ExportWorkerPool) requeue(qs string) error {
+	recovered := 0
+	stale := time.Now().Add(-exportStaleHeartbeats*pool.heartbeat).UnixNano() / int64(time.Millisecond)
+	err := pool.store.Query(nil, qs, 0, constants.DefaultLimit, "created", nil, func(labelExports []LabelExport, es entities.ESReturn) {
+		for i := range labelExports {
+			labelExport := labelExports[i]
+			if labelExport.Status == constants.ExportStatusRunning && labelExport.lastBeat() > stale {
+				continue
+			}
+			if labelExport.Status != constants.ExportStatusQueued {
+				// conditional, another instance may be recovering or claiming it too
+				err := pool.store.Update(labelExport, kvStr2Inf{
+					"status": constants.ExportStatusQueued,
+				})
+				if errors.Is(err, utils.ErrVersionConflict) {
+					continue
+				}
+				if err != nil {
+					utils.LogError(err)
+					continue
+				}
+			}
+			pool.Enqueue(labelExport.ID)
+			recovered++
+		}
+	})
+	if recovered > 0 {
+		utils.LogInfo("Recovered %d label export jobs", recovered)
+	}
+	return err
+}
+
+func (pool *ExportWorkerPool) Enqueue(labelExportID string) {
+	err := pool.queue.Enqueue(labelExportID)
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+// Cancel stops the job if it is running on this instance, a job running on
+// another one stops at its next heartbeat once it reads CANCELED
+func (pool *ExportWorkerPool) Cancel(labelExportID string) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	cancel, found := pool.cancels[labelExportID]
+	if found {
+		cancel()
+	}
+	return found
+}
+
+func (pool *ExportWorkerPool) work() {
+	for true {
+		item, err := pool.queue.DequeueOrWaitForNextElement()
+		if err != nil {
+			utils.LogError(err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		labelExportID, ok := item.(string)
+		if !ok {
+			continue
+		}
+		pool.process(labelExportID)
+	}
+}
+
+func (pool *ExportWorkerPool) process(labelExportID string) {
+	labelExport, _, err := pool.store.Get(nil, fmt.Sprintf("_id:%s", labelExportID))
+	if err != nil {
+		utils.LogError(err)
+		return
+	}
+
+	// canceled or already handled while waiting in the queue
+	if labelExport.Status != constants.ExportStatusQueued {
+		return
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	labelExport.Status = constants.ExportStatusRunning
+	labelExport.Attempts++
+	labelExport.StartedAt = now
+	labelExport.Owner = pool.owner
+	labelExport.Heartbeat = now
+	labelExport.Progress = &ExportProgress{}
+	// claimed on the revision read above, so only one worker runs the job
+	err = pool.store.Update(*labelExport, kvStr2Inf{
+		"status":     labelExport.Status,
+		"attempts":   labelExport.Attempts,
+		"started_at": labelExport.StartedAt,
+		"owner":      labelExport.Owner,
+		"heartbeat":  labelExport.Heartbeat,
+		"error":      "",
+		"progress":   labelExport.Progress,
+	})
+	if errors.Is(err, utils.ErrVersionConflict) {
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		return
+	}
+	// the job is ours now, its progress and result are written unconditionally
+	labelExport.Revision = entities.Revision{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.mu.Lock()
+	pool.cancels[labelExportID] = cancel
+	pool.mu.Unlock()
+
+	done := make(chan struct{})
+	go pool.beat(labelExportID, cancel, done)
+	err = pool.run(ctx, labelExport)
+	close(done)
+
+	pool.mu.Lock()
+	delete(pool.cancels, labelExportID)
+	pool.mu.Unlock()
+
+	update := kvStr2Inf{
+		"finished_at": time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if labelExport.Progress != nil {
+		update["progress"] = labelExport.Progress
+	}
+	// another instance may have canceled the job since the last heartbeat
+	canceled := ctx.Err() != nil
+	if current, _, err := pool.store.Get(nil, fmt.Sprintf("_id:%s", labelExportID)); err != nil {
+		utils.LogError(err)
+	} else if current.Status == constants.ExportStatusCanceled {
+		canceled = true
+	}
+	switch {
+	case canceled:
+		update["status"] = constants.ExportStatusCanceled
+	case err != nil:
+		utils.LogError(err)
+		update["status"] = constants.ExportStatusFailed
+		update["error"] = err.Error()
+	default:
+		update["status"] = constants.ExportStatusDone
+	}
+	cancel()
+
+	err = pool.store.Update(*labelExport, update)
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+// beat saves the heartbeat of the running job until done, and cancels it once
+// it is CANCELED in the index
+func (pool *ExportWorkerPool) beat(labelExportID string, cancel context.CancelFunc, done chan struct{}) {
+	ticker := time.NewTicker(pool.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		labelExport, _, err := pool.store.Get(nil, fmt.Sprintf("_id:%s", labelExportID))
+		if err != nil {
+			utils.LogError(err)
+			continue
+		}
+		if labelExport.Status == constants.ExportStatusCanceled {
+			cancel()
+			return
+		}
+		err = pool.store.Update(LabelExport{ID: labelExportID}, kvStr2Inf{
+			"heartbeat": time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			utils.LogError(err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/label_group"
+	"vindr-lab-api/object"
+)
+
+// sections of an export, in the order of the JSON file
+const (
+	exportSectionLabelGroups = "label_groups"
+	exportSectionImpression  = "impression"
+	exportSectionFinding     = "finding"
+	exportSectionLabels      = "labels"
+	exportSectionObjects     = "objects"
+	exportSectionStudies     = "studies"
+	exportSectionComments    = "comments"
+	exportSectionArchives    = "archives"
+)
+
+var exportSections = []string{
+	exportSectionLabelGroups,
+	exportSectionImpression,
+	exportSectionFinding,
+	exportSectionLabels,
+	exportSectionObjects,
+	exportSectionStudies,
+	exportSectionComments,
+	exportSectionArchives,
+}
+
+// exportWriter receives the items of an export one by one. EndStudy follows
+// the items of every study, Close completes the output, Discard releases what
+// is left after a failure
+type exportWriter interface {
+	Write(section string, item interface{}) error
+	EndStudy() error
+	Close() error
+	Discard()
+}
+
+// ndjsonExportWriter writes one {"type": section, "data": item} line per item
+type ndjsonExportWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+type ndjsonRecord struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+func newNDJSONExportWriter(out io.Writer) *ndjsonExportWriter {
+	w := bufio.NewWriter(out)
+	return &ndjsonExportWriter{
+		w:       w,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (writer *ndjsonExportWriter) Write(section string, item interface{}) error {
+	return writer.encoder.Encode(ndjsonRecord{Type: section, Data: item})
+}
+
+func (writer *ndjsonExportWriter) EndStudy() error {
+	return nil
+}
+
+func (writer *ndjsonExportWriter) Close() error {
+	return writer.w.Flush()
+}
+
+func (writer *ndjsonExportWriter) Discard() {}
+
+// jsonExportWriter writes the same document as the old in-memory export. Items
+// of every section are spilled to a temporary file, Close concatenates them
+type jsonExportWriter struct {
+	out      io.Writer
+	sections []string
+	files    map[string]*os.File
+	bufs     map[string]*bufio.Writer
+}
+
+func newJSONExportWriter(out io.Writer) *jsonExportWriter {
+	return newSectionsJSONWriter(out, exportSections)
+}
+
+// newSectionsJSONWriter writes an object with one array per section, in order
+func newSectionsJSONWriter(out io.Writer, sections []string) *jsonExportWriter {
+	return &jsonExportWriter{
+		out:      out,
+		sections: sections,
+		files:    make(map[string]*os.File),
+		bufs:     make(map[string]*bufio.Writer),
+	}
+}
+
+func (writer *jsonExportWriter) Write(section string, item interface{}) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	buf, found := writer.bufs[section]
+	if !found {
+		file, err := ioutil.TempFile("", fmt.Sprintf("export_%s_*.json", section))
+		if err != nil {
+			return err
+		}
+		writer.files[section] = file
+		buf = bufio.NewWriter(file)
+		writer.bufs[section] = buf
+	} else if err := buf.WriteByte(','); err != nil {
+		return err
+	}
+
+	_, err = buf.Write(b)
+	return err
+}
+
+func (writer *jsonExportWriter) EndStudy() error {
+	return nil
+}
+
+func (writer *jsonExportWriter) Close() error {
+	defer writer.Discard()
+
+	out := bufio.NewWriter(writer.out)
+	out.WriteByte('{')
+	for i, section := range writer.sections {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		fmt.Fprintf(out, "%q:[", section)
+		if file, found := writer.files[section]; found {
+			if err := writer.bufs[section].Flush(); err != nil {
+				return err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, file); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	}
+	out.WriteByte('}')
+	return out.Flush()
+}
+
+func (writer *jsonExportWriter) Discard() {
+	for section, file := range writer.files {
+		file.Close()
+		os.Remove(file.Name())
+		delete(writer.files, section)
+		delete(writer.bufs, section)
+	}
+}
+
+// exportCollector keeps the items of one study in memory for the formats which
+// are converted from whole studies (COCO, VOC, DICOM). flush receives every
+// study with the labels and label groups of the export, which come first
+type exportCollector struct {
+	file  *exportFile
+	flush func(file *exportFile) error
+}
+
+func newExportCollector(flush func(file *exportFile) error) *exportCollector {
+	collector := &exportCollector{
+		file: &exportFile{
+			LabelGroups: make([]label_group.LabelGroup, 0),
+			Labels:      make([]annotation.Label, 0),
+		},
+		flush: flush,
+	}
+	collector.reset()
+	return collector
+}
+
+// reset drops the items of the study, labels and label groups are kept
+func (collector *exportCollector) reset() {
+	file := collector.file
+	file.Impression = make([]annotation.Annotation, 0)
+	file.Finding = make([]annotation.Annotation, 0)
+	file.Objects = make([]object.Object, 0)
+	file.Studies = make([]map[string]interface{}, 0)
+	file.Comments = make([]map[string]interface{}, 0)
+	file.Archives = make([]string, 0)
+}
+func (collector *exportCollector) Write(section string, item interface{}) error {
+	file := collector.file
+	ok := false
+	switch section {
+	case exportSectionLabelGroups:
+		var v label_group.LabelGroup
+		if v, ok = item.(label_group.LabelGroup); ok {
+			file.LabelGroups = append(file.LabelGroups, v)
+		}
+	case exportSectionImpression, exportSectionFinding:
+		var v annotation.Annotation
+		if v, ok = item.(annotation.Annotation); ok && section == exportSectionImpression {
+			file.Impression = append(file.Impression, v)
+		} else if ok {
+			file.Finding = append(file.Finding, v)
+		}
+	case exportSectionLabels:
+		var v annotation.Label
+		if v, ok = item.(annotation.Label); ok {
+			file.Labels = append(file.Labels, v)
+		}
+	case exportSectionObjects:
+		var v object.Object
+		if v, ok = item.(object.Object); ok {
+			file.Objects = append(file.Objects, v)
+		}
+	case exportSectionStudies, exportSectionComments:
+		var v map[string]interface{}
+		if v, ok = item.(map[string]interface{}); ok && section == exportSectionStudies {
+			file.Studies = append(file.Studies, v)
+		} else if ok {
+			file.Comments = append(file.Comments, v)
+		}
+	case exportSectionArchives:
+		var v string
+		if v, ok = item.(string); ok {
+			file.Archives = append(file.Archives, v)
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("Unexpected %T in export section %s", item, section)
+	}
+	return nil
+}
+
+func (collector *exportCollector) EndStudy() error {
+	defer collector.reset()
+	return collector.flush(collector.file)
+}
+
+func (collector *exportCollector) Close() error {
+	return nil
+}
+
+func (collector *exportCollector) Discard() {}
@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/project"
+	"vindr-lab-api/study"
+	"vindr-lab-api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultAtRiskHours an open task due within this many hours is at risk
+const DefaultAtRiskHours = 24
+
+// SLAReport the open tasks with a due date, Overdue ones are past it and
+// AtRisk ones are due within AtRiskHours
+type SLAReport struct {
+	AtRiskHours int        `json:"at_risk_hours"`
+	Now         int64      `json:"now"`
+	Projects    []SLACount `json:"projects"`
+	Assignees   []SLACount `json:"assignees"`
+}
+
+// SLACount of a project or of an assignee, tasks of the pool have no assignee
+type SLACount struct {
+	ProjectID  string `json:"project_id,omitempty"`
+	AssigneeID string `json:"assignee_id,omitempty"`
+	Open       int    `json:"open"`
+	Overdue    int    `json:"overdue"`
+	AtRisk     int    `json:"at_risk"`
+}
+
+func (count *SLACount) add(task study.Task, now, atRisk int64) {
+	count.Open++
+	switch {
+	case task.DueAt < now:
+		count.Overdue++
+	case task.DueAt < now+atRisk:
+		count.AtRisk++
+	}
+}
+
+// computeSLA counts the tasks of the report, the most overdue first
+func computeSLA(tasks []study.Task, now int64, atRiskHours int) SLAReport {
+	atRisk := int64(atRiskHours) * int64(time.Hour/time.Millisecond)
+	mapProject := make(map[string]*SLACount)
+	mapAssignee := make(map[string]*SLACount)
+	for _, task := range tasks {
+		if task.DueAt <= 0 || task.Status == constants.TaskStatusCompleted {
+			continue
+		}
+		if _, found := mapProject[task.ProjectID]; !found {
+			mapProject[task.ProjectID] = &SLACount{ProjectID: task.ProjectID}
+		}
+		if _, found := mapAssignee[task.AssigneeID]; !found {
+			mapAssignee[task.AssigneeID] = &SLACount{AssigneeID: task.AssigneeID}
+		}
+		mapProject[task.ProjectID].add(task, now, atRisk)
+		mapAssignee[task.AssigneeID].add(task, now, atRisk)
+	}
+
+	report := SLAReport{AtRiskHours: atRiskHours, Now: now}
+	report.Projects = sortSLACounts(mapProject, func(count SLACount) string { return count.ProjectID })
+	report.Assignees = sortSLACounts(mapAssignee, func(count SLACount) string { return count.AssigneeID })
+	return report
+}
+
+func sortSLACounts(mapCount map[string]*SLACount, key func(SLACount) string) []SLACount {
+	counts := make([]SLACount, 0, len(mapCount))
+	for _, count := range mapCount {
+		counts = append(counts, *count)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Overdue != counts[j].Overdue {
+			return counts[i].Overdue > counts[j].Overdue
+		}
+		if counts[i].AtRisk != counts[j].AtRisk {
+			return counts[i].AtRisk > counts[j].AtRisk
+		}
+		return key(counts[i]) < key(counts[j])
+	})
+	return counts
+}
+
+// GetSLA reports the overdue and at risk tasks of the projects given, or of
+// the projects the caller owns
+func (app *StatsAPI) GetSLA(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	atRiskHours := DefaultAtRiskHours
+	if v := c.Query(constants.ParamAtRiskHours); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours < 0 {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+		atRiskHours = hours
+	}
+
+	projectIDs := c.QueryArray(constants.ParamProjectID)
+	if len(projectIDs) == 0 {
+		authInfo := mw.GetAuthInfoFromGin(c)
+		err := app.projectStore.Query(nil, fmt.Sprintf("roles_mapping.PO.keyword:%s", authInfo.ID), 0, constants.DefaultLimit, "", nil,
+			func(projects []project.Project, es entities.ESReturn) {
+				for _, p := range projects {
+					projectIDs = append(projectIDs, p.ID)
+				}
+			})
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+	}
+
+	tasks := make([]study.Task, 0)
+	if len(projectIDs) > 0 {
+		err := app.taskStore.Query(map[string][]string{"project_id.keyword": projectIDs},
+			fmt.Sprintf("archived:%v AND due_at:>0 AND NOT status.keyword:%s", false, constants.TaskStatusCompleted),
+			0, constants.DefaultLimit, "", nil, func(items []study.Task, es entities.ESReturn) {
+				tasks = append(tasks, items...)
+			})
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+	}
+
+	resp.Data = computeSLA(tasks, time.Now().UnixNano()/int64(time.Millisecond), atRiskHours)
+	c.JSON(http.StatusOK, resp)
+}
+
+// countOverdue the open tasks matching qs past their due date
+func (app *StatsAPI) countOverdue(qs string, now int64) (int, error) {
+	_, esReturn, err := app.taskStore.GetSlice(nil, fmt.Sprintf("%s AND archived:%v AND due_at:>0 AND due_at:<%d AND NOT status.keyword:%s",
+		qs, false, now, constants.TaskStatusCompleted), 0, 0, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	return esReturn.Hits.Total.Value, nil
+}
@@ -1,7 +1,7 @@
 package stats
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -27,23 +27,25 @@ import (
 )
 
 type StatsAPI struct {
-	labelExportStore *LabelExportES
-	labelGroupStore  *label_group.LabelGroupES
-	labelStore       *annotation.LabelES
-	projectStore     *project.ProjectES
-	objectStore      *object.ObjectES
-	antnStore        *annotation.AnnotationES
-	studyStore       *study.StudyES
-	taskStore        *study.TaskES
+	labelExportStore LabelExportStore
+	labelGroupStore  label_group.LabelGroupStore
+	labelStore       annotation.LabelStore
+	projectStore     project.ProjectStore
+	objectStore      object.ObjectStore
+	antnStore        annotation.AnnotationStore
+	studyStore       study.StudyStore
+	taskStore        study.TaskStore
 	kcStore          *account.KeycloakStore
 	logger           *zap.Logger
 	minioClient      *MinIOStorage
+	pacs             *study.PACSRegistry
+	exportPool       *ExportWorkerPool
 }
 
 // NewLabelExportAPI it is going to be very huge
-func NewLabelExportAPI(labelExportStore *LabelExportES, labelGroupStore *label_group.LabelGroupES, labelStore *annotation.LabelES, projectStore *project.ProjectES,
-	antnStore *annotation.AnnotationES, objectStore *object.ObjectES, studyStore *study.StudyES, taskStore *study.TaskES,
-	minioClient *MinIOStorage, kcStore *account.KeycloakStore, logger *zap.Logger) (app *StatsAPI) {
+func NewLabelExportAPI(labelExportStore LabelExportStore, labelGroupStore label_group.LabelGroupStore, labelStore annotation.LabelStore, projectStore project.ProjectStore,
+	antnStore annotation.AnnotationStore, objectStore object.ObjectStore, studyStore study.StudyStore, taskStore study.TaskStore,
+	minioClient *MinIOStorage, pacs *study.PACSRegistry, kcStore *account.KeycloakStore, logger *zap.Logger) (app *StatsAPI) {
 	app = &StatsAPI{
 		labelExportStore: labelExportStore,
 		labelGroupStore:  labelGroupStore,
@@ -55,18 +57,30 @@ func NewLabelExportAPI(labelExportStore *LabelExportES, labelGroupStore *label_g
 		taskStore:        taskStore,
 		logger:           logger,
 		minioClient:      minioClient,
+		pacs:             pacs,
 		kcStore:          kcStore,
 	}
+	app.exportPool = NewExportWorkerPool(labelExportStore, app.RunLabelExport)
 	return app
 }
 
+// StartExportWorkers runs the export jobs in background and resumes the interrupted ones
+func (app *StatsAPI) StartExportWorkers(size int) {
+	app.exportPool.Start(size)
+}
+
 func (app *StatsAPI) InitRoute(engine *gin.Engine, path string) {
 	group := engine.Group(path, mw.WrapAuthInfo(app.logger))
 	group.POST("/label_exports", mw.ValidPerms("label_exports", mw.PERM_C), app.CreateExportLabel)
 	group.GET("/label_exports", mw.ValidPerms("label_exports", mw.PERM_R), app.GetLabelExports)
 	group.GET("/label_exports/download/:id", mw.ValidPerms("label_exports", mw.PERM_R), app.DownloadLabelExport)
+	group.GET("/label_exports/:id", mw.ValidPerms("label_exports", mw.PERM_R), app.GetLabelExport)
+	group.POST("/label_exports/:id/retry", mw.ValidPerms("label_exports", mw.PERM_C), app.RetryLabelExport)
+	group.POST("/label_exports/:id/cancel", mw.ValidPerms("label_exports", mw.PERM_C), app.CancelLabelExport)
 	group.GET("/projects_by_role", mw.ValidPerms(path, mw.PERM_R), app.GetProjectsByRole)
 	group.GET("/agg_labels", mw.ValidPerms(path, mw.PERM_R), app.GetStatsLabelsByAgg)
+	group.GET("/agreement", mw.ValidPerms(path, mw.PERM_R), app.GetAgreement)
+	group.GET("/sla", mw.ValidPerms(path, mw.PERM_R), app.GetSLA)
 	group.GET("/studies/:id/assignee", mw.ValidPerms(path, mw.PERM_R), app.GetAssgineeOfStudy)
 }
 
@@ -84,6 +98,19 @@ func (app *StatsAPI) CreateExportLabel(c *gin.Context) {
 		return
 	}
 
+	if labelExport.Format != "" && !IsValidExportFormat(labelExport.Format) {
+		app.logger.Info("Export format is not supported")
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	if labelExport.PushToOrthanc && labelExport.Format != constants.ExportFormatDICOM {
+		app.logger.Info("Only DICOM exports can be pushed to orthanc")
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
 	if len(existedTags) == 0 {
 		labelExports, _, _ := app.labelExportStore.GetSlice(nil, "", 0, constants.DefaultLimit, "", nil)
 		for _, item := range labelExports {
@@ -104,8 +131,8 @@ func (app *StatsAPI) CreateExportLabel(c *gin.Context) {
 	labelExport.New()
 	labelExport.CreatorID = authInfo.ID
 	projectID := labelExport.ProjectID
-	project, _, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
-	if projectID == "" || project == nil {
+	_, _, err = app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if projectID == "" || errors.Is(err, utils.ErrNotFound) {
 		app.logger.Info("ProjectID is nil")
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
@@ -119,210 +146,18 @@ func (app *StatsAPI) CreateExportLabel(c *gin.Context) {
 	}
 
 	utils.LogInfo("Create es object")
-	app.labelExportStore.Create(labelExport)
-
-	go func() {
-
-		labelGroupIDs := project.LabelGroupIDs
-
-		labelGroupsReturn, _, err := app.labelGroupStore.GetSlice(map[string][]string{
-			"_id": labelGroupIDs,
-		}, "", 0, constants.DefaultLimit, "", nil)
-		if err != nil {
-			utils.LogError(err)
-			resp.ErrorCode = constants.ServerError
-			c.JSON(http.StatusInternalServerError, resp)
-			return
-		}
-
-		labelsReturn := make([]annotation.Label, 0)
-		mapLabelImps := make(map[string]bool)
-		mapLabelFind := make(map[string]bool)
-
-		utils.LogInfo("Get labels")
-		app.labelStore.Query(map[string][]string{"label_group_id.keyword": labelGroupIDs}, "", 0, constants.DefaultLimit, "", nil,
-			func(labels []annotation.Label, esReturn entities.ESReturn) {
-				for i, label := range labels {
-					if _, found := utils.FindInSlice(labelGroupIDs, label.LabelGroupID); found {
-						labelsReturn = append(labelsReturn, labels[i])
-						switch label.Type {
-						case "IMPRESSION":
-							mapLabelImps[label.ID] = true
-							break
-						case "FINDING":
-							mapLabelFind[label.ID] = true
-							break
-						}
-					}
-				}
-			})
-
-		utils.LogInfo("Get and map Annotations by types, Get comments")
-
-		mapA8sImps := make(map[string]annotation.Annotation)
-		mapA8sFind := make(map[string]annotation.Annotation)
-		comments := make([]map[string]interface{}, 0)
-
-		mapID2User, err := app.kcStore.GetAccountsAsMap("")
-		if err != nil {
-			utils.LogError(err)
-		}
-
-		totalTasks := 0
-		app.studyStore.Query(nil, fmt.Sprintf("project_id.keyword:%s", projectID), 0, constants.DefaultLimit*10, "", nil, func(studies []study.Study, es entities.ESReturn) {
-			utils.LogInfo("size of tasks: %d", totalTasks)
-			for _, s := range studies {
-				app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND type.keyword:%s AND status.keyword:%s",
-					projectID, s.ID, constants.TaskTypeReview, constants.TaskStatusCompleted),
-					0, constants.DefaultLimit, "", nil, func(tasks []study.Task, es entities.ESReturn) {
-
-						totalTasks += len(tasks)
-						taskIDs := make([]string, 0)
-
-						for _, task := range tasks {
-							taskIDs = append(taskIDs, task.ID)
-
-							if task.Comment != "" {
-								o, _, err := app.objectStore.Get(nil, fmt.Sprintf("study_id.keyword:%s", task.StudyID))
-								if err != nil {
-									utils.LogError(err)
-								} else {
-									comments = append(comments, map[string]interface{}{
-										"id":         task.ID,
-										"object_id":  o.ID,
-										"creator_id": task.AssigneeID,
-										"content":    task.Comment,
-									})
-								}
-							}
-						}
-
-						if len(taskIDs) > 0 {
-							app.antnStore.Query(map[string][]string{
-								"task_id.keyword": taskIDs,
-							}, "", 0, constants.DefaultLimit, "", nil,
-								func(antns []annotation.Annotation, e entities.ESReturn) {
-									for i := range antns {
-										antn := antns[i]
-										if mapID2User[antn.CreatorID] != nil && antn.CreatorName == "" {
-											antn.CreatorName = mapID2User[antn.CreatorID].Username
-										}
-
-										for _, labelID := range antn.LabelIDs {
-											if _, found := mapLabelImps[labelID]; found {
-												mapA8sImps[antn.ID] = antn
-											}
-											if _, found := mapLabelFind[labelID]; found {
-												mapA8sFind[antn.ID] = antn
-											}
-										}
-									}
-								})
-						}
-					})
-			}
-
-		})
-		utils.LogInfo("size of tasks: %d", totalTasks)
-
-		antnImps := make([]annotation.Annotation, 0)
-		antnFind := make([]annotation.Annotation, 0)
-		for _, v := range mapA8sImps {
-			antnImps = append(antnImps, v)
-		}
-		for _, v := range mapA8sFind {
-			antnFind = append(antnFind, v)
-		}
-
-		utils.LogInfo("Get and return objects")
-		mapObjectTypeCount := make(map[string]int)
-		objectsRet := make([]object.Object, 0)
-		studyCount := 0
-		studiesRet := make([]map[string]interface{}, 0)
-
-		app.studyStore.Query(nil, fmt.Sprintf("project_id.keyword:%s", projectID),
-			0, constants.DefaultLimit, "", nil, func(studies []study.Study, es entities.ESReturn) {
-				studyCount += len(studies)
-
-				for _, study := range studies {
-					err := app.objectStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s", projectID, study.ID),
-						0, constants.DefaultLimit, "", nil, func(objects []object.Object, es entities.ESReturn) {
-							objectsRet = append(objectsRet, objects...)
-
-							for _, object := range objects {
-								mapObjectTypeCount[object.Type]++
-								if object.Type == constants.ObjectTypeStudy {
-									studiesRet = append(studiesRet, map[string]interface{}{
-										"object_id": object.ID,
-										"code":      study.Code,
-										"status":    study.Status,
-									})
-								}
-							}
-						})
-
-					if err != nil {
-						utils.LogError(err)
-					}
-				}
-			})
-		utils.LogInfo("%d\t%v", studyCount, mapObjectTypeCount)
-
-		utils.LogInfo("Get and return archived objects")
-		mapArchives := make(map[string]bool)
-		listArchives := make([]string, 0)
-		acrhivedTask := 0
-		app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND archived:%v", projectID, true), 0, constants.DefaultLimit,
-			"", nil, func(tasks []study.Task, es entities.ESReturn) {
-				acrhivedTask += len(tasks)
-				for _, t := range tasks {
-					app.objectStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND type.keyword:STUDY", projectID, t.StudyID), 0, 10, "", nil, func(objects []object.Object, es entities.ESReturn) {
-						if len(objects) == 0 {
-							utils.LogInfo("error")
-						}
-						for _, o := range objects {
-							mapArchives[o.ID] = true
-						}
-					})
-				}
-			})
-		for k := range mapArchives {
-			listArchives = append(listArchives, k)
-		}
-		utils.LogInfo("%d-%d", acrhivedTask, len(listArchives))
-
-		utils.LogInfo("Link result to return map")
-		exportFile := make(map[string]interface{})
-		exportFile["label_groups"] = labelGroupsReturn
-		exportFile["impression"] = antnImps
-		exportFile["finding"] = antnFind
-		exportFile["labels"] = labelsReturn
-		exportFile["objects"] = objectsRet
-		exportFile["studies"] = studiesRet
-		exportFile["comments"] = comments
-		exportFile["archives"] = listArchives
-
-		// fmt.Println(exportFile)
-		bytes, _ := json.Marshal(exportFile)
-
-		utils.LogInfo("Store file to minio")
-		err1 := app.minioClient.StoreFile(labelExport.Tag, bytes)
-		if err1 != nil {
-			utils.LogError(err)
-			resp.ErrorCode = constants.ServerError
-			c.JSON(http.StatusInternalServerError, resp)
-			return
-		}
-
-		resp.Data = kvStr2Inf{
-			constants.ParamID: labelExport.ID,
-		}
-
-		utils.LogInfo("Update es object")
-		labelExport.Status = constants.ExportStatusDone
-		app.labelExportStore.Create(labelExport)
-	}()
+	err = app.labelExportStore.Create(labelExport)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	app.exportPool.Enqueue(labelExport.ID)
 
+	resp.Data = kvStr2Inf{
+		constants.ParamID: labelExport.ID,
+	}
 	c.JSON(http.StatusOK, resp)
 
 	return
@@ -436,6 +271,44 @@ func (app *StatsAPI) GetStatsLabelsByAgg(c *gin.Context) {
 	return
 }
 
+func (app *StatsAPI) GetAgreement(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	projectID := c.Query(constants.ParamProjectID)
+	p, _, _ := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if projectID == "" || p == nil {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	iouThreshold := DefaultIoUThreshold
+	if v := c.Query(constants.ParamIoUThreshold); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+		iouThreshold = threshold
+	}
+
+	input, err := app.getAgreementInput(p)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	input.IoUThreshold = iouThreshold
+
+	agreement := computeAgreement(*input)
+	agreement.ProjectID = projectID
+
+	resp.Data = agreement
+	c.JSON(http.StatusOK, resp)
+}
+
 func (app *StatsAPI) GetLabelExports(c *gin.Context) {
 	resp := entities.NewResponse()
 
@@ -458,6 +331,127 @@ func (app *StatsAPI) GetLabelExports(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+func (app *StatsAPI) GetLabelExport(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	labelExportID := c.Param(constants.ParamID)
+	labelExport, _, err := app.labelExportStore.Get(nil, fmt.Sprintf("_id:%s", labelExportID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = labelExport
+	c.JSON(http.StatusOK, resp)
+}
+
+func (app *StatsAPI) RetryLabelExport(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	labelExportID := c.Param(constants.ParamID)
+	labelExport, _, err := app.labelExportStore.Get(nil, fmt.Sprintf("_id:%s", labelExportID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if !labelExport.IsRetryable() {
+		app.logger.Info("Only failed or canceled exports can be retried")
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	err = app.labelExportStore.Update(*labelExport, kvStr2Inf{
+		"status":      constants.ExportStatusQueued,
+		"error":       "",
+		"finished_at": 0,
+	})
+	// retried or claimed by another request since it was read
+	if errors.Is(err, utils.ErrVersionConflict) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	app.exportPool.Enqueue(labelExport.ID)
+
+	resp.Data = kvStr2Inf{
+		constants.ParamID: labelExport.ID,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (app *StatsAPI) CancelLabelExport(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	labelExportID := c.Param(constants.ParamID)
+	labelExport, _, err := app.labelExportStore.Get(nil, fmt.Sprintf("_id:%s", labelExportID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	if !labelExport.IsUnfinished() {
+		app.logger.Info("Export is already finished")
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	// a job running here is marked CANCELED by its worker once it stops, one
+	// running on another instance is stopped there at its next heartbeat
+	if !app.exportPool.Cancel(labelExport.ID) {
+		err = app.labelExportStore.Update(*labelExport, kvStr2Inf{
+			"status":      constants.ExportStatusCanceled,
+			"finished_at": time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		// claimed by a worker since it was read, the cancel can be sent again
+		if errors.Is(err, utils.ErrVersionConflict) {
+			resp.ErrorCode = constants.ServerConflict
+			c.JSON(http.StatusConflict, resp)
+			return
+		}
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+	}
+
+	resp.Data = kvStr2Inf{
+		constants.ParamID: labelExport.ID,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func (app *StatsAPI) DownloadLabelExport(c *gin.Context) {
 	resp := entities.NewResponse()
 
@@ -577,7 +571,7 @@ func (app *StatsAPI) GetProjectsByRole(c *gin.Context) {
 			}
 		}
 		break
-	case constants.ProjRoleReviewer, constants.ProjRoleAnnotator:
+	case constants.ProjRoleReviewer, constants.ProjRoleAnnotator, constants.ProjRoleArbitrator:
 		for i, project := range projectsRet {
 			_, esReturn, err := app.taskStore.GetSlice(nil, fmt.Sprintf("assignee_id:%s AND project_id:%s", userID, project.ID), 0, 0, "", aggs)
 			if err != nil {
@@ -602,6 +596,26 @@ func (app *StatsAPI) GetProjectsByRole(c *gin.Context) {
 		break
 	}
 
+	// overdue tasks of the project, or of the caller in it
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, project := range projectsRet {
+		qs := fmt.Sprintf("project_id.keyword:%s", project.ID)
+		if roles[0] != constants.ProjRoleProjectOwner {
+			qs = fmt.Sprintf("%s AND assignee_id.keyword:%s", qs, userID)
+		}
+		overdue, err := app.countOverdue(qs, now)
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+		if projectsRet[i].Meta == nil {
+			projectsRet[i].Meta = make(map[string]interface{})
+		}
+		projectsRet[i].Meta[constants.MetaOverdue] = overdue
+	}
+
 	resp.Count = esReturn.Hits.Total.Value
 	resp.Data = projectsRet
 	c.JSON(http.StatusOK, resp)
@@ -618,17 +632,17 @@ func (app *StatsAPI) GetAssgineeOfStudy(c *gin.Context) {
 	}
 
 	s, _, err := app.studyStore.Get(nil, fmt.Sprintf("_id:%s", studyID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
-	if s == nil {
-		resp.ErrorCode = constants.ServerInvalidData
-		c.JSON(http.StatusBadRequest, resp)
-		return
-	}
 
 	p, _, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", s.ProjectID))
 	if err != nil {
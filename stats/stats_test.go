@@ -1,7 +1,23 @@
 package stats
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/study"
+	"vindr-lab-api/utils/dicom"
 
 	"gopkg.in/go-playground/assert.v1"
 )
@@ -24,3 +40,420 @@ func TestToString(t *testing.T) {
 		assert.Equal(t, "{\"id\":\"\",\"created\":0,\"file_path\":\"\",\"creator_id\":\"\",\"project_id\":\"\",\"tag\":\"\"}", labelExport.String())
 	}
 }
+
+func TestExportStatus(t *testing.T) {
+	{
+		labelExport := LabelExport{Tag: "tag"}
+		labelExport.New()
+		assert.Equal(t, constants.ExportStatusQueued, labelExport.Status)
+		assert.Equal(t, true, labelExport.IsUnfinished())
+		assert.Equal(t, false, labelExport.IsRetryable())
+	}
+	{
+		labelExport := LabelExport{Status: constants.ExportStatusPending}
+		assert.Equal(t, true, labelExport.IsUnfinished())
+	}
+	{
+		labelExport := LabelExport{Status: constants.ExportStatusFailed}
+		assert.Equal(t, false, labelExport.IsUnfinished())
+		assert.Equal(t, true, labelExport.IsRetryable())
+	}
+	{
+		assert.Equal(t, true, IsValidExportStatus(constants.ExportStatusCanceled))
+		assert.Equal(t, false, IsValidExportStatus("UNKNOWN"))
+	}
+}
+
+func TestToCOCO(t *testing.T) {
+	file := exportFile{
+		Labels: []annotation.Label{{ID: "label", Name: "Nodule", Type: constants.LabelTypeFinding}},
+		Objects: []object.Object{{ID: "object", Type: constants.ObjectTypeImage,
+			Meta: &entities.MetaData{SOPInstanceUID: "sop"}}},
+		Finding: []annotation.Annotation{
+			{ID: "box", ObjectID: "object", Type: constants.AntnTypeBox, LabelIDs: []string{"label"},
+				Data: []interface{}{map[string]interface{}{"x": 1.0, "y": 2.0}, map[string]interface{}{"x": 4.0, "y": 6.0}}},
+			{ID: "polygon", ObjectID: "object", Type: constants.AntnTypePolygon, LabelIDs: []string{"label"},
+				Data: []interface{}{map[string]interface{}{"x": 0.0, "y": 0.0}, map[string]interface{}{"x": 2.0, "y": 0.0},
+					map[string]interface{}{"x": 0.0, "y": 2.0}}},
+			{ID: "tag", ObjectID: "object", Type: constants.AntnTypeTag, LabelIDs: []string{"label"}},
+		},
+	}
+
+	ids := &cocoIDs{}
+	coco := file.toCOCO(map[string]imageSize{"sop": {width: 512, height: 256}}, ids)
+	assert.Equal(t, 1, len(coco.Images))
+	assert.Equal(t, "sop", coco.Images[0].FileName)
+	assert.Equal(t, 512, coco.Images[0].Width)
+	assert.Equal(t, 256, coco.Images[0].Height)
+	assert.Equal(t, 1, len(coco.Categories))
+	assert.Equal(t, 2, len(coco.Annotations))
+	assert.Equal(t, []float64{1, 2, 3, 4}, coco.Annotations[0].Bbox)
+	assert.Equal(t, 12.0, coco.Annotations[0].Area)
+	assert.Equal(t, 2.0, coco.Annotations[1].Area)
+	assert.Equal(t, [][]float64{{0, 0, 2, 0, 0, 2}}, coco.Annotations[1].Segmentation)
+
+	// the next study goes on with the IDs of the previous one
+	next := file.toCOCO(nil, ids)
+	assert.Equal(t, 2, next.Images[0].ID)
+	assert.Equal(t, 3, next.Annotations[0].ID)
+	assert.Equal(t, 2, next.Annotations[0].ImageID)
+}
+
+func TestExportCollector(t *testing.T) {
+	flushed := make([]exportFile, 0)
+	collector := newExportCollector(func(file *exportFile) error {
+		flushed = append(flushed, *file)
+		return nil
+	})
+	assert.Equal(t, nil, collector.Write(exportSectionLabels, annotation.Label{ID: "label"}))
+	for _, id := range []string{"s1", "s2"} {
+		assert.Equal(t, nil, collector.Write(exportSectionObjects, object.Object{ID: id}))
+		assert.Equal(t, nil, collector.Write(exportSectionFinding, annotation.Annotation{ID: id, ObjectID: id}))
+		assert.Equal(t, nil, collector.EndStudy())
+	}
+
+	// every study is flushed alone, with the labels of the export
+	assert.Equal(t, 2, len(flushed))
+	for i, id := range []string{"s1", "s2"} {
+		assert.Equal(t, 1, len(flushed[i].Objects))
+		assert.Equal(t, id, flushed[i].Objects[0].ID)
+		assert.Equal(t, 1, len(flushed[i].Finding))
+		assert.Equal(t, "label", flushed[i].Labels[0].ID)
+	}
+	assert.Equal(t, 0, len(collector.file.Objects))
+}
+
+func TestToVOC(t *testing.T) {
+	file := exportFile{
+		Labels: []annotation.Label{{ID: "label", Name: "Nodule", Type: constants.LabelTypeFinding}},
+		Objects: []object.Object{{ID: "object", Type: constants.ObjectTypeImage,
+			Meta: &entities.MetaData{SOPInstanceUID: "sop"}}},
+		Finding: []annotation.Annotation{
+			{ID: "box", ObjectID: "object", Type: constants.AntnTypeBox, LabelIDs: []string{"label"},
+				Data: []interface{}{map[string]interface{}{"x": 1.0, "y": 2.0}, map[string]interface{}{"x": 4.0, "y": 6.0}}},
+		},
+	}
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	assert.Equal(t, nil, file.toVOC(zipWriter, "folder", map[string]imageSize{"sop": {width: 512, height: 256}}))
+	assert.Equal(t, nil, zipWriter.Close())
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(zipReader.File))
+	assert.Equal(t, "sop.xml", zipReader.File[0].Name)
+	r, err := zipReader.File[0].Open()
+	assert.Equal(t, nil, err)
+	voc := vocAnnotation{}
+	assert.Equal(t, nil, xml.NewDecoder(r).Decode(&voc))
+	assert.Equal(t, 512, voc.Size.Width)
+	assert.Equal(t, "Nodule", voc.Objects[0].Name)
+	assert.Equal(t, 4.0, voc.Objects[0].BndBox.XMax)
+}
+
+func TestRasterizePolygon(t *testing.T) {
+	points := []annotation.Point2D{{X: 1, Y: 1}, {X: 3, Y: 1}, {X: 3, Y: 3}, {X: 1, Y: 3}}
+	pixels := rasterizePolygon(points, 4, 4)
+	count := 0
+	for _, set := range pixels {
+		if set {
+			count++
+		}
+	}
+	assert.Equal(t, 4, count)
+	assert.Equal(t, true, pixels[1*4+1])
+	assert.Equal(t, false, pixels[0])
+}
+
+func TestDcmFileMapUIDs(t *testing.T) {
+	export := &dicomExport{projectID: "project", sourceUIDs: map[string]bool{"1.2": true, "1.2.3": true}}
+	file := &dicom.Instance{SOPClassUID: dicom.SegmentationStorage, SOPInstanceUID: "2.25.1", Dataset: dicom.Dataset{
+		{Tag: dicom.Tag(0x0008, 0x0016), VR: "UI", Value: dicom.SegmentationStorage},
+		{Tag: dicom.Tag(0x0020, 0x000D), VR: "UI", Value: "1.2"},
+		{Tag: dicom.Tag(0x0008, 0x1115), VR: "SQ", Value: []dicom.Dataset{{
+			{Tag: dicom.Tag(0x0008, 0x1155), VR: "UI", Value: "1.2.3"},
+		}}},
+	}}
+
+	mapped := file.Dataset.MapUIDs(export.mapPACSUID)
+	assert.Equal(t, dicom.SegmentationStorage, mapped[0].Value)
+	assert.Equal(t, "project.1.2", mapped[1].Value)
+	assert.Equal(t, "project.1.2.3", mapped[2].Value.([]dicom.Dataset)[0][0].Value)
+	// the built file is left as is for the zip
+	assert.Equal(t, "1.2.3", file.Dataset[2].Value.([]dicom.Dataset)[0][0].Value)
+
+	zipped, err := file.Encode(func(uid string) string { return uid })
+	assert.Equal(t, nil, err)
+	pushed, err := file.Encode(export.mapPACSUID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Contains(zipped, []byte("2.25.1")))
+	assert.Equal(t, true, bytes.Contains(pushed, []byte("2.25.1")))
+	assert.Equal(t, true, bytes.Contains(pushed, []byte("project.1.2.3")))
+}
+
+func TestJSONExportWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newJSONExportWriter(&buf)
+	assert.Equal(t, nil, writer.Write(exportSectionArchives, "a"))
+	assert.Equal(t, nil, writer.Write(exportSectionLabels, annotation.Label{ID: "label"}))
+	assert.Equal(t, nil, writer.Write(exportSectionArchives, "b"))
+	assert.Equal(t, nil, writer.Close())
+
+	file := exportFile{}
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &file))
+	assert.Equal(t, []string{"a", "b"}, file.Archives)
+	assert.Equal(t, "label", file.Labels[0].ID)
+	assert.Equal(t, 0, len(file.Finding))
+	assert.Equal(t, 0, len(writer.files))
+}
+
+func TestNDJSONExportWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newNDJSONExportWriter(&buf)
+	assert.Equal(t, nil, writer.Write(exportSectionArchives, "a"))
+	assert.Equal(t, nil, writer.Write(exportSectionArchives, "b"))
+	assert.Equal(t, nil, writer.Close())
+	assert.Equal(t, "{\"type\":\"archives\",\"data\":\"a\"}\n{\"type\":\"archives\",\"data\":\"b\"}\n", buf.String())
+}
+
+func TestComputeAgreement(t *testing.T) {
+	box := func(x0, y0, x1, y1 float64) []annotation.Point2D {
+		return []annotation.Point2D{{X: x0, Y: y0}, {X: x1, Y: y1}}
+	}
+	input := agreementInput{
+		Labels: []annotation.Label{
+			{ID: "tag", Scope: constants.LabelScopeStudy, AnnotationType: constants.AntnTypeTag},
+			{ID: "box", Scope: constants.LabelScopeImage, AnnotationType: constants.AntnTypeBox},
+			{ID: "image_tag", Scope: constants.LabelScopeImage, AnnotationType: constants.AntnTypeTag},
+		},
+		Annotators: map[string][]string{"s1": {"a", "b"}, "s2": {"a", "b"}, "s3": {"a", "b"}, "s4": {"a", "b"}},
+		Images:     map[string][]string{"s1": {"o1", "o2", "o3"}},
+		Antns: []agreementAntn{
+			{StudyID: "s1", ObjectID: "o1", Annotator: "a", Type: constants.AntnTypeTag, LabelIDs: []string{"image_tag"}},
+			{StudyID: "s1", ObjectID: "o1", Annotator: "b", Type: constants.AntnTypeTag, LabelIDs: []string{"image_tag"}},
+			{StudyID: "s1", ObjectID: "o2", Annotator: "b", Type: constants.AntnTypeTag, LabelIDs: []string{"image_tag"}},
+			{StudyID: "s1", Annotator: "a", Type: constants.AntnTypeTag, LabelIDs: []string{"tag"}},
+			{StudyID: "s1", Annotator: "b", Type: constants.AntnTypeTag, LabelIDs: []string{"tag"}},
+			{StudyID: "s2", Annotator: "a", Type: constants.AntnTypeTag, LabelIDs: []string{"tag"}},
+			{StudyID: "s1", ObjectID: "o1", Annotator: "a", Type: constants.AntnTypeBox, LabelIDs: []string{"box"}, Points: box(0, 0, 10, 10)},
+			{StudyID: "s1", ObjectID: "o1", Annotator: "b", Type: constants.AntnTypeBox, LabelIDs: []string{"box"}, Points: box(0, 0, 10, 8)},
+			{StudyID: "s1", ObjectID: "o1", Annotator: "b", Type: constants.AntnTypeBox, LabelIDs: []string{"box"}, Points: box(50, 50, 60, 60)},
+		},
+	}
+
+	agreement := computeAgreement(input)
+	assert.Equal(t, 4, agreement.Studies)
+	assert.Equal(t, 3, len(agreement.Labels))
+
+	box0 := agreement.Labels[0]
+	assert.Equal(t, "box", box0.LabelID)
+	assert.Equal(t, 1, box0.Matched)
+	assert.Equal(t, 1, box0.Unmatched)
+	assert.Equal(t, 0.8, *box0.MeanIoU)
+
+	// o3 no annotator tagged is an item both agree on
+	imageTag := agreement.Labels[1]
+	assert.Equal(t, 3, imageTag.Items)
+	assert.Equal(t, 2.0/3.0, *imageTag.Pairs[0].ObservedAgreement)
+
+	tag := agreement.Labels[2]
+	assert.Equal(t, 4, tag.Items)
+	assert.Equal(t, 0.75, *tag.Pairs[0].ObservedAgreement)
+	assert.Equal(t, 0.5, *tag.Pairs[0].CohenKappa)
+	assert.Equal(t, [2]string{"a", "b"}, agreement.Pairs[0].AnnotatorIDs)
+}
+
+func TestComputeSLA(t *testing.T) {
+	hour := int64(3600 * 1000)
+	now := 100 * hour
+	task := func(projectID, assigneeID, status string, dueAt int64) study.Task {
+		return study.Task{ProjectID: projectID, AssigneeID: assigneeID, Status: status, DueAt: dueAt}
+	}
+	report := computeSLA([]study.Task{
+		task("p1", "u1", constants.TaskStatusDoing, now-hour),
+		task("p1", "u1", constants.TaskStatusNew, now+2*hour),
+		task("p1", "u2", constants.TaskStatusNew, now+48*hour),
+		task("p1", "u2", constants.TaskStatusCompleted, now-hour),
+		task("p2", "u2", constants.TaskStatusNew, now-2*hour),
+		task("p2", "", constants.TaskStatusNew, now+hour),
+		task("p2", "u3", constants.TaskStatusNew, 0),
+	}, now, DefaultAtRiskHours)
+
+	assert.Equal(t, []SLACount{
+		{ProjectID: "p1", Open: 3, Overdue: 1, AtRisk: 1},
+		{ProjectID: "p2", Open: 2, Overdue: 1, AtRisk: 1},
+	}, report.Projects)
+	assert.Equal(t, []SLACount{
+		{AssigneeID: "u1", Open: 2, Overdue: 1, AtRisk: 1},
+		{AssigneeID: "u2", Open: 2, Overdue: 1},
+		{AssigneeID: "", Open: 1, AtRisk: 1},
+	}, report.Assignees)
+}
+
+func TestExportWorkerPool(t *testing.T) {
+	store := NewLabelExportMemory()
+	started := make(chan bool, 1)
+	stopped := make(chan bool, 1)
+	pool := NewExportWorkerPool(store, func(ctx context.Context, labelExport *LabelExport) error {
+		started <- true
+		select {
+		case <-ctx.Done():
+			stopped <- true
+		case <-time.After(5 * time.Second):
+			stopped <- false
+		}
+		return nil
+	})
+	pool.heartbeat = 10 * time.Millisecond
+
+	// canceled by another instance while running here
+	assert.Equal(t, nil, store.Create(LabelExport{ID: "running", Status: constants.ExportStatusQueued}))
+	go pool.process("running")
+	<-started
+	assert.Equal(t, nil, store.Update(LabelExport{ID: "running"}, kvStr2Inf{"status": constants.ExportStatusCanceled}))
+	assert.Equal(t, true, <-stopped)
+	time.Sleep(50 * time.Millisecond)
+	canceled, _, _ := store.Get(nil, "_id:running")
+	assert.Equal(t, constants.ExportStatusCanceled, canceled.Status)
+	assert.Equal(t, pool.owner, canceled.Owner)
+
+	// running jobs are recovered only once their owner stopped beating
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	assert.Equal(t, nil, store.Create(LabelExport{ID: "alive", Status: constants.ExportStatusRunning, Owner: "other", StartedAt: now - 60000, Heartbeat: now}))
+	assert.Equal(t, nil, store.Create(LabelExport{ID: "stale", Status: constants.ExportStatusRunning, Owner: "other", StartedAt: now - 60000, Heartbeat: now - 60000}))
+	assert.Equal(t, nil, pool.Recover())
+	alive, _, _ := store.Get(nil, "_id:alive")
+	assert.Equal(t, constants.ExportStatusRunning, alive.Status)
+	stale, _, _ := store.Get(nil, "_id:stale")
+	assert.Equal(t, constants.ExportStatusQueued, stale.Status)
+}
+
+// racingLabelExportStore runs race once right after the next Get, as another instance would
+type racingLabelExportStore struct {
+	LabelExportStore
+	race func()
+}
+
+func (store *racingLabelExportStore) Get(queries map[string][]string, qs string) (*LabelExport, *entities.ESReturn, error) {
+	labelExport, esReturn, err := store.LabelExportStore.Get(queries, qs)
+	if store.race != nil {
+		race := store.race
+		store.race = nil
+		race()
+	}
+	return labelExport, esReturn, err
+}
+
+func TestExportWorkerPoolClaim(t *testing.T) {
+	memory := NewLabelExportMemory()
+	store := &racingLabelExportStore{LabelExportStore: memory}
+	runs := make(chan string, 4)
+	pool := NewExportWorkerPool(store, func(ctx context.Context, labelExport *LabelExport) error {
+		runs <- labelExport.ID
+		return nil
+	})
+	pool.heartbeat = 10 * time.Millisecond
+
+	// claimed by another instance between the read and the claim here
+	assert.Equal(t, nil, memory.Create(LabelExport{ID: "claimed", Status: constants.ExportStatusQueued}))
+	store.race = func() {
+		assert.Equal(t, nil, memory.Update(LabelExport{ID: "claimed"}, kvStr2Inf{"status": constants.ExportStatusRunning, "owner": "other"}))
+	}
+	pool.process("claimed")
+	assert.Equal(t, 0, len(runs))
+	claimed, _, _ := memory.Get(nil, "_id:claimed")
+	assert.Equal(t, "other", claimed.Owner)
+	assert.Equal(t, nil, memory.Delete(*claimed))
+
+	// the owner dies after Start, the sweep queues the job again once its heartbeat is stale
+	pool.Start(1)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	assert.Equal(t, nil, memory.Create(LabelExport{ID: "orphan", Status: constants.ExportStatusRunning, Owner: "other", Heartbeat: now}))
+	select {
+	case id := <-runs:
+		assert.Equal(t, "orphan", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the orphan job was not recovered")
+	}
+	time.Sleep(50 * time.Millisecond)
+	orphan, _, _ := memory.Get(nil, "_id:orphan")
+	assert.Equal(t, constants.ExportStatusDone, orphan.Status)
+	assert.Equal(t, pool.owner, orphan.Owner)
+}
+
+// slowPACS answers the tags of every instance after a delay and counts the requests running together
+type slowPACS struct {
+	study.PACS
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (pacs *slowPACS) GetInstanceTags(studyUID, seriesUID, sopUID string) (map[string]string, error) {
+	pacs.mu.Lock()
+	pacs.running++
+	if pacs.running > pacs.most {
+		pacs.most = pacs.running
+	}
+	pacs.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	pacs.mu.Lock()
+	pacs.running--
+	pacs.mu.Unlock()
+	return map[string]string{"Rows": "256", "Columns": "512", "SOPInstanceUID": sopUID}, nil
+}
+
+func TestGetImageSizes(t *testing.T) {
+	projectStore := project.NewProjectMemory()
+	assert.Equal(t, nil, projectStore.Create(project.Project{ID: "p"}))
+	pacs := &slowPACS{}
+	app := &StatsAPI{pacs: study.NewPACSRegistry(pacs, projectStore)}
+
+	file := &exportFile{Objects: make([]object.Object, 0)}
+	for i := 0; i < 4*exportPACSRequests; i++ {
+		file.Objects = append(file.Objects, object.Object{ID: fmt.Sprint(i), Type: constants.ObjectTypeImage,
+			Meta: &entities.MetaData{SOPInstanceUID: fmt.Sprintf("sop%d", i)}})
+	}
+	file.Objects = append(file.Objects, object.Object{ID: "study", Type: constants.ObjectTypeStudy, Meta: &entities.MetaData{}})
+
+	sizes, err := app.getImageSizes(context.Background(), "p", file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4*exportPACSRequests, len(sizes))
+	assert.Equal(t, imageSize{width: 512, height: 256}, sizes["sop3"])
+	// the images are read in parallel, never more than exportPACSRequests at a time
+	assert.Equal(t, true, pacs.most > 1)
+	assert.Equal(t, true, pacs.most <= exportPACSRequests)
+}
+
+func TestBuildSR(t *testing.T) {
+	export := &dicomExport{
+		file:     &exportFile{},
+		images:   map[string]*dicomImage{},
+		mapLabel: map[string]annotation.Label{"label": {ID: "label", Name: "Nodule"}},
+	}
+	studyObject := object.Object{ID: "study", Type: constants.ObjectTypeStudy, Meta: &entities.MetaData{StudyInstanceUID: "1.2"}}
+	f, err := export.buildSR(studyObject, []annotation.Annotation{{ID: "tag", ObjectID: "study", LabelIDs: []string{"label"}}})
+	assert.Equal(t, nil, err)
+
+	// the concept names of the content items of the root container, in order
+	concepts := make([]string, 0)
+	for _, element := range f.Dataset {
+		if element.Tag != dicom.Tag(0x0040, 0xA730) {
+			continue
+		}
+		for _, item := range element.Value.([]dicom.Dataset) {
+			for _, itemElement := range item {
+				if itemElement.Tag == dicom.Tag(0x0040, 0xA043) {
+					concepts = append(concepts, itemElement.Value.([]dicom.Dataset)[0][0].Value.(string))
+				}
+			}
+		}
+	}
+	assert.Equal(t, []string{dcmCodeLanguage.Value, dcmCodeObserverType.Value, dcmCodeDeviceUID.Value, dcmCodeDeviceName.Value,
+		dcmCodeProcedure.Value, dcmCodeQualitative.Value}, concepts)
+
+	_, err = f.Encode(func(uid string) string { return uid })
+	assert.Equal(t, nil, err)
+}
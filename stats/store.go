@@ -0,0 +1,20 @@
+package stats
+
+import (
+	"vindr-lab-api/entities"
+)
+
+// LabelExportStore is implemented by LabelExportES and LabelExportMemory
+type LabelExportStore interface {
+	Create(exportLabel LabelExport) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]LabelExport, *entities.ESReturn, error)
+	Get(queries map[string][]string, qs string) (*LabelExport, *entities.ESReturn, error)
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(labelExports []LabelExport, es entities.ESReturn)) error
+	Update(labelExport LabelExport, update map[string]interface{}) error
+	Delete(label LabelExport) error
+}
+
+var (
+	_ LabelExportStore = (*LabelExportES)(nil)
+	_ LabelExportStore = (*LabelExportMemory)(nil)
+)
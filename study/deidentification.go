@@ -0,0 +1,36 @@
+package study
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DeidentificationMapping an original value of an attribute of the DICOM files
+// of a project and the value it was masked with. The mappings are kept apart
+// from the studies, no route reads them
+type DeidentificationMapping struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Tag       string `json:"tag"`
+	Original  string `json:"original"`
+	Masked    string `json:"masked"`
+	Created   int64  `json:"created"`
+}
+
+func NewDeidentificationMapping(projectID, tag, original, masked string) DeidentificationMapping {
+	return DeidentificationMapping{
+		// the same value masked twice is kept once
+		ID:        fmt.Sprintf("%s_%s_%s", projectID, tag, masked),
+		ProjectID: projectID,
+		Tag:       tag,
+		Original:  original,
+		Masked:    masked,
+		Created:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (mapping *DeidentificationMapping) String() string {
+	b, _ := json.Marshal(mapping)
+	return string(b)
+}
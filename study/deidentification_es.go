@@ -0,0 +1,117 @@
+package study
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"go.uber.org/zap"
+)
+
+// DeidentificationES keeps the mappings in an index of their own, which only
+// the server should be allowed to read
+type DeidentificationES struct {
+	esClient  *elasticsearch.Client
+	indexName string
+	logger    *zap.Logger
+}
+
+func NewDeidentificationStore(client *elasticsearch.Client, indexName string, logger *zap.Logger) *DeidentificationES {
+	return &DeidentificationES{
+		client, indexName, logger,
+	}
+}
+
+// BulkCreate indexes the mappings in one request
+func (store *DeidentificationES) BulkCreate(mappings []DeidentificationMapping) error {
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, mapping := range mappings {
+		meta := fmt.Sprintf(`{ "index" : { "_index" : "%s", "_id" : "%s" } }%s`, store.indexName, mapping.ID, "\n")
+		buf.WriteString(meta)
+		buf.WriteString(mapping.String())
+		buf.WriteString("\n")
+	}
+
+	es := store.esClient
+	res, err := es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithContext(context.Background()), es.Bulk.WithRefresh("true"))
+	if err != nil {
+		return fmt.Errorf("BulkRequest ERROR: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR indexing de-identification mappings", res.Status())
+	}
+
+	var blk entities.ESBulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		return fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	if blk.Errors {
+		for _, d := range blk.Items {
+			if d.Index.Status > 201 {
+				return fmt.Errorf("[%d] %s: %s", d.Index.Status, d.Index.Error.Type, d.Index.Error.Reason)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetSlice function
+func (store *DeidentificationES) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]DeidentificationMapping, *entities.ESReturn, error) {
+	es := store.esClient
+
+	var (
+		esReturn entities.ESReturn
+		esError  entities.ESError
+		buf      bytes.Buffer
+	)
+
+	body := utils.ConvertInputsToESQueryBody(queries, qs, from, size, sort, nil)
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, nil, fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(store.indexName),
+		es.Search.WithBody(&buf),
+		es.Search.WithTrackTotalHits(true),
+		es.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if err := json.NewDecoder(res.Body).Decode(&esError); err != nil {
+			return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+		}
+		return nil, nil, fmt.Errorf("[%s] %s: %s", res.Status(), esError.Error.Type, esError.Error.Reason)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&esReturn); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	mappings := make([]DeidentificationMapping, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var mapping DeidentificationMapping
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &mapping); err == nil {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, &esReturn, nil
+}
@@ -0,0 +1,45 @@
+package study
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// DeidentificationMemory keeps de-identification mappings in memory
+type DeidentificationMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewDeidentificationMemory() *DeidentificationMemory {
+	return &DeidentificationMemory{utils.NewMemoryIndex("deidentification")}
+}
+
+// BulkCreate function
+func (store *DeidentificationMemory) BulkCreate(mappings []DeidentificationMapping) error {
+	for _, mapping := range mappings {
+		if err := store.index.Index(mapping.ID, mapping, entities.Revision{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *DeidentificationMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]DeidentificationMapping, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mappings := make([]DeidentificationMapping, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var mapping DeidentificationMapping
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &mapping); err == nil {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, esReturn, nil
+}
@@ -0,0 +1,53 @@
+package study
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/constants"
+
+	"github.com/google/uuid"
+)
+
+// IngestJob a DICOM upload of a project, the files are stored in the PACS of
+// the project then their studies and objects are created. Status stays
+// RUNNING until every file was read, DONE even when some files had Errors
+type IngestJob struct {
+	ID             string            `json:"id"`
+	ProjectID      string            `json:"project_id"`
+	CreatorID      string            `json:"creator_id"`
+	Created        int64             `json:"created"`
+	Modified       int64             `json:"modified,omitempty"`
+	FinishedAt     int64             `json:"finished_at,omitempty"`
+	Status         string            `json:"status"`
+	TotalFiles     int               `json:"total_files"`
+	ProcessedFiles int               `json:"processed_files"`
+	StudyIDs       []string          `json:"study_ids"`
+	Objects        int               `json:"objects"`
+	Errors         []IngestFileError `json:"errors"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// IngestFileError a file that was not ingested, files of a ZIP are named
+// archive/path/in/archive
+type IngestFileError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+func NewIngestJob(projectID, creatorID string) IngestJob {
+	return IngestJob{
+		ID:        uuid.New().String(),
+		ProjectID: projectID,
+		CreatorID: creatorID,
+		Created:   time.Now().UnixNano() / int64(time.Millisecond),
+		Status:    constants.IngestStatusRunning,
+		StudyIDs:  make([]string, 0),
+		Errors:    make([]IngestFileError, 0),
+	}
+}
+
+func (job *IngestJob) String() string {
+	b, _ := json.Marshal(job)
+	return string(b)
+}
@@ -0,0 +1,143 @@
+package study
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"go.uber.org/zap"
+)
+
+type IngestJobES struct {
+	esClient    *elasticsearch.Client
+	indexPrefix string
+	logger      *zap.Logger
+}
+
+func NewIngestJobStore(client *elasticsearch.Client, indexPrefix string, logger *zap.Logger) *IngestJobES {
+	return &IngestJobES{
+		client, indexPrefix, logger,
+	}
+}
+
+func (store *IngestJobES) getIndexName(job IngestJob) string {
+	indexTime := utils.ConvertTimeStampToTime(job.Created)
+	return fmt.Sprintf("%s_%d%02d", store.indexPrefix, indexTime.Year(), indexTime.Month())
+}
+
+// Create function
+func (store *IngestJobES) Create(job IngestJob) error {
+	req := esapi.IndexRequest{
+		Index:      store.getIndexName(job),
+		DocumentID: job.ID,
+		Body:       strings.NewReader(job.String()),
+		Refresh:    "true",
+	}
+
+	res, err := req.Do(context.Background(), store.esClient.Transport)
+	if err != nil {
+		return fmt.Errorf("IndexRequest ERROR: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR indexing document ID=%s", res.Status(), job.ID)
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *IngestJobES) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]IngestJob, *entities.ESReturn, error) {
+	es := store.esClient
+
+	var (
+		esReturn entities.ESReturn
+		esError  entities.ESError
+		buf      bytes.Buffer
+	)
+
+	body := utils.ConvertInputsToESQueryBody(queries, qs, from, size, sort, nil)
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, nil, fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(fmt.Sprintf("%s_*", store.indexPrefix)),
+		es.Search.WithBody(&buf),
+		es.Search.WithTrackTotalHits(true),
+		es.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if err := json.NewDecoder(res.Body).Decode(&esError); err != nil {
+			return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+		}
+		return nil, nil, fmt.Errorf("[%s] %s: %s", res.Status(), esError.Error.Type, esError.Error.Reason)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&esReturn); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	jobs := make([]IngestJob, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var job IngestJob
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, &esReturn, nil
+}
+
+// Get function
+func (store *IngestJobES) Get(queries map[string][]string, qs string) (*IngestJob, *entities.ESReturn, error) {
+	jobs, esReturn, err := store.GetSlice(queries, qs, 0, 1, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, esReturn, utils.ErrNotFound
+	}
+	return &jobs[0], esReturn, nil
+}
+
+// Update function
+func (store *IngestJobES) Update(job IngestJob, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(kvStr2Inf{"doc": update}); err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+	req := esapi.UpdateRequest{
+		Index:      store.getIndexName(job),
+		DocumentID: job.ID,
+		Refresh:    "true",
+		Body:       &buf,
+	}
+
+	res, err := req.Do(context.Background(), store.esClient)
+	if err != nil {
+		return fmt.Errorf("UpdateRequest ERROR: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR updating document ID=%s", res.Status(), job.ID)
+	}
+	return nil
+}
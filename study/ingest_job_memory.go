@@ -0,0 +1,59 @@
+package study
+
+import (
+	"encoding/json"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// IngestJobMemory keeps ingest jobs in memory
+type IngestJobMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewIngestJobMemory() *IngestJobMemory {
+	return &IngestJobMemory{utils.NewMemoryIndex("ingest_job")}
+}
+
+// Create function
+func (store *IngestJobMemory) Create(job IngestJob) error {
+	return store.index.Index(job.ID, job, entities.Revision{})
+}
+
+// GetSlice function
+func (store *IngestJobMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]IngestJob, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jobs := make([]IngestJob, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var job IngestJob
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, esReturn, nil
+}
+
+// Get function
+func (store *IngestJobMemory) Get(queries map[string][]string, qs string) (*IngestJob, *entities.ESReturn, error) {
+	jobs, esReturn, err := store.GetSlice(queries, qs, 0, 1, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, esReturn, utils.ErrNotFound
+	}
+	return &jobs[0], esReturn, nil
+}
+
+// Update function
+func (store *IngestJobMemory) Update(job IngestJob, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(job.ID, update, entities.Revision{})
+}
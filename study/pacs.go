@@ -0,0 +1,98 @@
+package study
+
+import (
+	"fmt"
+	"sort"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/project"
+)
+
+// PACS keeps the DICOM files of the studies. The studies uploaded to a
+// project are stored with their UIDs prefixed by its ID
+type PACS interface {
+	HasStudy(studyUID string) (bool, error)
+	DeleteStudyByUID(studyUID string) error
+	// StoreInstance stores a DICOM Part 10 file
+	StoreInstance(data []byte) error
+	// GetInstanceTags the text values of the instance by DICOM keyword
+	GetInstanceTags(studyUID, seriesUID, sopUID string) (map[string]string, error)
+	// ListStudies the StudyInstanceUID of every study
+	ListStudies() ([]string, error)
+	ListStudyInstances(studyUID string) ([]PACSInstance, error)
+}
+
+// PACSInstance the UIDs of an instance of a study
+type PACSInstance struct {
+	SeriesInstanceUID string
+	SOPInstanceUID    string
+}
+
+var (
+	_ PACS = (*StudyOrthanC)(nil)
+	_ PACS = (*DICOMweb)(nil)
+)
+
+// PACSRegistry the PACS configured on the server, a project uses the one its
+// PACS field names or the default one
+type PACSRegistry struct {
+	defaultPACS  PACS
+	byName       map[string]PACS
+	projectStore project.ProjectStore
+}
+
+func NewPACSRegistry(defaultPACS PACS, projectStore project.ProjectStore) *PACSRegistry {
+	return &PACSRegistry{
+		defaultPACS:  defaultPACS,
+		byName:       map[string]PACS{constants.PACSOrthanc: defaultPACS},
+		projectStore: projectStore,
+	}
+}
+
+// Add a PACS projects can name
+func (registry *PACSRegistry) Add(name string, pacs PACS) {
+	registry.byName[name] = pacs
+}
+
+// Names the PACS projects can name
+func (registry *PACSRegistry) Names() []string {
+	names := make([]string, 0, len(registry.byName))
+	for name := range registry.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get the PACS of the name, the default one when it is empty
+func (registry *PACSRegistry) Get(name string) (PACS, error) {
+	if name == "" {
+		return registry.defaultPACS, nil
+	}
+	pacs, found := registry.byName[name]
+	if !found {
+		return nil, fmt.Errorf("PACS %s is not configured", name)
+	}
+	return pacs, nil
+}
+
+// ForProject the PACS of the project
+func (registry *PACSRegistry) ForProject(projectID string) (PACS, error) {
+	p, _, err := registry.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("project %s not found", projectID)
+	}
+	return registry.Get(p.PACS)
+}
+
+// deleteStudyFiles removes the files of the study from the PACS of its project
+func (registry *PACSRegistry) deleteStudyFiles(s Study) error {
+	pacs, err := registry.ForProject(s.ProjectID)
+	if err != nil {
+		return err
+	}
+	return pacs.DeleteStudyByUID(fmt.Sprintf("%s.%s", s.ProjectID, s.DICOMTags.StudyInstanceUID[0]))
+}
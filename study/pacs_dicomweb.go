@@ -0,0 +1,256 @@
+package study
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"vindr-lab-api/entities"
+
+	"github.com/gojektech/heimdall/v6/httpclient"
+)
+
+// DICOMweb a PACS reached through the QIDO-RS, WADO-RS and STOW-RS services of
+// DICOM PS3.18 at uri. A study is deleted by a DELETE on its WADO-RS URL, which
+// not every PACS allows
+type DICOMweb struct {
+	uri        string
+	httpClient *httpclient.Client
+}
+
+// dicomJSONAttribute an attribute of the DICOM JSON model of PS3.18 F.2
+type dicomJSONAttribute struct {
+	VR    string        `json:"vr"`
+	Value []interface{} `json:"Value,omitempty"`
+}
+
+func NewDICOMweb(uri string) *DICOMweb {
+	return &DICOMweb{
+		uri: strings.TrimRight(uri, "/"),
+		httpClient: httpclient.NewClient(
+			httpclient.WithHTTPTimeout(5000*time.Millisecond),
+			httpclient.WithRetryCount(3),
+		),
+	}
+}
+
+// HasStudy searches the study with QIDO-RS
+func (dicomweb *DICOMweb) HasStudy(studyUID string) (bool, error) {
+	query := url.Values{"StudyInstanceUID": {studyUID}, "includefield": {"0020000D"}}
+	studies, err := dicomweb.search(fmt.Sprintf("%s/studies?%s", dicomweb.uri, query.Encode()))
+	if err != nil {
+		return false, err
+	}
+	return len(studies) > 0, nil
+}
+
+// ListStudies implements PACS, searching every study with QIDO-RS by pages
+func (dicomweb *DICOMweb) ListStudies() ([]string, error) {
+	const page = 1000
+	uids := make([]string, 0)
+	for offset := 0; ; offset += page {
+		query := url.Values{"includefield": {"0020000D"}, "limit": {strconv.Itoa(page)}, "offset": {strconv.Itoa(offset)}}
+		studies, err := dicomweb.search(fmt.Sprintf("%s/studies?%s", dicomweb.uri, query.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		for _, study := range studies {
+			if uid := dicomJSONTags(study)["StudyInstanceUID"]; uid != "" {
+				uids = append(uids, uid)
+			}
+		}
+		if len(studies) < page {
+			return uids, nil
+		}
+	}
+}
+
+// ListStudyInstances implements PACS
+func (dicomweb *DICOMweb) ListStudyInstances(studyUID string) ([]PACSInstance, error) {
+	query := url.Values{"includefield": {"0020000E", "00080018"}}
+	found, err := dicomweb.search(fmt.Sprintf("%s/studies/%s/instances?%s", dicomweb.uri, url.PathEscape(studyUID), query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]PACSInstance, 0, len(found))
+	for _, instance := range found {
+		tags := dicomJSONTags(instance)
+		instances = append(instances, PACSInstance{SeriesInstanceUID: tags["SeriesInstanceUID"], SOPInstanceUID: tags["SOPInstanceUID"]})
+	}
+	return instances, nil
+}
+
+// search the QIDO-RS uri, no content is an empty result
+func (dicomweb *DICOMweb) search(uri string) ([]map[string]dicomJSONAttribute, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dicom+json")
+	res, err := dicomweb.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	results := make([]map[string]dicomJSONAttribute, 0)
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return results, nil
+	case http.StatusOK:
+	default:
+		return nil, errors.New(res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	return results, nil
+}
+
+// DeleteStudyByUID implements PACS
+func (dicomweb *DICOMweb) DeleteStudyByUID(studyUID string) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/studies/%s", dicomweb.uri, url.PathEscape(studyUID)), nil)
+	if err != nil {
+		return err
+	}
+	res, err := dicomweb.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNoContent {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+// StoreInstance stores the file with STOW-RS
+func (dicomweb *DICOMweb) StoreInstance(data []byte) error {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+	part, err := body.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/studies", dicomweb.uri), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf(`multipart/related; type="application/dicom"; boundary=%s`, body.Boundary()))
+	req.Header.Set("Accept", "application/dicom+json")
+	res, err := dicomweb.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// 202 the instance was stored with warnings
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+// GetInstanceTags reads the metadata of the instance with WADO-RS, only the
+// attributes of entities.DICOMDictionary are named
+func (dicomweb *DICOMweb) GetInstanceTags(studyUID, seriesUID, sopUID string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/studies/%s/series/%s/instances/%s/metadata", dicomweb.uri,
+		url.PathEscape(studyUID), url.PathEscape(seriesUID), url.PathEscape(sopUID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dicom+json")
+	res, err := dicomweb.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	instances := make([]map[string]dicomJSONAttribute, 0)
+	if err := json.NewDecoder(res.Body).Decode(&instances); err != nil {
+		return nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	if len(instances) == 0 {
+		return nil, errors.New("[MANUAL] Data is empty")
+	}
+	return dicomJSONTags(instances[0]), nil
+}
+
+// dicomJSONTags the text of the attributes of the dictionary, values are
+// separated by a backslash and person names are their alphabetic group
+func dicomJSONTags(dataset map[string]dicomJSONAttribute) map[string]string {
+	tags := make(map[string]string)
+	for key, attribute := range dataset {
+		tag, err := strconv.ParseUint(key, 16, 32)
+		if err != nil {
+			continue
+		}
+		keyword, found := entities.DICOMKeywords[uint32(tag)]
+		if !found {
+			continue
+		}
+		values := make([]string, 0, len(attribute.Value))
+		for _, value := range attribute.Value {
+			switch v := value.(type) {
+			case string:
+				values = append(values, v)
+			case float64:
+				values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+			case map[string]interface{}:
+				if name, ok := v["Alphabetic"].(string); ok {
+					values = append(values, name)
+				}
+			}
+		}
+		if value := strings.Join(values, "\\"); value != "" {
+			tags[keyword] = value
+		}
+	}
+	return tags
+}
+
+// newDICOMJSON the DICOM JSON of the tags of the dictionary
+func newDICOMJSON(tags map[string]string) map[string]dicomJSONAttribute {
+	dataset := make(map[string]dicomJSONAttribute)
+	for keyword, text := range tags {
+		attribute, found := entities.DICOMDictionary[keyword]
+		if !found {
+			continue
+		}
+		values := make([]interface{}, 0)
+		for _, value := range strings.Split(text, "\\") {
+			switch attribute.VR {
+			case "US", "IS", "DS":
+				if number, err := strconv.ParseFloat(value, 64); err == nil {
+					values = append(values, number)
+				}
+			case "PN":
+				values = append(values, map[string]interface{}{"Alphabetic": value})
+			default:
+				values = append(values, value)
+			}
+		}
+		dataset[fmt.Sprintf("%08X", attribute.Tag)] = dicomJSONAttribute{VR: attribute.VR, Value: values}
+	}
+	return dataset
+}
@@ -0,0 +1,157 @@
+package study
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"vindr-lab-api/utils"
+	"vindr-lab-api/utils/dicom"
+)
+
+// FakeDICOMweb an in-process DICOMweb server keeping the instances in memory,
+// for tests. It searches studies, optionally by StudyInstanceUID, and the
+// instances of a study, stores, deletes studies and returns the metadata of
+// an instance
+type FakeDICOMweb struct {
+	mu        sync.Mutex
+	instances map[string]fakeDICOMwebInstance
+}
+
+type fakeDICOMwebInstance struct {
+	studyUID  string
+	seriesUID string
+	tags      map[string]string
+}
+
+func NewFakeDICOMweb() *FakeDICOMweb {
+	return &FakeDICOMweb{instances: make(map[string]fakeDICOMwebInstance)}
+}
+
+// Tags the tags of the stored instance, nil when it is not stored
+func (fake *FakeDICOMweb) Tags(sopUID string) map[string]string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.instances[sopUID].tags
+}
+
+// Count the stored instances
+func (fake *FakeDICOMweb) Count() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.instances)
+}
+
+func (fake *FakeDICOMweb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "studies" && r.Method == http.MethodPost:
+		fake.store(w, r)
+	case len(parts) == 1 && parts[0] == "studies" && r.Method == http.MethodGet:
+		studyUID := r.URL.Query().Get("StudyInstanceUID")
+		studyUIDs := make([]string, 0)
+		for _, instance := range fake.instances {
+			if _, found := utils.FindInSlice(studyUIDs, instance.studyUID); !found && (studyUID == "" || instance.studyUID == studyUID) {
+				studyUIDs = append(studyUIDs, instance.studyUID)
+			}
+		}
+		sort.Strings(studyUIDs)
+		if offset, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && offset < len(studyUIDs) {
+			studyUIDs = studyUIDs[offset:]
+		} else if err == nil {
+			studyUIDs = nil
+		}
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit < len(studyUIDs) {
+			studyUIDs = studyUIDs[:limit]
+		}
+		studies := make([]map[string]dicomJSONAttribute, 0)
+		for _, uid := range studyUIDs {
+			studies = append(studies, newDICOMJSON(map[string]string{"StudyInstanceUID": uid}))
+		}
+		fake.writeResults(w, studies)
+	case len(parts) == 3 && parts[0] == "studies" && parts[2] == "instances" && r.Method == http.MethodGet:
+		instances := make([]map[string]dicomJSONAttribute, 0)
+		for sopUID, instance := range fake.instances {
+			if instance.studyUID == parts[1] {
+				instances = append(instances, newDICOMJSON(map[string]string{
+					"StudyInstanceUID": instance.studyUID, "SeriesInstanceUID": instance.seriesUID, "SOPInstanceUID": sopUID,
+				}))
+			}
+		}
+		fake.writeResults(w, instances)
+	case len(parts) == 2 && parts[0] == "studies" && r.Method == http.MethodDelete:
+		deleted := false
+		for sopUID, instance := range fake.instances {
+			if instance.studyUID == parts[1] {
+				delete(fake.instances, sopUID)
+				deleted = true
+			}
+		}
+		if !deleted {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 7 && parts[0] == "studies" && parts[6] == "metadata" && r.Method == http.MethodGet:
+		instance, found := fake.instances[parts[5]]
+		if !found || instance.studyUID != parts[1] || instance.seriesUID != parts[3] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dicom+json")
+		json.NewEncoder(w).Encode([]map[string]dicomJSONAttribute{newDICOMJSON(instance.tags)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// writeResults answers a search, without content when nothing matched
+func (fake *FakeDICOMweb) writeResults(w http.ResponseWriter, results []map[string]dicomJSONAttribute) {
+	if len(results) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dicom+json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// store the DICOM files of a STOW-RS request
+func (fake *FakeDICOMweb) store(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, err := dicom.ParseFile(data)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		tags := file.Tags()
+		fake.instances[tags["SOPInstanceUID"]] = fakeDICOMwebInstance{
+			studyUID:  tags["StudyInstanceUID"],
+			seriesUID: tags["SeriesInstanceUID"],
+			tags:      tags,
+		}
+	}
+	w.Header().Set("Content-Type", "application/dicom+json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,102 @@
+package study
+
+import (
+	"database/sql"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// StudyStore is implemented by StudyES, StudyMemory and StudySQL
+type StudyStore interface {
+	Create(study Study) error
+	Get(queries map[string][]string, qs string) (*Study, *entities.ESReturn, error)
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Study, *entities.ESReturn, error)
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(studies []Study, es entities.ESReturn)) error
+	Scroll(queries map[string][]string, qs string, size int, sort string, f func(studies []Study, es entities.ESReturn) error) error
+	Delete(queries map[string][]string, qs string) error
+	Update(study Study, update map[string]interface{}) error
+}
+
+// TaskStore is implemented by TaskES, TaskMemory and TaskSQL
+type TaskStore interface {
+	Create(task Task) error
+	Bulk(tasks []Task) error
+	Get(queries map[string][]string, qs string) (*Task, *entities.ESReturn, error)
+	Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(tasks []Task, es entities.ESReturn)) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Task, *entities.ESReturn, error)
+	Delete(queries map[string][]string, qs string) error
+	Update(task Task, update map[string]interface{}) error
+}
+
+// TaskEventStore is implemented by TaskEventES and TaskEventMemory
+type TaskEventStore interface {
+	BulkCreate(events []TaskEvent) error
+	Query(queries map[string][]string, qs string, from, size int, sort string, f func([]TaskEvent, entities.ESReturn)) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]TaskEvent, *entities.ESReturn, error)
+}
+
+// IngestJobStore is implemented by IngestJobES and IngestJobMemory, Update
+// needs the Created of the job
+type IngestJobStore interface {
+	Create(job IngestJob) error
+	Get(queries map[string][]string, qs string) (*IngestJob, *entities.ESReturn, error)
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]IngestJob, *entities.ESReturn, error)
+	Update(job IngestJob, update map[string]interface{}) error
+}
+
+// DeidentificationStore is implemented by DeidentificationES and
+// DeidentificationMemory
+type DeidentificationStore interface {
+	BulkCreate(mappings []DeidentificationMapping) error
+	GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]DeidentificationMapping, *entities.ESReturn, error)
+}
+
+var (
+	_ StudyStore = (*StudyES)(nil)
+	_ StudyStore = (*StudyMemory)(nil)
+	_ StudyStore = (*StudySQL)(nil)
+	_ TaskStore  = (*TaskES)(nil)
+	_ TaskStore  = (*TaskMemory)(nil)
+	_ TaskStore  = (*TaskSQL)(nil)
+
+	_ TaskEventStore = (*TaskEventES)(nil)
+	_ TaskEventStore = (*TaskEventMemory)(nil)
+	_ IngestJobStore = (*IngestJobES)(nil)
+	_ IngestJobStore = (*IngestJobMemory)(nil)
+
+	_ DeidentificationStore = (*DeidentificationES)(nil)
+	_ DeidentificationStore = (*DeidentificationMemory)(nil)
+)
+
+// Transactor runs f on task and study stores whose writes are applied all
+// together or not at all, when the backend supports it
+type Transactor interface {
+	InTransaction(f func(taskStore TaskStore, studyStore StudyStore) error) error
+}
+
+// storeTransactor Elasticsearch and the memory stores have no transactions,
+// f writes straight through the stores
+type storeTransactor struct {
+	taskStore  TaskStore
+	studyStore StudyStore
+}
+
+func (t storeTransactor) InTransaction(f func(taskStore TaskStore, studyStore StudyStore) error) error {
+	return f(t.taskStore, t.studyStore)
+}
+
+// SQLTransactor runs f in a database transaction, rolled back when f fails
+type SQLTransactor struct {
+	db *sql.DB
+}
+
+func NewSQLTransactor(db *sql.DB) *SQLTransactor {
+	return &SQLTransactor{db}
+}
+
+func (t *SQLTransactor) InTransaction(f func(taskStore TaskStore, studyStore StudyStore) error) error {
+	return utils.InSQLTx(t.db, func(tx *sql.Tx) error {
+		return f(NewTaskSQL(tx), NewStudySQL(tx))
+	})
+}
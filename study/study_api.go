@@ -2,43 +2,69 @@ package study
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"vindr-lab-api/constants"
 	"vindr-lab-api/entities"
+	"vindr-lab-api/helper"
 	"vindr-lab-api/mw"
 	"vindr-lab-api/object"
 	"vindr-lab-api/project"
 	"vindr-lab-api/utils"
 
+	"github.com/bsm/redislock"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 type StudyAPI struct {
-	studyStore   *StudyES
-	taskStore    *TaskES
-	projectStore *project.ProjectES
-	objectStore  *object.ObjectES
-	studyOrthanC *StudyOrthanC
+	studyStore   StudyStore
+	taskStore    TaskStore
+	projectStore project.ProjectStore
+	objectStore  object.ObjectStore
+	pacs         *PACSRegistry
 	Logger       *zap.Logger
+
+	idGenerator    *helper.IDGenerator
+	ingestJobStore IngestJobStore
+	// ingests serializes the creation of the studies of upload jobs
+	ingests sync.Mutex
+
+	deidentificationStore DeidentificationStore
+	deidentificationKey   []byte
+
+	locker *redislock.Client
+	// reconciling keeps one reconciliation running at a time in this server
+	reconciling      sync.Mutex
+	reconcileRunning bool
 }
 
-func NewStudyAPI(studyStore *StudyES, taskStore *TaskES, projectStore *project.ProjectES, objectStore *object.ObjectES, studyOrthanC *StudyOrthanC, logger *zap.Logger) (app *StudyAPI) {
+func NewStudyAPI(studyStore StudyStore, taskStore TaskStore, projectStore project.ProjectStore, objectStore object.ObjectStore, pacs PACS, logger *zap.Logger) (app *StudyAPI) {
 	app = &StudyAPI{
 		studyStore:   studyStore,
 		taskStore:    taskStore,
 		projectStore: projectStore,
 		objectStore:  objectStore,
-		studyOrthanC: studyOrthanC,
+		pacs:         NewPACSRegistry(pacs, projectStore),
 		Logger:       logger,
+
+		ingestJobStore:        NewIngestJobMemory(),
+		deidentificationStore: NewDeidentificationMemory(),
 	}
 	return app
 }
 
+// SetPACSRegistry the PACS the projects can use, only the one given to
+// NewStudyAPI by default
+func (app *StudyAPI) SetPACSRegistry(registry *PACSRegistry) {
+	app.pacs = registry
+}
+
 func (app *StudyAPI) InitRoute(engine *gin.Engine, path string) {
 	group := engine.Group(path, mw.WrapAuthInfo(app.Logger))
 	group.GET("", mw.ValidPerms(path, mw.PERM_R), app.FetchStudy)
@@ -46,6 +72,11 @@ func (app *StudyAPI) InitRoute(engine *gin.Engine, path string) {
 	group.GET("/:id", mw.ValidPerms(path, mw.PERM_R), app.GetStudy)
 	group.PUT("/:id", mw.ValidPerms(path, mw.PERM_U), app.UpdateStudy)
 	group.POST("/delete_many", mw.ValidPerms(path, mw.PERM_D), app.DeleteManyStudies)
+	group.POST("/upload", mw.ValidPerms(path, mw.PERM_C), app.UploadStudies)
+	group.GET("/upload/:id", mw.ValidPerms(path, mw.PERM_R), app.GetIngestJob)
+	group.GET("/phi_check", mw.ValidPerms(path, mw.PERM_R), app.CheckPHI)
+	group.GET("/reconciliation", mw.ValidPerms(path, mw.PERM_R), app.GetReconciliation)
+	group.POST("/reconciliation", mw.ValidPerms(path, mw.PERM_D), app.RepairReconciliation)
 }
 
 func (app *StudyAPI) FetchStudy(c *gin.Context) {
@@ -96,6 +127,11 @@ func (app *StudyAPI) GetStudy(c *gin.Context) {
 	}
 
 	study, _, err := app.studyStore.Get(nil, fmt.Sprintf("_id:%s", studyID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -103,14 +139,23 @@ func (app *StudyAPI) GetStudy(c *gin.Context) {
 		return
 	}
 
-	oStudyID, err := app.studyOrthanC.FindObjectByUID("Study", fmt.Sprintf("%s.%s", study.ProjectID, study.DICOMTags.StudyInstanceUID[0]))
+	pacs, err := app.pacs.ForProject(study.ProjectID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	found, err := pacs.HasStudy(fmt.Sprintf("%s.%s", study.ProjectID, study.DICOMTags.StudyInstanceUID[0]))
+	if err == nil && !found {
+		err = fmt.Errorf("study %s is not in the PACS", study.ID)
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
-	utils.LogInfo(oStudyID)
 
 	resp.Data = study
 
@@ -236,6 +281,11 @@ func (app *StudyAPI) DeleteStudy(c *gin.Context) {
 	}
 
 	study, _, err := app.studyStore.Get(nil, fmt.Sprintf("_id:%s AND status.keyword:%s", studyID, constants.StudyStatusUnassigned))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -243,12 +293,6 @@ func (app *StudyAPI) DeleteStudy(c *gin.Context) {
 		return
 	}
 
-	if study == nil {
-		resp.ErrorCode = constants.ServerInvalidData
-		c.JSON(http.StatusBadRequest, resp)
-		return
-	}
-
 	err = app.studyStore.Delete(nil, fmt.Sprintf("_id:%s AND status.keyword:%s", studyID, constants.StudyStatusUnassigned))
 	if err != nil {
 		resp.ErrorCode = constants.ServerError
@@ -266,8 +310,9 @@ func (app *StudyAPI) DeleteStudy(c *gin.Context) {
 	// go func() {
 	// 	//delete dicom file from orthanc
 	// }()
-	err = app.studyOrthanC.DeleteDicomFile(app.studyOrthanC, *study)
+	err = app.pacs.deleteStudyFiles(*study)
 	if err != nil {
+		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
 		return
@@ -335,7 +380,7 @@ func (app *StudyAPI) DeleteManyStudies(c *gin.Context) {
 	// 	return
 	// }
 
-	deleted, err := DeleteStudies(studyIDs, app.studyStore, app.taskStore, app.objectStore, app.studyOrthanC)
+	deleted, err := DeleteStudies(studyIDs, app.studyStore, app.taskStore, app.objectStore, app.pacs)
 
 	resp.Meta = &kvStr2Inf{
 		"deleted":     deleted,
@@ -351,7 +396,7 @@ func (app *StudyAPI) DeleteManyStudies(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-func DeleteStudies(studyIDs []string, studyStore *StudyES, taskStore *TaskES, objectStore *object.ObjectES, studyOrthanC *StudyOrthanC) (int, error) {
+func DeleteStudies(studyIDs []string, studyStore StudyStore, taskStore TaskStore, objectStore object.ObjectStore, pacs *PACSRegistry) (int, error) {
 	deleted := 0
 
 	for i := range studyIDs {
@@ -382,7 +427,7 @@ func DeleteStudies(studyIDs []string, studyStore *StudyES, taskStore *TaskES, ob
 			return deleted, err
 		}
 
-		err = studyOrthanC.DeleteDicomFile(studyOrthanC, *s)
+		err = pacs.deleteStudyFiles(*s)
 		if err != nil {
 			utils.LogError(err)
 		}
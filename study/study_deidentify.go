@@ -0,0 +1,271 @@
+package study
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+	"vindr-lab-api/utils/dicom"
+
+	"github.com/gin-gonic/gin"
+)
+
+// phiFindingsLimit findings listed by a PHI check, the others are only counted
+const phiFindingsLimit = 100
+
+// PHIFinding an attribute of a study that may identify its patient, Reason
+// PRESENT when the profile removes it, NOT_MASKED when the value is not one
+// the project masked
+type PHIFinding struct {
+	StudyID string `json:"study_id"`
+	Code    string `json:"code"`
+	Tag     string `json:"tag"`
+	Reason  string `json:"reason"`
+}
+
+// PHIReport the studies of a project checked against its de-identification
+// profile, or the basic profile when it has none
+type PHIReport struct {
+	ProjectID      string       `json:"project_id"`
+	Studies        int          `json:"studies"`
+	StudiesWithPHI int          `json:"studies_with_phi"`
+	Clean          bool         `json:"clean"`
+	Findings       []PHIFinding `json:"findings"`
+}
+
+// deidentifier masks the instances uploaded to a project following its
+// profile. The same value is masked the same way in every upload of the
+// project, recorded the mappings already kept by this upload
+type deidentifier struct {
+	projectID string
+	key       []byte
+	profile   *project.DeidentificationProfile
+	actions   map[string]string
+	recorded  map[string]bool
+}
+
+// SetDeidentificationStore where the original values of the masked ones are
+// kept, in memory by default
+func (app *StudyAPI) SetDeidentificationStore(store DeidentificationStore) {
+	app.deidentificationStore = store
+}
+
+// SetDeidentificationKey the secret the HASH and UID values are derived with,
+// changing it masks the next uploads differently
+func (app *StudyAPI) SetDeidentificationKey(key string) {
+	app.deidentificationKey = []byte(key)
+}
+
+func newDeidentifier(p *project.Project, key []byte) *deidentifier {
+	d := &deidentifier{projectID: p.ID, key: key, profile: p.DeidentificationProfile, recorded: make(map[string]bool)}
+	if d.profile != nil {
+		d.actions = d.profile.Actions()
+	}
+	return d
+}
+
+func (d *deidentifier) sum(kind, value string) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(d.projectID + "\x00" + kind + "\x00" + value))
+	return mac.Sum(nil)
+}
+
+// hash 16 hexadecimal digits, short enough for any text VR
+func (d *deidentifier) hash(value string) string {
+	return hex.EncodeToString(d.sum(constants.DeidActionHash, value))[:16]
+}
+
+// uid a UID derived from a 128 bits integer as in PS3.5 B.2
+func (d *deidentifier) uid(value string) string {
+	return "2.25." + new(big.Int).SetBytes(d.sum(constants.DeidActionUID, value)[:16]).String()
+}
+
+// deidentify the changes storing the instance of tags de-identified to
+// the PACS with the UIDs prefixed by the project, the tags as they are then
+// without the prefix, and the mappings of the values it masks
+func (d *deidentifier) deidentify(tags map[string]string) (dicom.Modification, map[string]string, []DeidentificationMapping) {
+	modification := dicom.Modification{Replace: make(map[string]string)}
+	masked := make(map[string]string)
+	for key, value := range tags {
+		masked[key] = value
+	}
+	mappings := make([]DeidentificationMapping, 0)
+
+	if d.profile != nil {
+		modification.RemovePrivateTags = true
+		for tag, action := range d.actions {
+			value, found := tags[tag]
+			switch action {
+			case constants.DeidActionRemove:
+				modification.Remove = append(modification.Remove, tag)
+				delete(masked, tag)
+			case constants.DeidActionEmpty:
+				if found {
+					modification.Replace[tag] = ""
+					delete(masked, tag)
+				}
+			case constants.DeidActionHash, constants.DeidActionUID:
+				if !found {
+					continue
+				}
+				masked[tag] = d.hash(value)
+				if action == constants.DeidActionUID {
+					masked[tag] = d.uid(value)
+				}
+				modification.Replace[tag] = masked[tag]
+				mappings = append(mappings, NewDeidentificationMapping(d.projectID, tag, value, masked[tag]))
+			}
+		}
+		sort.Strings(modification.Remove)
+		masked["PatientIdentityRemoved"] = "YES"
+		masked["DeidentificationMethod"] = d.profile.DeidentificationMethod()
+		modification.Replace["PatientIdentityRemoved"] = masked["PatientIdentityRemoved"]
+		modification.Replace["DeidentificationMethod"] = masked["DeidentificationMethod"]
+	}
+
+	for _, key := range maskedUIDTags {
+		modification.Replace[key] = d.projectID + "." + masked[key]
+	}
+	return modification, masked, mappings
+}
+
+// record keeps the mappings this upload did not keep yet
+func (d *deidentifier) record(store DeidentificationStore, mappings []DeidentificationMapping) error {
+	fresh := make([]DeidentificationMapping, 0)
+	for _, mapping := range mappings {
+		if !d.recorded[mapping.ID] {
+			fresh = append(fresh, mapping)
+		}
+	}
+	if err := store.BulkCreate(fresh); err != nil {
+		return err
+	}
+	for _, mapping := range fresh {
+		d.recorded[mapping.ID] = true
+	}
+	return nil
+}
+
+// CheckPHI reports the DICOM tags of the studies of the project that its
+// de-identification profile would not have let through
+func (app *StudyAPI) CheckPHI(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	projectID := c.Query(constants.ParamProjectID)
+	if projectID == "" {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	projects, _, err := app.projectStore.GetSlice(nil, fmt.Sprintf("_id:%s", projectID), 0, 1, "", nil)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if len(projects) == 0 {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	report, err := app.checkPHI(&projects[0])
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = report
+	c.JSON(http.StatusOK, resp)
+}
+
+func (app *StudyAPI) checkPHI(p *project.Project) (*PHIReport, error) {
+	profile := p.DeidentificationProfile
+	if profile == nil {
+		profile = &project.DeidentificationProfile{}
+	}
+	actions := profile.Actions()
+	report := &PHIReport{ProjectID: p.ID, Findings: make([]PHIFinding, 0)}
+	// values the project masked, by tag
+	masked := make(map[string]bool)
+
+	isMasked := func(tag, value string) (bool, error) {
+		if known, found := masked[tag+"\x00"+value]; found {
+			return known, nil
+		}
+		_, esReturn, err := app.deidentificationStore.GetSlice(map[string][]string{
+			"project_id.keyword": {p.ID},
+			"tag.keyword":        {tag},
+			"masked.keyword":     {value},
+		}, "", 0, 0, "")
+		if err != nil {
+			return false, err
+		}
+		masked[tag+"\x00"+value] = esReturn.Hits.Total.Value > 0
+		return masked[tag+"\x00"+value], nil
+	}
+
+	err := app.studyStore.Scroll(nil, fmt.Sprintf("project_id.keyword:%s", p.ID), constants.DefaultLimit, "", func(studies []Study, es entities.ESReturn) error {
+		for _, s := range studies {
+			report.Studies++
+			tags := make(map[string]interface{})
+			b, _ := json.Marshal(s.DICOMTags)
+			json.Unmarshal(b, &tags)
+
+			findings := make([]PHIFinding, 0)
+			for tag, action := range actions {
+				values, _ := tags[tag].([]interface{})
+				reason := ""
+				for _, v := range values {
+					value, ok := v.(string)
+					if !ok || value == "" {
+						continue
+					}
+					if action == constants.DeidActionRemove || action == constants.DeidActionEmpty {
+						reason = constants.PHIReasonPresent
+						break
+					}
+					known, err := isMasked(tag, value)
+					if err != nil {
+						return err
+					}
+					if !known {
+						reason = constants.PHIReasonNotMasked
+						break
+					}
+				}
+				if reason != "" {
+					findings = append(findings, PHIFinding{StudyID: s.ID, Code: s.Code, Tag: tag, Reason: reason})
+				}
+			}
+
+			if len(findings) > 0 {
+				report.StudiesWithPHI++
+				sort.Slice(findings, func(i, j int) bool { return findings[i].Tag < findings[j].Tag })
+				for _, finding := range findings {
+					if len(report.Findings) < phiFindingsLimit {
+						report.Findings = append(report.Findings, finding)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Clean = report.StudiesWithPHI == 0
+	return report, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -84,7 +83,7 @@ func (store *StudyES) Get(queries map[string][]string, qs string) (*Study, *enti
 	if len(studies) > 0 {
 		return &studies[0], esReturn, nil
 	}
-	return nil, esReturn, errors.New("Return is empty")
+	return nil, esReturn, utils.ErrNotFound
 }
 
 // GetSlice function
@@ -170,6 +169,21 @@ func (store *StudyES) Query(queries map[string][]string, qs string, from, size i
 	return nil
 }
 
+// Scroll get all with the scroll API, f stops it by returning an error
+func (store *StudyES) Scroll(queries map[string][]string, qs string, size int, sort string, f func(studies []Study, es entities.ESReturn) error) error {
+	return utils.ScrollES(store.esClient, getStudyIndexWildcard(store.indexPrefix), queries, qs, size, sort, func(esReturn entities.ESReturn) error {
+		studies := make([]Study, 0)
+		for _, hit := range esReturn.Hits.Hits {
+			var study Study
+			bytesData, _ := json.Marshal(hit.Source)
+			if err := json.Unmarshal(bytesData, &study); err == nil {
+				studies = append(studies, study)
+			}
+		}
+		return f(studies, esReturn)
+	})
+}
+
 // Delete function
 func (store *StudyES) Delete(queries map[string][]string, qs string) error {
 	var buf bytes.Buffer
@@ -0,0 +1,476 @@
+package study
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/helper"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+	"vindr-lab-api/utils/dicom"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ingestProgressEvery files between two saves of the progress of a job
+const ingestProgressEvery = 10
+
+// maskedUIDTags the PACS keeps these UIDs prefixed by the ID of the project,
+// the studies and objects keep them as they are
+var maskedUIDTags = []string{"StudyInstanceUID", "SeriesInstanceUID", "SOPInstanceUID"}
+
+// studyListTags the values of every instance are kept in the DICOMTags of the
+// study, the other tags come from its first instance
+var studyListTags = []string{"SeriesInstanceUID", "Modality", "BodyPartExamined"}
+
+// uploadedFile a file of the request saved until its job is over
+type uploadedFile struct {
+	name string
+	path string
+}
+
+// ingestFile a DICOM file of a job, read when it is ingested
+type ingestFile struct {
+	name string
+	read func() ([]byte, error)
+}
+
+// ingestedStudy the instances of a study read by a job, series maps their
+// SeriesInstanceUID to their SOPInstanceUIDs
+type ingestedStudy struct {
+	tags        map[string][]string
+	series      map[string][]string
+	seriesOrder []string
+}
+
+// SetIDGenerator the generator of the codes of the uploaded studies
+func (app *StudyAPI) SetIDGenerator(idGenerator *helper.IDGenerator) {
+	app.idGenerator = idGenerator
+}
+
+// SetIngestJobStore where upload jobs are kept, in memory by default
+func (app *StudyAPI) SetIngestJobStore(store IngestJobStore) {
+	app.ingestJobStore = store
+}
+
+// UploadStudies stores the DICOM files, or ZIP archives of them, of the
+// multipart fields files and file to the PACS of the project then creates their studies and
+// objects in the project. The IngestJob it answers with is followed at
+// GET /upload/:id
+func (app *StudyAPI) UploadStudies(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	projectID := c.Query(constants.ParamProjectID)
+	if projectID == "" {
+		projectID = c.PostForm(constants.ParamProjectID)
+	}
+	fileHeaders := append(form.File["files"], form.File["file"]...)
+	if projectID == "" || len(fileHeaders) == 0 {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	projects, _, err := app.projectStore.GetSlice(nil, fmt.Sprintf("_id:%s", projectID), 0, 1, "", nil)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if len(projects) == 0 {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	authInfo := mw.GetAuthInfoFromGin(c)
+
+	// the files of the request are removed once it is answered
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	uploads := make([]uploadedFile, 0)
+	for i, fileHeader := range fileHeaders {
+		upload := uploadedFile{
+			name: fileHeader.Filename,
+			path: filepath.Join(dir, fmt.Sprintf("%d_%s", i, filepath.Base(fileHeader.Filename))),
+		}
+		if err := c.SaveUploadedFile(fileHeader, upload.path); err != nil {
+			os.RemoveAll(dir)
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+		uploads = append(uploads, upload)
+	}
+
+	job := NewIngestJob(projectID, authInfo.ID)
+	if err := app.ingestJobStore.Create(job); err != nil {
+		os.RemoveAll(dir)
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	go func() {
+		defer os.RemoveAll(dir)
+		app.runIngestJob(job, &projects[0], uploads)
+	}()
+
+	resp.Data = job
+	c.JSON(http.StatusOK, resp)
+}
+
+func (app *StudyAPI) GetIngestJob(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	jobs, _, err := app.ingestJobStore.GetSlice(nil, fmt.Sprintf("_id:%s", c.Param(constants.ParamID)), 0, 1, "")
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if len(jobs) == 0 {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	resp.Data = jobs[0]
+	c.JSON(http.StatusOK, resp)
+}
+
+// FailInterruptedIngestJobs the files of the jobs running when the server
+// stopped are gone, they are marked FAILED
+func (app *StudyAPI) FailInterruptedIngestJobs() error {
+	jobs, _, err := app.ingestJobStore.GetSlice(nil, fmt.Sprintf("status.keyword:%s", constants.IngestStatusRunning),
+		0, constants.DefaultLimit, "")
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		err := app.ingestJobStore.Update(job, kvStr2Inf{
+			"status":      constants.IngestStatusFailed,
+			"error":       "interrupted by a restart",
+			"finished_at": time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runIngestJob ingests every file then creates the studies found, the job
+// fails when the studies or objects cannot be written
+func (app *StudyAPI) runIngestJob(job IngestJob, p *project.Project, uploads []uploadedFile) {
+	files, closeFiles := app.listIngestFiles(&job, uploads)
+	defer closeFiles()
+	job.TotalFiles = len(files)
+	app.saveIngestProgress(job)
+
+	pacs, err := app.pacs.Get(p.PACS)
+	if err != nil {
+		job.Status = constants.IngestStatusFailed
+		job.Error = err.Error()
+		app.finishIngestJob(job)
+		return
+	}
+
+	d := newDeidentifier(p, app.deidentificationKey)
+	studies := make(map[string]*ingestedStudy)
+	studyOrder := make([]string, 0)
+	for i, file := range files {
+		tags, err := app.ingestInstance(d, pacs, file)
+		if err != nil {
+			job.Errors = append(job.Errors, IngestFileError{File: file.name, Error: err.Error()})
+		} else {
+			uid := tags["StudyInstanceUID"]
+			if _, found := studies[uid]; !found {
+				studies[uid] = &ingestedStudy{series: make(map[string][]string)}
+				studyOrder = append(studyOrder, uid)
+			}
+			studies[uid].add(tags)
+		}
+
+		job.ProcessedFiles = i + 1
+		if job.ProcessedFiles%ingestProgressEvery == 0 {
+			app.saveIngestProgress(job)
+		}
+	}
+
+	job.Status = constants.IngestStatusDone
+	// two jobs of the same study must not both create it
+	app.ingests.Lock()
+	for _, uid := range studyOrder {
+		studyID, err := app.createIngestedStudy(p, job.CreatorID, uid, studies[uid])
+		if err != nil {
+			utils.LogError(err)
+			job.Status = constants.IngestStatusFailed
+			job.Error = err.Error()
+			break
+		}
+		job.StudyIDs = append(job.StudyIDs, studyID)
+
+		_, esReturn, err := app.objectStore.GetSlice(nil, fmt.Sprintf("study_id.keyword:%s", studyID), 0, 0, "", nil)
+		if err == nil {
+			job.Objects += esReturn.Hits.Total.Value
+		}
+	}
+	app.ingests.Unlock()
+
+	app.finishIngestJob(job)
+}
+
+func (app *StudyAPI) finishIngestJob(job IngestJob) {
+	job.FinishedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	err := app.ingestJobStore.Update(job, kvStr2Inf{
+		"status":          job.Status,
+		"error":           job.Error,
+		"finished_at":     job.FinishedAt,
+		"total_files":     job.TotalFiles,
+		"processed_files": job.ProcessedFiles,
+		"study_ids":       job.StudyIDs,
+		"objects":         job.Objects,
+		"errors":          job.Errors,
+	})
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+func (app *StudyAPI) saveIngestProgress(job IngestJob) {
+	err := app.ingestJobStore.Update(job, kvStr2Inf{
+		"total_files":     job.TotalFiles,
+		"processed_files": job.ProcessedFiles,
+		"errors":          job.Errors,
+	})
+	if err != nil {
+		utils.LogError(err)
+	}
+}
+
+// listIngestFiles the uploaded files with the files of the ZIP archives in
+// place of them, archives that cannot be opened are errors of the job
+func (app *StudyAPI) listIngestFiles(job *IngestJob, uploads []uploadedFile) ([]ingestFile, func()) {
+	files := make([]ingestFile, 0)
+	archives := make([]*zip.ReadCloser, 0)
+	closeFiles := func() {
+		for _, archive := range archives {
+			archive.Close()
+		}
+	}
+
+	for _, upload := range uploads {
+		upload := upload
+		if !strings.EqualFold(filepath.Ext(upload.name), ".zip") {
+			files = append(files, ingestFile{name: upload.name, read: func() ([]byte, error) {
+				return ioutil.ReadFile(upload.path)
+			}})
+			continue
+		}
+
+		archive, err := zip.OpenReader(upload.path)
+		if err != nil {
+			job.Errors = append(job.Errors, IngestFileError{File: upload.name, Error: err.Error()})
+			continue
+		}
+		archives = append(archives, archive)
+		for _, entry := range archive.File {
+			entry := entry
+			// DICOMDIR indexes the other files of the archive
+			if entry.FileInfo().IsDir() || strings.EqualFold(path.Base(entry.Name), "DICOMDIR") {
+				continue
+			}
+			files = append(files, ingestFile{name: upload.name + "/" + entry.Name, read: func() ([]byte, error) {
+				r, err := entry.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer r.Close()
+				return ioutil.ReadAll(r)
+			}})
+		}
+	}
+	return files, closeFiles
+}
+
+// ingestInstance stores the file to the PACS de-identified, with its UIDs
+// masked by the project, the tags returned are the de-identified ones
+// without the mask
+func (app *StudyAPI) ingestInstance(d *deidentifier, pacs PACS, file ingestFile) (map[string]string, error) {
+	data, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+	dcm, err := dicom.ParseFile(data)
+	if err != nil {
+		return nil, err
+	}
+	tags := dcm.Tags()
+
+	prefix := d.projectID + "."
+	// downloaded from the project, it is already masked
+	if strings.HasPrefix(tags["StudyInstanceUID"], prefix) {
+		if err := pacs.StoreInstance(data); err != nil {
+			return nil, fmt.Errorf("storing to the PACS: %s", err)
+		}
+		for _, key := range maskedUIDTags {
+			tags[key] = strings.TrimPrefix(tags[key], prefix)
+		}
+		return tags, nil
+	}
+
+	for _, key := range maskedUIDTags {
+		if tags[key] == "" {
+			return nil, fmt.Errorf("%s is missing", key)
+		}
+	}
+	modification, deidentified, mappings := d.deidentify(tags)
+	// the masked values can be traced back before any is stored
+	if err := d.record(app.deidentificationStore, mappings); err != nil {
+		return nil, fmt.Errorf("keeping the masked values: %s", err)
+	}
+	if err := dcm.Modify(modification); err != nil {
+		return nil, fmt.Errorf("de-identifying: %s", err)
+	}
+	if err := pacs.StoreInstance(dcm.Encode()); err != nil {
+		return nil, fmt.Errorf("storing to the PACS: %s", err)
+	}
+	return deidentified, nil
+}
+
+func (ingested *ingestedStudy) add(tags map[string]string) {
+	if ingested.tags == nil {
+		ingested.tags = make(map[string][]string)
+		for key, value := range tags {
+			ingested.tags[key] = []string{value}
+		}
+	}
+	mergeStudyListTags(ingested.tags, map[string][]string{
+		"SeriesInstanceUID": {tags["SeriesInstanceUID"]},
+		"Modality":          {tags["Modality"]},
+		"BodyPartExamined":  {tags["BodyPartExamined"]},
+	})
+
+	seriesUID := tags["SeriesInstanceUID"]
+	if _, found := ingested.series[seriesUID]; !found {
+		ingested.seriesOrder = append(ingested.seriesOrder, seriesUID)
+	}
+	if _, found := utils.FindInSlice(ingested.series[seriesUID], tags["SOPInstanceUID"]); !found {
+		ingested.series[seriesUID] = append(ingested.series[seriesUID], tags["SOPInstanceUID"])
+	}
+}
+
+// mergeStudyListTags adds the values of src missing from dst, true when there was any
+func mergeStudyListTags(dst, src map[string][]string) bool {
+	changed := false
+	for _, key := range studyListTags {
+		for _, value := range src[key] {
+			if _, found := utils.FindInSlice(dst[key], value); value != "" && !found {
+				dst[key] = append(dst[key], value)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// createIngestedStudy creates the study of the project with the UID, or adds
+// the series of ingested to it, then creates the objects of its instances
+func (app *StudyAPI) createIngestedStudy(p *project.Project, creatorID, uid string, ingested *ingestedStudy) (string, error) {
+	studies, _, err := app.studyStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s AND dicom_tags.StudyInstanceUID.keyword:%s", p.ID, uid),
+		0, 1, "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var studyID string
+	if len(studies) > 0 {
+		studyID = studies[0].ID
+		tags := make(map[string][]string)
+		b, _ := json.Marshal(studies[0].DICOMTags)
+		json.Unmarshal(b, &tags)
+		if mergeStudyListTags(tags, ingested.tags) {
+			if err := app.studyStore.Update(studies[0], kvStr2Inf{"dicom_tags": tags}); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		counter, err := app.idGenerator.GenNew("study_" + p.ID)
+		if err != nil {
+			return "", err
+		}
+		dicomTags := DICOMTags{}
+		b, _ := json.Marshal(ingested.tags)
+		if err := json.Unmarshal(b, &dicomTags); err != nil {
+			return "", err
+		}
+
+		s := Study{
+			ID:           uuid.New().String(),
+			Modified:     now,
+			TimeInserted: now,
+			Code:         fmt.Sprintf("STD-%d", counter),
+			Status:       constants.StudyStatusUnassigned,
+			ProjectID:    p.ID,
+			CreatorID:    creatorID,
+			DICOMTags:    &dicomTags,
+		}
+		if err := app.studyStore.Create(s); err != nil {
+			return "", err
+		}
+		studyID = s.ID
+	}
+
+	if err := app.createIngestedObjects(p.ID, studyID, uid, ingested); err != nil {
+		return "", err
+	}
+	return studyID, nil
+}
+
+// createIngestedObjects creates the STUDY, SERIES and IMAGE objects of the
+// instances of ingested the study does not have yet
+func (app *StudyAPI) createIngestedObjects(projectID, studyID, uid string, ingested *ingestedStudy) error {
+	// one series at a time, ProcessCreateObject puts every SOP in every series
+	for _, seriesUID := range ingested.seriesOrder {
+		sopUIDs := ingested.series[seriesUID]
+		err := object.ProcessCreateObject(app.objectStore, nil, object.ObjectBig{
+			ProjectID:             projectID,
+			StudyID:               studyID,
+			ListStudyInstanceUID:  &[]string{uid},
+			ListSeriesInstanceUID: &[]string{seriesUID},
+			ListSOPInstanceUID:    &sopUIDs,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
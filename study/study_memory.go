@@ -0,0 +1,97 @@
+package study
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// StudyMemory keeps studies in memory, for running without a cluster and in tests
+type StudyMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewStudyMemory() *StudyMemory {
+	return &StudyMemory{utils.NewMemoryIndex("study")}
+}
+
+// Create function
+func (store *StudyMemory) Create(study Study) error {
+	return store.index.Index(study.ID, study, entities.Revision{})
+}
+
+// Get get one ESReturn
+func (store *StudyMemory) Get(queries map[string][]string, qs string) (*Study, *entities.ESReturn, error) {
+	studies, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(studies) > 0 {
+		return &studies[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// GetSlice function
+func (store *StudyMemory) GetSlice(queries map[string][]string, qs string,
+	from, size int, sort string, aggs []string) ([]Study, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	studies := make([]Study, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var study Study
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &study); err == nil {
+			studies = append(studies, study)
+		}
+	}
+	return studies, esReturn, nil
+}
+
+// Query get all
+func (store *StudyMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(studies []Study, es entities.ESReturn)) error {
+	for {
+		studies, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(studies, *esReturn)
+
+		if len(studies) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Scroll pages through the hits, f stops it by returning an error
+func (store *StudyMemory) Scroll(queries map[string][]string, qs string, size int, sort string, f func(studies []Study, es entities.ESReturn) error) error {
+	for from := 0; ; from += size {
+		studies, esReturn, err := store.GetSlice(queries, qs, from, size, sort, nil)
+		if err != nil {
+			return err
+		}
+		if len(studies) == 0 {
+			return nil
+		}
+		if err := f(studies, *esReturn); err != nil {
+			return err
+		}
+	}
+}
+
+// Delete function
+func (store *StudyMemory) Delete(queries map[string][]string, qs string) error {
+	return store.index.Delete(queries, qs)
+}
+
+// Update function
+func (store *StudyMemory) Update(study Study, update map[string]interface{}) error {
+	return store.index.Update(study.ID, update, entities.Revision{})
+}
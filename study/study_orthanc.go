@@ -11,7 +11,6 @@ import (
 	"time"
 
 	"vindr-lab-api/entities"
-	"vindr-lab-api/utils"
 
 	"github.com/gojektech/heimdall/v6/httpclient"
 )
@@ -41,6 +40,20 @@ func NewStudyOrthanC(uri string) *StudyOrthanC {
 }
 
 func (orthanc *StudyOrthanC) FindObjectByUID(scope, uid string) (string, error) {
+	ids, err := orthanc.find(scope, uid)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) > 0 {
+		return ids[0], nil
+	}
+
+	return "", errors.New("[MANUAL] Data is empty")
+}
+
+// find the OrthanC IDs of the studies, series or instances (SOP) of the UID
+func (orthanc *StudyOrthanC) find(scope, uid string) ([]string, error) {
 	var buf bytes.Buffer
 
 	level := ""
@@ -64,48 +77,144 @@ func (orthanc *StudyOrthanC) FindObjectByUID(scope, uid string) (string, error)
 		},
 	}
 	if err := json.NewEncoder(&buf).Encode(body); err != nil {
-		return "", fmt.Errorf("Error encoding query: %s", err)
+		return nil, fmt.Errorf("Error encoding query: %s", err)
 	}
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/tools/find", orthanc.uri), &buf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	res, err := orthanc.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return "", errors.New(res.Status)
+		return nil, errors.New(res.Status)
 	}
 
-	studies := make([]string, 0)
+	ids := make([]string, 0)
 	defer res.Body.Close()
-	if err := json.NewDecoder(res.Body).Decode(&studies); err != nil {
-		return "", fmt.Errorf("Error parsing the response body: %s", err)
+	if err := json.NewDecoder(res.Body).Decode(&ids); err != nil {
+		return nil, fmt.Errorf("Error parsing the response body: %s", err)
 	}
+	return ids, nil
+}
 
-	if len(studies) > 0 {
-		return studies[0], nil
+// HasStudy implements PACS
+func (orthanc *StudyOrthanC) HasStudy(studyUID string) (bool, error) {
+	ids, err := orthanc.find("Study", studyUID)
+	return len(ids) > 0, err
+}
+
+// DeleteStudyByUID implements PACS
+func (orthanc *StudyOrthanC) DeleteStudyByUID(studyUID string) error {
+	orthancStudyID, err := orthanc.FindObjectByUID("Study", studyUID)
+	if err != nil {
+		return err
 	}
+	return orthanc.DeleteStudy(orthancStudyID)
+}
 
-	return "", errors.New("[MANUAL] Data is empty")
+// StoreInstance implements PACS
+func (orthanc *StudyOrthanC) StoreInstance(data []byte) error {
+	_, err := orthanc.UploadInstance(data)
+	return err
 }
 
-func (orthanc *StudyOrthanC) DeleteDicomFile(studyOrthanC *StudyOrthanC, s Study) error {
-	orthancStudyID, err := studyOrthanC.FindObjectByUID("Study", fmt.Sprintf("%s.%s", s.ProjectID, s.DICOMTags.StudyInstanceUID[0]))
+// GetInstanceTags implements PACS, OrthanC names every tag it knows
+func (orthanc *StudyOrthanC) GetInstanceTags(studyUID, seriesUID, sopUID string) (map[string]string, error) {
+	orthancID, err := orthanc.FindObjectByUID("SOP", sopUID)
 	if err != nil {
-		utils.LogError(err)
-		return err
+		return nil, err
 	}
+	return orthanc.GetSimplifiedTagValues(orthancID)
+}
+
+// ListStudies implements PACS, reading the studies of OrthanC by pages
+func (orthanc *StudyOrthanC) ListStudies() ([]string, error) {
+	const page = 1000
+	uids := make([]string, 0)
+	for since := 0; ; since += page {
+		var buf bytes.Buffer
+		body := &kvStr2Inf{"Level": "Study", "Query": kvStr2Inf{}, "Expand": true, "Since": since, "Limit": page}
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, fmt.Errorf("Error encoding query: %s", err)
+		}
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/tools/find", orthanc.uri), &buf)
+		if err != nil {
+			return nil, err
+		}
+		res, err := orthanc.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		studies := make([]struct {
+			MainDicomTags struct {
+				StudyInstanceUID string `json:"StudyInstanceUID"`
+			} `json:"MainDicomTags"`
+		}, 0)
+		err = json.NewDecoder(res.Body).Decode(&studies)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New(res.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the response body: %s", err)
+		}
+
+		for _, s := range studies {
+			uids = append(uids, s.MainDicomTags.StudyInstanceUID)
+		}
+		if len(studies) < page {
+			return uids, nil
+		}
+	}
+}
 
-	err = orthanc.DeleteStudy(orthancStudyID)
+// ListStudyInstances implements PACS
+func (orthanc *StudyOrthanC) ListStudyInstances(studyUID string) ([]PACSInstance, error) {
+	orthancStudyID, err := orthanc.FindObjectByUID("Study", studyUID)
 	if err != nil {
-		utils.LogError(err)
-		return err
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/studies/%s/series", orthanc.uri, orthancStudyID), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := orthanc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	return nil
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	series := make([]struct {
+		ID            string `json:"ID"`
+		MainDicomTags struct {
+			SeriesInstanceUID string `json:"SeriesInstanceUID"`
+		} `json:"MainDicomTags"`
+	}, 0)
+	if err := json.NewDecoder(res.Body).Decode(&series); err != nil {
+		return nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	instances := make([]PACSInstance, 0)
+	for _, s := range series {
+		seriesInstances, err := orthanc.GetInstancesBySeries(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range *seriesInstances {
+			instances = append(instances, PACSInstance{
+				SeriesInstanceUID: s.MainDicomTags.SeriesInstanceUID,
+				SOPInstanceUID:    instance.MainDicomTags.SOPInstanceUID,
+			})
+		}
+	}
+	return instances, nil
 }
 
 func (orthanc *StudyOrthanC) DeleteStudy(orthancStudyID string) error {
@@ -195,6 +304,57 @@ func (orthanc *StudyOrthanC) GetSimplifiedTagsByID(orthancImageID string) (*enti
 	return &tags, nil
 }
 
+// GetSimplifiedTagValues every tag of the instance having a text value
+func (orthanc *StudyOrthanC) GetSimplifiedTagValues(orthancImageID string) (map[string]string, error) {
+	res, err := orthanc.httpClient.Get(fmt.Sprintf("%s/instances/%s/simplified-tags", orthanc.uri, orthancImageID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	source := make(map[string]interface{})
+	if err := json.NewDecoder(res.Body).Decode(&source); err != nil {
+		return nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	tags := make(map[string]string)
+	for key, value := range source {
+		if s, ok := value.(string); ok && s != "" {
+			tags[key] = s
+		}
+	}
+	return tags, nil
+}
+
+// UploadInstance stores a DICOM file to OrthanC, returns its OrthanC ID
+func (orthanc *StudyOrthanC) UploadInstance(data []byte) (string, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/instances", orthanc.uri), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/dicom")
+	res, err := orthanc.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(res.Status)
+	}
+
+	stored := struct {
+		ID string `json:"ID"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&stored); err != nil {
+		return "", fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	return stored.ID, nil
+}
+
 // DownloadStudy from OrthanC
 // format: dicom, zip
 func (orthanc *StudyOrthanC) DownloadStudy(orthancStudyID, format, filepath string) error {
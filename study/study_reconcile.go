@@ -0,0 +1,335 @@
+package study
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+
+	"github.com/bsm/redislock"
+	"github.com/gin-gonic/gin"
+)
+
+// reconciliationFindingsLimit findings listed by a reconciliation, the others
+// are only counted and still repaired
+const reconciliationFindingsLimit = 1000
+
+// reconciliationGrace the unreferenced DICOM studies of a project are not
+// deleted while an upload of the project runs or for this long after it
+// finished, its studies may not be created or searchable yet
+const reconciliationGrace = 1 * time.Hour
+
+// ReconciliationFinding a study of the store or of a PACS the other side does
+// not match. Studies are matched on the StudyInstanceUID the PACS keeps
+// prefixed by the ID of their project
+type ReconciliationFinding struct {
+	Problem          string `json:"problem"`
+	PACS             string `json:"pacs"`
+	ProjectID        string `json:"project_id,omitempty"`
+	StudyID          string `json:"study_id,omitempty"`
+	Code             string `json:"code,omitempty"`
+	StudyInstanceUID string `json:"study_instance_uid"`
+	Repaired         bool   `json:"repaired"`
+	Error            string `json:"error,omitempty"`
+}
+
+// ReconciliationReport the studies of the store checked against the PACS of
+// their project, MISSING_DICOM and MISSING_OBJECTS ones, and the studies of
+// every PACS no study refers to, UNREFERENCED_DICOM ones
+type ReconciliationReport struct {
+	ProjectID         string                  `json:"project_id,omitempty"`
+	Repair            bool                    `json:"repair"`
+	StartedAt         int64                   `json:"started_at"`
+	FinishedAt        int64                   `json:"finished_at"`
+	Studies           int                     `json:"studies"`
+	PACSStudies       int                     `json:"pacs_studies"`
+	MissingDICOM      int                     `json:"missing_dicom"`
+	MissingObjects    int                     `json:"missing_objects"`
+	UnreferencedDICOM int                     `json:"unreferenced_dicom"`
+	Findings          []ReconciliationFinding `json:"findings"`
+}
+
+// reconciliation the state of a run, the PACS by name and the projects read
+// so far, nil when they are not found
+type reconciliation struct {
+	report   *ReconciliationReport
+	pacs     map[string]PACS
+	projects map[string]*project.Project
+	// pacsStudies the prefixed StudyInstanceUIDs of each PACS, true once a
+	// study refers to it
+	pacsStudies map[string]map[string]bool
+}
+
+// SetLocker the redis locks keeping two servers from reconciling the same
+// interval, without them every server does it
+func (app *StudyAPI) SetLocker(locker *redislock.Client) {
+	app.locker = locker
+}
+
+// RunReconciliation reconciles the studies and the PACS every interval,
+// repairing what it finds when repair is set
+func (app *StudyAPI) RunReconciliation(interval time.Duration, repair bool) {
+	for {
+		time.Sleep(interval)
+
+		if app.locker != nil {
+			// the lock expires by itself at the next round
+			_, err := app.locker.Obtain(context.Background(), "study_reconciliation", interval, nil)
+			if errors.Is(err, redislock.ErrNotObtained) {
+				continue
+			}
+			if err != nil {
+				utils.LogError(err)
+				continue
+			}
+		}
+		report, err := app.Reconcile("", repair)
+		if err != nil {
+			utils.LogError(err)
+			continue
+		}
+		utils.LogInfo("Reconciliation: %d studies missing DICOM, %d missing objects, %d DICOM studies unreferenced",
+			report.MissingDICOM, report.MissingObjects, report.UnreferencedDICOM)
+	}
+}
+
+// GetReconciliation reports how the studies and the PACS differ, of one
+// project with project_id, without repairing anything
+func (app *StudyAPI) GetReconciliation(c *gin.Context) {
+	app.reconcile(c, false)
+}
+
+// RepairReconciliation reports how the studies and the PACS differ then
+// creates the missing objects and deletes the unreferenced DICOM studies
+func (app *StudyAPI) RepairReconciliation(c *gin.Context) {
+	app.reconcile(c, true)
+}
+
+func (app *StudyAPI) reconcile(c *gin.Context, repair bool) {
+	resp := entities.NewResponse()
+
+	app.reconciling.Lock()
+	running := app.reconcileRunning
+	app.reconcileRunning = true
+	app.reconciling.Unlock()
+	if running {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	defer func() {
+		app.reconciling.Lock()
+		app.reconcileRunning = false
+		app.reconciling.Unlock()
+	}()
+
+	report, err := app.Reconcile(c.Query(constants.ParamProjectID), repair)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = report
+	c.JSON(http.StatusOK, resp)
+}
+
+// Reconcile walks the studies, of the project when projectID is set, and the
+// studies of every PACS. With repair the objects of the studies having none
+// are created from their instances in the PACS, and the DICOM studies of a
+// project no study refers to are deleted, unless the project had an upload
+// within reconciliationGrace. Studies missing their DICOM are only reported,
+// and DICOM studies of no project are left alone
+func (app *StudyAPI) Reconcile(projectID string, repair bool) (*ReconciliationReport, error) {
+	if repair {
+		// the uploads of this server cannot create studies meanwhile
+		app.ingests.Lock()
+		defer app.ingests.Unlock()
+	}
+
+	r := &reconciliation{
+		report: &ReconciliationReport{
+			ProjectID: projectID,
+			Repair:    repair,
+			StartedAt: time.Now().UnixNano() / int64(time.Millisecond),
+			Findings:  make([]ReconciliationFinding, 0),
+		},
+		pacs:        make(map[string]PACS),
+		projects:    make(map[string]*project.Project),
+		pacsStudies: make(map[string]map[string]bool),
+	}
+
+	for _, name := range app.pacs.Names() {
+		pacs, _ := app.pacs.Get(name)
+		uids, err := pacs.ListStudies()
+		if err != nil {
+			return nil, fmt.Errorf("listing the studies of PACS %s: %s", name, err)
+		}
+		r.pacs[name] = pacs
+		r.pacsStudies[name] = make(map[string]bool)
+		for _, uid := range uids {
+			if projectID == "" || strings.HasPrefix(uid, projectID+".") {
+				r.pacsStudies[name][uid] = false
+			}
+		}
+		r.report.PACSStudies += len(r.pacsStudies[name])
+	}
+
+	query := ""
+	if projectID != "" {
+		query = fmt.Sprintf("project_id.keyword:%s", projectID)
+	}
+	err := app.studyStore.Scroll(nil, query, constants.DefaultLimit, "", func(studies []Study, es entities.ESReturn) error {
+		for _, s := range studies {
+			if err := app.reconcileStudy(r, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uploading := make(map[string]bool)
+	if repair {
+		if uploading, err = app.uploadingProjects(time.Now().Add(-reconciliationGrace)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range app.pacs.Names() {
+		unreferenced := make([]string, 0)
+		for uid, referred := range r.pacsStudies[name] {
+			if !referred {
+				unreferenced = append(unreferenced, uid)
+			}
+		}
+		sort.Strings(unreferenced)
+		for _, uid := range unreferenced {
+			finding := ReconciliationFinding{Problem: constants.ReconcileUnreferencedDICOM, PACS: name, StudyInstanceUID: uid}
+			// UIDs are made of digits, the prefix of a project is not
+			if prefix := strings.SplitN(uid, ".", 2)[0]; strings.Trim(prefix, "0123456789") != "" {
+				finding.ProjectID = prefix
+				switch {
+				case repair && uploading[prefix]:
+					finding.Error = "An upload of the project is running or just finished"
+				case repair:
+					app.repair(&finding, r.pacs[name].DeleteStudyByUID(uid))
+				}
+			}
+			r.report.UnreferencedDICOM++
+			r.add(finding)
+		}
+	}
+
+	r.report.FinishedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	return r.report, nil
+}
+
+// uploadingProjects the IDs of the projects with an upload running or
+// finished since
+func (app *StudyAPI) uploadingProjects(since time.Time) (map[string]bool, error) {
+	ret := make(map[string]bool)
+	qs := fmt.Sprintf("status.keyword:%s OR finished_at:>=%d", constants.IngestStatusRunning, since.UnixNano()/int64(time.Millisecond))
+	for from := 0; ; from += constants.DefaultLimit {
+		jobs, _, err := app.ingestJobStore.GetSlice(nil, qs, from, constants.DefaultLimit, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			ret[job.ProjectID] = true
+		}
+		if len(jobs) < constants.DefaultLimit {
+			return ret, nil
+		}
+	}
+}
+
+func (app *StudyAPI) reconcileStudy(r *reconciliation, s Study) error {
+	// studies not uploaded from DICOM files cannot be matched
+	if s.DICOMTags == nil || len(s.DICOMTags.StudyInstanceUID) == 0 {
+		return nil
+	}
+	r.report.Studies++
+
+	p, found := r.projects[s.ProjectID]
+	if !found {
+		var err error
+		// the studies of a deleted project are checked against the default PACS
+		if p, _, err = app.projectStore.Get(nil, fmt.Sprintf("_id:%s", s.ProjectID)); err != nil && !errors.Is(err, utils.ErrNotFound) {
+			return err
+		}
+		r.projects[s.ProjectID] = p
+	}
+	name := constants.PACSOrthanc
+	if p != nil && p.PACS != "" {
+		name = p.PACS
+	}
+
+	uid := fmt.Sprintf("%s.%s", s.ProjectID, s.DICOMTags.StudyInstanceUID[0])
+	finding := ReconciliationFinding{PACS: name, ProjectID: s.ProjectID, StudyID: s.ID, Code: s.Code, StudyInstanceUID: uid}
+	if _, found := r.pacsStudies[name][uid]; !found {
+		finding.Problem = constants.ReconcileMissingDICOM
+		r.report.MissingDICOM++
+		r.add(finding)
+		return nil
+	}
+	r.pacsStudies[name][uid] = true
+
+	_, esReturn, err := app.objectStore.GetSlice(nil, fmt.Sprintf("study_id.keyword:%s", s.ID), 0, 0, "", nil)
+	if err != nil {
+		return err
+	}
+	if esReturn.Hits.Total.Value > 0 {
+		return nil
+	}
+	finding.Problem = constants.ReconcileMissingObjects
+	if r.report.Repair {
+		app.repair(&finding, app.recreateObjects(r.pacs[name], s, uid))
+	}
+	r.report.MissingObjects++
+	r.add(finding)
+	return nil
+}
+
+// recreateObjects creates the objects of the study from its instances in the PACS
+func (app *StudyAPI) recreateObjects(pacs PACS, s Study, uid string) error {
+	instances, err := pacs.ListStudyInstances(uid)
+	if err != nil {
+		return err
+	}
+	prefix := s.ProjectID + "."
+	ingested := &ingestedStudy{series: make(map[string][]string)}
+	for _, instance := range instances {
+		ingested.add(map[string]string{
+			"SeriesInstanceUID": strings.TrimPrefix(instance.SeriesInstanceUID, prefix),
+			"SOPInstanceUID":    strings.TrimPrefix(instance.SOPInstanceUID, prefix),
+		})
+	}
+	return app.createIngestedObjects(s.ProjectID, s.ID, s.DICOMTags.StudyInstanceUID[0], ingested)
+}
+
+func (app *StudyAPI) repair(finding *ReconciliationFinding, err error) {
+	if err != nil {
+		utils.LogError(err)
+		finding.Error = err.Error()
+		return
+	}
+	finding.Repaired = true
+}
+
+func (r *reconciliation) add(finding ReconciliationFinding) {
+	if len(r.report.Findings) < reconciliationFindingsLimit {
+		r.report.Findings = append(r.report.Findings, finding)
+	}
+}
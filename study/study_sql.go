@@ -0,0 +1,110 @@
+package study
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// StudySQL keeps studies in a relational database, see utils.SQLTable
+type StudySQL struct {
+	table *utils.SQLTable
+}
+
+func NewStudySQL(db utils.SQLExecutor) *StudySQL {
+	return &StudySQL{utils.NewSQLTable(db, "studies", "project_id", "status")}
+}
+
+// CreateTable creates the studies table when missing
+func (store *StudySQL) CreateTable() error {
+	return store.table.CreateTable()
+}
+
+// Create function
+func (store *StudySQL) Create(study Study) error {
+	return store.table.Index(study.ID, study, entities.Revision{})
+}
+
+// Get get one ESReturn
+func (store *StudySQL) Get(queries map[string][]string, qs string) (*Study, *entities.ESReturn, error) {
+	studies, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(studies) > 0 {
+		return &studies[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// GetSlice function
+func (store *StudySQL) GetSlice(queries map[string][]string, qs string,
+	from, size int, sort string, aggs []string) ([]Study, *entities.ESReturn, error) {
+	esReturn, err := store.table.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	studies := make([]Study, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var study Study
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &study); err == nil {
+			studies = append(studies, study)
+		}
+	}
+	return studies, esReturn, nil
+}
+
+// Query get all
+func (store *StudySQL) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(studies []Study, es entities.ESReturn)) error {
+	// a size of 0 would read the first page forever
+	if size <= 0 {
+		size = constants.DefaultLimit
+	}
+	for {
+		studies, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(studies, *esReturn)
+
+		if len(studies) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// Scroll pages through the hits, f stops it by returning an error
+func (store *StudySQL) Scroll(queries map[string][]string, qs string, size int, sort string, f func(studies []Study, es entities.ESReturn) error) error {
+	if size <= 0 {
+		size = constants.DefaultLimit
+	}
+	for from := 0; ; from += size {
+		studies, esReturn, err := store.GetSlice(queries, qs, from, size, sort, nil)
+		if err != nil {
+			return err
+		}
+		if len(studies) == 0 {
+			return nil
+		}
+		if err := f(studies, *esReturn); err != nil {
+			return err
+		}
+	}
+}
+
+// Delete function
+func (store *StudySQL) Delete(queries map[string][]string, qs string) error {
+	return store.table.Delete(queries, qs)
+}
+
+// Update function
+func (store *StudySQL) Update(study Study, update map[string]interface{}) error {
+	return store.table.Update(study.ID, update, entities.Revision{})
+}
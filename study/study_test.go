@@ -1,11 +1,33 @@
 package study
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/helper"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils/dicom"
 
+	"github.com/gin-gonic/gin"
+	"github.com/gojektech/heimdall/v6/httpclient"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 var study = Study{
@@ -40,3 +62,508 @@ func TestString(t *testing.T) {
 		assert.Equal(t, "{\"id\":\"\",\"modified\":0,\"time_inserted\":0,\"code\":\"\",\"status\":\"\",\"project_id\":\"\",\"creator_id\":\"\"}", study.String())
 	}
 }
+
+// newOrthancServer keeps the tags of the instances posted to it
+func newOrthancServer(instances map[string]map[string]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/instances":
+			data, _ := ioutil.ReadAll(r.Body)
+			file, err := dicom.ParseFile(data)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tags := file.Tags()
+			id := tags["SOPInstanceUID"]
+			instances[id] = tags
+			json.NewEncoder(w).Encode(map[string]string{"ID": id})
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "simplified-tags":
+			json.NewEncoder(w).Encode(instances[parts[1]])
+		case r.Method == http.MethodDelete && len(parts) == 2:
+			delete(instances, parts[1])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// newDICOMFile a DICOM file in explicit VR little endian with the tags of the
+// dictionary
+func newDICOMFile(tags map[string]string) []byte {
+	file := &dicom.File{Explicit: true}
+	file.Meta = []dicom.FileElement{
+		dicom.NewFileElement(dicom.MediaStorageSOPInstanceUID, tags["SOPInstanceUID"], true),
+		dicom.NewFileElement(dicom.TransferSyntaxUID, dicom.ExplicitVRLittleEndian, true),
+	}
+	for keyword, value := range tags {
+		file.Dataset = append(file.Dataset, dicom.NewFileElement(entities.DICOMDictionary[keyword].Tag, value, true))
+	}
+	sort.Slice(file.Dataset, func(i, j int) bool { return file.Dataset[i].Tag < file.Dataset[j].Tag })
+	return file.Encode()
+}
+
+func TestUploadStudies(t *testing.T) {
+	orthancInstances := make(map[string]map[string]string)
+	orthanc := newOrthancServer(orthancInstances)
+	defer orthanc.Close()
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app := NewStudyAPI(NewStudyMemory(), NewTaskMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		&StudyOrthanC{uri: orthanc.URL, httpClient: httpclient.NewClient()}, zap.NewNop())
+	app.SetIDGenerator(helper.NewIDGenerator(idServer.URL))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1"}))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/studies", func(c *gin.Context) {
+		c.Set(mw.GIN_CONTEXT_AUTHINFO, mw.Account{ID: "u1"})
+	})
+	group.GET("/:id", app.GetStudy)
+	group.POST("/upload", app.UploadStudies)
+	group.GET("/upload/:id", app.GetIngestJob)
+
+	instance := func(study, series, sop, modality string) []byte {
+		return newDICOMFile(map[string]string{"StudyInstanceUID": study, "SeriesInstanceUID": series,
+			"SOPInstanceUID": sop, "Modality": modality, "PatientID": "patient"})
+	}
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	// in order, the series of the study are listed as they are read
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"a/1.dcm", instance("1.1", "1.1.1", "1.1.1.1", "CT")},
+		{"a/2.dcm", instance("1.1", "1.1.2", "1.1.2.1", "SR")},
+		{"DICOMDIR", []byte("index")},
+		{"notes", []byte("not DICOM")},
+	} {
+		w, _ := zipWriter.Create(entry.name)
+		w.Write(entry.data)
+	}
+	assert.Nil(t, zipWriter.Close())
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	w, _ := form.CreateFormFile("files", "batch.zip")
+	w.Write(archive.Bytes())
+	w, _ = form.CreateFormFile("files", "3.dcm")
+	w.Write(instance("2.1", "2.1.1", "2.1.1.1", "MR"))
+	assert.Nil(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/studies/upload", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/studies/upload?project_id=p1", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec = httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data IngestJob `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	var job IngestJob
+	for i := 0; i < 100; i++ {
+		rec = serve(engine, http.MethodGet, "/studies/upload/"+resp.Data.ID, "", "")
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		if job = resp.Data; job.Status != constants.IngestStatusRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, constants.IngestStatusDone, job.Status)
+	assert.Equal(t, 4, job.TotalFiles)
+	assert.Equal(t, 4, job.ProcessedFiles)
+	assert.Equal(t, []IngestFileError{{File: "batch.zip/notes", Error: "not a DICOM file"}}, job.Errors)
+	assert.Equal(t, 2, len(job.StudyIDs))
+	assert.Equal(t, 8, job.Objects)
+
+	s, _, _ := app.studyStore.Get(nil, "dicom_tags.StudyInstanceUID.keyword:1.1")
+	assert.Equal(t, "STD-7", s.Code)
+	assert.Equal(t, constants.StudyStatusUnassigned, s.Status)
+	assert.Equal(t, []string{"1.1.1", "1.1.2"}, s.DICOMTags.SeriesInstanceUID)
+	assert.Equal(t, []string{"CT", "SR"}, s.DICOMTags.Modality)
+	assert.Equal(t, []string{"patient"}, s.DICOMTags.PatientID)
+	images, _, _ := app.objectStore.GetSlice(nil, fmt.Sprintf("study_id.keyword:%s AND type.keyword:%s", s.ID, constants.ObjectTypeImage),
+		0, constants.DefaultLimit, "", nil)
+	assert.Equal(t, 2, len(images))
+
+	assert.Equal(t, 3, len(orthancInstances))
+	for _, tags := range orthancInstances {
+		assert.True(t, strings.HasPrefix(tags["StudyInstanceUID"], "p1."))
+	}
+}
+
+func TestUploadStudiesDeidentified(t *testing.T) {
+	orthancInstances := make(map[string]map[string]string)
+	orthanc := newOrthancServer(orthancInstances)
+	defer orthanc.Close()
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app := NewStudyAPI(NewStudyMemory(), NewTaskMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		&StudyOrthanC{uri: orthanc.URL, httpClient: httpclient.NewClient()}, zap.NewNop())
+	app.SetIDGenerator(helper.NewIDGenerator(idServer.URL))
+	app.SetDeidentificationKey("secret")
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", DeidentificationProfile: &project.DeidentificationProfile{
+		Options: []string{constants.DeidOptionRetainPatientCharacteristics},
+	}}))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p2"}))
+	// a study of p2 uploaded before any de-identification
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s2", Code: "STD-1", ProjectID: "p2", DICOMTags: &DICOMTags{
+		StudyInstanceUID: []string{"9.1"}, PatientID: []string{"patient"}, PatientName: []string{"DOE^JOHN"},
+	}}))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/studies/upload", func(c *gin.Context) {
+		c.Set(mw.GIN_CONTEXT_AUTHINFO, mw.Account{ID: "u1"})
+	}, app.UploadStudies)
+	engine.GET("/studies/upload/:id", app.GetIngestJob)
+	engine.GET("/studies/phi_check", app.CheckPHI)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, sop := range []string{"1.1.1.1", "1.1.1.2"} {
+		w, _ := form.CreateFormFile("files", fmt.Sprintf("%d.dcm", i))
+		w.Write(newDICOMFile(map[string]string{"StudyInstanceUID": "1.1", "SeriesInstanceUID": "1.1.1", "SOPInstanceUID": sop,
+			"Modality": "CT", "PatientID": "patient", "PatientName": "DOE^JOHN", "PatientSex": "M",
+			"InstitutionName": "General Hospital", "StudyDate": "20200101"}))
+	}
+	assert.Nil(t, form.Close())
+	req := httptest.NewRequest(http.MethodPost, "/studies/upload?project_id=p1", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data IngestJob `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	for i := 0; i < 100 && resp.Data.Status == constants.IngestStatusRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+		rec = serve(engine, http.MethodGet, "/studies/upload/"+resp.Data.ID, "", "")
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	assert.Equal(t, constants.IngestStatusDone, resp.Data.Status)
+	assert.Equal(t, 0, len(resp.Data.Errors))
+
+	s, _, err := app.studyStore.Get(nil, "project_id.keyword:p1")
+	assert.Nil(t, err)
+	tags := s.DICOMTags
+	assert.True(t, strings.HasPrefix(tags.StudyInstanceUID[0], "2.25."))
+	assert.NotEqual(t, "patient", tags.PatientID[0])
+	assert.Empty(t, tags.PatientName)
+	assert.Empty(t, tags.StudyDate)
+	assert.Equal(t, []string{"M"}, tags.PatientSex)
+	assert.Equal(t, []string{"YES"}, tags.PatientIdentityRemoved)
+	images, _, _ := app.objectStore.GetSlice(nil, fmt.Sprintf("study_id.keyword:%s AND type.keyword:%s", s.ID, constants.ObjectTypeImage),
+		0, constants.DefaultLimit, "", nil)
+	assert.Equal(t, 2, len(images))
+
+	assert.Equal(t, 2, len(orthancInstances))
+	for _, instance := range orthancInstances {
+		assert.Equal(t, "p1."+tags.StudyInstanceUID[0], instance["StudyInstanceUID"])
+		assert.Equal(t, tags.PatientID[0], instance["PatientID"])
+		assert.Equal(t, "", instance["PatientName"])
+		_, found := instance["InstitutionName"]
+		assert.False(t, found)
+	}
+
+	mappings, _, _ := app.deidentificationStore.GetSlice(map[string][]string{"original.keyword": {"1.1"}}, "", 0, 10, "")
+	assert.Equal(t, 1, len(mappings))
+	assert.Equal(t, tags.StudyInstanceUID[0], mappings[0].Masked)
+	// the same study of another upload gets the same UIDs
+	d := newDeidentifier(&project.Project{ID: "p1", DeidentificationProfile: &project.DeidentificationProfile{}}, []byte("secret"))
+	_, masked, _ := d.deidentify(map[string]string{"StudyInstanceUID": "1.1", "SeriesInstanceUID": "1.1.1", "SOPInstanceUID": "1.1.1.1"})
+	assert.Equal(t, tags.StudyInstanceUID[0], masked["StudyInstanceUID"])
+
+	var report struct {
+		Data PHIReport `json:"data"`
+	}
+	rec = serve(engine, http.MethodGet, "/studies/phi_check?project_id=p1", "", "")
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.Data.Studies)
+	assert.True(t, report.Data.Clean)
+
+	rec = serve(engine, http.MethodGet, "/studies/phi_check?project_id=p2", "", "")
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.False(t, report.Data.Clean)
+	assert.Equal(t, 1, report.Data.StudiesWithPHI)
+	assert.Equal(t, []PHIFinding{
+		{StudyID: "s2", Code: "STD-1", Tag: "PatientID", Reason: constants.PHIReasonNotMasked},
+		{StudyID: "s2", Code: "STD-1", Tag: "PatientName", Reason: constants.PHIReasonPresent},
+		{StudyID: "s2", Code: "STD-1", Tag: "StudyInstanceUID", Reason: constants.PHIReasonNotMasked},
+	}, report.Data.Findings)
+}
+
+func TestUploadStudiesDICOMweb(t *testing.T) {
+	orthancInstances := make(map[string]map[string]string)
+	orthanc := newOrthancServer(orthancInstances)
+	defer orthanc.Close()
+	fake := NewFakeDICOMweb()
+	dicomweb := httptest.NewServer(fake)
+	defer dicomweb.Close()
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app := NewStudyAPI(NewStudyMemory(), NewTaskMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		&StudyOrthanC{uri: orthanc.URL, httpClient: httpclient.NewClient()}, zap.NewNop())
+	app.pacs.Add("hospital", NewDICOMweb(dicomweb.URL))
+	app.SetIDGenerator(helper.NewIDGenerator(idServer.URL))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", PACS: "hospital"}))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p2", PACS: "unknown"}))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/studies", func(c *gin.Context) {
+		c.Set(mw.GIN_CONTEXT_AUTHINFO, mw.Account{ID: "u1"})
+	})
+	group.GET("/:id", app.GetStudy)
+	group.DELETE("/:id", app.DeleteStudy)
+	group.POST("/upload", app.UploadStudies)
+	group.GET("/upload/:id", app.GetIngestJob)
+
+	upload := func(projectID string) IngestJob {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for i, sop := range []string{"1.1.1.1", "1.1.1.2"} {
+			w, _ := form.CreateFormFile("files", fmt.Sprintf("%d.dcm", i))
+			w.Write(newDICOMFile(map[string]string{"StudyInstanceUID": "1.1", "SeriesInstanceUID": "1.1.1", "SOPInstanceUID": sop,
+				"Modality": "CT", "PatientName": "DOE^JOHN", "Rows": "512"}))
+		}
+		assert.Nil(t, form.Close())
+		req := httptest.NewRequest(http.MethodPost, "/studies/upload?project_id="+projectID, bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp struct {
+			Data IngestJob `json:"data"`
+		}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		for i := 0; i < 100 && resp.Data.Status == constants.IngestStatusRunning; i++ {
+			time.Sleep(10 * time.Millisecond)
+			rec = serve(engine, http.MethodGet, "/studies/upload/"+resp.Data.ID, "", "")
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		}
+		return resp.Data
+	}
+
+	job := upload("p1")
+	assert.Equal(t, constants.IngestStatusDone, job.Status)
+	assert.Equal(t, 0, len(job.Errors))
+	assert.Equal(t, 1, len(job.StudyIDs))
+	assert.Equal(t, 2, fake.Count())
+	assert.Equal(t, 0, len(orthancInstances))
+	stored := fake.Tags("p1.1.1.1.2")
+	assert.Equal(t, "p1.1.1", stored["StudyInstanceUID"])
+	assert.Equal(t, "DOE^JOHN", stored["PatientName"])
+	assert.Equal(t, "512", stored["Rows"])
+
+	tags, err := NewDICOMweb(dicomweb.URL).GetInstanceTags("p1.1.1", "p1.1.1.1", "p1.1.1.1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, stored, tags)
+
+	rec := serve(engine, http.MethodGet, "/studies/"+job.StudyIDs[0], "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = serve(engine, http.MethodDelete, "/studies/"+job.StudyIDs[0], "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 0, fake.Count())
+
+	job = upload("p2")
+	assert.Equal(t, constants.IngestStatusFailed, job.Status)
+	assert.Equal(t, "PACS unknown is not configured", job.Error)
+}
+
+func TestReconciliation(t *testing.T) {
+	orthanc, hospital := NewFakeDICOMweb(), NewFakeDICOMweb()
+	orthancServer, hospitalServer := httptest.NewServer(orthanc), httptest.NewServer(hospital)
+	defer orthancServer.Close()
+	defer hospitalServer.Close()
+
+	app := NewStudyAPI(NewStudyMemory(), NewTaskMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		NewDICOMweb(orthancServer.URL), zap.NewNop())
+	app.pacs.Add("hospital", NewDICOMweb(hospitalServer.URL))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", PACS: "hospital"}))
+
+	store := func(pacs PACS, study, series, sop string) {
+		assert.Nil(t, pacs.StoreInstance(newDICOMFile(map[string]string{
+			"StudyInstanceUID": study, "SeriesInstanceUID": series, "SOPInstanceUID": sop,
+		})))
+	}
+	hospitalPACS, _ := app.pacs.Get("hospital")
+	orthancPACS, _ := app.pacs.Get("")
+	// a study whose objects were not created
+	store(hospitalPACS, "p1.1.1", "p1.1.1.1", "p1.1.1.1.1")
+	store(hospitalPACS, "p1.1.1", "p1.1.1.2", "p1.1.1.2.1")
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", Code: "STD-1", ProjectID: "p1", Status: constants.StudyStatusUnassigned,
+		DICOMTags: &DICOMTags{StudyInstanceUID: []string{"1.1"}}}))
+	// a study whose DICOM was lost
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s2", Code: "STD-2", ProjectID: "p1", Status: constants.StudyStatusUnassigned,
+		DICOMTags: &DICOMTags{StudyInstanceUID: []string{"2.2"}}}))
+	// a study deleted from the project only, and one of no project
+	store(hospitalPACS, "p1.3.3", "p1.3.3.1", "p1.3.3.1.1")
+	store(orthancPACS, "4.4", "4.4.1", "4.4.1.1")
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/studies/reconciliation", app.GetReconciliation)
+	engine.POST("/studies/reconciliation", app.RepairReconciliation)
+
+	var resp struct {
+		Data ReconciliationReport `json:"data"`
+	}
+	rec := serve(engine, http.MethodGet, "/studies/reconciliation", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	report := resp.Data
+	assert.Equal(t, 2, report.Studies)
+	assert.Equal(t, 3, report.PACSStudies)
+	assert.Equal(t, 1, report.MissingDICOM)
+	assert.Equal(t, 1, report.MissingObjects)
+	assert.Equal(t, 2, report.UnreferencedDICOM)
+	assert.Equal(t, []ReconciliationFinding{
+		{Problem: constants.ReconcileMissingObjects, PACS: "hospital", ProjectID: "p1", StudyID: "s1", Code: "STD-1", StudyInstanceUID: "p1.1.1"},
+		{Problem: constants.ReconcileMissingDICOM, PACS: "hospital", ProjectID: "p1", StudyID: "s2", Code: "STD-2", StudyInstanceUID: "p1.2.2"},
+		{Problem: constants.ReconcileUnreferencedDICOM, PACS: "hospital", ProjectID: "p1", StudyInstanceUID: "p1.3.3"},
+		{Problem: constants.ReconcileUnreferencedDICOM, PACS: constants.PACSOrthanc, StudyInstanceUID: "4.4"},
+	}, report.Findings)
+	assert.Equal(t, 3, hospital.Count())
+
+	rec = serve(engine, http.MethodPost, "/studies/reconciliation?project_id=p1", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	report = resp.Data
+	assert.Equal(t, 2, report.PACSStudies)
+	assert.Equal(t, 1, report.UnreferencedDICOM)
+	for _, finding := range report.Findings {
+		assert.Equal(t, finding.Problem != constants.ReconcileMissingDICOM, finding.Repaired)
+	}
+	assert.Equal(t, 2, hospital.Count())
+	assert.Equal(t, 1, orthanc.Count())
+	images, _, _ := app.objectStore.GetSlice(nil, fmt.Sprintf("study_id.keyword:s1 AND type.keyword:%s", constants.ObjectTypeImage),
+		0, constants.DefaultLimit, "", nil)
+	assert.Equal(t, 2, len(images))
+	for _, image := range images {
+		assert.Equal(t, "1.1", image.Meta.StudyInstanceUID)
+		assert.False(t, strings.HasPrefix(image.Meta.SOPInstanceUID, "p1."))
+	}
+
+	report2, err := app.Reconcile("p1", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report2.MissingDICOM)
+	assert.Equal(t, 0, report2.MissingObjects)
+	assert.Equal(t, 0, report2.UnreferencedDICOM)
+}
+
+func TestReconciliationDuringUpload(t *testing.T) {
+	hospital := NewFakeDICOMweb()
+	var posts int32
+	stored, release := make(chan bool), make(chan bool)
+	hospitalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the upload stops after its first file (the orphan is the first post) until released
+		if r.Method == http.MethodPost && atomic.AddInt32(&posts, 1) == 3 {
+			stored <- true
+			<-release
+		}
+		hospital.ServeHTTP(w, r)
+	}))
+	defer hospitalServer.Close()
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	orthancServer := httptest.NewServer(NewFakeDICOMweb())
+	defer orthancServer.Close()
+
+	app := NewStudyAPI(NewStudyMemory(), NewTaskMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		NewDICOMweb(orthancServer.URL), zap.NewNop())
+	app.pacs.Add("hospital", NewDICOMweb(hospitalServer.URL))
+	app.SetIDGenerator(helper.NewIDGenerator(idServer.URL))
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", PACS: "hospital"}))
+	hospitalPACS, _ := app.pacs.Get("hospital")
+	assert.Nil(t, hospitalPACS.StoreInstance(newDICOMFile(map[string]string{
+		"StudyInstanceUID": "p1.9.9", "SeriesInstanceUID": "p1.9.9.1", "SOPInstanceUID": "p1.9.9.1.1",
+	})))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/studies", func(c *gin.Context) {
+		c.Set(mw.GIN_CONTEXT_AUTHINFO, mw.Account{ID: "u1"})
+	})
+	group.POST("/upload", app.UploadStudies)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i, sop := range []string{"1.1.1.1", "1.1.1.2"} {
+		w, _ := form.CreateFormFile("files", fmt.Sprintf("%d.dcm", i))
+		w.Write(newDICOMFile(map[string]string{"StudyInstanceUID": "1.1", "SeriesInstanceUID": "1.1.1", "SOPInstanceUID": sop}))
+	}
+	assert.Nil(t, form.Close())
+	req := httptest.NewRequest(http.MethodPost, "/studies/upload?project_id=p1", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data IngestJob `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	// the first file of the upload is in the PACS, its study is not created yet
+	<-stored
+	report, err := app.Reconcile("p1", true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.UnreferencedDICOM)
+	for _, finding := range report.Findings {
+		assert.False(t, finding.Repaired)
+		assert.NotEmpty(t, finding.Error)
+	}
+	assert.Equal(t, 2, hospital.Count())
+
+	// a repair waits for the studies of the upload being created
+	done := make(chan *ReconciliationReport)
+	go func() {
+		report, err := app.Reconcile("p1", true)
+		assert.Nil(t, err)
+		done <- report
+	}()
+	release <- true
+	report = <-done
+	job := resp.Data
+	for i := 0; i < 100; i++ {
+		current, _, _ := app.ingestJobStore.Get(nil, "_id:"+job.ID)
+		if job = *current; job.Status != constants.IngestStatusRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, constants.IngestStatusDone, job.Status)
+	assert.Equal(t, 3, hospital.Count())
+
+	// the orphan is deleted once the upload is past the grace period
+	report, err = app.Reconcile("p1", true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.UnreferencedDICOM)
+	assert.Equal(t, 3, hospital.Count())
+	assert.Nil(t, app.ingestJobStore.Update(job, kvStr2Inf{
+		"finished_at": time.Now().Add(-2*reconciliationGrace).UnixNano() / int64(time.Millisecond),
+	}))
+	report, err = app.Reconcile("p1", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []ReconciliationFinding{
+		{Problem: constants.ReconcileUnreferencedDICOM, PACS: "hospital", ProjectID: "p1", StudyInstanceUID: "p1.9.9", Repaired: true},
+	}, report.Findings)
+	assert.Equal(t, 2, hospital.Count())
+}
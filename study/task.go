@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
 
 	"github.com/google/uuid"
 )
@@ -14,11 +15,14 @@ var mapTaskStatus = map[string]int{
 	constants.TaskStatusNew:       0,
 	constants.TaskStatusDoing:     1,
 	constants.TaskStatusCompleted: 2,
+	constants.TaskStatusRejected:  3,
+	constants.TaskStatusReturned:  4,
 }
 
 var mapTaskType = map[string]bool{
-	constants.TaskTypeAnnotate: true,
-	constants.TaskTypeReview:   true,
+	constants.TaskTypeAnnotate:  true,
+	constants.TaskTypeReview:    true,
+	constants.TaskTypeArbitrate: true,
 }
 
 type TaskSubmit struct {
@@ -40,6 +44,18 @@ type TaskAssignment2 struct {
 		Query  string `json:"query"`
 		Status string `json:"status"`
 	} `json:"search_query"`
+	// ReadersPerStudy how many assignees get a task of each study, 1 by default
+	ReadersPerStudy int `json:"readers_per_study,omitempty"`
+	// Weights the share of the studies of each assignee for WEIGHTED, 1 by default
+	Weights map[string]int `json:"weights,omitempty"`
+	// DryRun only returns the AssignmentPreview, nothing is created
+	DryRun bool `json:"dry_run,omitempty"`
+	// DuplicatePolicy SKIP by default, REJECT fails when a task would be a duplicate
+	DuplicatePolicy string `json:"duplicate_policy,omitempty"`
+	// Priority of the created tasks, see Task
+	Priority int `json:"priority,omitempty"`
+	// DueAt of the created tasks, see Task
+	DueAt int64 `json:"due_at,omitempty"`
 }
 
 type Task struct {
@@ -53,10 +69,25 @@ type Task struct {
 	Created    int64  `json:"created"`
 	Modified   int64  `json:"modified"`
 	Type       string `json:"type"`
+	Stage      string `json:"stage,omitempty"`
 	StudyCode  string `json:"study_code,omitempty"`
 	Study      *Study `json:"study,omitempty"`
 	Comment    string `json:"comment"`
 	Archived   bool   `json:"archived"`
+	// RejectReason why the reviewer rejected the REVIEW task, or returned the ANNOTATE task
+	RejectReason string `json:"reject_reason,omitempty"`
+	// ReturnCount how many times the ANNOTATE task came back from review
+	ReturnCount int `json:"return_count"`
+	// SourceTaskIDs the disagreeing tasks an ARBITRATE task decides between
+	SourceTaskIDs []string `json:"source_task_ids,omitempty"`
+	// Priority the highest is claimed first by POST /tasks/next, then the oldest
+	Priority int `json:"priority"`
+	// DueAt when the task should be completed in milliseconds, none when 0
+	DueAt int64 `json:"due_at,omitempty"`
+	// Pooled the task was created without assignee for POST /tasks/next, it
+	// stays so once claimed
+	Pooled bool `json:"pooled,omitempty"`
+	entities.Revision
 }
 
 func (task *Task) NewTask(assgineeID, studyID, projectID, taskType string) {
@@ -138,8 +169,18 @@ func (taskAssignment2 *TaskAssignment2) IsValidData() bool {
 
 func (ta *TaskAssignment2) IsValidStrategy() bool {
 	switch ta.Strategy {
-	case constants.ASSIGN_STRATEGY_ALL, constants.ASSIGN_STRATEGY_EQUALLY:
-		return true
+	case constants.ASSIGN_STRATEGY_ALL, constants.ASSIGN_STRATEGY_EQUALLY, constants.ASSIGN_STRATEGY_LEAST_LOADED,
+		constants.ASSIGN_STRATEGY_WEIGHTED, constants.ASSIGN_STRATEGY_SKILL, constants.ASSIGN_STRATEGY_POOL:
+		if ta.ReadersPerStudy < 0 || ta.DueAt < 0 {
+			return false
+		}
+		for _, weight := range ta.Weights {
+			if weight < 0 {
+				return false
+			}
+		}
+		return ta.DuplicatePolicy == "" || ta.DuplicatePolicy == constants.ASSIGN_DUPLICATE_SKIP ||
+			ta.DuplicatePolicy == constants.ASSIGN_DUPLICATE_REJECT
 	default:
 		return false
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"vindr-lab-api/annotation"
 	"vindr-lab-api/constants"
@@ -15,47 +16,72 @@ import (
 	"vindr-lab-api/project"
 	"vindr-lab-api/utils"
 
+	"github.com/bsm/redislock"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
 type TaskAPI struct {
-	taskStore    *TaskES
-	studyStore   *StudyES
-	projectStore *project.ProjectES
-	antnStore    *annotation.AnnotationES
-	labelStore   *annotation.LabelES
-	idGenerator  *helper.IDGenerator
-	objectStore  *object.ObjectES
-	logger       *zap.Logger
+	taskStore        TaskStore
+	studyStore       StudyStore
+	projectStore     project.ProjectStore
+	antnStore        annotation.AnnotationStore
+	antnHistoryStore annotation.AnnotationHistoryStore
+	labelStore       annotation.LabelStore
+	idGenerator      *helper.IDGenerator
+	objectStore      object.ObjectStore
+	transactor       Transactor
+	reviewStrategy   string
+	locker           *redislock.Client
+	claims           sync.Mutex
+	eventStore       TaskEventStore
+	notifier         Notifier
+	logger           *zap.Logger
 }
 
-func NewTaskAPI(taskStore *TaskES, studyStore *StudyES, projectStore *project.ProjectES, objectStore *object.ObjectES, antnStore *annotation.AnnotationES, labelStore *annotation.LabelES, idGenerator *helper.IDGenerator, logger *zap.Logger) (app *TaskAPI) {
+func NewTaskAPI(taskStore TaskStore, studyStore StudyStore, projectStore project.ProjectStore, objectStore object.ObjectStore, antnStore annotation.AnnotationStore, antnHistoryStore annotation.AnnotationHistoryStore, labelStore annotation.LabelStore, idGenerator *helper.IDGenerator, logger *zap.Logger) (app *TaskAPI) {
 	app = &TaskAPI{
-		taskStore:    taskStore,
-		studyStore:   studyStore,
-		projectStore: projectStore,
-		objectStore:  objectStore,
-		idGenerator:  idGenerator,
-		antnStore:    antnStore,
-		labelStore:   labelStore,
-		logger:       logger,
+		taskStore:        taskStore,
+		studyStore:       studyStore,
+		projectStore:     projectStore,
+		objectStore:      objectStore,
+		idGenerator:      idGenerator,
+		antnStore:        antnStore,
+		antnHistoryStore: antnHistoryStore,
+		labelStore:       labelStore,
+		transactor:       storeTransactor{taskStore, studyStore},
+		reviewStrategy:   constants.ASSIGN_STRATEGY_EQUALLY,
+		eventStore:       NewTaskEventMemory(),
+		logger:           logger,
 	}
 	return app
 }
 
+// SetTransactor groups the task and study writes of assignment, status changes
+// and deletion, by default they go straight through the stores
+func (app *TaskAPI) SetTransactor(transactor Transactor) {
+	app.transactor = transactor
+}
+
 func (app *TaskAPI) InitRoute(engine *gin.Engine, path string) {
 	group := engine.Group(path, mw.WrapAuthInfo(app.logger))
 	group.GET("", mw.ValidPerms(path, mw.PERM_R), app.GetTasks)
 	group.POST("/assign", mw.ValidPerms(path, mw.PERM_C), app.CreateTask)
 	group.POST("/delete_many", mw.ValidPerms(path, mw.PERM_D), app.DeleteTasks)
 	group.POST("/update_status_many", mw.ValidPerms(path, mw.PERM_U), app.UpdateTasksStatus)
+	group.POST("/update_schedule_many", mw.ValidPerms(path, mw.PERM_U), app.UpdateTasksSchedule)
+	group.POST("/next", mw.ValidPerms(path, mw.PERM_U), app.ClaimNextTask)
+	group.POST("/reassign", mw.ValidPerms(path, mw.PERM_C), app.ReassignTasks)
 	group.GET("/:id", mw.ValidPerms(path, mw.PERM_R), app.GetTask)
 	group.PUT("/:id", mw.ValidPerms(path, mw.PERM_U), app.UpdateTask)
 	group.DELETE("/:id", mw.ValidPerms(path, mw.PERM_D), app.DeleteTask)
 	group.PUT("/:id/annotations", mw.ValidPerms(path, mw.PERM_U), app.SetManyAnnotationsV2)
 	group.PUT("/:id/status", mw.ValidPerms(path, mw.PERM_U), app.UpdateTaskStatus)
 	group.PUT("/:id/archive", mw.ValidPerms(path, mw.PERM_U), app.ChangeArchiveStatus)
+	group.GET("/:id/history", mw.ValidPerms(path, mw.PERM_R), app.GetTaskHistory)
+	group.GET("/:id/sources", mw.ValidPerms(path, mw.PERM_R), app.GetTaskSources)
+	group.GET("/:id/events", mw.ValidPerms(path, mw.PERM_R), app.GetTaskEvents)
+	group.POST("/:id/restore", mw.ValidPerms(path, mw.PERM_U), app.RestoreTaskAnnotations)
 }
 
 func (app *TaskAPI) GetTask(c *gin.Context) {
@@ -64,6 +90,11 @@ func (app *TaskAPI) GetTask(c *gin.Context) {
 	taskID := c.Param(constants.ParamID)
 
 	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -71,6 +102,7 @@ func (app *TaskAPI) GetTask(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", task.ETag())
 	resp.Data = *task
 	c.JSON(http.StatusOK, resp)
 }
@@ -85,6 +117,11 @@ func (app *TaskAPI) GetTasks(c *gin.Context) {
 	if sort == "" && queries == nil && queryStr == "" {
 		sort = "-created"
 	}
+	// the work list of an assignee comes by priority then due date, tasks
+	// without one last
+	if c.Query(constants.ParamSort) == "" && role != constants.ProjRoleProjectOwner {
+		sort = "-priority,due_at,-created"
+	}
 
 	tasks := make([]Task, 0)
 	esReturn := entities.ESReturn{}
@@ -109,7 +146,7 @@ func (app *TaskAPI) GetTasks(c *gin.Context) {
 		esReturn = *esReturn1
 
 		break
-	case constants.ProjRoleAnnotator, constants.ProjRoleReviewer:
+	case constants.ProjRoleAnnotator, constants.ProjRoleReviewer, constants.ProjRoleArbitrator:
 
 		if queryStr != "" {
 			queryStr = fmt.Sprintf("%s AND assignee_id.keyword:%s", queryStr, authInfo.ID)
@@ -165,45 +202,93 @@ func (app *TaskAPI) CreateTask(c *gin.Context) {
 		return
 	}
 
-	mapStudyID2Code := GetStudyIDsByAssignRequest(ta2, *app.studyStore)
-	for assignType, assignees := range ta2.AssigneeIDs {
-		tasks, err := DistributeTask(mapStudyID2Code, ta2, app.idGenerator, assignees,
-			ta2.ProjectID, authInfo.ID, assignType)
-		if err != nil {
-			utils.LogError(err)
+	p, err := app.getProject(ta2.ProjectID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	mapStudyID2Code := GetStudyIDsByAssignRequest(ta2, app.studyStore)
+	assignees := make([]string, 0)
+	for _, assigneesOfStage := range ta2.AssigneeIDs {
+		assignees = append(assignees, assigneesOfStage...)
+	}
+	workload, err := loadWorkload(app.taskStore, app.studyStore, p, ta2.Strategy, assignees, mapStudyID2Code)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	assignments, preview, err := planTasks(app.taskStore, p, ta2, mapStudyID2Code, workload)
+	if err != nil {
+		utils.LogError(err)
+		if errors.Is(err, errInvalidAssignment) {
 			resp.ErrorCode = constants.ServerInvalidData
 			c.JSON(http.StatusBadRequest, resp)
 			return
 		}
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	resp.Data = preview
+	if ta2.DryRun {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if ta2.DuplicatePolicy == constants.ASSIGN_DUPLICATE_REJECT && preview.Duplicates > 0 {
+		utils.LogError(fmt.Errorf("%d tasks of project %s are already assigned", preview.Duplicates, ta2.ProjectID))
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
 
-		if len(tasks) > 0 {
-			err = app.taskStore.Bulk(tasks)
-			if err != nil {
-				utils.LogError(err)
-				resp.ErrorCode = constants.ServerError
-				c.JSON(http.StatusInternalServerError, resp)
-				return
-			}
+	tasks, err := createAssignedTasks(app.idGenerator, mapStudyID2Code, assignments, ta2.ProjectID, authInfo.ID, ta2.Priority, ta2.DueAt)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
 
-			for i := range tasks {
-				studyID := tasks[i].StudyID
-				utils.LogDebug(studyID)
-				err1 := app.studyStore.Update(Study{ID: studyID}, kvStr2Inf{
-					"status": constants.StudyStatusAssigned,
-				})
-				if err1 != nil {
-					utils.LogError(err)
-					resp.ErrorCode = constants.ServerError
-					c.JSON(http.StatusInternalServerError, resp)
-					return
-				}
-			}
+	if len(tasks) > 0 {
+		err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+			return assignTasks(taskStore, studyStore, tasks)
+		})
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
 		}
 	}
 	c.JSON(http.StatusOK, resp)
 	return
 }
 
+// assignTasks creates the tasks then marks their studies as assigned
+func assignTasks(taskStore TaskStore, studyStore StudyStore, tasks []Task) error {
+	if err := taskStore.Bulk(tasks); err != nil {
+		return err
+	}
+
+	for i := range tasks {
+		studyID := tasks[i].StudyID
+		utils.LogDebug(studyID)
+		err := studyStore.Update(Study{ID: studyID}, kvStr2Inf{
+			"status": constants.StudyStatusAssigned,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type SetManyAnnotationsBody struct {
 	Annotations []annotation.Annotation `json:"annotations"`
 	Comment     string                  `json:"comment"`
@@ -219,6 +304,11 @@ func (app *TaskAPI) SetManyAnnotations(c *gin.Context) {
 		return
 	}
 	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -330,6 +420,11 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 		return
 	}
 	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -346,8 +441,9 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 	var setManyBody SetManyAnnotationsBody
 	err = c.ShouldBindJSON(&setManyBody)
 	authInfo := mw.GetAuthInfoFromGin(c)
+	rev, err1 := entities.ParseRevision(c.GetHeader("If-Match"))
 
-	if err != nil {
+	if err != nil || err1 != nil {
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
 		return
@@ -356,7 +452,15 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 	annotations := setManyBody.Annotations
 	taskComment := setManyBody.Comment
 
-	err = app.taskStore.Update(Task{ID: taskID}, kvStr2Inf{"comment": taskComment})
+	// the comment is written first and conditionally, a save based on an
+	// older state of the task is rejected before any annotation is written.
+	// Every save updates the task which moves its ETag on
+	err = app.taskStore.Update(Task{ID: taskID, Revision: rev}, kvStr2Inf{"comment": taskComment})
+	if errors.Is(err, utils.ErrVersionConflict) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -367,8 +471,8 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 	if len(annotations) > 0 {
 
 		unauthorizedAntns := 0
-		mapAntnType2Antns := make(map[string][]annotation.Annotation)
-		deleteIDs := make([]string, 0)
+		newAnnotations := make([]annotation.Annotation, 0)
+		deleted := make([]annotation.Annotation, 0)
 
 		for i := range annotations {
 			a := annotations[i]
@@ -388,13 +492,13 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 						labelID := a.LabelIDs[0]
 						l, _, err := app.labelStore.Get(nil, fmt.Sprintf("_id:%s", labelID))
 						if err == nil {
-							objectID, err := getObjectIDFromUID(a, l.Scope, *app.objectStore)
+							objectID, err := getObjectIDFromUID(a, l.Scope, app.objectStore)
 							if err == nil {
 								a.ObjectID = objectID
 							}
 						}
 					} else {
-						objectID, err := getObjectIDFromUID(a, constants.ObjectTypeSeries, *app.objectStore)
+						objectID, err := getObjectIDFromUID(a, constants.ObjectTypeSeries, app.objectStore)
 						if err == nil {
 							a.ObjectID = objectID
 						}
@@ -403,13 +507,12 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 
 				if a.IsValidAnnotation() {
 					a.Labels = nil
-					// newAnnotations = append(newAnnotations, annotations[i])
-					mapAntnType2Antns[a.Type] = append(mapAntnType2Antns[a.Type], a)
+					newAnnotations = append(newAnnotations, a)
 				}
 				break
 			case constants.EventDelete:
 				if a.ID != "" {
-					deleteIDs = append(deleteIDs, a.ID)
+					deleted = append(deleted, a)
 				}
 				break
 			default:
@@ -419,36 +522,28 @@ func (app *TaskAPI) SetManyAnnotationsV2(c *gin.Context) {
 		}
 		utils.LogInfo("Unable to access %d annotations", unauthorizedAntns)
 
-		for k, newAnnotations := range mapAntnType2Antns {
-			if newAnnotations != nil && len(newAnnotations) > 0 {
-				utils.LogInfo("%s\t%d", k, len(newAnnotations))
-				err := app.antnStore.BulkCreate(newAnnotations)
-				if err != nil {
-					utils.LogError(err)
-					resp.ErrorCode = constants.ServerError
-					c.JSON(http.StatusInternalServerError, resp)
-					return
-				}
-			}
+		err := app.writeAnnotations(authInfo.ID, newAnnotations, deleted, 0)
+		if errors.Is(err, utils.ErrVersionConflict) {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerConflict
+			c.JSON(http.StatusConflict, resp)
+			return
 		}
-
-		if len(deleteIDs) > 0 {
-			utils.LogDebug("%v", deleteIDs)
-			for i := range deleteIDs {
-				err := app.antnStore.Delete(nil, fmt.Sprintf("_id:%s", deleteIDs[i]))
-				if err != nil {
-					utils.LogError(err)
-					resp.ErrorCode = constants.ServerError
-					c.JSON(http.StatusInternalServerError, resp)
-					return
-				}
-			}
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
 		}
 	}
+
+	if task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID)); err == nil {
+		c.Header("ETag", task.ETag())
+	}
 	c.JSON(http.StatusOK, resp)
 }
 
-func getObjectIDFromUID(a annotation.Annotation, objectType string, objectES object.ObjectES) (string, error) {
+func getObjectIDFromUID(a annotation.Annotation, objectType string, objectES object.ObjectStore) (string, error) {
 
 	uid := ""
 	keySearch := ""
@@ -494,14 +589,25 @@ func (app *TaskAPI) UpdateTask(c *gin.Context) {
 
 	updateMap := make(map[string]interface{})
 	c.ShouldBind(&updateMap)
+	rev, err := entities.ParseRevision(c.GetHeader("If-Match"))
 
-	if _, found := updateMap["status"]; found {
+	_, foundStatus := updateMap["status"]
+	_, foundReason := updateMap["reject_reason"]
+	_, foundCount := updateMap["return_count"]
+	if foundStatus || foundReason || foundCount || err != nil {
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
+	delete(updateMap, "seq_no")
+	delete(updateMap, "primary_term")
 
-	err := app.taskStore.Update(Task{ID: taskID}, updateMap)
+	err = app.taskStore.Update(Task{ID: taskID, Revision: rev}, updateMap)
+	if errors.Is(err, utils.ErrVersionConflict) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
 	if err != nil {
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
@@ -531,32 +637,115 @@ func (app *TaskAPI) UpdateTaskStatus(c *gin.Context) {
 		return
 	}
 
-	if !IsValidTaskStatus(updateMap["status"]) {
+	// tasks are only RETURNED by the rejection of their review
+	status := updateMap["status"]
+	if !IsValidTaskStatus(status) || status == constants.TaskStatusReturned {
 		utils.LogError(fmt.Errorf("status is invalid"))
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
 
-	err = app.taskStore.Update(Task{ID: taskID}, kvStr2Inf{
-		"status": updateMap["status"],
-	})
+	reason := strings.TrimSpace(updateMap["reason"])
+	if status == constants.TaskStatusRejected && reason == "" {
+		utils.LogError(fmt.Errorf("reason is required to reject a task"))
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	rev, err := entities.ParseRevision(c.GetHeader("If-Match"))
 	if err != nil {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	current, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
 		c.JSON(http.StatusInternalServerError, resp)
 		return
 	}
+	p, err := app.getProject(current.ProjectID)
+	if err == nil {
+		err = checkTransition(p.GetWorkflow(), *current, status)
+	}
+	if errors.Is(err, errInvalidTransition) {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	// the transition was checked on the task as read, it must not change meanwhile
+	if rev.IsSet() {
+		current.Revision = rev
+	}
 
-	//then check and update study's status
-	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
-	if err == nil && task != nil {
-		err1 := app.UpdateStudyStatus(task.ProjectID, map[string]bool{
+	var task *Task
+	err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+		if status == constants.TaskStatusRejected {
+			if err := rejectTask(taskStore, p.GetWorkflow(), *current, reason); err != nil {
+				return err
+			}
+		} else {
+			err := taskStore.Update(Task{ID: taskID, Revision: current.Revision}, kvStr2Inf{
+				"status": status,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		//then check and update study's status
+		var err error
+		task, _, err = taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+		if err != nil {
+			return nil
+		}
+		if err := reopenRejectedTasks(taskStore, p.GetWorkflow(), *task); err != nil {
+			return err
+		}
+		if err := app.advanceWorkflow(taskStore, p, *task); err != nil {
+			return err
+		}
+		return updateStudyStatus(taskStore, studyStore, task.ProjectID, map[string]bool{
 			task.StudyID: true,
 		})
-		if err1 != nil {
-			resp.ErrorCode = constants.ServerError
-			c.JSON(http.StatusInternalServerError, resp)
-			return
+	})
+	if errors.Is(err, errCannotReject) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	if errors.Is(err, utils.ErrVersionConflict) {
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	// the reviewer can still start from scratch if the consensus fails
+	if task != nil {
+		if err1 := app.BuildConsensus(*task); err1 != nil {
+			utils.LogError(err1)
 		}
 	}
 
@@ -580,8 +769,9 @@ func (app *TaskAPI) UpdateTasksStatus(c *gin.Context) {
 		return
 	}
 
+	// rejecting needs a reason, see UpdateTaskStatus
 	newStatus := updateRequest.Status
-	if !IsValidTaskStatus(newStatus) {
+	if !IsValidTaskStatus(newStatus) || newStatus == constants.TaskStatusRejected || newStatus == constants.TaskStatusReturned {
 		utils.LogError(fmt.Errorf("status is invalid"))
 		resp.ErrorCode = constants.ServerInvalidData
 		c.JSON(http.StatusBadRequest, resp)
@@ -592,15 +782,39 @@ func (app *TaskAPI) UpdateTasksStatus(c *gin.Context) {
 
 	tasks := make([]Task, 0)
 	mapStudies := make(map[string]bool)
+	mapProject := make(map[string]*project.Project)
 	for i := range updateRequest.IDs {
 		taskID := updateRequest.IDs[i]
 		task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+		if errors.Is(err, utils.ErrNotFound) {
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusNotFound, resp)
+			return
+		}
 		if err != nil {
 			utils.LogError(err)
 			resp.ErrorCode = constants.ServerError
 			c.JSON(http.StatusInternalServerError, resp)
 			return
 		}
+
+		p, found := mapProject[task.ProjectID]
+		if !found {
+			p, err = app.getProject(task.ProjectID)
+			if err != nil {
+				utils.LogError(err)
+				resp.ErrorCode = constants.ServerError
+				c.JSON(http.StatusInternalServerError, resp)
+				return
+			}
+			mapProject[task.ProjectID] = p
+		}
+		if err := checkTransition(p.GetWorkflow(), *task, newStatus); err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerInvalidData
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
 		task.Status = newStatus
 
 		mapStudies[task.StudyID] = true
@@ -608,23 +822,110 @@ func (app *TaskAPI) UpdateTasksStatus(c *gin.Context) {
 	}
 
 	if len(tasks) > 0 {
-		err := app.taskStore.Bulk(tasks)
-		if err != nil {
+		// the tasks carry the revision they were read with
+		err := app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+			if err := taskStore.Bulk(tasks); err != nil {
+				return err
+			}
+			for i := range tasks {
+				p := mapProject[tasks[i].ProjectID]
+				if err := reopenRejectedTasks(taskStore, p.GetWorkflow(), tasks[i]); err != nil {
+					return err
+				}
+				if err := app.advanceWorkflow(taskStore, p, tasks[i]); err != nil {
+					return err
+				}
+			}
+			return updateStudyStatus(taskStore, studyStore, tasks[0].ProjectID, mapStudies)
+		})
+		if errors.Is(err, utils.ErrVersionConflict) {
 			utils.LogError(err)
-			resp.ErrorCode = constants.ServerError
-			c.JSON(http.StatusInternalServerError, resp)
+			resp.ErrorCode = constants.ServerConflict
+			c.JSON(http.StatusConflict, resp)
 			return
 		}
-
-		err = app.UpdateStudyStatus(tasks[0].ProjectID, mapStudies)
 		if err != nil {
 			utils.LogError(err)
 			resp.ErrorCode = constants.ServerError
 			c.JSON(http.StatusInternalServerError, resp)
 			return
 		}
+
+		mapConsensus := make(map[string]bool)
+		for i := range tasks {
+			if tasks[i].Type != constants.TaskTypeAnnotate || mapConsensus[tasks[i].StudyID] {
+				continue
+			}
+			mapConsensus[tasks[i].StudyID] = true
+			if err := app.BuildConsensus(tasks[i]); err != nil {
+				utils.LogError(err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// UpdateTasksScheduleBody the fields given are set on every task, a DueAt of 0 removes it
+type UpdateTasksScheduleBody struct {
+	IDs      []string `json:"ids"`
+	DueAt    *int64   `json:"due_at"`
+	Priority *int     `json:"priority"`
+}
+
+// UpdateTasksSchedule sets the due date and priority of many tasks
+func (app *TaskAPI) UpdateTasksSchedule(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	var body UpdateTasksScheduleBody
+	if err := c.ShouldBindJSON(&body); err != nil || len(body.IDs) == 0 ||
+		(body.DueAt == nil && body.Priority == nil) || (body.DueAt != nil && *body.DueAt < 0) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	tasks := make([]Task, 0)
+	err := app.taskStore.Query(map[string][]string{"_id": body.IDs}, "", 0, constants.DefaultLimit, "", nil, func(items []Task, es entities.ESReturn) {
+		tasks = append(tasks, items...)
+	})
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	// the tasks are written whole with the revision they were read with, so
+	// modified and the idle time of the task are left as is. A DueAt of 0 is
+	// omitted, missing due dates sort last
+	for i := range tasks {
+		if body.DueAt != nil {
+			tasks[i].DueAt = *body.DueAt
+		}
+		if body.Priority != nil {
+			tasks[i].Priority = *body.Priority
+		}
+	}
+	if len(tasks) > 0 {
+		err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+			return taskStore.Bulk(tasks)
+		})
+	}
+	if errors.Is(err, utils.ErrVersionConflict) {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
 	}
 
+	resp.Count = len(tasks)
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -685,15 +986,13 @@ func (app *TaskAPI) DeleteTask(c *gin.Context) {
 		return
 	}
 
+	// only NEW tasks can be deleted
 	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s AND status.keyword:%s", taskID, constants.TaskStatusNew))
-	if task == nil || err != nil {
-		utils.LogError(err)
-		resp.ErrorCode = constants.ServerError
-		c.JSON(http.StatusInternalServerError, resp)
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
 		return
 	}
-
-	err = app.taskStore.Delete(nil, fmt.Sprintf("_id:%s AND status.keyword:%s", taskID, constants.TaskStatusNew))
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -701,7 +1000,13 @@ func (app *TaskAPI) DeleteTask(c *gin.Context) {
 		return
 	}
 
-	err = app.UpdateStudyStatus(task.ProjectID, mapStudyIDs)
+	err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+		err := taskStore.Delete(nil, fmt.Sprintf("_id:%s AND status.keyword:%s", taskID, constants.TaskStatusNew))
+		if err != nil {
+			return err
+		}
+		return updateStudyStatus(taskStore, studyStore, task.ProjectID, mapStudyIDs)
+	})
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -709,7 +1014,7 @@ func (app *TaskAPI) DeleteTask(c *gin.Context) {
 		return
 	}
 
-	err = app.DeleteAnnotationsOfTasks([]string{taskID})
+	err = app.DeleteAnnotationsOfTasks(mw.GetAuthInfoFromGin(c).ID, []string{taskID})
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -759,17 +1064,15 @@ func (app *TaskAPI) DeleteTasks(c *gin.Context) {
 		}
 	})
 
-	err = app.taskStore.Delete(map[string][]string{
-		"_id": taskIDs,
-	}, fmt.Sprintf("status.keyword:%s", constants.TaskStatusNew))
-	if err != nil {
-		utils.LogError(err)
-		resp.ErrorCode = constants.ServerError
-		c.JSON(http.StatusInternalServerError, resp)
-		return
-	}
-
-	err = app.UpdateStudyStatus(projectID, mapStudyIDs)
+	err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+		err := taskStore.Delete(map[string][]string{
+			"_id": taskIDs,
+		}, fmt.Sprintf("status.keyword:%s", constants.TaskStatusNew))
+		if err != nil {
+			return err
+		}
+		return updateStudyStatus(taskStore, studyStore, projectID, mapStudyIDs)
+	})
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -777,7 +1080,7 @@ func (app *TaskAPI) DeleteTasks(c *gin.Context) {
 		return
 	}
 
-	err = app.DeleteAnnotationsOfTasks(taskIDs)
+	err = app.DeleteAnnotationsOfTasks(mw.GetAuthInfoFromGin(c).ID, taskIDs)
 	if err != nil {
 		utils.LogError(err)
 		resp.ErrorCode = constants.ServerError
@@ -788,14 +1091,14 @@ func (app *TaskAPI) DeleteTasks(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-// UpdateStudyStatus updtes study's status following its tasks's status
-func (app *TaskAPI) UpdateStudyStatus(projectID string, mapStudyIDs map[string]bool) error {
+// updateStudyStatus updtes study's status following its tasks's status
+func updateStudyStatus(taskStore TaskStore, studyStore StudyStore, projectID string, mapStudyIDs map[string]bool) error {
 	// mapStudyIDs := make(map[string]bool)
 
 	for studyID := range mapStudyIDs {
 		mapTaskStatusCount := make(map[string]int)
 		tasksOfStudy := 0
-		err := app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s", projectID, studyID),
+		err := taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s", projectID, studyID),
 			0, constants.DefaultLimit, "", nil,
 			func(tasks []Task, es entities.ESReturn) {
 				for i := range tasks {
@@ -811,30 +1114,17 @@ func (app *TaskAPI) UpdateStudyStatus(projectID string, mapStudyIDs map[string]b
 			return err
 		}
 
-		studyStatus := ""
-		completedTask := mapTaskStatusCount[constants.TaskStatusCompleted]
-		if completedTask > 0 {
-			if completedTask == tasksOfStudy {
-				studyStatus = constants.StudyStatusCompleted
-			} else if completedTask < tasksOfStudy {
-				studyStatus = constants.StudyStatusAssigned
-			} else {
-				return fmt.Errorf("Unexpected completed tasks, required %d got %d", tasksOfStudy, completedTask)
-			}
-		} else {
-			if tasksOfStudy == 0 {
-				studyStatus = constants.StudyStatusUnassigned
-			} else {
-				studyStatus = constants.StudyStatusAssigned
-			}
+		studyStatus, err := studyStatusOf(mapTaskStatusCount, tasksOfStudy)
+		if err != nil {
+			return err
 		}
 
 		if studyStatus != "" {
-			err1 := app.studyStore.Update(Study{ID: studyID}, kvStr2Inf{
+			err1 := studyStore.Update(Study{ID: studyID}, kvStr2Inf{
 				"status": studyStatus,
 			})
 			if err1 != nil {
-				return err
+				return err1
 			}
 		}
 	}
@@ -842,19 +1132,54 @@ func (app *TaskAPI) UpdateStudyStatus(projectID string, mapStudyIDs map[string]b
 	return nil
 }
 
-func (app *TaskAPI) DeleteAnnotationsOfTasks(taskIDs []string) error {
+// studyStatusOf a study is COMPLETED once all its tasks are. REJECTED and
+// RETURNED tasks are being worked on again, they keep the study ASSIGNED
+func studyStatusOf(mapTaskStatusCount map[string]int, tasksOfStudy int) (string, error) {
+	completedTask := mapTaskStatusCount[constants.TaskStatusCompleted]
+	if completedTask > tasksOfStudy {
+		return "", fmt.Errorf("Unexpected completed tasks, required %d got %d", tasksOfStudy, completedTask)
+	}
+
+	switch {
+	case tasksOfStudy == 0:
+		return constants.StudyStatusUnassigned, nil
+	case completedTask == tasksOfStudy:
+		return constants.StudyStatusCompleted, nil
+	default:
+		return constants.StudyStatusAssigned, nil
+	}
+}
+
+func (app *TaskAPI) DeleteAnnotationsOfTasks(actorID string, taskIDs []string) error {
 	for i := range taskIDs {
 		taskID := taskIDs[i]
-		err := app.antnStore.Delete(nil, fmt.Sprintf("task_id.keyword:%s", taskID))
+		antns := make([]annotation.Annotation, 0)
+		err := app.antnStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", taskID), 0, constants.DefaultLimit, "", nil,
+			func(items []annotation.Annotation, es entities.ESReturn) {
+				antns = append(antns, items...)
+			})
 		if err != nil {
 			return err
 		}
+
+		err = app.antnStore.Delete(nil, fmt.Sprintf("task_id.keyword:%s", taskID))
+		if err != nil {
+			return err
+		}
+
+		histories := make([]annotation.AnnotationHistory, 0, len(antns))
+		for j := range antns {
+			histories = append(histories, annotation.NewAnnotationHistory(actorID, &antns[j], nil))
+		}
+		if err := app.antnHistoryStore.BulkCreate(histories); err != nil {
+			utils.LogError(err)
+		}
 	}
 
 	return nil
 }
 
-func GetStudyIDsByAssignRequest(ta TaskAssignment2, studyStore StudyES) map[string]string {
+func GetStudyIDsByAssignRequest(ta TaskAssignment2, studyStore StudyStore) map[string]string {
 	mapStudyID2Code := make(map[string]string)
 
 	switch ta.SourceType {
@@ -862,7 +1187,7 @@ func GetStudyIDsByAssignRequest(ta TaskAssignment2, studyStore StudyES) map[stri
 		studyUIDs := ta.StudyInstanceUIDs
 		for i := range studyUIDs {
 			s, _, err := studyStore.Get(nil, fmt.Sprintf("project_id.keyword:%s AND dicom_tags.StudyInstanceUID.keyword:%s", ta.ProjectID, studyUIDs[i]))
-			if err == nil && s != nil {
+			if err == nil {
 				mapStudyID2Code[s.ID] = s.Code
 			}
 		}
@@ -870,7 +1195,7 @@ func GetStudyIDsByAssignRequest(ta TaskAssignment2, studyStore StudyES) map[stri
 	case constants.ASSIGN_SOURCE_SELECTED:
 		for i := range ta.StudyIDs {
 			s, _, err := studyStore.Get(nil, fmt.Sprintf("_id:%s", ta.StudyIDs[i]))
-			if err == nil && s != nil {
+			if err == nil {
 				mapStudyID2Code[s.ID] = s.Code
 			}
 		}
@@ -905,35 +1230,6 @@ func GetStudyIDsByAssignRequest(ta TaskAssignment2, studyStore StudyES) map[stri
 	return mapStudyID2Code
 }
 
-func DistributeTask(mapStudyID2Code map[string]string, ta2 TaskAssignment2, idGen *helper.IDGenerator,
-	assignees []string, projectID, creatorID, assignType string) ([]Task, error) {
-	tasks := make([]Task, 0)
-
-	switch ta2.Strategy {
-	case constants.ASSIGN_STRATEGY_ALL:
-		for _, assignee := range assignees {
-			for studyID, code := range mapStudyID2Code {
-				task, _ := CreateTask(idGen, code, assignee, ta2.ProjectID, studyID, creatorID, assignType)
-				tasks = append(tasks, *task)
-			}
-		}
-		break
-	case constants.ASSIGN_STRATEGY_EQUALLY:
-		sizeAssignee := len(assignees)
-		count := 0
-		for studyID, code := range mapStudyID2Code {
-			assignee := assignees[count%sizeAssignee]
-			count++
-
-			task, _ := CreateTask(idGen, code, assignee, ta2.ProjectID, studyID, creatorID, assignType)
-			tasks = append(tasks, *task)
-		}
-		break
-	}
-
-	return tasks, nil
-}
-
 func CreateTask(idGen *helper.IDGenerator, code, assigneeID, projectID, studyID, creatorID, taskType string) (*Task, error) {
 	task := Task{}
 	task.CreatorID = creatorID
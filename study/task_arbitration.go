@@ -0,0 +1,164 @@
+package study
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TaskSource a task an ARBITRATE task decides on, with its annotations
+type TaskSource struct {
+	Task        Task                    `json:"task"`
+	Annotations []annotation.Annotation `json:"annotations"`
+}
+
+// tasksDisagree loads the annotations of the tasks and checks them against the rule
+func (app *TaskAPI) tasksDisagree(rule project.DisagreementRule, taskIDs []string) (bool, error) {
+	if len(taskIDs) < 2 {
+		return false, nil
+	}
+
+	antns := make([]annotation.Annotation, 0)
+	err := app.antnStore.Query(map[string][]string{"task_id.keyword": taskIDs}, "", 0, constants.DefaultLimit, "", nil,
+		func(items []annotation.Annotation, es entities.ESReturn) {
+			antns = append(antns, items...)
+		})
+	if err != nil {
+		return false, err
+	}
+	return disagree(rule, antns, taskIDs), nil
+}
+
+// disagree see project.DisagreementRule, shapes are matched like the consensus does
+func disagree(rule project.DisagreementRule, antns []annotation.Annotation, taskIDs []string) bool {
+	mapTask := make(map[string]bool)
+	for _, taskID := range taskIDs {
+		mapTask[taskID] = true
+	}
+
+	// object -> task -> labels
+	tags := make(map[string]map[string]map[string]bool)
+	shapes := make(map[string][]consensusSource)
+	for _, antn := range antns {
+		if !mapTask[antn.TaskID] {
+			continue
+		}
+
+		switch antn.Type {
+		case constants.AntnTypeTag:
+			if _, found := tags[antn.ObjectID]; !found {
+				tags[antn.ObjectID] = make(map[string]map[string]bool)
+			}
+			if _, found := tags[antn.ObjectID][antn.TaskID]; !found {
+				tags[antn.ObjectID][antn.TaskID] = make(map[string]bool)
+			}
+			for _, labelID := range antn.LabelIDs {
+				tags[antn.ObjectID][antn.TaskID][labelID] = true
+			}
+		case constants.AntnTypeBox, constants.AntnTypePolygon:
+			points, ok := annotation.ParsePoints(antn.Data)
+			if !ok {
+				continue
+			}
+			labelIDs := append([]string{}, antn.LabelIDs...)
+			sort.Strings(labelIDs)
+			key := fmt.Sprintf("%s|%s|%v", antn.ObjectID, antn.Type, labelIDs)
+			shapes[key] = append(shapes[key], consensusSource{antn: antn, annotator: antn.TaskID, points: points})
+		}
+	}
+
+	if rule.Tags {
+		for _, byTask := range tags {
+			if len(byTask) != len(mapTask) {
+				return true
+			}
+			var first map[string]bool
+			for _, labels := range byTask {
+				if first == nil {
+					first = labels
+					continue
+				}
+				if len(labels) != len(first) {
+					return true
+				}
+				for labelID := range labels {
+					if !first[labelID] {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	if rule.MinIoU > 0 {
+		for _, sources := range shapes {
+			for _, cluster := range clusterShapes(sources, rule.MinIoU) {
+				if len(cluster.members) != len(mapTask) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// GetTaskSources the tasks an ARBITRATE task decides between, each with its
+// annotations so that they can be shown side by side
+func (app *TaskAPI) GetTaskSources(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	taskID := c.Param(constants.ParamID)
+	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	sources := make([]TaskSource, 0)
+	for _, sourceID := range task.SourceTaskIDs {
+		// a source deleted since the arbitration was created is left out
+		source, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", sourceID))
+		if errors.Is(err, utils.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+
+		antns := make([]annotation.Annotation, 0)
+		err = app.antnStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", sourceID), 0, constants.DefaultLimit, "", nil,
+			func(items []annotation.Annotation, es entities.ESReturn) {
+				antns = append(antns, items...)
+			})
+		if err != nil {
+			utils.LogError(err)
+			resp.ErrorCode = constants.ServerError
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+		sources = append(sources, TaskSource{Task: *source, Annotations: antns})
+	}
+
+	resp.Data = sources
+	resp.Count = len(sources)
+	c.JSON(http.StatusOK, resp)
+}
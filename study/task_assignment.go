@@ -0,0 +1,417 @@
+package study
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/helper"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+)
+
+// errInvalidAssignment the assignment cannot be planned from the request
+var errInvalidAssignment = errors.New("Invalid task assignment")
+
+// mapTaskTypeRole the role the assignees of a task type need
+var mapTaskTypeRole = map[string]string{
+	constants.TaskTypeAnnotate:  constants.ProjRoleAnnotator,
+	constants.TaskTypeReview:    constants.ProjRoleReviewer,
+	constants.TaskTypeArbitrate: constants.ProjRoleArbitrator,
+}
+
+// AssignWorkload what the strategies know of the assignees and studies
+type AssignWorkload struct {
+	// OpenTasks the tasks each assignee has not completed yet in the project
+	OpenTasks map[string]int
+	// Skills of each assignee, see project.ProjectPerson
+	Skills map[string][]string
+	// DICOMTags of each study, only needed by SKILL
+	DICOMTags map[string]*DICOMTags
+}
+
+// taskAssignment one task to create
+type taskAssignment struct {
+	StudyID    string
+	AssigneeID string
+	Stage      string
+	TaskType   string
+}
+
+// AssigneePlan the studies of a stage an assignee gets
+type AssigneePlan struct {
+	AssigneeID string   `json:"assignee_id"`
+	Stage      string   `json:"stage"`
+	StudyIDs   []string `json:"study_ids"`
+}
+
+// AssignConflict something in the way of a planned task, the DUPLICATE_TASK
+// ones are not part of the distribution
+type AssignConflict struct {
+	Type       string `json:"type"`
+	AssigneeID string `json:"assignee_id,omitempty"`
+	StudyID    string `json:"study_id,omitempty"`
+	Stage      string `json:"stage"`
+}
+
+// AssignmentPreview the tasks an assignment creates, or would create on a dry run
+type AssignmentPreview struct {
+	Distribution []AssigneePlan   `json:"distribution"`
+	Conflicts    []AssignConflict `json:"conflicts"`
+	Count        int              `json:"count"`
+	Duplicates   int              `json:"duplicates"`
+}
+
+// Values the values of a DICOM attribute, nil when the study does not have it
+func (tags *DICOMTags) Values(attribute string) []string {
+	if tags == nil {
+		return nil
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return nil
+	}
+	mapTags := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &mapTags); err != nil {
+		return nil
+	}
+
+	var values []string
+	if err := json.Unmarshal(mapTags[attribute], &values); err == nil {
+		return values
+	}
+	var value string
+	if err := json.Unmarshal(mapTags[attribute], &value); err == nil && value != "" {
+		return []string{value}
+	}
+	return nil
+}
+
+// canRead a person without skills reads every study, one with skills only
+// the studies having one of their values for each attribute they list
+func canRead(skills []string, tags *DICOMTags) bool {
+	mapAttribute := make(map[string][]string)
+	for _, skill := range skills {
+		if attribute, value, ok := project.ParseSkill(skill); ok {
+			mapAttribute[attribute] = append(mapAttribute[attribute], value)
+		}
+	}
+
+	for attribute, values := range mapAttribute {
+		matched := false
+		for _, studyValue := range tags.Values(attribute) {
+			for _, value := range values {
+				if strings.EqualFold(studyValue, value) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// planAssignment the tasks of the strategy of ta2, studies are taken in the
+// order of their code and ties between assignees go to the first listed so
+// that the same request always gives the same tasks:
+//   - ALL: every assignee gets every study
+//   - EQUALLY: round-robin
+//   - LEAST_LOADED: who has the fewest open tasks
+//   - WEIGHTED: studies shared in proportion to Weights
+//   - SKILL: who has the fewest open tasks among those whose skills match the study
+//   - POOL: nobody, the tasks are claimed through POST /tasks/next
+//
+// All but ALL give each study to ReadersPerStudy different assignees
+func planAssignment(mapStudyID2Code map[string]string, ta2 TaskAssignment2, assignees []string,
+	workload AssignWorkload) ([]taskAssignment, error) {
+	studyIDs := make([]string, 0, len(mapStudyID2Code))
+	for studyID := range mapStudyID2Code {
+		studyIDs = append(studyIDs, studyID)
+	}
+	sort.Slice(studyIDs, func(i, j int) bool {
+		ci, cj := mapStudyID2Code[studyIDs[i]], mapStudyID2Code[studyIDs[j]]
+		if ci != cj {
+			return ci < cj
+		}
+		return studyIDs[i] < studyIDs[j]
+	})
+
+	candidates := make([]string, 0, len(assignees))
+	mapCandidate := make(map[string]bool)
+	for _, assignee := range assignees {
+		if !mapCandidate[assignee] {
+			mapCandidate[assignee] = true
+			candidates = append(candidates, assignee)
+		}
+	}
+
+	assignments := make([]taskAssignment, 0)
+	if ta2.Strategy == constants.ASSIGN_STRATEGY_ALL {
+		for _, assignee := range candidates {
+			for _, studyID := range studyIDs {
+				assignments = append(assignments, taskAssignment{StudyID: studyID, AssigneeID: assignee})
+			}
+		}
+		return assignments, nil
+	}
+
+	readers := ta2.ReadersPerStudy
+	if readers == 0 {
+		readers = 1
+	}
+	if ta2.Strategy == constants.ASSIGN_STRATEGY_POOL {
+		for _, studyID := range studyIDs {
+			for i := 0; i < readers; i++ {
+				assignments = append(assignments, taskAssignment{StudyID: studyID})
+			}
+		}
+		return assignments, nil
+	}
+
+	// load: what is compared to pick, weight: what it is divided by
+	load := make(map[string]int)
+	weight := make(map[string]int)
+	for _, assignee := range candidates {
+		weight[assignee] = 1
+		switch ta2.Strategy {
+		case constants.ASSIGN_STRATEGY_LEAST_LOADED, constants.ASSIGN_STRATEGY_SKILL:
+			load[assignee] = workload.OpenTasks[assignee]
+		case constants.ASSIGN_STRATEGY_WEIGHTED:
+			if w, found := ta2.Weights[assignee]; found {
+				weight[assignee] = w
+			}
+		}
+	}
+	// (load[a]+1)/weight[a] < (load[b]+1)/weight[b], the share a would reach with one more study
+	before := func(a, b string) bool {
+		return (load[a]+1)*weight[b] < (load[b]+1)*weight[a]
+	}
+
+	for _, studyID := range studyIDs {
+		eligible := make([]string, 0, len(candidates))
+		for _, assignee := range candidates {
+			if weight[assignee] == 0 {
+				continue
+			}
+			if ta2.Strategy == constants.ASSIGN_STRATEGY_SKILL &&
+				!canRead(workload.Skills[assignee], workload.DICOMTags[studyID]) {
+				continue
+			}
+			eligible = append(eligible, assignee)
+		}
+		if len(eligible) < readers {
+			return nil, fmt.Errorf("Study %s needs %d readers but only %d can read it", studyID, readers, len(eligible))
+		}
+
+		sort.SliceStable(eligible, func(i, j int) bool {
+			return before(eligible[i], eligible[j])
+		})
+		for _, assignee := range eligible[:readers] {
+			load[assignee]++
+			assignments = append(assignments, taskAssignment{StudyID: studyID, AssigneeID: assignee})
+		}
+	}
+	return assignments, nil
+}
+
+// loadWorkload the open tasks of the assignees in p, the skills they have
+// there and, for SKILL, the DICOM tags of the studies
+func loadWorkload(taskStore TaskStore, studyStore StudyStore, p *project.Project, strategy string,
+	assignees []string, mapStudyID2Code map[string]string) (AssignWorkload, error) {
+	workload := AssignWorkload{
+		OpenTasks: make(map[string]int),
+		Skills:    make(map[string][]string),
+		DICOMTags: make(map[string]*DICOMTags),
+	}
+	if strategy != constants.ASSIGN_STRATEGY_LEAST_LOADED && strategy != constants.ASSIGN_STRATEGY_SKILL {
+		return workload, nil
+	}
+
+	if len(assignees) > 0 {
+		err := taskStore.Query(map[string][]string{"assignee_id.keyword": assignees, "project_id.keyword": {p.ID}},
+			fmt.Sprintf("archived:%v", false), 0, constants.DefaultLimit, "", nil, func(tasks []Task, es entities.ESReturn) {
+				for i := range tasks {
+					if tasks[i].Status != constants.TaskStatusCompleted {
+						workload.OpenTasks[tasks[i].AssigneeID]++
+					}
+				}
+			})
+		if err != nil {
+			return workload, err
+		}
+	}
+
+	if strategy != constants.ASSIGN_STRATEGY_SKILL {
+		return workload, nil
+	}
+	for _, person := range p.People {
+		workload.Skills[person.ID] = person.Skills
+	}
+	for studyID := range mapStudyID2Code {
+		s, _, err := studyStore.Get(nil, fmt.Sprintf("_id:%s", studyID))
+		if errors.Is(err, utils.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return workload, err
+		}
+		workload.DICOMTags[studyID] = s.DICOMTags
+	}
+	return workload, nil
+}
+
+// planTasks the tasks of every stage of ta2, assignees being keyed by stage or
+// by task type for the first stage of that type. A task whose assignee already
+// has one of the stage for the study is left out as a duplicate, as are the
+// POOL tasks of a study already having some, claimed or not
+func planTasks(taskStore TaskStore, p *project.Project, ta2 TaskAssignment2, mapStudyID2Code map[string]string,
+	workload AssignWorkload) ([]taskAssignment, *AssignmentPreview, error) {
+	workflow := p.GetWorkflow()
+	preview := &AssignmentPreview{Distribution: make([]AssigneePlan, 0), Conflicts: make([]AssignConflict, 0)}
+
+	// stage -> study -> assignees having a task
+	mapAssigned := make(map[string]map[string]map[string]bool)
+	markAssigned := func(stage, studyID, assigneeID string) {
+		if _, found := mapAssigned[stage]; !found {
+			mapAssigned[stage] = make(map[string]map[string]bool)
+		}
+		if _, found := mapAssigned[stage][studyID]; !found {
+			mapAssigned[stage][studyID] = make(map[string]bool)
+		}
+		mapAssigned[stage][studyID][assigneeID] = true
+	}
+	// stage -> studies having pool tasks
+	mapPooled := make(map[string]map[string]bool)
+	if len(mapStudyID2Code) > 0 {
+		studyIDs := make([]string, 0, len(mapStudyID2Code))
+		for studyID := range mapStudyID2Code {
+			studyIDs = append(studyIDs, studyID)
+		}
+		err := taskStore.Query(map[string][]string{"study_id.keyword": studyIDs},
+			fmt.Sprintf("project_id.keyword:%s AND archived:%v", ta2.ProjectID, false), 0, constants.DefaultLimit, "", nil,
+			func(tasks []Task, es entities.ESReturn) {
+				for i := range tasks {
+					stage := workflow.StageOf(tasks[i].Stage, tasks[i].Type)
+					if stage == nil {
+						continue
+					}
+					markAssigned(stage.Name, tasks[i].StudyID, tasks[i].AssigneeID)
+					if tasks[i].Pooled || tasks[i].AssigneeID == "" {
+						if _, found := mapPooled[stage.Name]; !found {
+							mapPooled[stage.Name] = make(map[string]bool)
+						}
+						mapPooled[stage.Name][tasks[i].StudyID] = true
+					}
+				}
+			})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	mapRoles := make(map[string]map[string]bool)
+	for _, person := range p.People {
+		mapRoles[person.ID] = make(map[string]bool)
+		for _, role := range person.Roles {
+			mapRoles[person.ID][role] = true
+		}
+	}
+
+	assignTypes := make([]string, 0, len(ta2.AssigneeIDs))
+	for assignType := range ta2.AssigneeIDs {
+		assignTypes = append(assignTypes, assignType)
+	}
+	sort.Strings(assignTypes)
+
+	planned := make([]taskAssignment, 0)
+	for _, assignType := range assignTypes {
+		stage := workflow.Stage(assignType)
+		if stage == nil {
+			stage = workflow.StageOf("", assignType)
+		}
+		if stage == nil {
+			return nil, nil, fmt.Errorf("%w: no stage [%s] in the workflow of project %s", errInvalidAssignment, assignType, ta2.ProjectID)
+		}
+
+		assignees := ta2.AssigneeIDs[assignType]
+		for _, assigneeID := range assignees {
+			if role := mapTaskTypeRole[stage.TaskType]; !mapRoles[assigneeID][role] {
+				preview.Conflicts = append(preview.Conflicts, AssignConflict{
+					Type: constants.AssignConflictMissingRole, AssigneeID: assigneeID, Stage: stage.Name})
+			}
+		}
+		studyIDs := make([]string, 0)
+		for studyID := range mapStudyID2Code {
+			if len(mapAssigned[stage.Name][studyID]) > 0 {
+				studyIDs = append(studyIDs, studyID)
+			}
+		}
+		sort.Strings(studyIDs)
+		for _, studyID := range studyIDs {
+			preview.Conflicts = append(preview.Conflicts, AssignConflict{
+				Type: constants.AssignConflictStudyAssigned, StudyID: studyID, Stage: stage.Name})
+		}
+
+		assignments, err := planAssignment(mapStudyID2Code, ta2, assignees, workload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errInvalidAssignment, err)
+		}
+		mapPlan := make(map[string]int)
+		for _, assignment := range assignments {
+			// a study has its pool tasks once, they all have no assignee
+			pooled := assignment.AssigneeID == ""
+			duplicate := mapAssigned[stage.Name][assignment.StudyID][assignment.AssigneeID]
+			if pooled {
+				duplicate = mapPooled[stage.Name][assignment.StudyID]
+			}
+			if duplicate {
+				preview.Duplicates++
+				preview.Conflicts = append(preview.Conflicts, AssignConflict{Type: constants.AssignConflictDuplicate,
+					AssigneeID: assignment.AssigneeID, StudyID: assignment.StudyID, Stage: stage.Name})
+				continue
+			}
+			if !pooled {
+				markAssigned(stage.Name, assignment.StudyID, assignment.AssigneeID)
+				workload.OpenTasks[assignment.AssigneeID]++
+			}
+
+			assignment.Stage = stage.Name
+			assignment.TaskType = stage.TaskType
+			planned = append(planned, assignment)
+			if _, found := mapPlan[assignment.AssigneeID]; !found {
+				mapPlan[assignment.AssigneeID] = len(preview.Distribution)
+				preview.Distribution = append(preview.Distribution, AssigneePlan{
+					AssigneeID: assignment.AssigneeID, Stage: stage.Name, StudyIDs: make([]string, 0)})
+			}
+			plan := &preview.Distribution[mapPlan[assignment.AssigneeID]]
+			plan.StudyIDs = append(plan.StudyIDs, assignment.StudyID)
+		}
+	}
+	preview.Count = len(planned)
+	return planned, preview, nil
+}
+
+// createAssignedTasks the tasks of the planned assignments
+func createAssignedTasks(idGen *helper.IDGenerator, mapStudyID2Code map[string]string, assignments []taskAssignment,
+	projectID, creatorID string, priority int, dueAt int64) ([]Task, error) {
+	tasks := make([]Task, 0, len(assignments))
+	for _, assignment := range assignments {
+		task, err := CreateTask(idGen, mapStudyID2Code[assignment.StudyID], assignment.AssigneeID, projectID,
+			assignment.StudyID, creatorID, assignment.TaskType)
+		if err != nil {
+			return nil, err
+		}
+		task.Stage = assignment.Stage
+		task.Priority = priority
+		task.DueAt = dueAt
+		task.Pooled = assignment.AssigneeID == ""
+		tasks = append(tasks, *task)
+	}
+	return tasks, nil
+}
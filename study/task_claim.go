@@ -0,0 +1,206 @@
+package study
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+
+	"github.com/bsm/redislock"
+	"github.com/gin-gonic/gin"
+)
+
+// claimLockTTL how long the lock of a project outlives a claim which stopped
+// refreshing it, a running claim refreshes it every half of it
+const claimLockTTL = 5 * time.Second
+
+// SetLocker the redis locks keeping two people from claiming the same task,
+// without them claims are only serialized within this process
+func (app *TaskAPI) SetLocker(locker *redislock.Client) {
+	app.locker = locker
+}
+
+// lockClaims waits for the claims of the project, the lock is kept until the
+// returned func releases it
+func (app *TaskAPI) lockClaims(projectID string) (func(), error) {
+	if app.locker == nil {
+		app.claims.Lock()
+		return app.claims.Unlock, nil
+	}
+
+	ctx := context.Background()
+	lock, err := app.locker.Obtain(ctx, "task_next_"+projectID, claimLockTTL, &redislock.Options{
+		RetryStrategy: redislock.LimitRetry(redislock.LinearBackoff(100*time.Millisecond), 30),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(claimLockTTL / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := lock.Refresh(ctx, claimLockTTL, nil); err != nil {
+					utils.LogError(err)
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		if err := lock.Release(ctx); err != nil {
+			utils.LogError(err)
+		}
+	}, nil
+}
+
+// ClaimNextTask moves the NEW task of the project with the highest priority,
+// then the oldest, that is assigned to the caller or to nobody to DOING for
+// the caller. Tasks of the pool need the role of their stage and are not
+// claimed by who already has a task of the stage for the study
+func (app *TaskAPI) ClaimNextTask(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	projectID := c.Query(constants.ParamProjectID)
+	taskType := c.Query(constants.ParamTaskType)
+	if projectID == "" || (taskType != "" && !IsValidTaskType(taskType)) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	authInfo := mw.GetAuthInfoFromGin(c)
+
+	p, err := app.getProject(projectID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	unlock, err := app.lockClaims(projectID)
+	if errors.Is(err, redislock.ErrNotObtained) {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerConflict
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	defer unlock()
+
+	task, err := app.claimNextTask(p, taskType, authInfo.ID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if task == nil {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	task.Study, _, _ = app.studyStore.Get(nil, fmt.Sprintf("_id:%s", task.StudyID))
+	c.Header("ETag", task.ETag())
+	resp.Data = *task
+	resp.Count = 1
+	c.JSON(http.StatusOK, resp)
+}
+
+// claimNextTask the claimed task, nil when there is none to claim
+func (app *TaskAPI) claimNextTask(p *project.Project, taskType, assigneeID string) (*Task, error) {
+	workflow := p.GetWorkflow()
+	mapRole := make(map[string]bool)
+	for _, person := range p.People {
+		if person.ID == assigneeID {
+			for _, role := range person.Roles {
+				mapRole[role] = true
+			}
+		}
+	}
+
+	qs := fmt.Sprintf("project_id.keyword:%s AND status.keyword:%s AND archived:%v", p.ID, constants.TaskStatusNew, false)
+	if taskType != "" {
+		qs = fmt.Sprintf("%s AND type.keyword:%s", qs, taskType)
+	}
+	queries := map[string][]string{"assignee_id.keyword": {assigneeID, ""}}
+	for from := 0; ; from += constants.DefaultLimit {
+		tasks, _, err := app.taskStore.GetSlice(queries, qs, from, constants.DefaultLimit, "-priority,created", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candidate := range tasks {
+			if checkTransition(workflow, candidate, constants.TaskStatusDoing) != nil {
+				continue
+			}
+			if candidate.AssigneeID == "" {
+				stage := workflow.StageOf(candidate.Stage, candidate.Type)
+				if !mapRole[mapTaskTypeRole[stage.TaskType]] {
+					continue
+				}
+				mapStage, err := tasksOfStudy(app.taskStore, workflow, candidate.ProjectID, candidate.StudyID)
+				if err != nil {
+					return nil, err
+				}
+				reading := false
+				for _, item := range mapStage[stage.Name] {
+					reading = reading || item.AssigneeID == assigneeID
+				}
+				if reading {
+					continue
+				}
+			}
+
+			err := app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+				err := taskStore.Update(Task{ID: candidate.ID, Revision: candidate.Revision}, kvStr2Inf{
+					"status":      constants.TaskStatusDoing,
+					"assignee_id": assigneeID,
+				})
+				if err != nil {
+					return err
+				}
+				return updateStudyStatus(taskStore, studyStore, candidate.ProjectID, map[string]bool{
+					candidate.StudyID: true,
+				})
+			})
+			// claimed by a request of another process meanwhile
+			if errors.Is(err, utils.ErrVersionConflict) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// a pool task released by its previous assignee keeps their annotations
+			if candidate.AssigneeID == "" {
+				if err := app.handOverAnnotations(assigneeID, candidate.ID, assigneeID); err != nil {
+					return nil, err
+				}
+			}
+			task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", candidate.ID))
+			return task, err
+		}
+
+		if len(tasks) < constants.DefaultLimit {
+			return nil, nil
+		}
+	}
+}
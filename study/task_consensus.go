@@ -0,0 +1,319 @@
+package study
+
+import (
+	"fmt"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+)
+
+// ConsensusIoUThreshold shapes of different annotators with a lower IoU are not merged
+const ConsensusIoUThreshold = 0.5
+
+// consensusSource is one annotation of an annotate task
+type consensusSource struct {
+	antn      annotation.Annotation
+	annotator string
+	points    []annotation.Point2D
+}
+
+// consensusCluster overlapping shapes of the same object and type, at most one
+// per annotator
+type consensusCluster struct {
+	members []consensusSource
+	sumIoU  float64
+	pairs   int
+}
+
+// BuildConsensus merges the annotations of the ANNOTATE tasks of a study into
+// its REVIEW task once the last of them is completed. Nothing is done while
+// some are still open, or when the review task already has annotations
+func (app *TaskAPI) BuildConsensus(task Task) error {
+	if task.Type != constants.TaskTypeAnnotate || task.Status != constants.TaskStatusCompleted {
+		return nil
+	}
+
+	tasks, _, err := app.taskStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND archived:%v",
+		task.ProjectID, task.StudyID, false), 0, constants.DefaultLimit, "", nil)
+	if err != nil {
+		return err
+	}
+
+	var review *Task
+	mapAnnotator := make(map[string]string)
+	taskIDs := make([]string, 0)
+	for i := range tasks {
+		switch tasks[i].Type {
+		case constants.TaskTypeReview:
+			if review == nil {
+				review = &tasks[i]
+			}
+		case constants.TaskTypeAnnotate:
+			if tasks[i].Status != constants.TaskStatusCompleted && tasks[i].ID != task.ID {
+				return nil
+			}
+			mapAnnotator[tasks[i].ID] = tasks[i].AssigneeID
+			taskIDs = append(taskIDs, tasks[i].ID)
+		}
+	}
+	if review == nil || len(taskIDs) < 2 {
+		return nil
+	}
+
+	_, esReturn, err := app.antnStore.GetSlice(nil, fmt.Sprintf("task_id.keyword:%s", review.ID), 0, 0, "", nil)
+	if err != nil {
+		return err
+	}
+	if esReturn.Hits.Total.Value > 0 {
+		return nil
+	}
+
+	antns := make([]annotation.Annotation, 0)
+	err = app.antnStore.Query(map[string][]string{"task_id.keyword": taskIDs}, "", 0, constants.DefaultLimit, "", nil,
+		func(items []annotation.Annotation, es entities.ESReturn) {
+			antns = append(antns, items...)
+		})
+	if err != nil {
+		return err
+	}
+
+	merged := mergeAnnotations(antns, mapAnnotator, ConsensusIoUThreshold)
+	for i := range merged {
+		merged[i].NewAnnotation()
+		merged[i].CreatorID = review.AssigneeID
+		merged[i].TaskID = review.ID
+	}
+
+	return app.writeAnnotations(review.AssigneeID, merged, nil, 0)
+}
+
+// mergeAnnotations keeps the TAG labels chosen by a strict majority of the
+// annotators of each object and clusters their BOUNDING_BOX and POLYGON
+// annotations by geometry, a cluster is kept when a majority of annotators
+// drew it and a majority of them chose one of its labels. Other annotation
+// types are left to the reviewer
+func mergeAnnotations(antns []annotation.Annotation, mapAnnotator map[string]string, threshold float64) []annotation.Annotation {
+	annotators := make(map[string]bool)
+	for _, annotator := range mapAnnotator {
+		annotators[annotator] = true
+	}
+	majority := len(annotators)/2 + 1
+
+	tags := make(map[string][]consensusSource)
+	shapes := make(map[string][]consensusSource)
+	objectIDs := make([]string, 0)
+	shapeKeys := make([]string, 0)
+	for _, antn := range antns {
+		annotator, found := mapAnnotator[antn.TaskID]
+		if !found {
+			continue
+		}
+		source := consensusSource{antn: antn, annotator: annotator}
+
+		switch antn.Type {
+		case constants.AntnTypeTag:
+			if _, found := tags[antn.ObjectID]; !found {
+				objectIDs = append(objectIDs, antn.ObjectID)
+			}
+			tags[antn.ObjectID] = append(tags[antn.ObjectID], source)
+		case constants.AntnTypeBox, constants.AntnTypePolygon:
+			points, ok := annotation.ParsePoints(antn.Data)
+			if !ok || antn.Type == constants.AntnTypeBox && !annotation.IsBoundingBox(points) ||
+				antn.Type == constants.AntnTypePolygon && !annotation.IsPolytgon(points) {
+				continue
+			}
+			source.points = points
+			key := fmt.Sprintf("%s|%s", antn.ObjectID, antn.Type)
+			if _, found := shapes[key]; !found {
+				shapeKeys = append(shapeKeys, key)
+			}
+			shapes[key] = append(shapes[key], source)
+		}
+	}
+
+	ret := make([]annotation.Annotation, 0)
+	for _, objectID := range objectIDs {
+		if antn, ok := mergeTags(tags[objectID], majority); ok {
+			ret = append(ret, antn)
+		}
+	}
+	for _, key := range shapeKeys {
+		for _, cluster := range clusterShapes(shapes[key], threshold) {
+			if len(cluster.members) < majority {
+				continue
+			}
+			if antn, ok := cluster.merge(majority); ok {
+				ret = append(ret, antn)
+			}
+		}
+	}
+
+	return ret
+}
+
+func mergeTags(sources []consensusSource, majority int) (annotation.Annotation, bool) {
+	kept, mapVotes := voteLabels(sources, majority)
+	if len(kept) == 0 {
+		return annotation.Annotation{}, false
+	}
+
+	antn := newConsensusAnnotation(sources[0].antn, sources)
+	antn.LabelIDs = kept
+	antn.Meta["consensus"].(map[string]interface{})["votes"] = mapVotes
+	return antn, true
+}
+
+// voteLabels the labels chosen by at least majority annotators of the sources,
+// and the number of annotators of each label
+func voteLabels(sources []consensusSource, majority int) ([]string, map[string]interface{}) {
+	votes := make(map[string]map[string]bool)
+	labelIDs := make([]string, 0)
+	for _, source := range sources {
+		for _, labelID := range source.antn.LabelIDs {
+			if _, found := votes[labelID]; !found {
+				votes[labelID] = make(map[string]bool)
+				labelIDs = append(labelIDs, labelID)
+			}
+			votes[labelID][source.annotator] = true
+		}
+	}
+
+	kept := make([]string, 0)
+	mapVotes := make(map[string]interface{})
+	for _, labelID := range labelIDs {
+		mapVotes[labelID] = len(votes[labelID])
+		if len(votes[labelID]) >= majority {
+			kept = append(kept, labelID)
+		}
+	}
+	return kept, mapVotes
+}
+
+// clusterShapes greedily puts each shape in the cluster it overlaps most
+func clusterShapes(sources []consensusSource, threshold float64) []*consensusCluster {
+	clusters := make([]*consensusCluster, 0)
+	for _, source := range sources {
+		var best *consensusCluster
+		bestIoU := 0.0
+		for _, cluster := range clusters {
+			if cluster.has(source.annotator) {
+				continue
+			}
+			iou := cluster.iou(source)
+			if iou >= threshold && iou > bestIoU {
+				best, bestIoU = cluster, iou
+			}
+		}
+
+		if best == nil {
+			clusters = append(clusters, &consensusCluster{members: []consensusSource{source}})
+			continue
+		}
+		for _, member := range best.members {
+			best.sumIoU += annotation.ShapeIoU(member.antn.Type, member.points, source.antn.Type, source.points)
+			best.pairs++
+		}
+		best.members = append(best.members, source)
+	}
+	return clusters
+}
+
+func (cluster *consensusCluster) has(annotator string) bool {
+	for _, member := range cluster.members {
+		if member.annotator == annotator {
+			return true
+		}
+	}
+	return false
+}
+
+// iou mean IoU of a shape with the members of the cluster
+func (cluster *consensusCluster) iou(source consensusSource) float64 {
+	sum := 0.0
+	for _, member := range cluster.members {
+		sum += annotation.ShapeIoU(member.antn.Type, member.points, source.antn.Type, source.points)
+	}
+	return sum / float64(len(cluster.members))
+}
+
+// merge averages the corners of boxes, a polygon cluster keeps the member
+// closest to all the others. The labels are those chosen by at least majority
+// members, the cluster is dropped when there are none
+func (cluster *consensusCluster) merge(majority int) (annotation.Annotation, bool) {
+	kept, mapVotes := voteLabels(cluster.members, majority)
+	if len(kept) == 0 {
+		return annotation.Annotation{}, false
+	}
+
+	representative := cluster.members[0]
+	if representative.antn.Type == constants.AntnTypeBox {
+		var x0, y0, x1, y1 float64
+		for _, member := range cluster.members {
+			xMin, yMin, xMax, yMax := annotation.BoundsOf(member.points)
+			x0, y0, x1, y1 = x0+xMin, y0+yMin, x1+xMax, y1+yMax
+		}
+		n := float64(len(cluster.members))
+		representative.antn.Data = []interface{}{
+			map[string]interface{}{"x": x0 / n, "y": y0 / n},
+			map[string]interface{}{"x": x1 / n, "y": y1 / n},
+		}
+	} else {
+		bestIoU := -1.0
+		for i, member := range cluster.members {
+			sum := 0.0
+			for j, other := range cluster.members {
+				if i != j {
+					sum += annotation.ShapeIoU(member.antn.Type, member.points, other.antn.Type, other.points)
+				}
+			}
+			if sum > bestIoU {
+				representative, bestIoU = member, sum
+			}
+		}
+	}
+
+	antn := newConsensusAnnotation(representative.antn, cluster.members)
+	meanIoU := 1.0
+	if cluster.pairs > 0 {
+		meanIoU = cluster.sumIoU / float64(cluster.pairs)
+	}
+	antn.LabelIDs = kept
+	consensus := antn.Meta["consensus"].(map[string]interface{})
+	consensus["votes"] = mapVotes
+	consensus["mean_iou"] = meanIoU
+	return antn, true
+}
+
+// newConsensusAnnotation copies an annotation and records its sources in meta.consensus
+func newConsensusAnnotation(antn annotation.Annotation, sources []consensusSource) annotation.Annotation {
+	meta := make(map[string]interface{})
+	for k, v := range antn.Meta {
+		meta[k] = v
+	}
+
+	antnIDs := make([]string, 0, len(sources))
+	taskIDs := make([]string, 0, len(sources))
+	annotators := make([]string, 0, len(sources))
+	for _, source := range sources {
+		antnIDs = append(antnIDs, source.antn.ID)
+		taskIDs = append(taskIDs, source.antn.TaskID)
+		annotators = append(annotators, source.annotator)
+	}
+	meta["consensus"] = map[string]interface{}{
+		"source_annotation_ids": antnIDs,
+		"source_task_ids":       taskIDs,
+		"annotator_ids":         annotators,
+	}
+
+	return annotation.Annotation{
+		ObjectID:    antn.ObjectID,
+		ProjectID:   antn.ProjectID,
+		StudyID:     antn.StudyID,
+		Description: antn.Description,
+		Data:        antn.Data,
+		Type:        antn.Type,
+		Meta:        meta,
+		LabelIDs:    antn.LabelIDs,
+	}
+}
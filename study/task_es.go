@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -42,6 +42,12 @@ func getTaskIndexWildcard(IndexPrefix string) string {
 	return index
 }
 
+// PutIndexTemplate maps priority, due_at and the timestamps of the monthly task indices,
+// so the work-list sorts do not depend on the first task of the month having them
+func (store *TaskES) PutIndexTemplate() error {
+	return utils.PutIndexTemplate(store.esClient, "es_template_task", getTaskIndexWildcard(store.indexPrefix))
+}
+
 // Create function
 func (store *TaskES) Create(task Task) error {
 	req := esapi.IndexRequest{
@@ -83,13 +89,12 @@ func (store *TaskES) Bulk(tasks []Task) error {
 		raw map[string]interface{}
 		blk *entities.ESBulkResponse
 
-		indexName = getTaskIndexName(store.indexPrefix, tasks[0])
-
-		numItems   int
-		numErrors  int
-		numIndexed int
-		numBatches int
-		currBatch  int
+		numItems     int
+		numErrors    int
+		numConflicts int
+		numIndexed   int
+		numBatches   int
+		currBatch    int
 	)
 
 	count := len(tasks)
@@ -116,7 +121,8 @@ func (store *TaskES) Bulk(tasks []Task) error {
 			currBatch++
 		}
 
-		meta := []byte(fmt.Sprintf(`{ "index" : { "_id" : "%s" } }%s`, object.ID, "\n"))
+		meta := utils.BulkIndexMeta(getTaskIndexName(store.indexPrefix, object), object.ID, object.Revision)
+		object.Revision = entities.Revision{}
 
 		data, err := json.Marshal(object)
 		if err != nil {
@@ -132,7 +138,7 @@ func (store *TaskES) Bulk(tasks []Task) error {
 		if i > 0 && i%batch == 0 || i == count-1 {
 			utils.LogDebug("[%d/%d] ", currBatch, numBatches)
 
-			res, err = es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithIndex(indexName), es.Bulk.WithRefresh("true"))
+			res, err = es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithRefresh("true"))
 			if err != nil {
 				log.Fatalf("Failure indexing batch %d: %s", currBatch, err)
 				return err
@@ -154,6 +160,9 @@ func (store *TaskES) Bulk(tasks []Task) error {
 					log.Fatalf("Failure to to parse response body: %s", err)
 				} else {
 					for _, d := range blk.Items {
+						if d.Index.Status == http.StatusConflict {
+							numConflicts++
+						}
 						if d.Index.Status > 201 {
 							numErrors++
 							utils.LogDebug("  Error: [%d]: %s: %s: %s: %s",
@@ -188,6 +197,9 @@ func (store *TaskES) Bulk(tasks []Task) error {
 			dur.Truncate(time.Millisecond),
 			humanize.Comma(int64(1000.0/float64(dur/time.Millisecond)*float64(numIndexed))))
 	}
+	if numConflicts > 0 {
+		return fmt.Errorf("%w: %d documents", utils.ErrVersionConflict, numConflicts)
+	}
 	return nil
 }
 
@@ -198,7 +210,7 @@ func (store *TaskES) Get(queries map[string][]string, qs string) (*Task, *entiti
 		return nil, nil, err
 	}
 	if len(tasks) == 0 {
-		return nil, esReturn, errors.New("Item not found")
+		return nil, esReturn, utils.ErrNotFound
 	}
 	return &tasks[0], esReturn, nil
 }
@@ -246,6 +258,7 @@ func (store *TaskES) GetSlice(queries map[string][]string, qs string, from, size
 		es.Search.WithIndex(getTaskIndexWildcard(store.indexPrefix)),
 		es.Search.WithBody(&buf),
 		es.Search.WithTrackTotalHits(true),
+		es.Search.WithSeqNoPrimaryTerm(true),
 		es.Search.WithPretty(),
 	)
 
@@ -276,6 +289,7 @@ func (store *TaskES) GetSlice(queries map[string][]string, qs string, from, size
 		bytesData, _ := json.Marshal(mapData)
 		err := json.Unmarshal(bytesData, &task)
 		if err == nil {
+			task.Revision = entities.NewRevision(hit)
 			tasks = append(tasks, task)
 		}
 	}
@@ -349,6 +363,10 @@ func (store *TaskES) Update(task Task, update map[string]interface{}) error {
 		Refresh:    "true",
 		Body:       &buf,
 	}
+	if task.Revision.IsSet() {
+		req.IfSeqNo = task.SeqNo
+		req.IfPrimaryTerm = task.PrimaryTerm
+	}
 
 	// Return an API response object from request
 	ctx := context.Background()
@@ -358,6 +376,9 @@ func (store *TaskES) Update(task Task, update map[string]interface{}) error {
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusConflict {
+		return utils.ErrVersionConflict
+	}
 	if res.IsError() {
 		return fmt.Errorf("%s ERROR updating document ID=%s", res.Status(), task.ID)
 	}
@@ -0,0 +1,74 @@
+package study
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"vindr-lab-api/utils"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMakeSortQueryUnmappedType(t *testing.T) {
+	sort := utils.MakeSortQuery("-priority,due_at,-created,status")
+	assert.Equal(t, fmt.Sprint(sort), fmt.Sprint([]map[string]interface{}{
+		{"priority": map[string]interface{}{"order": "desc", "unmapped_type": "long"}},
+		{"due_at": map[string]interface{}{"order": "asc", "unmapped_type": "long"}},
+		{"created": map[string]interface{}{"order": "desc", "unmapped_type": "long"}},
+		{"status.keyword": map[string]interface{}{"order": "asc"}},
+	}))
+}
+
+// TestTaskESSortUnmapped sorts the work list across a monthly task index created before priority and due_at existed
+func TestTaskESSortUnmapped(t *testing.T) {
+	uri := os.Getenv("ELASTICSEARCH_URI")
+	if uri == "" {
+		t.Skip("ELASTICSEARCH_URI is not set")
+	}
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{uri}})
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	prefix := fmt.Sprintf("test_tasks_%d", time.Now().UnixNano())
+	store := NewTaskStore(es, prefix, zap.NewNop())
+	defer esapi.IndicesDeleteRequest{Index: []string{getTaskIndexWildcard(prefix)}}.Do(ctx, es)
+
+	// the old index is created with no template, its document has no priority nor due_at
+	oldIndex := prefix + "_200001"
+	res, err := esapi.IndicesCreateRequest{Index: oldIndex}.Do(ctx, es)
+	assert.Nil(t, err)
+	assert.False(t, res.IsError(), res.String())
+	res.Body.Close()
+	res, err = esapi.IndexRequest{
+		Index:      oldIndex,
+		DocumentID: "old",
+		Body:       strings.NewReader(`{"id":"old","project_id":"p","created":946684800000}`),
+		Refresh:    "true",
+	}.Do(ctx, es)
+	assert.Nil(t, err)
+	assert.False(t, res.IsError(), res.String())
+	res.Body.Close()
+
+	// the template is read from templates/ of the working directory of the server
+	wd, _ := os.Getwd()
+	assert.Nil(t, os.Chdir(".."))
+	err = store.PutIndexTemplate()
+	os.Chdir(wd)
+	assert.Nil(t, err)
+	defer esapi.IndicesDeleteIndexTemplateRequest{Name: "es_template_task"}.Do(ctx, es)
+
+	assert.Nil(t, store.Create(Task{ID: "new", ProjectID: "p", Priority: 2, Created: time.Now().UnixNano() / int64(time.Millisecond)}))
+
+	tasks, _, err := store.GetSlice(map[string][]string{"project_id.keyword": {"p"}}, "", 0, 10, "-priority,due_at,-created", nil)
+	assert.Nil(t, err)
+	if assert.Len(t, tasks, 2) {
+		assert.Equal(t, "new", tasks[0].ID)
+		assert.Equal(t, "old", tasks[1].ID)
+	}
+}
@@ -0,0 +1,72 @@
+package study
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TaskEvent something done to a task other than working on it, kept for the record
+type TaskEvent struct {
+	ID         string `json:"id"`
+	TaskID     string `json:"task_id"`
+	ProjectID  string `json:"project_id"`
+	StudyID    string `json:"study_id"`
+	Event      string `json:"event"`
+	AssigneeID string `json:"assignee_id"`
+	Detail     string `json:"detail,omitempty"`
+	Created    int64  `json:"created"`
+}
+
+func NewTaskEvent(task Task, event, detail string) TaskEvent {
+	return TaskEvent{
+		ID:         uuid.New().String(),
+		TaskID:     task.ID,
+		ProjectID:  task.ProjectID,
+		StudyID:    task.StudyID,
+		Event:      event,
+		AssigneeID: task.AssigneeID,
+		Detail:     detail,
+		Created:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (event *TaskEvent) String() string {
+	b, _ := json.Marshal(event)
+	return string(b)
+}
+
+// SetTaskEventStore where the events of tasks are kept, in memory by default
+func (app *TaskAPI) SetTaskEventStore(eventStore TaskEventStore) {
+	app.eventStore = eventStore
+}
+
+// GetTaskEvents the events of a task, oldest first
+func (app *TaskAPI) GetTaskEvents(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	taskID := c.Param(constants.ParamID)
+	events := make([]TaskEvent, 0)
+	err := app.eventStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", taskID), 0, constants.DefaultLimit, "created",
+		func(items []TaskEvent, es entities.ESReturn) {
+			events = append(events, items...)
+		})
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = events
+	resp.Count = len(events)
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,142 @@
+package study
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"go.uber.org/zap"
+)
+
+// TaskEventES is append only, events are never updated or deleted
+type TaskEventES struct {
+	esClient    *elasticsearch.Client
+	indexPrefix string
+	logger      *zap.Logger
+}
+
+func NewTaskEventStore(client *elasticsearch.Client, indexPrefix string, logger *zap.Logger) *TaskEventES {
+	return &TaskEventES{
+		client, indexPrefix, logger,
+	}
+}
+
+func (store *TaskEventES) getIndexName(event TaskEvent) string {
+	indexTime := utils.ConvertTimeStampToTime(event.Created)
+	return fmt.Sprintf("%s_%d%02d", store.indexPrefix, indexTime.Year(), indexTime.Month())
+}
+
+// BulkCreate indexes the events in one request
+func (store *TaskEventES) BulkCreate(events []TaskEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		meta := fmt.Sprintf(`{ "index" : { "_index" : "%s", "_id" : "%s" } }%s`, store.getIndexName(event), event.ID, "\n")
+		buf.WriteString(meta)
+		buf.WriteString(event.String())
+		buf.WriteString("\n")
+	}
+
+	es := store.esClient
+	res, err := es.Bulk(bytes.NewReader(buf.Bytes()), es.Bulk.WithContext(context.Background()), es.Bulk.WithRefresh("true"))
+	if err != nil {
+		return fmt.Errorf("BulkRequest ERROR: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR indexing task events", res.Status())
+	}
+
+	var blk entities.ESBulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		return fmt.Errorf("Error parsing the response body: %s", err)
+	}
+	if blk.Errors {
+		for _, d := range blk.Items {
+			if d.Index.Status > 201 {
+				return fmt.Errorf("[%d] %s: %s", d.Index.Status, d.Index.Error.Type, d.Index.Error.Reason)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Query function
+func (store *TaskEventES) Query(queries map[string][]string, qs string, from, size int, sort string, f func([]TaskEvent, entities.ESReturn)) error {
+	for {
+		events, esReturn, err := store.GetSlice(queries, qs, from, size, sort)
+		if err != nil {
+			return err
+		}
+
+		f(events, *esReturn)
+
+		if len(events) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *TaskEventES) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]TaskEvent, *entities.ESReturn, error) {
+	es := store.esClient
+
+	var (
+		esReturn entities.ESReturn
+		esError  entities.ESError
+		buf      bytes.Buffer
+	)
+
+	body := utils.ConvertInputsToESQueryBody(queries, qs, from, size, sort, nil)
+	utils.LogDebug(utils.ConvertMapToString(*body))
+
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, nil, fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(fmt.Sprintf("%s_*", store.indexPrefix)),
+		es.Search.WithBody(&buf),
+		es.Search.WithTrackTotalHits(true),
+		es.Search.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		if err := json.NewDecoder(res.Body).Decode(&esError); err != nil {
+			return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+		}
+		return nil, nil, fmt.Errorf("[%s] %s: %s", res.Status(), esError.Error.Type, esError.Error.Reason)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&esReturn); err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	events := make([]TaskEvent, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var event TaskEvent
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &event); err == nil {
+			events = append(events, event)
+		}
+	}
+
+	return events, &esReturn, nil
+}
@@ -0,0 +1,63 @@
+package study
+
+import (
+	"encoding/json"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// TaskEventMemory keeps task events in memory
+type TaskEventMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewTaskEventMemory() *TaskEventMemory {
+	return &TaskEventMemory{utils.NewMemoryIndex("task_event")}
+}
+
+// BulkCreate function
+func (store *TaskEventMemory) BulkCreate(events []TaskEvent) error {
+	for _, event := range events {
+		if err := store.index.Index(event.ID, event, entities.Revision{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query function
+func (store *TaskEventMemory) Query(queries map[string][]string, qs string, from, size int, sort string, f func([]TaskEvent, entities.ESReturn)) error {
+	for {
+		events, esReturn, err := store.GetSlice(queries, qs, from, size, sort)
+		if err != nil {
+			return err
+		}
+
+		f(events, *esReturn)
+
+		if len(events) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *TaskEventMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string) ([]TaskEvent, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make([]TaskEvent, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var event TaskEvent
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, esReturn, nil
+}
@@ -0,0 +1,252 @@
+package study
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RestoreTaskBody struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// writeAnnotations indexes antns, deletes the deleted ones and appends the
+// changes to the annotation history. restoredAt is set when the changes come
+// from a restore. Nothing is written when a revision is stale
+func (app *TaskAPI) writeAnnotations(actorID string, antns, deleted []annotation.Annotation, restoredAt int64) error {
+	ids := make([]string, 0, len(antns)+len(deleted))
+	for i := range antns {
+		ids = append(ids, antns[i].ID)
+	}
+	for i := range deleted {
+		ids = append(ids, deleted[i].ID)
+	}
+	mapBefore, err := app.getAnnotationsByIDs(ids)
+	if err != nil {
+		return err
+	}
+
+	// delete by query has no precondition, and a failed bulk would be partial
+	stale := 0
+	for _, antn := range append(append([]annotation.Annotation{}, antns...), deleted...) {
+		if before, found := mapBefore[antn.ID]; antn.Revision.IsSet() && (!found || !antn.Revision.Matches(before.Revision)) {
+			stale++
+		}
+	}
+	if stale > 0 {
+		return fmt.Errorf("%w: %d annotations", utils.ErrVersionConflict, stale)
+	}
+
+	// annotations are indexed by type, BulkCreate expects one type per call
+	mapAntnType2Antns := make(map[string][]annotation.Annotation)
+	for i := range antns {
+		mapAntnType2Antns[antns[i].Type] = append(mapAntnType2Antns[antns[i].Type], antns[i])
+	}
+	for k, newAnnotations := range mapAntnType2Antns {
+		utils.LogInfo("%s\t%d", k, len(newAnnotations))
+		if err := app.antnStore.BulkCreate(newAnnotations); err != nil {
+			return err
+		}
+	}
+
+	for i := range deleted {
+		if err := app.antnStore.Delete(nil, fmt.Sprintf("_id:%s", deleted[i].ID)); err != nil {
+			return err
+		}
+	}
+
+	histories := make([]annotation.AnnotationHistory, 0, len(ids))
+	for i := range antns {
+		var before *annotation.Annotation
+		if antn, found := mapBefore[antns[i].ID]; found {
+			before = &antn
+		}
+		after := antns[i]
+		histories = append(histories, annotation.NewAnnotationHistory(actorID, before, &after))
+	}
+	for i := range deleted {
+		if antn, found := mapBefore[deleted[i].ID]; found {
+			histories = append(histories, annotation.NewAnnotationHistory(actorID, &antn, nil))
+		}
+	}
+	for i := range histories {
+		histories[i].RestoredAt = restoredAt
+	}
+
+	return app.antnHistoryStore.BulkCreate(histories)
+}
+
+func (app *TaskAPI) getAnnotationsByIDs(ids []string) (map[string]annotation.Annotation, error) {
+	ret := make(map[string]annotation.Annotation)
+	for i := 0; i < len(ids); i += constants.DefaultLimit {
+		end := i + constants.DefaultLimit
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err := app.antnStore.Query(map[string][]string{"_id": ids[i:end]}, "", 0, constants.DefaultLimit, "", nil,
+			func(antns []annotation.Annotation, es entities.ESReturn) {
+				for _, antn := range antns {
+					ret[antn.ID] = antn
+				}
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (app *TaskAPI) getTaskHistories(taskID string) ([]annotation.AnnotationHistory, error) {
+	histories := make([]annotation.AnnotationHistory, 0)
+	err := app.antnHistoryStore.Query(map[string][]string{"task_id.keyword": {taskID}}, "", 0, constants.DefaultLimit, "created",
+		func(items []annotation.AnnotationHistory, es entities.ESReturn) {
+			histories = append(histories, items...)
+		})
+	return histories, err
+}
+
+// GetTaskHistory returns the changes of the annotations of a task, oldest first
+func (app *TaskAPI) GetTaskHistory(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	taskID := c.Param(constants.ParamID)
+	if taskID == "" {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	histories, err := app.getTaskHistories(taskID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = histories
+	c.JSON(http.StatusOK, resp)
+}
+
+// RestoreTaskAnnotations puts the annotations of a task back as they were at
+// a timestamp. The restore itself is recorded, so it can be undone the same way
+func (app *TaskAPI) RestoreTaskAnnotations(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	taskID := c.Param(constants.ParamID)
+	if taskID == "" {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	var body RestoreTaskBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.Timestamp <= 0 {
+		utils.LogError(fmt.Errorf("timestamp is invalid"))
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	task, _, err := app.taskStore.Get(nil, fmt.Sprintf("_id:%s", taskID))
+	if errors.Is(err, utils.ErrNotFound) {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if task.Status == constants.TaskStatusCompleted {
+		utils.LogError(errors.New("Task is completed, cannot overwrite its annotations"))
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	histories, err := app.getTaskHistories(taskID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	alive, known := annotation.AnnotationsAt(histories, body.Timestamp)
+
+	current := make(map[string]annotation.Annotation)
+	err = app.antnStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", taskID), 0, constants.DefaultLimit, "", nil,
+		func(antns []annotation.Annotation, es entities.ESReturn) {
+			for _, antn := range antns {
+				current[antn.ID] = antn
+			}
+		})
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	writes, deleteIDs := planRestore(current, alive, known)
+	deleted := make([]annotation.Annotation, 0, len(deleteIDs))
+	for _, id := range deleteIDs {
+		deleted = append(deleted, annotation.Annotation{ID: id})
+	}
+	err = app.writeAnnotations(mw.GetAuthInfoFromGin(c).ID, writes, deleted, body.Timestamp)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = kvStr2Inf{
+		"restored": len(writes),
+		"deleted":  len(deleteIDs),
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// planRestore compares the annotations of a task with the ones it had at the
+// timestamp, annotations the history does not know are left as they are
+func planRestore(current, alive map[string]annotation.Annotation, known map[string]bool) ([]annotation.Annotation, []string) {
+	writes := make([]annotation.Annotation, 0)
+	for id, antn := range alive {
+		if now, found := current[id]; found && sameAnnotation(now, antn) {
+			continue
+		}
+		// a restore overwrites whatever the annotation became
+		antn.Labels = nil
+		antn.Revision = entities.Revision{}
+		writes = append(writes, antn)
+	}
+
+	deleteIDs := make([]string, 0)
+	for id := range current {
+		if _, found := alive[id]; !found && known[id] {
+			deleteIDs = append(deleteIDs, id)
+		}
+	}
+	return writes, deleteIDs
+}
+
+func sameAnnotation(a, b annotation.Annotation) bool {
+	a.Labels, b.Labels = nil, nil
+	a.CreatorName, b.CreatorName = "", ""
+	a.Revision, b.Revision = entities.Revision{}, entities.Revision{}
+	bytesA, _ := json.Marshal(a)
+	bytesB, _ := json.Marshal(b)
+	return string(bytesA) == string(bytesB)
+}
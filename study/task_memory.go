@@ -0,0 +1,104 @@
+package study
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// TaskMemory keeps tasks in memory, for running without a cluster and in tests
+type TaskMemory struct {
+	index *utils.MemoryIndex
+}
+
+func NewTaskMemory() *TaskMemory {
+	return &TaskMemory{utils.NewMemoryIndex("task")}
+}
+
+// Create function
+func (store *TaskMemory) Create(task Task) error {
+	task.Revision = entities.Revision{}
+	return store.index.Index(task.ID, task, entities.Revision{})
+}
+
+// Bulk every task is written, the stale ones are counted like TaskES does
+func (store *TaskMemory) Bulk(tasks []Task) error {
+	numConflicts := 0
+	for _, task := range tasks {
+		rev := task.Revision
+		task.Revision = entities.Revision{}
+		err := store.index.Index(task.ID, task, rev)
+		if err == utils.ErrVersionConflict {
+			numConflicts++
+		} else if err != nil {
+			return err
+		}
+	}
+	if numConflicts > 0 {
+		return fmt.Errorf("%w: %d documents", utils.ErrVersionConflict, numConflicts)
+	}
+	return nil
+}
+
+// Get get one ESReturn
+func (store *TaskMemory) Get(queries map[string][]string, qs string) (*Task, *entities.ESReturn, error) {
+	tasks, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tasks) > 0 {
+		return &tasks[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Query get all
+func (store *TaskMemory) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(tasks []Task, es entities.ESReturn)) error {
+	for {
+		tasks, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(tasks, *esReturn)
+
+		if len(tasks) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *TaskMemory) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Task, *entities.ESReturn, error) {
+	esReturn, err := store.index.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := make([]Task, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var task Task
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &task); err == nil {
+			task.Revision = entities.NewRevision(hit)
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, esReturn, nil
+}
+
+// Delete function
+func (store *TaskMemory) Delete(queries map[string][]string, qs string) error {
+	return store.index.Delete(queries, qs)
+}
+
+// Update function
+func (store *TaskMemory) Update(task Task, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.index.Update(task.ID, update, task.Revision)
+}
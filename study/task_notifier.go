@@ -0,0 +1,52 @@
+package study
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Notifier tells people about an event of a task
+type Notifier interface {
+	Notify(event TaskEvent, recipientIDs []string) error
+}
+
+// WebhookNotifier posts the event and its recipients as JSON to a URI, which
+// reaches the people by mail or chat
+type WebhookNotifier struct {
+	uri    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(uri string) *WebhookNotifier {
+	return &WebhookNotifier{uri, &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify fails unless the webhook answers 2xx
+func (notifier *WebhookNotifier) Notify(event TaskEvent, recipientIDs []string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event":         event,
+		"recipient_ids": recipientIDs,
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := notifier.client.Post(notifier.uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s notifying %v of %s", res.Status, recipientIDs, event.Event)
+	}
+	return nil
+}
+
+// SetNotifier who tells the owners about idle tasks, they are only recorded
+// as task events without it
+func (app *TaskAPI) SetNotifier(notifier Notifier) {
+	app.notifier = notifier
+}
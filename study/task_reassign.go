@@ -0,0 +1,243 @@
+package study
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"vindr-lab-api/annotation"
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReassignBody the tasks of the project matching every filter given, at least
+// one is required, go to ToAssigneeID
+type ReassignBody struct {
+	ProjectID      string   `json:"project_id"`
+	TaskIDs        []string `json:"task_ids"`
+	FromAssigneeID string   `json:"from_assignee_id"`
+	Statuses       []string `json:"statuses"`
+	Type           string   `json:"type"`
+	ToAssigneeID   string   `json:"to_assignee_id"`
+	// Annotations KEEP by default, DISCARD deletes them and puts the task back to NEW
+	Annotations string `json:"annotations"`
+}
+
+func (body *ReassignBody) IsValid() bool {
+	if body.ProjectID == "" || body.ToAssigneeID == "" ||
+		(len(body.TaskIDs) == 0 && body.FromAssigneeID == "" && len(body.Statuses) == 0 && body.Type == "") {
+		return false
+	}
+	if body.Type != "" && !IsValidTaskType(body.Type) {
+		return false
+	}
+	return body.Annotations == "" || body.Annotations == constants.ReassignKeepAnnotations ||
+		body.Annotations == constants.ReassignDiscardAnnotations
+}
+
+// ReassignSkip a task that was not reassigned
+type ReassignSkip struct {
+	TaskID string `json:"task_id"`
+	Reason string `json:"reason"`
+}
+
+// ReassignResult the tasks reassigned and the ones left as they were
+type ReassignResult struct {
+	TaskIDs []string       `json:"task_ids"`
+	Skipped []ReassignSkip `json:"skipped"`
+}
+
+// ReassignTasks moves the open tasks matching the body to another assignee,
+// completed tasks, tasks the assignee cannot take because they lack the role
+// of the stage or already have a task of it for the study are skipped
+func (app *TaskAPI) ReassignTasks(c *gin.Context) {
+	resp := entities.NewResponse()
+
+	var body ReassignBody
+	if err := c.ShouldBindJSON(&body); err != nil || !body.IsValid() {
+		resp.ErrorCode = constants.ServerInvalidData
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	authInfo := mw.GetAuthInfoFromGin(c)
+
+	p, err := app.getProject(body.ProjectID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	queries := make(map[string][]string)
+	qs := fmt.Sprintf("project_id.keyword:%s AND archived:%v", body.ProjectID, false)
+	if len(body.TaskIDs) > 0 {
+		queries["_id"] = body.TaskIDs
+	}
+	if len(body.Statuses) > 0 {
+		queries["status.keyword"] = body.Statuses
+	}
+	if body.FromAssigneeID != "" {
+		qs = fmt.Sprintf("%s AND assignee_id.keyword:%s", qs, body.FromAssigneeID)
+	}
+	if body.Type != "" {
+		qs = fmt.Sprintf("%s AND type.keyword:%s", qs, body.Type)
+	}
+
+	tasks := make([]Task, 0)
+	err = app.taskStore.Query(queries, qs, 0, constants.DefaultLimit, "created", nil, func(items []Task, es entities.ESReturn) {
+		tasks = append(tasks, items...)
+	})
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	discard := body.Annotations == constants.ReassignDiscardAnnotations
+	result, err := app.reassignTasks(p, tasks, body.ToAssigneeID, discard, authInfo.ID)
+	if err != nil {
+		utils.LogError(err)
+		resp.ErrorCode = constants.ServerError
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = result
+	resp.Count = len(result.TaskIDs)
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandOverTasks gives the open tasks of a person leaving the project to
+// another with their annotations, see project.TaskHandover
+func (app *TaskAPI) HandOverTasks(projectID, fromID, toID, actorID string) error {
+	p, err := app.getProject(projectID)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]Task, 0)
+	err = app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND assignee_id.keyword:%s AND archived:%v", projectID, fromID, false),
+		0, constants.DefaultLimit, "created", nil, func(items []Task, es entities.ESReturn) {
+			tasks = append(tasks, items...)
+		})
+	if err != nil {
+		return err
+	}
+
+	result, err := app.reassignTasks(p, tasks, toID, false, actorID)
+	if err != nil {
+		return err
+	}
+	for _, skip := range result.Skipped {
+		utils.LogInfo("Task %s of %s is not handed over to %s: %s", skip.TaskID, fromID, toID, skip.Reason)
+	}
+	return nil
+}
+
+// reassignTasks moves the tasks to toID, recording a REASSIGNED event for each
+func (app *TaskAPI) reassignTasks(p *project.Project, tasks []Task, toID string, discard bool, actorID string) (ReassignResult, error) {
+	result := ReassignResult{TaskIDs: make([]string, 0), Skipped: make([]ReassignSkip, 0)}
+	workflow := p.GetWorkflow()
+	mapRole := make(map[string]bool)
+	for _, person := range p.People {
+		if person.ID == toID {
+			for _, role := range person.Roles {
+				mapRole[role] = true
+			}
+		}
+	}
+
+	events := make([]TaskEvent, 0)
+	for _, task := range tasks {
+		stage := workflow.StageOf(task.Stage, task.Type)
+		reason := ""
+		switch {
+		case task.Status == constants.TaskStatusCompleted:
+			reason = "the task is completed"
+		case task.AssigneeID == toID:
+			reason = "the task is already assigned to " + toID
+		case stage == nil || !mapRole[mapTaskTypeRole[stage.TaskType]]:
+			reason = fmt.Sprintf("%s does not have the %s role in the project", toID, mapTaskTypeRole[task.Type])
+		default:
+			mapStage, err := tasksOfStudy(app.taskStore, workflow, task.ProjectID, task.StudyID)
+			if err != nil {
+				return result, err
+			}
+			for _, item := range mapStage[stage.Name] {
+				if item.AssigneeID == toID {
+					reason = fmt.Sprintf("%s already has a %s task of the study", toID, stage.Name)
+				}
+			}
+		}
+		if reason != "" {
+			result.Skipped = append(result.Skipped, ReassignSkip{TaskID: task.ID, Reason: reason})
+			continue
+		}
+
+		update := kvStr2Inf{"assignee_id": toID}
+		if discard && checkTransition(workflow, task, constants.TaskStatusNew) == nil {
+			update["status"] = constants.TaskStatusNew
+		}
+		err := app.taskStore.Update(Task{ID: task.ID, Revision: task.Revision}, update)
+		if errors.Is(err, utils.ErrVersionConflict) {
+			result.Skipped = append(result.Skipped, ReassignSkip{TaskID: task.ID, Reason: "the task changed meanwhile"})
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		detail := "annotations kept"
+		if !discard {
+			if err := app.handOverAnnotations(actorID, task.ID, toID); err != nil {
+				return result, err
+			}
+		} else {
+			detail = "annotations discarded"
+			antns := make([]annotation.Annotation, 0)
+			err := app.antnStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", task.ID), 0, constants.DefaultLimit, "", nil,
+				func(items []annotation.Annotation, es entities.ESReturn) {
+					antns = append(antns, items...)
+				})
+			if err != nil {
+				return result, err
+			}
+			if err := app.writeAnnotations(actorID, nil, antns, 0); err != nil {
+				return result, err
+			}
+		}
+		events = append(events, NewTaskEvent(task, constants.TaskEventReassigned, fmt.Sprintf("to %s by %s, %s", toID, actorID, detail)))
+		result.TaskIDs = append(result.TaskIDs, task.ID)
+	}
+
+	if err := app.eventStore.BulkCreate(events); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// handOverAnnotations makes toID the creator of the annotations of the task so
+// the new assignee can edit them, each change is kept in the history
+func (app *TaskAPI) handOverAnnotations(actorID, taskID, toID string) error {
+	antns := make([]annotation.Annotation, 0)
+	err := app.antnStore.Query(nil, fmt.Sprintf("task_id.keyword:%s", taskID), 0, constants.DefaultLimit, "", nil,
+		func(items []annotation.Annotation, es entities.ESReturn) {
+			for _, antn := range items {
+				if antn.CreatorID != toID {
+					antn.CreatorID = toID
+					antns = append(antns, antn)
+				}
+			}
+		})
+	if err != nil || len(antns) == 0 {
+		return err
+	}
+	return app.writeAnnotations(actorID, antns, nil, 0)
+}
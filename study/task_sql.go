@@ -0,0 +1,118 @@
+package study
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/utils"
+)
+
+// TaskSQL keeps tasks in a relational database, see utils.SQLTable
+type TaskSQL struct {
+	table *utils.SQLTable
+}
+
+func NewTaskSQL(db utils.SQLExecutor) *TaskSQL {
+	table := utils.NewSQLTable(db, "tasks", "project_id", "study_id", "assignee_id", "status", "type").
+		WithTypedColumns(map[string]string{"priority": "long", "due_at": "long", "archived": "boolean"})
+	return &TaskSQL{table}
+}
+
+// CreateTable creates the tasks table when missing, or adds its new columns
+func (store *TaskSQL) CreateTable() error {
+	return store.table.CreateTable()
+}
+
+// Create function
+func (store *TaskSQL) Create(task Task) error {
+	task.Revision = entities.Revision{}
+	return store.table.Index(task.ID, task, entities.Revision{})
+}
+
+// Bulk writes all the tasks or none of them, one stale task rolls back the others
+func (store *TaskSQL) Bulk(tasks []Task) error {
+	return store.table.InTx(func(table *utils.SQLTable) error {
+		numConflicts := 0
+		for _, task := range tasks {
+			rev := task.Revision
+			task.Revision = entities.Revision{}
+			err := table.Index(task.ID, task, rev)
+			if err == utils.ErrVersionConflict {
+				numConflicts++
+			} else if err != nil {
+				return err
+			}
+		}
+		if numConflicts > 0 {
+			return fmt.Errorf("%w: %d documents", utils.ErrVersionConflict, numConflicts)
+		}
+		return nil
+	})
+}
+
+// Get get one ESReturn
+func (store *TaskSQL) Get(queries map[string][]string, qs string) (*Task, *entities.ESReturn, error) {
+	tasks, esReturn, err := store.GetSlice(queries, qs, 0, 1, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tasks) > 0 {
+		return &tasks[0], esReturn, nil
+	}
+	return nil, esReturn, utils.ErrNotFound
+}
+
+// Query get all
+func (store *TaskSQL) Query(queries map[string][]string, qs string, from, size int, sort string, aggs []string, f func(tasks []Task, es entities.ESReturn)) error {
+	// a size of 0 would read the first page forever
+	if size <= 0 {
+		size = constants.DefaultLimit
+	}
+	for {
+		tasks, esReturn, err := store.GetSlice(queries, qs, from, size, sort, aggs)
+		if err != nil {
+			return err
+		}
+
+		f(tasks, *esReturn)
+
+		if len(tasks) < size {
+			break
+		}
+		from += size
+	}
+	return nil
+}
+
+// GetSlice function
+func (store *TaskSQL) GetSlice(queries map[string][]string, qs string, from, size int, sort string, aggs []string) ([]Task, *entities.ESReturn, error) {
+	esReturn, err := store.table.Search(queries, qs, from, size, sort, aggs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := make([]Task, 0)
+	for _, hit := range esReturn.Hits.Hits {
+		var task Task
+		bytesData, _ := json.Marshal(hit.Source)
+		if err := json.Unmarshal(bytesData, &task); err == nil {
+			task.Revision = entities.NewRevision(hit)
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, esReturn, nil
+}
+
+// Delete function
+func (store *TaskSQL) Delete(queries map[string][]string, qs string) error {
+	return store.table.Delete(queries, qs)
+}
+
+// Update function
+func (store *TaskSQL) Update(task Task, update map[string]interface{}) error {
+	update["modified"] = time.Now().UnixNano() / int64(time.Millisecond)
+	return store.table.Update(task.ID, update, task.Revision)
+}
@@ -0,0 +1,155 @@
+package study
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+
+	"github.com/bsm/redislock"
+)
+
+// RunStaleTaskRelease releases the stale tasks of the projects every interval.
+// With redis locks only one server does it in an interval
+func (app *TaskAPI) RunStaleTaskRelease(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if app.locker != nil {
+			// the lock expires by itself at the next round
+			_, err := app.locker.Obtain(context.Background(), "task_stale_release", interval, nil)
+			if errors.Is(err, redislock.ErrNotObtained) {
+				continue
+			}
+			if err != nil {
+				utils.LogError(err)
+				continue
+			}
+		}
+		if err := app.ReleaseStaleTasks(time.Now()); err != nil {
+			utils.LogError(err)
+		}
+	}
+}
+
+// ReleaseStaleTasks applies the StaleTaskPolicy of every project having one
+func (app *TaskAPI) ReleaseStaleTasks(now time.Time) error {
+	projects := make([]project.Project, 0)
+	err := app.projectStore.Query(nil, "", 0, constants.DefaultLimit, "", nil, func(items []project.Project, es entities.ESReturn) {
+		for i := range items {
+			if items[i].StaleTaskPolicy != nil {
+				projects = append(projects, items[i])
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range projects {
+		if err := app.releaseStaleTasksOf(&projects[i], now); err != nil {
+			utils.LogError(fmt.Errorf("Releasing the stale tasks of project %s: %w", projects[i].ID, err))
+		}
+	}
+	return nil
+}
+
+// releaseStaleTasksOf notifies the owners of p once about each DOING task idle
+// past NotifyAfterHours, then releases it past ReleaseAfterHours
+func (app *TaskAPI) releaseStaleTasksOf(p *project.Project, now time.Time) error {
+	policy := p.StaleTaskPolicy
+	workflow := p.GetWorkflow()
+	ownerIDs := make([]string, 0)
+	for _, person := range p.People {
+		if _, found := utils.FindInSlice(person.Roles, constants.ProjRoleProjectOwner); found {
+			ownerIDs = append(ownerIDs, person.ID)
+		}
+	}
+
+	tasks := make([]Task, 0)
+	err := app.taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND status.keyword:%s AND archived:%v",
+		p.ID, constants.TaskStatusDoing, false), 0, constants.DefaultLimit, "", nil, func(items []Task, es entities.ESReturn) {
+		tasks = append(tasks, items...)
+	})
+	if err != nil {
+		return err
+	}
+
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	hour := int64(time.Hour / time.Millisecond)
+	for _, task := range tasks {
+		idleSince, err := app.lastActivity(task)
+		if err != nil {
+			return err
+		}
+		idle := nowMillis - idleSince
+
+		var event *TaskEvent
+		switch {
+		case idle >= int64(policy.ReleaseAfterHours)*hour:
+			if checkTransition(workflow, task, constants.TaskStatusNew) != nil {
+				utils.LogInfo("Stale task %s of project %s cannot go back to NEW", task.ID, p.ID)
+				continue
+			}
+			update := kvStr2Inf{"status": constants.TaskStatusNew}
+			if policy.Action == constants.StaleActionPool {
+				update["assignee_id"] = ""
+			}
+			err := app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+				if err := taskStore.Update(Task{ID: task.ID, Revision: task.Revision}, update); err != nil {
+					return err
+				}
+				return updateStudyStatus(taskStore, studyStore, task.ProjectID, map[string]bool{task.StudyID: true})
+			})
+			// somebody worked on it meanwhile
+			if errors.Is(err, utils.ErrVersionConflict) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			released := NewTaskEvent(task, constants.TaskEventReleased, policy.Action)
+			event = &released
+		case idle >= int64(policy.NotifyAfterHours)*hour:
+			_, esReturn, err := app.eventStore.GetSlice(nil, fmt.Sprintf("task_id.keyword:%s AND event.keyword:%s AND created:>=%d",
+				task.ID, constants.TaskEventIdle, idleSince), 0, 1, "")
+			if err != nil {
+				return err
+			}
+			if esReturn.Hits.Total.Value > 0 {
+				continue
+			}
+			notified := NewTaskEvent(task, constants.TaskEventIdle, fmt.Sprintf("idle for %d hours", idle/hour))
+			event = &notified
+		default:
+			continue
+		}
+
+		if err := app.eventStore.BulkCreate([]TaskEvent{*event}); err != nil {
+			return err
+		}
+		if app.notifier != nil && len(ownerIDs) > 0 {
+			if err := app.notifier.Notify(*event, ownerIDs); err != nil {
+				utils.LogError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// lastActivity when the task was last changed or had its annotations saved
+func (app *TaskAPI) lastActivity(task Task) (int64, error) {
+	histories, _, err := app.antnHistoryStore.GetSlice(nil, fmt.Sprintf("task_id.keyword:%s", task.ID), 0, 1, "-created")
+	if err != nil {
+		return 0, err
+	}
+	if len(histories) > 0 && histories[0].Created > task.Modified {
+		return histories[0].Created, nil
+	}
+	return task.Modified, nil
+}
@@ -1,10 +1,28 @@
 package study
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+	"vindr-lab-api/annotation"
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/helper"
+	"vindr-lab-api/mw"
+	"vindr-lab-api/object"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
 
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 var taskSubmit = TaskSubmit{
@@ -37,7 +55,7 @@ func TestNewTask(t *testing.T) {
 	}
 }
 
-func TestString(t *testing.T) {
+func TestTaskString(t *testing.T) {
 	{
 		assert.NotEqual(t, "{}", task.String())
 	}
@@ -79,3 +97,1056 @@ func TestIsValidTaskSubmit(t *testing.T) {
 		assert.Equal(t, false, taskSubmit.IsValidTaskSubmit())
 	}
 }
+
+func TestMergeAnnotations(t *testing.T) {
+	boxData := func(x0, y0, x1, y1 float64) interface{} {
+		return []interface{}{
+			map[string]interface{}{"x": x0, "y": y0},
+			map[string]interface{}{"x": x1, "y": y1},
+		}
+	}
+	mapAnnotator := map[string]string{"t1": "a1", "t2": "a2", "t3": "a3"}
+	antns := []annotation.Annotation{
+		{ID: "tag1", TaskID: "t1", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1", "l2"}},
+		{ID: "tag2", TaskID: "t2", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+		{ID: "tag3", TaskID: "t3", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l3"}},
+		{ID: "box1", TaskID: "t1", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l4"}, Data: boxData(0, 0, 10, 10)},
+		{ID: "box2", TaskID: "t2", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l4"}, Data: boxData(1, 1, 11, 11)},
+		{ID: "box3", TaskID: "t3", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l4"}, Data: boxData(50, 50, 60, 60)},
+		// the same lesion labelled differently by each annotator
+		{ID: "box4", TaskID: "t1", ObjectID: "o3", Type: constants.AntnTypeBox, LabelIDs: []string{"l4", "l5"}, Data: boxData(0, 0, 10, 10)},
+		{ID: "box5", TaskID: "t2", ObjectID: "o3", Type: constants.AntnTypeBox, LabelIDs: []string{"l5"}, Data: boxData(0, 0, 10, 11)},
+		{ID: "box6", TaskID: "t3", ObjectID: "o3", Type: constants.AntnTypeBox, LabelIDs: []string{"l6"}, Data: boxData(1, 0, 10, 10)},
+		// a majority drew it, none chose the same label
+		{ID: "box7", TaskID: "t1", ObjectID: "o4", Type: constants.AntnTypeBox, LabelIDs: []string{"l4"}, Data: boxData(0, 0, 10, 10)},
+		{ID: "box8", TaskID: "t2", ObjectID: "o4", Type: constants.AntnTypeBox, LabelIDs: []string{"l5"}, Data: boxData(0, 0, 10, 10)},
+	}
+
+	ret := mergeAnnotations(antns, mapAnnotator, ConsensusIoUThreshold)
+	assert.Equal(t, 3, len(ret))
+
+	assert.Equal(t, constants.AntnTypeTag, ret[0].Type)
+	assert.Equal(t, []string{"l1"}, ret[0].LabelIDs)
+
+	assert.Equal(t, constants.AntnTypeBox, ret[1].Type)
+	points, ok := annotation.ParsePoints(ret[1].Data)
+	assert.True(t, ok)
+	assert.Equal(t, []annotation.Point2D{{X: 0.5, Y: 0.5}, {X: 10.5, Y: 10.5}}, points)
+	consensus := ret[1].Meta["consensus"].(map[string]interface{})
+	assert.Equal(t, []string{"box1", "box2"}, consensus["source_annotation_ids"])
+	assert.Equal(t, []string{"a1", "a2"}, consensus["annotator_ids"])
+	assert.Equal(t, []string{"l4"}, ret[1].LabelIDs)
+
+	assert.Equal(t, "o3", ret[2].ObjectID)
+	assert.Equal(t, []string{"l5"}, ret[2].LabelIDs)
+	consensus = ret[2].Meta["consensus"].(map[string]interface{})
+	assert.Equal(t, []string{"box4", "box5", "box6"}, consensus["source_annotation_ids"])
+	assert.Equal(t, map[string]interface{}{"l4": 1, "l5": 2, "l6": 1}, consensus["votes"])
+}
+
+func TestDisagree(t *testing.T) {
+	box := func(x0, y0, x1, y1 float64) interface{} {
+		return []interface{}{map[string]interface{}{"x": x0, "y": y0}, map[string]interface{}{"x": x1, "y": y1}}
+	}
+	rule := project.DisagreementRule{Tags: true, MinIoU: 0.5}
+	taskIDs := []string{"r1", "r2"}
+	agreeing := []annotation.Annotation{
+		{TaskID: "r1", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1", "l2"}},
+		{TaskID: "r2", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l2"}},
+		{TaskID: "r2", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+		{TaskID: "r1", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l3"}, Data: box(0, 0, 10, 10)},
+		{TaskID: "r2", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l3"}, Data: box(1, 1, 10, 10)},
+	}
+	assert.False(t, disagree(rule, agreeing, taskIDs))
+
+	otherTag := append(append([]annotation.Annotation{}, agreeing...),
+		annotation.Annotation{TaskID: "r2", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l4"}})
+	assert.True(t, disagree(rule, otherTag, taskIDs))
+	assert.False(t, disagree(project.DisagreementRule{MinIoU: 0.5}, otherTag, taskIDs))
+
+	farBox := append(append([]annotation.Annotation{}, agreeing[:4]...),
+		annotation.Annotation{TaskID: "r2", ObjectID: "o2", Type: constants.AntnTypeBox, LabelIDs: []string{"l3"}, Data: box(6, 6, 16, 16)})
+	assert.True(t, disagree(rule, farBox, taskIDs))
+	assert.False(t, disagree(project.DisagreementRule{Tags: true}, farBox, taskIDs))
+}
+
+func TestPlanRestore(t *testing.T) {
+	current := map[string]annotation.Annotation{
+		"kept":    {ID: "kept", Description: "same"},
+		"changed": {ID: "changed", Description: "new"},
+		"created": {ID: "created"},
+		"old":     {ID: "old"},
+	}
+	alive := map[string]annotation.Annotation{
+		"kept":    {ID: "kept", Description: "same"},
+		"changed": {ID: "changed", Description: "before"},
+		"deleted": {ID: "deleted"},
+	}
+	known := map[string]bool{"kept": true, "changed": true, "created": true, "deleted": true}
+
+	writes, deleteIDs := planRestore(current, alive, known)
+	assert.Equal(t, 2, len(writes))
+	for _, antn := range writes {
+		assert.NotEqual(t, "kept", antn.ID)
+	}
+	assert.Equal(t, []string{"created"}, deleteIDs)
+}
+
+func TestStudyStatusOf(t *testing.T) {
+	status, err := studyStatusOf(map[string]int{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.StudyStatusUnassigned, status)
+
+	status, err = studyStatusOf(map[string]int{constants.TaskStatusCompleted: 2}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.StudyStatusCompleted, status)
+
+	status, err = studyStatusOf(map[string]int{constants.TaskStatusRejected: 1, constants.TaskStatusReturned: 1}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, constants.StudyStatusAssigned, status)
+
+	_, err = studyStatusOf(map[string]int{constants.TaskStatusCompleted: 3}, 2)
+	assert.NotNil(t, err)
+}
+
+func TestTaskRevision(t *testing.T) {
+	seqNo, primaryTerm := 7, 1
+	task := Task{ID: "id", Revision: entities.Revision{SeqNo: &seqNo, PrimaryTerm: &primaryTerm}}
+	assert.Equal(t, `"7-1"`, task.ETag())
+	assert.Contains(t, task.String(), `"seq_no":7`)
+
+	rev, err := entities.ParseRevision(task.ETag())
+	assert.Nil(t, err)
+	assert.True(t, rev.Matches(task.Revision))
+
+	stale, err := entities.ParseRevision("6-1")
+	assert.Nil(t, err)
+	assert.False(t, stale.Matches(task.Revision))
+
+	empty, err := entities.ParseRevision("")
+	assert.Nil(t, err)
+	assert.True(t, empty.Matches(task.Revision))
+
+	_, err = entities.ParseRevision("abc")
+	assert.NotNil(t, err)
+}
+
+func newMemoryTaskAPI() (*TaskAPI, *gin.Engine) {
+	app := NewTaskAPI(NewTaskMemory(), NewStudyMemory(), project.NewProjectMemory(), object.NewObjectMemory(),
+		annotation.NewAnnotationMemory(), annotation.NewAnnotationHistoryMemory(), annotation.NewLabelMemory(), nil, zap.NewNop())
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/tasks", func(c *gin.Context) {
+		c.Set(mw.GIN_CONTEXT_AUTHINFO, mw.Account{ID: "u1"})
+	})
+	group.GET("", app.GetTasks)
+	group.POST("/assign", app.CreateTask)
+	group.POST("/next", app.ClaimNextTask)
+	group.POST("/reassign", app.ReassignTasks)
+	group.POST("/update_schedule_many", app.UpdateTasksSchedule)
+	group.POST("/update_status_many", app.UpdateTasksStatus)
+	group.GET("/:id", app.GetTask)
+	group.PUT("/:id", app.UpdateTask)
+	group.PUT("/:id/annotations", app.SetManyAnnotationsV2)
+	group.PUT("/:id/status", app.UpdateTaskStatus)
+	group.GET("/:id/history", app.GetTaskHistory)
+	group.GET("/:id/sources", app.GetTaskSources)
+	group.GET("/:id/events", app.GetTaskEvents)
+	group.DELETE("/:id", app.DeleteTask)
+	return app, engine
+}
+
+// newIDServer an id generator always answering 7
+func newIDServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"last_insert_id": 7}`))
+	}))
+}
+
+func serve(engine *gin.Engine, method, url, ifMatch, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestTaskAPIWithMemoryStores(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.taskStore.Create(Task{ID: "t1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1",
+		Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing}))
+	assert.Nil(t, app.labelStore.Create(annotation.Label{ID: "l1", Scope: constants.ObjectTypeStudy}))
+	assert.Nil(t, app.objectStore.Create(object.Object{ID: "o1", ProjectID: "p1", StudyID: "s1", Type: constants.ObjectTypeStudy,
+		Meta: &entities.MetaData{StudyInstanceUID: "1.2.3"}}))
+
+	_, _, err := app.taskStore.Get(nil, "_id:unknown")
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+	_, _, err = app.studyStore.Get(nil, "_id:unknown")
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+	w := serve(engine, http.MethodGet, "/tasks/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/unknown/annotations", "", `{"comment": "none"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/unknown/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(engine, http.MethodPost, "/tasks/update_status_many", "", `{"ids": ["t1", "unknown"], "status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(engine, http.MethodDelete, "/tasks/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(engine, http.MethodGet, "/tasks/t1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	body := `{"comment": "first", "annotations": [{"event": "CREATED", "type": "TAG", "label_ids": ["l1"],
+		"project_id": "p1", "study_id": "s1", "task_id": "t1", "meta": {"masked_study_instance_uid": "p1.1.2.3"}}]}`
+	w = serve(engine, http.MethodPut, "/tasks/t1/annotations", etag, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	antns, _, err := app.antnStore.GetSlice(map[string][]string{"task_id.keyword": {"t1"}}, "", 0, 10, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(antns))
+	assert.Equal(t, "o1", antns[0].ObjectID)
+	assert.Equal(t, "u1", antns[0].CreatorID)
+
+	histories, err := app.getTaskHistories("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(histories))
+	assert.Equal(t, constants.EventCreate, histories[0].Event)
+
+	// the first save moved the task on, the same If-Match is now stale and
+	// nothing of the save is written
+	w = serve(engine, http.MethodPut, "/tasks/t1/annotations", etag, strings.Replace(body, "first", "second", 1))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	antns, _, err = app.antnStore.GetSlice(map[string][]string{"task_id.keyword": {"t1"}}, "", 0, 10, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(antns))
+	w = serve(engine, http.MethodPut, "/tasks/t1", etag, `{"comment": "third"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	task, _, err := app.taskStore.Get(nil, "_id:t1")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", task.Comment)
+
+	w = serve(engine, http.MethodPut, "/tasks/t1", "", `{"comment": "third"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	task, _, err = app.taskStore.Get(nil, "status.keyword:(NEW OR DOING) AND comment:third")
+	assert.Nil(t, err)
+	assert.Equal(t, "t1", task.ID)
+}
+
+// racingTaskStore runs race once right after a Get, as a concurrent writer would
+type racingTaskStore struct {
+	TaskStore
+	race func()
+}
+
+func (store *racingTaskStore) Get(queries map[string][]string, qs string) (*Task, *entities.ESReturn, error) {
+	task, esReturn, err := store.TaskStore.Get(queries, qs)
+	if race := store.race; race != nil {
+		store.race = nil
+		race()
+	}
+	return task, esReturn, err
+}
+
+func TestSetManyAnnotationsRace(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.taskStore.Create(Task{ID: "t1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1",
+		Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing}))
+	assert.Nil(t, app.labelStore.Create(annotation.Label{ID: "l1", Scope: constants.ObjectTypeStudy}))
+
+	w := serve(engine, http.MethodGet, "/tasks/t1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+
+	// another save lands between the read of the task and the writes of this one
+	store := &racingTaskStore{TaskStore: app.taskStore}
+	store.race = func() {
+		assert.Nil(t, store.TaskStore.Update(Task{ID: "t1"}, kvStr2Inf{"comment": "other"}))
+	}
+	app.taskStore = store
+
+	body := `{"comment": "mine", "annotations": [{"event": "CREATED", "type": "TAG", "label_ids": ["l1"],
+		"project_id": "p1", "study_id": "s1", "task_id": "t1", "meta": {"masked_study_instance_uid": "p1.1.2.3"}}]}`
+	w = serve(engine, http.MethodPut, "/tasks/t1/annotations", etag, body)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	_, esReturn, err := app.antnStore.GetSlice(map[string][]string{"task_id.keyword": {"t1"}}, "", 0, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, esReturn.Hits.Total.Value)
+	task, _, err := app.taskStore.Get(nil, "_id:t1")
+	assert.Nil(t, err)
+	assert.Equal(t, "other", task.Comment)
+}
+
+func TestTaskAPIWithSQLStores(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+	// every connection to :memory: opens its own database
+	db.SetMaxOpenConns(1)
+
+	taskStore, studyStore := NewTaskSQL(db), NewStudySQL(db)
+	assert.Nil(t, taskStore.CreateTable())
+	assert.Nil(t, studyStore.CreateTable())
+
+	app, engine := newMemoryTaskAPI()
+	app.taskStore, app.studyStore = taskStore, studyStore
+	app.SetTransactor(NewSQLTransactor(db))
+
+	assert.Nil(t, studyStore.Create(Study{ID: "s1", ProjectID: "p1", Status: constants.StudyStatusUnassigned}))
+	assert.Nil(t, taskStore.Bulk([]Task{
+		{ID: "t1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1", Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing},
+		{ID: "t2", ProjectID: "p1", StudyID: "s1", AssigneeID: "u2", Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusCompleted},
+	}))
+
+	_, _, err = taskStore.Get(nil, "_id:unknown")
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+	_, _, err = studyStore.Get(nil, "_id:unknown")
+	assert.True(t, errors.Is(err, utils.ErrNotFound))
+	w := serve(engine, http.MethodGet, "/tasks/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(engine, http.MethodPost, "/tasks/update_status_many", "", `{"ids": ["unknown"], "status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(engine, http.MethodGet, "/tasks/t1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+
+	w = serve(engine, http.MethodPut, "/tasks/t1/status", etag, `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	study, _, err := studyStore.Get(nil, "_id:s1")
+	assert.Nil(t, err)
+	assert.Equal(t, constants.StudyStatusCompleted, study.Status)
+
+	w = serve(engine, http.MethodPut, "/tasks/t1/status", etag, `{"status": "DOING"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// a stale task rolls back the whole bulk
+	tasks, _, err := taskStore.GetSlice(map[string][]string{"study_id.keyword": {"s1"}}, "", 0, 10, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tasks))
+	tasks[0].Status, tasks[1].Status = constants.TaskStatusNew, constants.TaskStatusNew
+	tasks[1].Revision = tasks[0].Revision
+	err = taskStore.Bulk(tasks)
+	assert.True(t, errors.Is(err, utils.ErrVersionConflict))
+	count := 0
+	assert.Nil(t, taskStore.Query(nil, "status.keyword:COMPLETED", 0, 10, "", nil, func(tasks []Task, es entities.ESReturn) {
+		count += len(tasks)
+	}))
+	assert.Equal(t, 2, count)
+	// a size of 0 reads pages of the default size
+	count = 0
+	assert.Nil(t, taskStore.Query(nil, "status.keyword:COMPLETED", 0, 0, "", nil, func(tasks []Task, es entities.ESReturn) {
+		count += len(tasks)
+	}))
+	assert.Equal(t, 2, count)
+
+	// so does a failure after the first writes of a transaction
+	errAbort := errors.New("abort")
+	err = app.transactor.InTransaction(func(taskStore TaskStore, studyStore StudyStore) error {
+		if err := taskStore.Delete(map[string][]string{"_id": {"t1", "t2"}}, ""); err != nil {
+			return err
+		}
+		if err := updateStudyStatus(taskStore, studyStore, "p1", map[string]bool{"s1": true}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+	study, _, err = studyStore.Get(nil, "_id:s1")
+	assert.Nil(t, err)
+	assert.Equal(t, constants.StudyStatusCompleted, study.Status)
+	task, _, err := taskStore.Get(nil, "_id:t2")
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+}
+
+func TestTaskSQLSearch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// a table of an older version, without the typed columns
+	_, err = db.Exec(`CREATE TABLE tasks (id TEXT PRIMARY KEY, seq_no BIGINT NOT NULL, created BIGINT NOT NULL DEFAULT 0,
+		project_id TEXT NOT NULL DEFAULT '', study_id TEXT NOT NULL DEFAULT '', assignee_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '', type TEXT NOT NULL DEFAULT '', doc TEXT NOT NULL)`)
+	assert.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO tasks (id, seq_no, created, project_id, status, doc) VALUES ('t0', 1, 5, 'p1', 'NEW',
+		'{"id": "t0", "project_id": "p1", "status": "NEW", "created": 5, "priority": 3, "archived": false}')`)
+	assert.Nil(t, err)
+
+	sqlStore, memoryStore := NewTaskSQL(db), NewTaskMemory()
+	assert.Nil(t, sqlStore.CreateTable())
+	assert.Nil(t, memoryStore.Create(Task{ID: "t0", ProjectID: "p1", Status: constants.TaskStatusNew, Created: 5, Priority: 3}))
+
+	tasks := make([]Task, 0)
+	for i := 1; i <= 20; i++ {
+		task := Task{ID: fmt.Sprintf("t%d", i), ProjectID: "p1", StudyID: fmt.Sprintf("s%d", i%3), AssigneeID: fmt.Sprintf("u%d", i%2),
+			Status: constants.TaskStatusNew, Created: int64(10 + i), Priority: i % 4, Archived: i%5 == 0}
+		if i%3 == 0 {
+			task.Status = constants.TaskStatusDoing
+		}
+		if i%2 == 0 {
+			task.DueAt = int64(100 - i)
+		}
+		tasks = append(tasks, task)
+	}
+	tasks[3].ProjectID = "p2"
+	assert.Nil(t, sqlStore.Bulk(tasks))
+	assert.Nil(t, memoryStore.Bulk(tasks))
+
+	type search struct {
+		queries    map[string][]string
+		qs         string
+		from, size int
+		sort       string
+		aggs       []string
+	}
+	searches := []search{
+		{qs: "project_id.keyword:p1 AND archived:false", size: 5, sort: "-priority,due_at,-created"},
+		{qs: "project_id.keyword:p1 AND archived:false", from: 5, size: 5, sort: "-priority,due_at,-created"},
+		{qs: "project_id.keyword:p1 AND archived:false", from: 15, size: 10, sort: "-priority,due_at,-created"},
+		{qs: "project_id.keyword:p1", size: 0, aggs: []string{"status", "assignee_id"}},
+		{queries: map[string][]string{"status.keyword": {"NEW", "DOING"}, "assignee_id.keyword": {"u1"}}, size: 50, sort: "due_at"},
+		{qs: "due_at:>=90 OR NOT priority:<2", size: 50, sort: "-due_at"},
+		{qs: "due_at:* AND NOT status.keyword:DOING", size: 50, sort: "-created"},
+		{qs: "_id:t1 OR _id:t0 OR priority:3", size: 50},
+		// the others are answered by SearchDocuments
+		{qs: "status:doing", size: 3, sort: "-priority"},
+		{qs: "study_id.keyword:s*", size: 50, sort: "study_id"},
+	}
+	for _, search := range searches {
+		name := fmt.Sprintf("%v %s %d %d %s %v", search.queries, search.qs, search.from, search.size, search.sort, search.aggs)
+		expected, expectedReturn, err := memoryStore.GetSlice(search.queries, search.qs, search.from, search.size, search.sort, search.aggs)
+		assert.Nil(t, err, name)
+		actual, actualReturn, err := sqlStore.GetSlice(search.queries, search.qs, search.from, search.size, search.sort, search.aggs)
+		assert.Nil(t, err, name)
+
+		expectedIDs, actualIDs := make([]string, 0), make([]string, 0)
+		for _, task := range expected {
+			expectedIDs = append(expectedIDs, task.ID)
+		}
+		for _, task := range actual {
+			actualIDs = append(actualIDs, task.ID)
+		}
+		assert.Equal(t, expectedIDs, actualIDs, name)
+		assert.Equal(t, expectedReturn.Hits.Total, actualReturn.Hits.Total, name)
+		assert.Equal(t, expectedReturn.Aggregations, actualReturn.Aggregations, name)
+	}
+
+	assert.Nil(t, sqlStore.Delete(nil, "project_id.keyword:p1 AND archived:true"))
+	_, esReturn, err := sqlStore.GetSlice(nil, "project_id.keyword:p1", 0, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 16, esReturn.Hits.Total.Value)
+}
+
+func TestRejectReviewTask(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", ProjectID: "p1", Status: constants.StudyStatusAssigned}))
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		{ID: "a1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1", Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusCompleted},
+		{ID: "r1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u2", Type: constants.TaskTypeReview, Status: constants.TaskStatusDoing},
+	}))
+	assert.Nil(t, app.antnStore.Create(annotation.Annotation{ID: "x1", TaskID: "a1", ProjectID: "p1", StudyID: "s1"}))
+
+	w := serve(engine, http.MethodPut, "/tasks/r1/status", "", `{"status": "REJECTED"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "REJECTED", "reason": "wrong side"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "RETURNED"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(engine, http.MethodPut, "/tasks/r1/status", "", `{"status": "REJECTED", "reason": "wrong side"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	review, _, _ := app.taskStore.Get(nil, "_id:r1")
+	assert.Equal(t, constants.TaskStatusRejected, review.Status)
+	assert.Equal(t, "wrong side", review.RejectReason)
+	task, _, _ := app.taskStore.Get(nil, "_id:a1")
+	assert.Equal(t, constants.TaskStatusReturned, task.Status)
+	assert.Equal(t, "u1", task.AssigneeID)
+	assert.Equal(t, 1, task.ReturnCount)
+	study, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, study.Status)
+	_, esReturn, _ := app.antnStore.GetSlice(nil, "task_id.keyword:a1", 0, 10, "", nil)
+	assert.Equal(t, 1, esReturn.Hits.Total.Value)
+
+	// completing the returned task gives the review back to the reviewer
+	w = serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	review, _, _ = app.taskStore.Get(nil, "_id:r1")
+	assert.Equal(t, constants.TaskStatusDoing, review.Status)
+
+	w = serve(engine, http.MethodPut, "/tasks/r1/status", "", `{"status": "REJECTED", "reason": "still wrong"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	task, _, _ = app.taskStore.Get(nil, "_id:a1")
+	assert.Equal(t, 2, task.ReturnCount)
+	assert.Equal(t, "still wrong", task.RejectReason)
+}
+
+func TestTwoLevelReviewWorkflow(t *testing.T) {
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app, engine := newMemoryTaskAPI()
+	app.idGenerator = helper.NewIDGenerator(idServer.URL)
+	open := map[string][]string{
+		constants.TaskStatusNew:      {constants.TaskStatusDoing},
+		constants.TaskStatusDoing:    {constants.TaskStatusCompleted, constants.TaskStatusRejected},
+		constants.TaskStatusReturned: {constants.TaskStatusDoing},
+	}
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowCustom,
+		WorkflowDefinition: &project.WorkflowDefinition{Stages: []project.WorkflowStage{
+			{Name: "annotate", TaskType: constants.TaskTypeAnnotate, Transitions: map[string][]string{
+				constants.TaskStatusNew:      {constants.TaskStatusDoing},
+				constants.TaskStatusDoing:    {constants.TaskStatusCompleted},
+				constants.TaskStatusReturned: {constants.TaskStatusCompleted},
+			}, Next: []project.WorkflowRule{{Stage: "review", AssigneeIDs: []string{"u2"}}}},
+			{Name: "review", TaskType: constants.TaskTypeReview, Transitions: open, ReturnsTo: "annotate",
+				Next: []project.WorkflowRule{{Stage: "second_review", AssigneeIDs: []string{"u3"}}}},
+			{Name: "second_review", TaskType: constants.TaskTypeReview, Transitions: open, ReturnsTo: "review"},
+		}}}))
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", ProjectID: "p1"}))
+	assert.Nil(t, app.taskStore.Create(Task{ID: "a1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1",
+		Type: constants.TaskTypeAnnotate, Stage: "annotate", Status: constants.TaskStatusNew}))
+
+	stageTask := func(stage string) *Task {
+		task, _, err := app.taskStore.Get(nil, fmt.Sprintf("stage.keyword:%s", stage))
+		if !errors.Is(err, utils.ErrNotFound) {
+			assert.Nil(t, err)
+		}
+		return task
+	}
+
+	w := serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "DOING"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, stageTask("review"))
+	w = serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	review := stageTask("review")
+	assert.NotNil(t, review)
+	assert.Equal(t, "u2", review.AssigneeID)
+	assert.Equal(t, "TSK-7", review.Code)
+	assert.Equal(t, constants.TaskStatusNew, review.Status)
+
+	serve(engine, http.MethodPut, "/tasks/"+review.ID+"/status", "", `{"status": "DOING"}`)
+	w = serve(engine, http.MethodPut, "/tasks/"+review.ID+"/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := stageTask("second_review")
+	assert.NotNil(t, second)
+	assert.Equal(t, "u3", second.AssigneeID)
+
+	// the second level sends the first review back, not the annotation
+	serve(engine, http.MethodPut, "/tasks/"+second.ID+"/status", "", `{"status": "DOING"}`)
+	w = serve(engine, http.MethodPut, "/tasks/"+second.ID+"/status", "", `{"status": "REJECTED", "reason": "missed a nodule"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	review = stageTask("review")
+	assert.Equal(t, constants.TaskStatusReturned, review.Status)
+	assert.Equal(t, 1, review.ReturnCount)
+	task, _, _ := app.taskStore.Get(nil, "_id:a1")
+	assert.Equal(t, constants.TaskStatusCompleted, task.Status)
+	study, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, study.Status)
+
+	w = serve(engine, http.MethodPut, "/tasks/"+review.ID+"/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	serve(engine, http.MethodPut, "/tasks/"+review.ID+"/status", "", `{"status": "DOING"}`)
+	w = serve(engine, http.MethodPut, "/tasks/"+review.ID+"/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the rejected second review is reopened rather than created again
+	second, _, _ = app.taskStore.Get(nil, "_id:"+second.ID)
+	assert.Equal(t, constants.TaskStatusDoing, second.Status)
+	_, esReturn, _ := app.taskStore.GetSlice(nil, "stage.keyword:second_review", 0, 10, "", nil)
+	assert.Equal(t, 1, esReturn.Hits.Total.Value)
+}
+
+func TestTriangleReviewTask(t *testing.T) {
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app, engine := newMemoryTaskAPI()
+	app.idGenerator = helper.NewIDGenerator(idServer.URL)
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowTriangle,
+		People: []project.ProjectPerson{
+			{ID: "u1", Roles: []string{constants.ProjRoleAnnotator, constants.ProjRoleReviewer}},
+			{ID: "u2", Roles: []string{constants.ProjRoleAnnotator}},
+			{ID: "u3", Roles: []string{constants.ProjRoleReviewer}},
+			{ID: "u4", Roles: []string{constants.ProjRoleReviewer}},
+		}}))
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", ProjectID: "p1"}))
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		{ID: "a1", ProjectID: "p1", StudyID: "s1", StudyCode: "STD-1", AssigneeID: "u1", Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing},
+		{ID: "a2", ProjectID: "p1", StudyID: "s1", StudyCode: "STD-1", AssigneeID: "u2", Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing},
+		// u3 already has a review to do on another study
+		{ID: "r0", ProjectID: "p1", StudyID: "s0", AssigneeID: "u3", Type: constants.TaskTypeReview, Status: constants.TaskStatusNew},
+	}))
+	reviewOf := func(studyID string) *Task {
+		task, _, err := app.taskStore.Get(nil, fmt.Sprintf("study_id.keyword:%s AND type.keyword:REVIEW", studyID))
+		if !errors.Is(err, utils.ErrNotFound) {
+			assert.Nil(t, err)
+		}
+		return task
+	}
+
+	w := serve(engine, http.MethodPut, "/tasks/a1/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, reviewOf("s1"))
+
+	w = serve(engine, http.MethodPut, "/tasks/a2/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	review := reviewOf("s1")
+	assert.NotNil(t, review)
+	assert.Equal(t, "u4", review.AssigneeID)
+	assert.Equal(t, "TSK-7", review.Code)
+	assert.Equal(t, "STD-1", review.StudyCode)
+	assert.Equal(t, constants.WorkflowStageReview, review.Stage)
+	study, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, study.Status)
+
+	// completing again does not give the study a second review
+	serve(engine, http.MethodPut, "/tasks/a2/status", "", `{"status": "DOING"}`)
+	serve(engine, http.MethodPut, "/tasks/a2/status", "", `{"status": "COMPLETED"}`)
+	_, esReturn, _ := app.taskStore.GetSlice(nil, "study_id.keyword:s1 AND type.keyword:REVIEW", 0, 10, "", nil)
+	assert.Equal(t, 1, esReturn.Hits.Total.Value)
+
+	app.SetReviewStrategy(constants.ASSIGN_STRATEGY_NONE)
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s2", ProjectID: "p1"}))
+	assert.Nil(t, app.taskStore.Create(Task{ID: "a3", ProjectID: "p1", StudyID: "s2", AssigneeID: "u1",
+		Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusDoing}))
+	w = serve(engine, http.MethodPut, "/tasks/a3/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, reviewOf("s2"))
+}
+
+func TestArbitrateDisagreeingReviews(t *testing.T) {
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app, engine := newMemoryTaskAPI()
+	app.idGenerator = helper.NewIDGenerator(idServer.URL)
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowTriangle,
+		People: []project.ProjectPerson{
+			{ID: "u3", Roles: []string{constants.ProjRoleReviewer}},
+			{ID: "u4", Roles: []string{constants.ProjRoleReviewer}},
+			{ID: "u5", Roles: []string{constants.ProjRoleArbitrator}},
+		}}))
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", ProjectID: "p1"}))
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		{ID: "r1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u3", Type: constants.TaskTypeReview, Status: constants.TaskStatusDoing},
+		{ID: "r2", ProjectID: "p1", StudyID: "s1", AssigneeID: "u4", Type: constants.TaskTypeReview, Status: constants.TaskStatusDoing},
+	}))
+	assert.Nil(t, app.antnStore.BulkCreate([]annotation.Annotation{
+		{ID: "x1", TaskID: "r1", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+		{ID: "x2", TaskID: "r2", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l2"}},
+	}))
+
+	w := serve(engine, http.MethodPut, "/tasks/r1/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(engine, http.MethodPut, "/tasks/r2/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	arbitration, _, err := app.taskStore.Get(nil, "type.keyword:ARBITRATE")
+	assert.Nil(t, err)
+	assert.NotNil(t, arbitration)
+	assert.Equal(t, "u5", arbitration.AssigneeID)
+	assert.Equal(t, constants.WorkflowStageArbitrate, arbitration.Stage)
+	assert.ElementsMatch(t, []string{"r1", "r2"}, arbitration.SourceTaskIDs)
+	study, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, study.Status)
+
+	w = serve(engine, http.MethodGet, "/tasks/"+arbitration.ID+"/sources", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"label_ids":["l1"]`)
+	assert.Contains(t, w.Body.String(), `"label_ids":["l2"]`)
+	assert.Contains(t, w.Body.String(), `"count":2`)
+
+	serve(engine, http.MethodPut, "/tasks/"+arbitration.ID+"/status", "", `{"status": "DOING"}`)
+	w = serve(engine, http.MethodPut, "/tasks/"+arbitration.ID+"/status", "", `{"status": "COMPLETED"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	study, _, _ = app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusCompleted, study.Status)
+
+	// a deleted source is left out
+	assert.Nil(t, app.taskStore.Delete(nil, "_id:r2"))
+	w = serve(engine, http.MethodGet, "/tasks/"+arbitration.ID+"/sources", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"label_ids":["l1"]`)
+	assert.NotContains(t, w.Body.String(), `"label_ids":["l2"]`)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+	w = serve(engine, http.MethodGet, "/tasks/unknown/sources", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPlanAssignment(t *testing.T) {
+	studies := map[string]string{"s1": "STD-1", "s2": "STD-2", "s3": "STD-3", "s4": "STD-4"}
+	plan := func(ta2 TaskAssignment2, assignees []string, workload AssignWorkload) []string {
+		assignments, err := planAssignment(studies, ta2, assignees, workload)
+		assert.Nil(t, err)
+		plan := make([]string, 0)
+		for _, assignment := range assignments {
+			plan = append(plan, assignment.StudyID+":"+assignment.AssigneeID)
+		}
+		return plan
+	}
+
+	equally := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_EQUALLY}
+	assert.Equal(t, []string{"s1:u1", "s2:u2", "s3:u1", "s4:u2"}, plan(equally, []string{"u1", "u2"}, AssignWorkload{}))
+
+	leastLoaded := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_LEAST_LOADED}
+	busy := AssignWorkload{OpenTasks: map[string]int{"u1": 3}}
+	assert.Equal(t, []string{"s1:u2", "s2:u2", "s3:u2", "s4:u1"}, plan(leastLoaded, []string{"u1", "u2"}, busy))
+
+	weighted := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_WEIGHTED, Weights: map[string]int{"u1": 3, "u3": 0}}
+	assert.Equal(t, []string{"s1:u1", "s2:u1", "s3:u1", "s4:u2"}, plan(weighted, []string{"u1", "u2", "u3"}, AssignWorkload{}))
+
+	doubleReading := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_EQUALLY, ReadersPerStudy: 2}
+	assert.Equal(t, []string{"s1:u1", "s1:u2", "s2:u3", "s2:u1", "s3:u2", "s3:u3", "s4:u1", "s4:u2"},
+		plan(doubleReading, []string{"u1", "u2", "u3"}, AssignWorkload{}))
+	_, err := planAssignment(studies, doubleReading, []string{"u1"}, AssignWorkload{})
+	assert.NotNil(t, err)
+
+	pool := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_POOL, ReadersPerStudy: 2}
+	assert.Equal(t, []string{"s1:", "s1:", "s2:", "s2:", "s3:", "s3:", "s4:", "s4:"}, plan(pool, nil, AssignWorkload{}))
+
+	skill := TaskAssignment2{Strategy: constants.ASSIGN_STRATEGY_SKILL}
+	skilled := AssignWorkload{
+		OpenTasks: map[string]int{"u3": 1},
+		Skills:    map[string][]string{"u1": {"Modality:CT"}, "u2": {"Modality:MR", "BodyPartExamined:HEAD"}},
+		DICOMTags: map[string]*DICOMTags{
+			"s1": {Modality: []string{"CT"}},
+			"s2": {Modality: []string{"MR"}, BodyPartExamined: []string{"head"}},
+			"s3": {Modality: []string{"MR"}, BodyPartExamined: []string{"CHEST"}},
+			"s4": {Modality: []string{"ct"}},
+		},
+	}
+	assert.Equal(t, []string{"s1:u1", "s2:u2", "s3:u3", "s4:u1"}, plan(skill, []string{"u1", "u2", "u3"}, skilled))
+	_, err = planAssignment(studies, skill, []string{"u1", "u2"}, skilled)
+	assert.NotNil(t, err)
+}
+
+func TestLoadWorkload(t *testing.T) {
+	taskStore := NewTaskMemory()
+	assert.Nil(t, taskStore.Bulk([]Task{
+		{ID: "t1", ProjectID: "p1", AssigneeID: "u1", Status: constants.TaskStatusNew},
+		{ID: "t2", ProjectID: "p1", AssigneeID: "u1", Status: constants.TaskStatusCompleted},
+		{ID: "t3", ProjectID: "p1", AssigneeID: "u2", Status: constants.TaskStatusDoing},
+		// the tasks of another project do not weigh on p1
+		{ID: "t4", ProjectID: "p2", AssigneeID: "u2", Status: constants.TaskStatusNew},
+		{ID: "t5", ProjectID: "p2", AssigneeID: "u2", Status: constants.TaskStatusNew},
+	}))
+	workload, err := loadWorkload(taskStore, NewStudyMemory(), &project.Project{ID: "p1"},
+		constants.ASSIGN_STRATEGY_LEAST_LOADED, []string{"u1", "u2"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"u1": 1, "u2": 1}, workload.OpenTasks)
+}
+
+func TestAssignDryRunAndDuplicates(t *testing.T) {
+	idServer := newIDServer()
+	defer idServer.Close()
+
+	app, engine := newMemoryTaskAPI()
+	app.idGenerator = helper.NewIDGenerator(idServer.URL)
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowSingle,
+		People: []project.ProjectPerson{{ID: "u2", Roles: []string{constants.ProjRoleAnnotator}}}}))
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", Code: "STD-1", ProjectID: "p1"}))
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s2", Code: "STD-2", ProjectID: "p1"}))
+	assert.Nil(t, app.taskStore.Create(Task{ID: "t1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u2",
+		Type: constants.TaskTypeAnnotate, Status: constants.TaskStatusNew}))
+
+	body := `{"project_id": "p1", "source_type": "SELECTED", "study_ids": ["s1", "s2"], "strategy": "ALL",
+		"assignee_ids": {"ANNOTATE": ["u2", "u3"]}%s}`
+	countTasks := func() int {
+		tasks, _, err := app.taskStore.GetSlice(nil, "project_id.keyword:p1", 0, constants.DefaultLimit, "", nil)
+		assert.Nil(t, err)
+		return len(tasks)
+	}
+
+	w := serve(engine, http.MethodPost, "/tasks/assign", "", fmt.Sprintf(body, `, "dry_run": true`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, countTasks())
+	var resp struct {
+		Data AssignmentPreview `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 3, resp.Data.Count)
+	assert.Equal(t, 1, resp.Data.Duplicates)
+	assert.Equal(t, []AssigneePlan{
+		{AssigneeID: "u2", Stage: constants.WorkflowStageAnnotate, StudyIDs: []string{"s2"}},
+		{AssigneeID: "u3", Stage: constants.WorkflowStageAnnotate, StudyIDs: []string{"s1", "s2"}},
+	}, resp.Data.Distribution)
+	assert.ElementsMatch(t, []AssignConflict{
+		{Type: constants.AssignConflictMissingRole, AssigneeID: "u3", Stage: constants.WorkflowStageAnnotate},
+		{Type: constants.AssignConflictStudyAssigned, StudyID: "s1", Stage: constants.WorkflowStageAnnotate},
+		{Type: constants.AssignConflictDuplicate, AssigneeID: "u2", StudyID: "s1", Stage: constants.WorkflowStageAnnotate},
+	}, resp.Data.Conflicts)
+
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", fmt.Sprintf(body, `, "duplicate_policy": "REJECT"`))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, 1, countTasks())
+
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", fmt.Sprintf(body, ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 4, countTasks())
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", fmt.Sprintf(body, ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 4, countTasks())
+
+	// a study keeps its pool tasks once, even claimed
+	pool := `{"project_id": "p1", "source_type": "SELECTED", "study_ids": ["s1", "s2"], "strategy": "POOL",
+		"assignee_ids": {"ANNOTATE": []}}`
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", pool)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 6, countTasks())
+	pooled, _, err := app.taskStore.GetSlice(nil, "pooled:true", 0, constants.DefaultLimit, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pooled))
+	for _, task := range pooled {
+		assert.Equal(t, "", task.AssigneeID)
+	}
+	assert.Nil(t, app.taskStore.Update(pooled[0], kvStr2Inf{"assignee_id": "u2", "status": constants.TaskStatusDoing}))
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", strings.Replace(pool, `"POOL"`, `"POOL", "dry_run": true`, 1))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 0, resp.Data.Count)
+	assert.Equal(t, 2, resp.Data.Duplicates)
+	w = serve(engine, http.MethodPost, "/tasks/assign", "", pool)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 6, countTasks())
+}
+
+func TestClaimNextTask(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowSingle,
+		People: []project.ProjectPerson{{ID: "u1", Roles: []string{constants.ProjRoleAnnotator}}}}))
+	for _, studyID := range []string{"s1", "s2", "s3", "s4"} {
+		assert.Nil(t, app.studyStore.Create(Study{ID: studyID, ProjectID: "p1"}))
+	}
+	newTask := func(id, studyID, assigneeID, status string, priority int, created int64) Task {
+		return Task{ID: id, ProjectID: "p1", StudyID: studyID, AssigneeID: assigneeID, Type: constants.TaskTypeAnnotate,
+			Status: status, Priority: priority, Created: created}
+	}
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		newTask("t1", "s1", "u2", constants.TaskStatusNew, 9, 1),
+		newTask("t2", "s2", "u1", constants.TaskStatusNew, 1, 1),
+		newTask("t3", "s1", "", constants.TaskStatusNew, 5, 3),
+		newTask("t4", "s2", "", constants.TaskStatusNew, 5, 2),
+		newTask("t5", "s3", "", constants.TaskStatusNew, 7, 1),
+		newTask("t6", "s3", "u1", constants.TaskStatusCompleted, 0, 1),
+		{ID: "t7", ProjectID: "p1", StudyID: "s4", Type: constants.TaskTypeReview, Status: constants.TaskStatusNew, Priority: 8},
+	}))
+	// left by the annotator t3 was released from
+	assert.Nil(t, app.antnStore.BulkCreate([]annotation.Annotation{
+		{ID: "a1", TaskID: "t3", ObjectID: "o1", CreatorID: "u9", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+	}))
+
+	w := serve(engine, http.MethodPost, "/tasks/next", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	claimed := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		w = serve(engine, http.MethodPost, "/tasks/next?project_id=p1&type=ANNOTATE", "", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Data *Task `json:"data"`
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		if resp.Data == nil {
+			break
+		}
+		assert.Equal(t, "u1", resp.Data.AssigneeID)
+		assert.Equal(t, constants.TaskStatusDoing, resp.Data.Status)
+		claimed = append(claimed, resp.Data.ID)
+	}
+	// u1 already has tasks of s2 and s3 so the older pool tasks are left, t7 needs a REVIEWER
+	assert.Equal(t, []string{"t3", "t2"}, claimed)
+	assert.NotContains(t, serve(engine, http.MethodPost, "/tasks/next?project_id=p1", "", "").Body.String(), `"data"`)
+	task, _, _ := app.taskStore.Get(nil, "_id:t4")
+	assert.Equal(t, "", task.AssigneeID)
+	study, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, study.Status)
+	antn, _, _ := app.antnStore.Get(nil, "_id:a1")
+	assert.Equal(t, "u1", antn.CreatorID)
+}
+
+// notifierFunc a Notifier calling itself
+type notifierFunc func(event TaskEvent, recipientIDs []string) error
+
+func (f notifierFunc) Notify(event TaskEvent, recipientIDs []string) error {
+	return f(event, recipientIDs)
+}
+
+func TestReleaseStaleTasks(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	notified := make([]string, 0)
+	app.SetNotifier(notifierFunc(func(event TaskEvent, recipientIDs []string) error {
+		assert.Equal(t, []string{"o1"}, recipientIDs)
+		notified = append(notified, event.TaskID+":"+event.Event)
+		return nil
+	}))
+
+	now := time.Now()
+	hoursAgo := func(hours int) int64 {
+		return now.Add(-time.Duration(hours)*time.Hour).UnixNano() / int64(time.Millisecond)
+	}
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowSingle,
+		People:          []project.ProjectPerson{{ID: "o1", Roles: []string{constants.ProjRoleProjectOwner}}},
+		StaleTaskPolicy: &project.StaleTaskPolicy{NotifyAfterHours: 24, ReleaseAfterHours: 72, Action: constants.StaleActionPool}}))
+	newTask := func(id string, modified int64) Task {
+		return Task{ID: id, ProjectID: "p1", StudyID: "s1", AssigneeID: "u1", Type: constants.TaskTypeAnnotate,
+			Status: constants.TaskStatusDoing, Modified: modified}
+	}
+	assert.Nil(t, app.studyStore.Create(Study{ID: "s1", ProjectID: "p1"}))
+	for _, task := range []Task{newTask("t1", hoursAgo(30)), newTask("t2", hoursAgo(100)), newTask("t3", hoursAgo(80))} {
+		assert.Nil(t, app.taskStore.Create(task))
+	}
+	assert.Nil(t, app.antnHistoryStore.BulkCreate([]annotation.AnnotationHistory{
+		{ID: "h1", TaskID: "t2", AnnotationID: "a1", Event: constants.EventUpdate, Created: hoursAgo(1)},
+	}))
+
+	assert.Nil(t, app.ReleaseStaleTasks(now))
+	assert.Nil(t, app.ReleaseStaleTasks(now))
+	assert.ElementsMatch(t, []string{"t1:IDLE", "t3:RELEASED"}, notified)
+
+	t3, _, _ := app.taskStore.Get(nil, "_id:t3")
+	assert.Equal(t, constants.TaskStatusNew, t3.Status)
+	assert.Equal(t, "", t3.AssigneeID)
+	t2, _, _ := app.taskStore.Get(nil, "_id:t2")
+	assert.Equal(t, constants.TaskStatusDoing, t2.Status)
+	// the release updates the status of the study with the task
+	s1, _, _ := app.studyStore.Get(nil, "_id:s1")
+	assert.Equal(t, constants.StudyStatusAssigned, s1.Status)
+
+	w := serve(engine, http.MethodGet, "/tasks/t3/events", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"event":"RELEASED","assignee_id":"u1","detail":"POOL"`)
+}
+
+func TestReassignTasks(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.projectStore.Create(project.Project{ID: "p1", Workflow: constants.ProjWorkflowSingle,
+		People: []project.ProjectPerson{
+			{ID: "u1", Roles: []string{constants.ProjRoleAnnotator}},
+			{ID: "u2", Roles: []string{constants.ProjRoleAnnotator}},
+		}}))
+	newTask := func(id, studyID, assigneeID, status string) Task {
+		return Task{ID: id, ProjectID: "p1", StudyID: studyID, AssigneeID: assigneeID, Type: constants.TaskTypeAnnotate, Status: status}
+	}
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		newTask("t1", "s1", "u1", constants.TaskStatusDoing),
+		newTask("t2", "s2", "u1", constants.TaskStatusCompleted),
+		newTask("t3", "s3", "u1", constants.TaskStatusNew),
+		newTask("t4", "s3", "u2", constants.TaskStatusNew),
+	}))
+	assert.Nil(t, app.antnStore.BulkCreate([]annotation.Annotation{
+		{ID: "a1", TaskID: "t1", ObjectID: "o1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+	}))
+
+	w := serve(engine, http.MethodPost, "/tasks/reassign", "", `{"project_id": "p1", "to_assignee_id": "u2"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(engine, http.MethodPost, "/tasks/reassign", "", `{"project_id": "p1", "task_ids": ["t1"], "to_assignee_id": "u3"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"task_ids":[],"skipped":[{"task_id":"t1","reason":"u3 does not have the ANNOTATOR role in the project"}]`)
+
+	w = serve(engine, http.MethodPost, "/tasks/reassign", "",
+		`{"project_id": "p1", "from_assignee_id": "u1", "to_assignee_id": "u2", "annotations": "DISCARD"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data ReassignResult `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"t1"}, resp.Data.TaskIDs)
+	assert.Equal(t, 2, len(resp.Data.Skipped))
+
+	t1, _, _ := app.taskStore.Get(nil, "_id:t1")
+	assert.Equal(t, "u2", t1.AssigneeID)
+	assert.Equal(t, constants.TaskStatusNew, t1.Status)
+	antns, _, _ := app.antnStore.GetSlice(nil, "task_id.keyword:t1", 0, constants.DefaultLimit, "", nil)
+	assert.Empty(t, antns)
+	histories, _ := app.getTaskHistories("t1")
+	assert.Equal(t, 1, len(histories))
+	t3, _, _ := app.taskStore.Get(nil, "_id:t3")
+	assert.Equal(t, "u1", t3.AssigneeID)
+
+	w = serve(engine, http.MethodGet, "/tasks/t1/events", "", "")
+	assert.Contains(t, w.Body.String(), `"event":"REASSIGNED","assignee_id":"u1","detail":"to u2 by u1, annotations discarded"`)
+
+	assert.Nil(t, app.HandOverTasks("p1", "u1", "u2", "u9"))
+	t3, _, _ = app.taskStore.Get(nil, "_id:t3")
+	assert.Equal(t, "u1", t3.AssigneeID)
+
+	// kept annotations go to the new assignee so they can edit them
+	assert.Nil(t, app.taskStore.Create(newTask("t5", "s5", "u1", constants.TaskStatusDoing)))
+	assert.Nil(t, app.antnStore.BulkCreate([]annotation.Annotation{
+		{ID: "a2", TaskID: "t5", ObjectID: "o5", CreatorID: "u1", Type: constants.AntnTypeTag, LabelIDs: []string{"l1"}},
+	}))
+	w = serve(engine, http.MethodPost, "/tasks/reassign", "", `{"project_id": "p1", "task_ids": ["t5"], "to_assignee_id": "u2"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	antns, _, _ = app.antnStore.GetSlice(nil, "task_id.keyword:t5", 0, constants.DefaultLimit, "", nil)
+	assert.Equal(t, 1, len(antns))
+	assert.Equal(t, "u2", antns[0].CreatorID)
+	histories, _ = app.getTaskHistories("t5")
+	assert.Equal(t, 1, len(histories))
+	assert.Equal(t, constants.EventUpdate, histories[0].Event)
+	assert.Equal(t, "u1", histories[0].Before.CreatorID)
+}
+
+func TestUpdateTasksSchedule(t *testing.T) {
+	app, engine := newMemoryTaskAPI()
+	assert.Nil(t, app.taskStore.Bulk([]Task{
+		{ID: "t1", ProjectID: "p1", StudyID: "s1", AssigneeID: "u1", Status: constants.TaskStatusNew, DueAt: 300},
+		{ID: "t2", ProjectID: "p1", StudyID: "s2", AssigneeID: "u1", Status: constants.TaskStatusNew, Modified: 1},
+		{ID: "t3", ProjectID: "p1", StudyID: "s3", AssigneeID: "u1", Status: constants.TaskStatusNew, DueAt: 200},
+	}))
+
+	w := serve(engine, http.MethodPost, "/tasks/update_schedule_many", "", `{"ids": ["t1"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(engine, http.MethodPost, "/tasks/update_schedule_many", "", `{"ids": ["t1"], "due_at": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(engine, http.MethodPost, "/tasks/update_schedule_many", "", `{"ids": ["t2", "t3", "t9"], "due_at": 100, "priority": 5}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":2`)
+
+	tasks, _, err := app.taskStore.GetSlice(nil, "project_id.keyword:p1", 0, constants.DefaultLimit, "due_at", nil)
+	assert.Nil(t, err)
+	ids := make([]string, 0)
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []string{"t2", "t3", "t1"}, ids)
+	assert.Equal(t, 5, tasks[0].Priority)
+	// scheduling is no activity on the task
+	assert.Equal(t, int64(1), tasks[0].Modified)
+
+	w = serve(engine, http.MethodPost, "/tasks/update_schedule_many", "", `{"ids": ["t2"], "due_at": 0}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	tasks, _, _ = app.taskStore.GetSlice(nil, "project_id.keyword:p1", 0, constants.DefaultLimit, "due_at", nil)
+	assert.Equal(t, "t2", tasks[2].ID)
+	assert.Equal(t, int64(0), tasks[2].DueAt)
+
+	// the work list comes by priority then due date
+	w = serve(engine, http.MethodGet, "/tasks?_role=ANNOTATOR", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data []Task `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	ids = make([]string, 0)
+	for _, task := range resp.Data {
+		ids = append(ids, task.ID)
+	}
+	assert.Equal(t, []string{"t3", "t2", "t1"}, ids)
+}
@@ -0,0 +1,285 @@
+package study
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+	"vindr-lab-api/project"
+	"vindr-lab-api/utils"
+)
+
+var (
+	// errInvalidTransition the workflow of the project does not allow the status change
+	errInvalidTransition = errors.New("Status change is not allowed by the workflow")
+	// errCannotReject only a task whose stage returns to another one can be rejected
+	errCannotReject = errors.New("The stage of the task cannot reject")
+)
+
+// getProject the project of tasks, a SINGLE one with nobody when it is not found
+func (app *TaskAPI) getProject(projectID string) (*project.Project, error) {
+	p, _, err := app.projectStore.Get(nil, fmt.Sprintf("_id:%s", projectID))
+	if errors.Is(err, utils.ErrNotFound) {
+		return &project.Project{ID: projectID, Workflow: constants.ProjWorkflowSingle}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetReviewStrategy how the workflow rules without strategy pick the
+// person of a role, EQUALLY by default
+func (app *TaskAPI) SetReviewStrategy(strategy string) {
+	app.reviewStrategy = strategy
+}
+
+// checkTransition the stage of the task must allow moving it to status
+func checkTransition(workflow *project.WorkflowDefinition, task Task, status string) error {
+	stage := workflow.StageOf(task.Stage, task.Type)
+	if stage == nil || !stage.CanTransition(task.Status, status) {
+		return fmt.Errorf("%w: %s task %s from %s to %s", errInvalidTransition, task.Type, task.ID, task.Status, status)
+	}
+	return nil
+}
+
+// tasksOfStudy the tasks of the study that are not archived, keyed by their stage
+func tasksOfStudy(taskStore TaskStore, workflow *project.WorkflowDefinition, projectID, studyID string) (map[string][]Task, error) {
+	tasks, _, err := taskStore.GetSlice(nil, fmt.Sprintf("project_id.keyword:%s AND study_id.keyword:%s AND archived:%v",
+		projectID, studyID, false), 0, constants.DefaultLimit, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mapStage := make(map[string][]Task)
+	for i := range tasks {
+		if stage := workflow.StageOf(tasks[i].Stage, tasks[i].Type); stage != nil {
+			mapStage[stage.Name] = append(mapStage[stage.Name], tasks[i])
+		}
+	}
+	return mapStage, nil
+}
+
+// rejectTask rejects the task and returns the completed tasks of the stage it
+// returns to, in the same study, to their assignees. Their annotations are kept
+// and each return is counted on the task
+func rejectTask(taskStore TaskStore, workflow *project.WorkflowDefinition, task Task, reason string) error {
+	stage := workflow.StageOf(task.Stage, task.Type)
+	if stage == nil || stage.ReturnsTo == "" {
+		return errCannotReject
+	}
+
+	err := taskStore.Update(Task{ID: task.ID, Revision: task.Revision}, kvStr2Inf{
+		"status":        constants.TaskStatusRejected,
+		"reject_reason": reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	mapStage, err := tasksOfStudy(taskStore, workflow, task.ProjectID, task.StudyID)
+	if err != nil {
+		return err
+	}
+
+	returned := make([]Task, 0)
+	for _, item := range mapStage[stage.ReturnsTo] {
+		if item.Status != constants.TaskStatusCompleted {
+			continue
+		}
+		item.Status = constants.TaskStatusReturned
+		item.RejectReason = reason
+		item.ReturnCount++
+		returned = append(returned, item)
+	}
+	if len(returned) == 0 {
+		return nil
+	}
+	return taskStore.Bulk(returned)
+}
+
+// reopenRejectedTasks puts the REJECTED tasks of the stages returning to the
+// stage of a completed task back to DOING, once none of its tasks is RETURNED
+func reopenRejectedTasks(taskStore TaskStore, workflow *project.WorkflowDefinition, task Task) error {
+	stage := workflow.StageOf(task.Stage, task.Type)
+	if stage == nil || task.Status != constants.TaskStatusCompleted {
+		return nil
+	}
+
+	mapStage, err := tasksOfStudy(taskStore, workflow, task.ProjectID, task.StudyID)
+	if err != nil {
+		return err
+	}
+	for _, item := range mapStage[stage.Name] {
+		if item.Status == constants.TaskStatusReturned && item.ID != task.ID {
+			return nil
+		}
+	}
+
+	reopened := make([]Task, 0)
+	for _, other := range workflow.Stages {
+		if other.ReturnsTo != stage.Name {
+			continue
+		}
+		for _, item := range mapStage[other.Name] {
+			if item.Status == constants.TaskStatusRejected {
+				item.Status = constants.TaskStatusDoing
+				reopened = append(reopened, item)
+			}
+		}
+	}
+	if len(reopened) == 0 {
+		return nil
+	}
+	return taskStore.Bulk(reopened)
+}
+
+// advanceWorkflow creates the tasks of the next stages of a completed task once
+// every task of its stage in the study is completed. An assignee who already
+// has a task of the next stage in the study does not get another one, nor does
+// a role when anybody has
+func (app *TaskAPI) advanceWorkflow(taskStore TaskStore, p *project.Project, task Task) error {
+	workflow := p.GetWorkflow()
+	stage := workflow.StageOf(task.Stage, task.Type)
+	if stage == nil || len(stage.Next) == 0 || task.Status != constants.TaskStatusCompleted {
+		return nil
+	}
+
+	mapStage, err := tasksOfStudy(taskStore, workflow, task.ProjectID, task.StudyID)
+	if err != nil {
+		return err
+	}
+	for _, item := range mapStage[stage.Name] {
+		if item.Status != constants.TaskStatusCompleted && item.ID != task.ID {
+			return nil
+		}
+	}
+
+	created := make([]Task, 0)
+	for _, rule := range stage.Next {
+		next := workflow.Stage(rule.Stage)
+		if next == nil {
+			continue
+		}
+
+		sourceTaskIDs := make([]string, 0)
+		if rule.Disagreement != nil {
+			for _, item := range mapStage[stage.Name] {
+				sourceTaskIDs = append(sourceTaskIDs, item.ID)
+			}
+			disagreeing, err := app.tasksDisagree(*rule.Disagreement, sourceTaskIDs)
+			if err != nil {
+				return err
+			}
+			if !disagreeing {
+				continue
+			}
+		}
+
+		assigneeIDs := rule.AssigneeIDs
+		if len(assigneeIDs) == 0 {
+			if len(mapStage[next.Name]) > 0 {
+				continue
+			}
+			// the people who did the stage do not check their own work
+			mapExcluded := make(map[string]bool)
+			for _, item := range mapStage[stage.Name] {
+				mapExcluded[item.AssigneeID] = true
+			}
+			assigneeIDs, err = app.pickAssignees(taskStore, p, workflow, rule, next.Name, mapExcluded)
+			if err != nil {
+				return err
+			}
+			if len(assigneeIDs) == 0 {
+				utils.LogInfo("No %s picked for the %s task of study %s", rule.Role, next.Name, task.StudyID)
+				continue
+			}
+		}
+
+		mapAssignee := make(map[string]bool)
+		for _, item := range mapStage[next.Name] {
+			mapAssignee[item.AssigneeID] = true
+		}
+		for _, assigneeID := range assigneeIDs {
+			if mapAssignee[assigneeID] {
+				continue
+			}
+			mapAssignee[assigneeID] = true
+
+			newTask, err := CreateTask(app.idGenerator, task.StudyCode, assigneeID, task.ProjectID, task.StudyID, task.CreatorID, next.TaskType)
+			if err != nil {
+				return err
+			}
+			newTask.Stage = next.Name
+			if len(sourceTaskIDs) > 0 {
+				newTask.SourceTaskIDs = sourceTaskIDs
+			}
+			created = append(created, *newTask)
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	return taskStore.Bulk(created)
+}
+
+// pickAssignees Count people of the project having the role of the rule, none
+// when nobody has it or the strategy is NONE
+func (app *TaskAPI) pickAssignees(taskStore TaskStore, p *project.Project, workflow *project.WorkflowDefinition,
+	rule project.WorkflowRule, stageName string, mapExcluded map[string]bool) ([]string, error) {
+	strategy := rule.Strategy
+	if strategy == "" {
+		strategy = app.reviewStrategy
+	}
+	count := rule.Count
+	if count == 0 {
+		count = 1
+	}
+
+	candidates := make([]string, 0)
+	for _, person := range p.People {
+		for _, role := range person.Roles {
+			if role == rule.Role && !mapExcluded[person.ID] {
+				candidates = append(candidates, person.ID)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 || strategy == constants.ASSIGN_STRATEGY_NONE {
+		return nil, nil
+	}
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+
+	if strategy == constants.ASSIGN_STRATEGY_RANDOM {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		return candidates[:count], nil
+	}
+
+	// EQUALLY: who has the fewest open tasks of the stage in the project, the first of them on ties
+	mapOpen := make(map[string]int)
+	next := workflow.Stage(stageName)
+	err := taskStore.Query(nil, fmt.Sprintf("project_id.keyword:%s AND type.keyword:%s AND archived:%v", p.ID, next.TaskType, false),
+		0, constants.DefaultLimit, "", nil, func(tasks []Task, es entities.ESReturn) {
+			for i := range tasks {
+				stage := workflow.StageOf(tasks[i].Stage, tasks[i].Type)
+				if stage != nil && stage.Name == stageName && tasks[i].Status != constants.TaskStatusCompleted {
+					mapOpen[tasks[i].AssigneeID]++
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return mapOpen[candidates[i]] < mapOpen[candidates[j]]
+	})
+	return candidates[:count], nil
+}
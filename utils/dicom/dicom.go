@@ -0,0 +1,94 @@
+// Package dicom reads, modifies and writes DICOM Part 10 files in little endian
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ImplicitVRLittleEndian = "1.2.840.10008.1.2"
+	ExplicitVRLittleEndian = "1.2.840.10008.1.2.1"
+	ExplicitVRBigEndian    = "1.2.840.10008.1.2.2"
+	DeflatedExplicitVR     = "1.2.840.10008.1.2.1.99"
+	ImplementationClassUID = "2.25.302370498413785411426462329349262131553"
+	SegmentationStorage    = "1.2.840.10008.5.1.4.1.1.66.4"
+	ComprehensiveSRStorage = "1.2.840.10008.5.1.4.1.1.88.33"
+
+	MediaStorageSOPInstanceUID = 0x00020003
+	TransferSyntaxUID          = 0x00020010
+	Item                       = 0xFFFEE000
+	SequenceDelimitation       = 0xFFFEE0DD
+
+	undefinedLength = 0xFFFFFFFF
+)
+
+// longVRs the VRs of explicit VR elements having a 4 bytes length
+var longVRs = map[string]bool{
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true, "SQ": true,
+	"SV": true, "UC": true, "UN": true, "UR": true, "UT": true, "UV": true,
+}
+
+// textVRs the VRs read as text, values of the other VRs are binary
+var textVRs = map[string]bool{
+	"AE": true, "AS": true, "CS": true, "DA": true, "DS": true, "DT": true, "IS": true, "LO": true,
+	"LT": true, "PN": true, "SH": true, "ST": true, "TM": true, "UC": true, "UI": true, "UR": true, "UT": true,
+}
+
+func Tag(group, element uint16) uint32 {
+	return uint32(group)<<16 | uint32(element)
+}
+
+// NewUID a UID under the 2.25 root, derived from a random UUID
+func NewUID() string {
+	id := uuid.New()
+	return "2.25." + new(big.Int).SetBytes(id[:]).String()
+}
+
+// pad values to an even length, UI and binary with NUL, text with space
+func pad(vr string, value []byte) []byte {
+	if len(value)%2 == 0 {
+		return value
+	}
+	switch vr {
+	case "UI", "OB":
+		return append(value, 0x00)
+	default:
+		return append(value, ' ')
+	}
+}
+
+// writeHeader the tag, VR and length of an element, implicit VR elements have
+// no VR and a 4 bytes length
+func writeHeader(buf *bytes.Buffer, tag uint32, vr string, length int, explicit bool) error {
+	if explicit && !longVRs[vr] && length > 0xFFFF {
+		return fmt.Errorf("DICOM element %08X is too long", tag)
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(tag>>16))
+	binary.Write(buf, binary.LittleEndian, uint16(tag))
+	switch {
+	case !explicit:
+		binary.Write(buf, binary.LittleEndian, uint32(length))
+	case longVRs[vr]:
+		buf.WriteString(vr)
+		buf.Write([]byte{0, 0})
+		binary.Write(buf, binary.LittleEndian, uint32(length))
+	default:
+		buf.WriteString(vr)
+		binary.Write(buf, binary.LittleEndian, uint16(length))
+	}
+	return nil
+}
+
+// writePreamble the preamble, the prefix and the group length of the file
+// meta information
+func writePreamble(buf *bytes.Buffer, metaLength int) {
+	buf.Write(make([]byte, 128))
+	buf.WriteString("DICM")
+	writeHeader(buf, 0x00020000, "UL", 4, true)
+	binary.Write(buf, binary.LittleEndian, uint32(metaLength))
+}
@@ -0,0 +1,123 @@
+package dicom
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeFile(t *testing.T) {
+	b, err := EncodeFile(ComprehensiveSRStorage, "1.2.3", Dataset{
+		{Tag: Tag(0x0010, 0x0020), VR: "LO", Value: "odd"},
+		{Tag: Tag(0x0008, 0x0016), VR: "UI", Value: ComprehensiveSRStorage},
+		{Tag: Tag(0x0040, 0xA730), VR: "SQ", Value: []Dataset{{
+			{Tag: Tag(0x0040, 0xA160), VR: "UT", Value: "text"},
+		}}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "DICM", string(b[128:132]))
+	assert.Equal(t, 0, len(b)%2)
+
+	// what is written is read back by the parser
+	file, err := ParseFile(b)
+	assert.Nil(t, err)
+	assert.True(t, file.Explicit)
+	assert.Equal(t, "1.2.3", file.MetaValue(MediaStorageSOPInstanceUID))
+	assert.Equal(t, []uint32{Tag(0x0008, 0x0016), Tag(0x0010, 0x0020), Tag(0x0040, 0xA730)}, func() []uint32 {
+		tags := make([]uint32, 0)
+		for _, element := range file.Dataset {
+			tags = append(tags, element.Tag)
+		}
+		return tags
+	}())
+	assert.Equal(t, "odd", file.Tags()["PatientID"])
+	assert.True(t, bytes.Equal(b, file.Encode()))
+}
+
+func TestInstanceMapUIDs(t *testing.T) {
+	instance := &Instance{SegmentationStorage, "2.25.1", Dataset{
+		{Tag: Tag(0x0008, 0x0016), VR: "UI", Value: SegmentationStorage},
+		{Tag: Tag(0x0008, 0x1115), VR: "SQ", Value: []Dataset{{
+			{Tag: Tag(0x0008, 0x1155), VR: "UI", Value: "1.2.3"},
+		}}},
+	}}
+	mapUID := func(uid string) string {
+		if uid == "1.2.3" {
+			return "project.1.2.3"
+		}
+		return uid
+	}
+
+	mapped := instance.Dataset.MapUIDs(mapUID)
+	assert.Equal(t, SegmentationStorage, mapped[0].Value)
+	assert.Equal(t, "project.1.2.3", mapped[1].Value.([]Dataset)[0][0].Value)
+	// the built instance is left as is
+	assert.Equal(t, "1.2.3", instance.Dataset[1].Value.([]Dataset)[0][0].Value)
+
+	b, err := instance.Encode(mapUID)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(b, []byte("2.25.1")))
+	assert.True(t, bytes.Contains(b, []byte("project.1.2.3")))
+}
+
+func TestParseFileImplicitVR(t *testing.T) {
+	element := func(tag uint32, value string) []byte {
+		b := []byte{byte(tag >> 16), byte(tag >> 24), byte(tag), byte(tag >> 8)}
+		return append(append(b, byte(len(value)), byte(len(value)>>8), 0, 0), value...)
+	}
+	undefined := func(tag uint32) []byte {
+		return []byte{byte(tag >> 16), byte(tag >> 24), byte(tag), byte(tag >> 8), 0xFF, 0xFF, 0xFF, 0xFF}
+	}
+	delimitation := func(tag uint32) []byte {
+		return []byte{byte(tag >> 16), byte(tag >> 24), byte(tag), byte(tag >> 8), 0, 0, 0, 0}
+	}
+
+	file := &File{Meta: []FileElement{
+		NewFileElement(MediaStorageSOPInstanceUID, "1.1.1.1", true),
+		NewFileElement(TransferSyntaxUID, ImplicitVRLittleEndian, true),
+	}}
+	var dataset []byte
+	dataset = append(dataset, element(0x00080018, "1.1.1.1\x00")...)
+	dataset = append(dataset, element(0x00080050, "A1")...)
+	// a sequence of an item of undefined length, holding a nested sequence
+	dataset = append(dataset, undefined(0x00081140)...)
+	dataset = append(dataset, undefined(Item)...)
+	dataset = append(dataset, element(0x00081150, "1.2\x00")...)
+	dataset = append(dataset, undefined(0x00089215)...)
+	dataset = append(dataset, delimitation(SequenceDelimitation)...)
+	dataset = append(dataset, delimitation(0xFFFEE00D)...)
+	dataset = append(dataset, delimitation(SequenceDelimitation)...)
+	dataset = append(dataset, element(0x00100010, "DOE^JOHN")...)
+	dataset = append(dataset, element(0x00191010, "private ")...)
+	dataset = append(dataset, element(0x00280010, "\x00\x02")...)
+	data := append(file.Encode(), dataset...)
+
+	parsed, err := ParseFile(data)
+	assert.Nil(t, err)
+	assert.False(t, parsed.Explicit)
+	assert.Equal(t, 6, len(parsed.Dataset))
+	assert.Equal(t, map[string]string{"SOPInstanceUID": "1.1.1.1", "AccessionNumber": "A1", "PatientName": "DOE^JOHN", "Rows": "512"},
+		parsed.Tags())
+
+	assert.Nil(t, parsed.Modify(Modification{
+		Replace:           map[string]string{"SOPInstanceUID": "9.9.9", "PatientID": "abc"},
+		Remove:            []string{"AccessionNumber"},
+		RemovePrivateTags: true,
+	}))
+	reparsed, err := ParseFile(parsed.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, "9.9.9", reparsed.MetaValue(MediaStorageSOPInstanceUID))
+	assert.Equal(t, map[string]string{"SOPInstanceUID": "9.9.9", "PatientID": "abc", "PatientName": "DOE^JOHN", "Rows": "512"},
+		reparsed.Tags())
+	assert.Equal(t, []uint32{0x00080018, 0x00081140, 0x00100010, 0x00100020, 0x00280010}, func() []uint32 {
+		tags := make([]uint32, 0)
+		for _, element := range reparsed.Dataset {
+			tags = append(tags, element.Tag)
+		}
+		return tags
+	}())
+
+	_, err = ParseFile(data[:len(data)-3])
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,287 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vindr-lab-api/entities"
+)
+
+// Modification the changes made to a DICOM file, attributes are named by
+// their keyword in entities.DICOMDictionary
+type Modification struct {
+	Replace           map[string]string
+	Remove            []string
+	RemovePrivateTags bool
+}
+
+// FileElement an element of the top level of a dataset, raw is the element
+// as it is encoded in the file, header included
+type FileElement struct {
+	Tag   uint32
+	VR    string
+	Value []byte
+	raw   []byte
+}
+
+// File a DICOM Part 10 file, elements of the file meta information and of
+// the dataset in the order of the file
+type File struct {
+	Meta     []FileElement
+	Dataset  []FileElement
+	Explicit bool
+}
+
+// ParseFile reads the top level elements of a DICOM Part 10 file in little
+// endian, sequences and encapsulated pixel data are kept as they are
+func ParseFile(data []byte) (*File, error) {
+	if len(data) < 132 || string(data[128:132]) != "DICM" {
+		return nil, errors.New("not a DICOM file")
+	}
+	file := &File{}
+	pos := 132
+	for pos < len(data) && binary.LittleEndian.Uint16(data[pos:]) == 0x0002 {
+		element, next, err := readElement(data, pos, true)
+		if err != nil {
+			return nil, err
+		}
+		file.Meta = append(file.Meta, element)
+		pos = next
+	}
+
+	switch syntax := file.MetaValue(TransferSyntaxUID); syntax {
+	case ImplicitVRLittleEndian:
+	case ExplicitVRBigEndian, DeflatedExplicitVR:
+		return nil, fmt.Errorf("transfer syntax %s is not supported", syntax)
+	default:
+		file.Explicit = true
+	}
+
+	for pos < len(data) {
+		element, next, err := readElement(data, pos, file.Explicit)
+		if err != nil {
+			return nil, err
+		}
+		file.Dataset = append(file.Dataset, element)
+		pos = next
+	}
+	return file, nil
+}
+
+func readElement(data []byte, pos int, explicit bool) (FileElement, int, error) {
+	start := pos
+	if pos+8 > len(data) {
+		return FileElement{}, 0, errors.New("truncated DICOM file")
+	}
+	tag := uint32(binary.LittleEndian.Uint16(data[pos:]))<<16 | uint32(binary.LittleEndian.Uint16(data[pos+2:]))
+	pos += 4
+
+	var vr string
+	var length uint32
+	if explicit {
+		vr = string(data[pos : pos+2])
+		if longVRs[vr] {
+			if pos+8 > len(data) {
+				return FileElement{}, 0, errors.New("truncated DICOM file")
+			}
+			length = binary.LittleEndian.Uint32(data[pos+4:])
+			pos += 8
+		} else {
+			length = uint32(binary.LittleEndian.Uint16(data[pos+2:]))
+			pos += 4
+		}
+	} else {
+		vr = "UN"
+		if attribute, found := entities.DICOMDictionary[entities.DICOMKeywords[tag]]; found {
+			vr = attribute.VR
+		}
+		length = binary.LittleEndian.Uint32(data[pos:])
+		pos += 4
+	}
+
+	element := FileElement{Tag: tag, VR: vr}
+	if length == undefinedLength {
+		end, err := skipUndefinedLength(data, pos, explicit)
+		if err != nil {
+			return FileElement{}, 0, err
+		}
+		element.raw = data[start:end]
+		return element, end, nil
+	}
+	end := pos + int(length)
+	if end > len(data) {
+		return FileElement{}, 0, errors.New("truncated DICOM file")
+	}
+	element.Value = data[pos:end]
+	element.raw = data[start:end]
+	return element, end, nil
+}
+
+// skipUndefinedLength the position after the sequence delimitation item
+// closing the element of undefined length whose value starts at pos
+func skipUndefinedLength(data []byte, pos int, explicit bool) (int, error) {
+	depth := 1
+	for depth > 0 {
+		if pos+8 > len(data) {
+			return 0, errors.New("truncated DICOM file")
+		}
+		tag := uint32(binary.LittleEndian.Uint16(data[pos:]))<<16 | uint32(binary.LittleEndian.Uint16(data[pos+2:]))
+		// items and delimitations always have a 4 bytes length and no VR
+		if tag>>16 == 0xFFFE {
+			length := binary.LittleEndian.Uint32(data[pos+4:])
+			pos += 8
+			switch {
+			case tag == SequenceDelimitation:
+				depth--
+			case tag == Item && length != undefinedLength:
+				pos += int(length)
+			}
+			continue
+		}
+		_, next, err := readElement(data, pos, explicit)
+		if err != nil {
+			return 0, err
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// MetaValue the text value of an element of the file meta information
+func (file *File) MetaValue(tag uint32) string {
+	for _, element := range file.Meta {
+		if element.Tag == tag {
+			return text(element.Value)
+		}
+	}
+	return ""
+}
+
+func text(value []byte) string {
+	return strings.TrimRight(string(value), " \x00")
+}
+
+// Tags the values of the elements of entities.DICOMDictionary, by keyword,
+// multiple values are separated by a backslash
+func (file *File) Tags() map[string]string {
+	tags := make(map[string]string)
+	for _, element := range file.Dataset {
+		keyword, found := entities.DICOMKeywords[element.Tag]
+		if !found || element.Value == nil {
+			continue
+		}
+		value := ""
+		switch vr := entities.DICOMDictionary[keyword].VR; {
+		case textVRs[vr]:
+			value = strings.TrimSpace(text(element.Value))
+		case vr == "US":
+			values := make([]string, 0)
+			for i := 0; i+2 <= len(element.Value); i += 2 {
+				values = append(values, strconv.Itoa(int(binary.LittleEndian.Uint16(element.Value[i:]))))
+			}
+			value = strings.Join(values, "\\")
+		}
+		if value != "" {
+			tags[keyword] = value
+		}
+	}
+	return tags
+}
+
+// Modify the file with the changes made, the new elements are inserted in
+// the order of their tags
+func (file *File) Modify(modification Modification) error {
+	replace := make(map[uint32]string)
+	for keyword, value := range modification.Replace {
+		attribute, found := entities.DICOMDictionary[keyword]
+		if !found {
+			return fmt.Errorf("%s is not in the dictionary", keyword)
+		}
+		replace[attribute.Tag] = value
+	}
+	remove := make(map[uint32]bool)
+	for _, keyword := range modification.Remove {
+		if attribute, found := entities.DICOMDictionary[keyword]; found {
+			remove[attribute.Tag] = true
+		}
+	}
+
+	dataset := make([]FileElement, 0, len(file.Dataset))
+	for _, element := range file.Dataset {
+		private := (element.Tag>>16)%2 == 1
+		if remove[element.Tag] || private && modification.RemovePrivateTags {
+			continue
+		}
+		if value, found := replace[element.Tag]; found {
+			element = NewFileElement(element.Tag, value, file.Explicit)
+			delete(replace, element.Tag)
+		}
+		dataset = append(dataset, element)
+	}
+	for tag, value := range replace {
+		dataset = append(dataset, NewFileElement(tag, value, file.Explicit))
+	}
+	sort.SliceStable(dataset, func(i, j int) bool { return dataset[i].Tag < dataset[j].Tag })
+	file.Dataset = dataset
+
+	// the file meta information repeats the SOPInstanceUID
+	if uid, found := modification.Replace["SOPInstanceUID"]; found {
+		for i, element := range file.Meta {
+			if element.Tag == MediaStorageSOPInstanceUID {
+				file.Meta[i] = NewFileElement(element.Tag, uid, true)
+			}
+		}
+	}
+	return nil
+}
+
+// NewFileElement an element of the dictionary of the value as Tags reads it,
+// text is padded to an even length
+func NewFileElement(tag uint32, value string, explicit bool) FileElement {
+	vr := "UN"
+	if attribute, found := entities.DICOMDictionary[entities.DICOMKeywords[tag]]; found {
+		vr = attribute.VR
+	}
+	if tag == MediaStorageSOPInstanceUID || tag == TransferSyntaxUID {
+		vr = "UI"
+	}
+	b := []byte(value)
+	if vr == "US" {
+		b = make([]byte, 0)
+		for _, v := range strings.Split(value, "\\") {
+			if n, err := strconv.ParseUint(v, 10, 16); err == nil {
+				b = append(b, byte(n), byte(n>>8))
+			}
+		}
+	}
+	b = pad(vr, b)
+
+	var buf bytes.Buffer
+	writeHeader(&buf, tag, vr, len(b), explicit)
+	buf.Write(b)
+	return FileElement{Tag: tag, VR: vr, Value: b, raw: buf.Bytes()}
+}
+
+// Encode the DICOM Part 10 file, the group length of the file meta
+// information is computed again
+func (file *File) Encode() []byte {
+	var meta bytes.Buffer
+	for _, element := range file.Meta {
+		if element.Tag != 0x00020000 {
+			meta.Write(element.raw)
+		}
+	}
+
+	var buf bytes.Buffer
+	writePreamble(&buf, meta.Len())
+	buf.Write(meta.Bytes())
+	for _, element := range file.Dataset {
+		buf.Write(element.raw)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,143 @@
+package dicom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Element is one attribute of a dataset, Value is a string, []string,
+// uint16, uint32, []byte or []Dataset for sequences
+type Element struct {
+	Tag   uint32
+	VR    string
+	Value interface{}
+}
+
+type Dataset []Element
+
+// Instance a SOP instance built once, encoded for every destination
+type Instance struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+	Dataset        Dataset
+}
+
+type Code struct {
+	Value   string
+	Scheme  string
+	Meaning string
+}
+
+func (code Code) Dataset() Dataset {
+	return Dataset{
+		{Tag: Tag(0x0008, 0x0100), VR: "SH", Value: code.Value},
+		{Tag: Tag(0x0008, 0x0102), VR: "SH", Value: code.Scheme},
+		{Tag: Tag(0x0008, 0x0104), VR: "LO", Value: code.Meaning},
+	}
+}
+
+// EncodeFile writes a DICOM Part 10 file in Explicit VR Little Endian
+func EncodeFile(sopClassUID, sopInstanceUID string, dataset Dataset) ([]byte, error) {
+	meta, err := Dataset{
+		{Tag: Tag(0x0002, 0x0001), VR: "OB", Value: []byte{0x00, 0x01}},
+		{Tag: Tag(0x0002, 0x0002), VR: "UI", Value: sopClassUID},
+		{Tag: Tag(0x0002, 0x0003), VR: "UI", Value: sopInstanceUID},
+		{Tag: Tag(0x0002, 0x0010), VR: "UI", Value: ExplicitVRLittleEndian},
+		{Tag: Tag(0x0002, 0x0012), VR: "UI", Value: ImplementationClassUID},
+	}.encode()
+	if err != nil {
+		return nil, err
+	}
+	body, err := dataset.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writePreamble(&buf, len(meta))
+	buf.Write(meta)
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// Encode the instance with the UI values of its dataset rewritten by mapUID
+func (instance *Instance) Encode(mapUID func(uid string) string) ([]byte, error) {
+	return EncodeFile(instance.SOPClassUID, instance.SOPInstanceUID, instance.Dataset.MapUIDs(mapUID))
+}
+
+// MapUIDs a copy of the dataset, sequences included, with the UI values
+// rewritten by mapUID
+func (dataset Dataset) MapUIDs(mapUID func(uid string) string) Dataset {
+	elements := make(Dataset, len(dataset))
+	for i, element := range dataset {
+		switch v := element.Value.(type) {
+		case string:
+			if element.VR == "UI" {
+				element.Value = mapUID(v)
+			}
+		case []Dataset:
+			items := make([]Dataset, len(v))
+			for j, item := range v {
+				items[j] = item.MapUIDs(mapUID)
+			}
+			element.Value = items
+		}
+		elements[i] = element
+	}
+	return elements
+}
+
+func (dataset Dataset) encode() ([]byte, error) {
+	elements := make(Dataset, len(dataset))
+	copy(elements, dataset)
+	sort.SliceStable(elements, func(i, j int) bool {
+		return elements[i].Tag < elements[j].Tag
+	})
+
+	var buf bytes.Buffer
+	for _, element := range elements {
+		value, err := element.encodeValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHeader(&buf, element.Tag, element.VR, len(value), true); err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	return buf.Bytes(), nil
+}
+
+func (element Element) encodeValue() ([]byte, error) {
+	var buf bytes.Buffer
+	switch v := element.Value.(type) {
+	case string:
+		buf.WriteString(v)
+	case []string:
+		buf.WriteString(strings.Join(v, "\\"))
+	case uint16:
+		binary.Write(&buf, binary.LittleEndian, v)
+	case uint32:
+		binary.Write(&buf, binary.LittleEndian, v)
+	case []byte:
+		buf.Write(v)
+	case []Dataset:
+		for _, item := range v {
+			b, err := item.encode()
+			if err != nil {
+				return nil, err
+			}
+			binary.Write(&buf, binary.LittleEndian, uint16(0xFFFE))
+			binary.Write(&buf, binary.LittleEndian, uint16(0xE000))
+			binary.Write(&buf, binary.LittleEndian, uint32(len(b)))
+			buf.Write(b)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("DICOM element %08X has unsupported value %T", element.Tag, element.Value)
+	}
+	return pad(element.VR, buf.Bytes()), nil
+}
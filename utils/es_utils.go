@@ -1,14 +1,32 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 
 	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
 
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/gin-gonic/gin"
 )
 
+// ScrollKeepAlive how long ES keeps a scroll context between two pages
+const ScrollKeepAlive = time.Minute
+
+// ErrVersionConflict a write carried a revision the document no longer has
+var ErrVersionConflict = errors.New("Version conflict, the document was changed by another request")
+
+// ErrNotFound the Get of every store backend found no document
+var ErrNotFound = errors.New("Item not found")
+
 var Meta = map[string]bool{
 	"study_instance_uid":         true,
 	"sop_instance_uid":           true,
@@ -61,11 +79,15 @@ func ConvertQueryParamsToMap(context *gin.Context) map[string][]string {
 
 type kvStr2Inf = map[string]interface{}
 
-var nonKeywordFields = map[string]bool{
-	"created":       true,
-	"time_inserted": true,
-	"modified":      true,
-	"archived":      true,
+// nonKeywordFields the fields searched and sorted on as they are, with their
+// type for the indices which have no mapping of them yet
+var nonKeywordFields = map[string]string{
+	"created":       "long",
+	"time_inserted": "long",
+	"modified":      "long",
+	"archived":      "boolean",
+	"due_at":        "long",
+	"priority":      "long",
 }
 
 func MakeSortQuery(sortRaw string) []kvStr2Inf {
@@ -86,14 +108,21 @@ func MakeSortQuery(sortRaw string) []kvStr2Inf {
 			criteria = sort
 		}
 
-		if _, found := nonKeywordFields[criteria]; !found {
+		fieldType, found := nonKeywordFields[criteria]
+		if !found {
 			criteria += ".keyword"
 		}
 
+		sortCriteria := kvStr2Inf{
+			"order": order,
+		}
+		// an index created before the field existed has no mapping of it,
+		// ES rejects the sort on such an index otherwise
+		if fieldType == "long" {
+			sortCriteria["unmapped_type"] = fieldType
+		}
 		sortQuery = append(sortQuery, kvStr2Inf{
-			criteria: kvStr2Inf{
-				"order": order,
-			},
+			criteria: sortCriteria,
 		})
 	}
 
@@ -175,3 +204,144 @@ func ConvertInputsToESQueryBody(queries map[string][]string, qs string, from, si
 
 	return &body
 }
+
+// BulkIndexMeta the action line of a bulk index, a set revision makes it
+// conditional on the document being unchanged
+func BulkIndexMeta(index, id string, rev entities.Revision) []byte {
+	action := kvStr2Inf{
+		"_index": index,
+		"_id":    id,
+	}
+	if rev.IsSet() {
+		action["if_seq_no"] = *rev.SeqNo
+		action["if_primary_term"] = *rev.PrimaryTerm
+	}
+	b, _ := json.Marshal(kvStr2Inf{"index": action})
+	return append(b, '\n')
+}
+
+// ScrollES pages through every hit of the query with the scroll API, it has no
+// from+size window limit. Scrolling stops at the first error returned by f
+func ScrollES(es *elasticsearch.Client, index string, queries map[string][]string, qs string, size int, sort string, f func(esReturn entities.ESReturn) error) error {
+	var buf bytes.Buffer
+	body := ConvertInputsToESQueryBody(queries, qs, -1, size, sort, nil)
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+	LogDebug(ConvertMapToString(*body))
+
+	res, err := es.Search(
+		es.Search.WithContext(context.Background()),
+		es.Search.WithIndex(index),
+		es.Search.WithBody(&buf),
+		es.Search.WithScroll(ScrollKeepAlive),
+	)
+	if err != nil {
+		return fmt.Errorf("Error getting response: %s", err)
+	}
+
+	scrollID := ""
+	defer func() {
+		if scrollID != "" {
+			res, err := es.ClearScroll(es.ClearScroll.WithScrollID(scrollID))
+			if err != nil {
+				LogError(err)
+				return
+			}
+			res.Body.Close()
+		}
+	}()
+
+	for true {
+		var (
+			esReturn entities.ESReturn
+			esError  entities.ESError
+		)
+
+		if res.IsError() {
+			defer res.Body.Close()
+			if err := json.NewDecoder(res.Body).Decode(&esError); err != nil {
+				return fmt.Errorf("Error parsing the response body: %s", err)
+			}
+			return fmt.Errorf("[%s] %s: %s", res.Status(), esError.Error.Type, esError.Error.Reason)
+		}
+
+		err := json.NewDecoder(res.Body).Decode(&esReturn)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Error parsing the response body: %s", err)
+		}
+		scrollID = esReturn.ScrollID
+
+		if len(esReturn.Hits.Hits) == 0 {
+			break
+		}
+		if err := f(esReturn); err != nil {
+			return err
+		}
+
+		res, err = es.Scroll(
+			es.Scroll.WithScrollID(scrollID),
+			es.Scroll.WithScroll(ScrollKeepAlive),
+		)
+		if err != nil {
+			return fmt.Errorf("Error getting response: %s", err)
+		}
+	}
+	return nil
+}
+
+// PutIndexTemplate creates the index template read from templates/<name>.json,
+// the indexPatterns replace its index_patterns for the indices named from the config
+func PutIndexTemplate(esClient *elasticsearch.Client, indexTemplate string, indexPatterns ...string) error {
+	file := strings.Join([]string{"templates", indexTemplate + ".json"}, "/")
+	dat, err := ioutil.ReadFile(file)
+	m := make(map[string]interface{})
+	json.Unmarshal(dat, &m)
+	if len(indexPatterns) > 0 {
+		m["index_patterns"] = indexPatterns
+	}
+
+	var buf bytes.Buffer
+
+	if err := json.NewEncoder(&buf).Encode(m); err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	create := true
+
+	req := esapi.IndicesPutIndexTemplateRequest{
+		Name:   indexTemplate,
+		Body:   &buf,
+		Create: &create,
+		Human:  true,
+		Pretty: true,
+	}
+
+	// Return an API response object from request
+	ctx := context.Background()
+	res, err := req.Do(ctx, esClient)
+	if err != nil {
+		return fmt.Errorf(fmt.Sprintf("PutTemplate ERROR: %s", err))
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("%s ERROR putting template %s", res.Status(), indexTemplate)
+	}
+
+	// Deserialize the response into a map.
+	var resMap map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&resMap); err != nil {
+		return fmt.Errorf("Error parsing the response body: %s", err)
+	}
+
+	// Print the response status and indexed document version.
+	// fmt.Println("Status:", res.Status(), "Result:", resMap["result"], "Version:", int(resMap["_version"].(float64)), resMap)
+
+	if resMap["result"] == "created" {
+		return nil
+	}
+
+	return err
+}
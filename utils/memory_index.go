@@ -0,0 +1,788 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"vindr-lab-api/constants"
+	"vindr-lab-api/entities"
+)
+
+// memoryPrimaryTerm a memory index is never failed over
+const memoryPrimaryTerm = 1
+
+// MemoryIndex keeps documents in memory and answers the subset of the ES query
+// DSL built by ConvertInputsToESQueryBody: term filters, query_string with
+// AND/OR/NOT, groups, wildcards and ranges, sort, paging and terms aggregations
+type MemoryIndex struct {
+	mu    sync.RWMutex
+	name  string
+	seqNo int
+	pos   int
+	docs  map[string]*memoryDoc
+}
+
+type memoryDoc struct {
+	source map[string]interface{}
+	seqNo  int
+	pos    int
+}
+
+func NewMemoryIndex(name string) *MemoryIndex {
+	return &MemoryIndex{
+		name: name,
+		docs: make(map[string]*memoryDoc),
+	}
+}
+
+func toSource(doc interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	source := make(map[string]interface{})
+	err = json.Unmarshal(b, &source)
+	return source, err
+}
+
+// checkRevision an unset revision always passes, like a write without if_seq_no
+func (idx *MemoryIndex) checkRevision(doc *memoryDoc, rev entities.Revision) error {
+	if !rev.IsSet() {
+		return nil
+	}
+	if doc == nil || *rev.SeqNo != doc.seqNo || *rev.PrimaryTerm != memoryPrimaryTerm {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Index creates or replaces a document
+func (idx *MemoryIndex) Index(id string, doc interface{}, rev entities.Revision) error {
+	source, err := toSource(doc)
+	if err != nil {
+		return fmt.Errorf("Cannot encode %s: %s", id, err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	current := idx.docs[id]
+	if err := idx.checkRevision(current, rev); err != nil {
+		return err
+	}
+
+	idx.seqNo++
+	if current == nil {
+		idx.pos++
+		idx.docs[id] = &memoryDoc{source: source, seqNo: idx.seqNo, pos: idx.pos}
+		return nil
+	}
+	current.source = source
+	current.seqNo = idx.seqNo
+	return nil
+}
+
+// Update merges a partial document into an existing one
+func (idx *MemoryIndex) Update(id string, doc interface{}, rev entities.Revision) error {
+	partial, err := toSource(doc)
+	if err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	current := idx.docs[id]
+	if err := idx.checkRevision(current, rev); err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("404 Not Found ERROR updating document ID=%s: %w", id, ErrNotFound)
+	}
+
+	mergeSource(current.source, partial)
+	idx.seqNo++
+	current.seqNo = idx.seqNo
+	return nil
+}
+
+// mergeSource objects are merged recursively, any other value is replaced
+func mergeSource(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok1 := v.(map[string]interface{})
+		dstMap, ok2 := dst[k].(map[string]interface{})
+		if ok1 && ok2 {
+			mergeSource(dstMap, srcMap)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// Delete removes every document matching the query
+func (idx *MemoryIndex) Delete(queries map[string][]string, qs string) error {
+	query, err := parseQueryString(qs)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for id, doc := range idx.docs {
+		if matchQueries(id, doc.source, queries, query) {
+			delete(idx.docs, id)
+		}
+	}
+	return nil
+}
+
+// Search returns the matching documents in the shape of an ES search response
+func (idx *MemoryIndex) Search(queries map[string][]string, qs string, from, size int, sortRaw string, aggs []string) (*entities.ESReturn, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	docs := make([]Document, 0, len(idx.docs))
+	positions := make(map[string]int)
+	for id, doc := range idx.docs {
+		docs = append(docs, Document{ID: id, SeqNo: doc.seqNo, Source: doc.source})
+		positions[id] = doc.pos
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return positions[docs[i].ID] < positions[docs[j].ID]
+	})
+
+	return SearchDocuments(idx.name, docs, queries, qs, from, size, sortRaw, aggs)
+}
+
+// Document is a stored source as searched by SearchDocuments
+type Document struct {
+	ID     string
+	SeqNo  int
+	Source map[string]interface{}
+}
+
+// SearchDocuments filters, sorts, pages and aggregates documents like an ES
+// search would, documents equal for the sort keep their order
+func SearchDocuments(index string, docs []Document, queries map[string][]string, qs string, from, size int, sortRaw string, aggs []string) (*entities.ESReturn, error) {
+	query, err := parseQueryString(qs)
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 {
+		from = 0
+	}
+	if size < 0 {
+		size = 10
+	}
+
+	matches := make([]Document, 0)
+	for _, doc := range docs {
+		if matchQueries(doc.ID, doc.Source, queries, query) {
+			matches = append(matches, doc)
+		}
+	}
+	sorts := parseMemorySort(sortRaw)
+	sort.SliceStable(matches, func(i, j int) bool {
+		return lessSource(matches[i].Source, matches[j].Source, sorts)
+	})
+
+	esReturn := entities.ESReturn{}
+	esReturn.Hits.Total = entities.Total{Value: len(matches), Relation: "eq"}
+	if from > len(matches) {
+		from = len(matches)
+	}
+	end := len(matches)
+	if from+size < end {
+		end = from + size
+	}
+	esReturn.Hits.Hits = documentHits(index, matches[from:end])
+
+	if len(aggs) > 0 {
+		aggregations := make(map[string]entities.Aggregation)
+		for _, agg := range aggs {
+			counts := make(map[string]int)
+			for _, m := range matches {
+				seen := make(map[string]bool)
+				for _, v := range leafValues(m.Source, agg) {
+					if s, ok := v.(string); ok && !seen[s] {
+						seen[s] = true
+						counts[s]++
+					}
+				}
+			}
+			aggregations[agg] = termsAggregation(counts)
+		}
+		esReturn.Aggregations = &aggregations
+	}
+
+	return &esReturn, nil
+}
+
+// documentHits the documents as the hits of an ES search response
+func documentHits(index string, docs []Document) []entities.HitsLocal {
+	hits := make([]entities.HitsLocal, 0, len(docs))
+	for _, doc := range docs {
+		source, _ := toSource(doc.Source)
+		seqNo, primaryTerm := doc.SeqNo, memoryPrimaryTerm
+		hits = append(hits, entities.HitsLocal{
+			Index:       index,
+			Type:        "_doc",
+			ID:          doc.ID,
+			Score:       1,
+			SeqNo:       &seqNo,
+			PrimaryTerm: &primaryTerm,
+			Source:      source,
+		})
+	}
+	return hits
+}
+
+// RequiredTerms the exact values a matching document must have, from the
+// single value entries of queries and the top level AND of qs. Stores use
+// them to narrow what they load before SearchDocuments
+func RequiredTerms(queries map[string][]string, qs string) (map[string]string, error) {
+	query, err := parseQueryString(qs)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := make([]memoryTerm, 0)
+	for field, values := range queries {
+		if len(values) == 1 {
+			terms = append(terms, newMemoryTerm(field, values[0]))
+		}
+	}
+	switch q := query.(type) {
+	case memoryTerm:
+		terms = append(terms, q)
+	case memoryAnd:
+		for _, sub := range q {
+			if term, ok := sub.(memoryTerm); ok {
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	ret := make(map[string]string)
+	for _, term := range terms {
+		if (term.keyword || term.field == "_id") && term.op == "" && !strings.ContainsAny(term.value, "*?") {
+			if _, found := ret[term.field]; !found {
+				ret[term.field] = term.value
+			}
+		}
+	}
+	return ret, nil
+}
+
+func termsAggregation(counts map[string]int) entities.Aggregation {
+	buckets := make([]entities.Buckets, 0, len(counts))
+	for k, v := range counts {
+		buckets = append(buckets, entities.Buckets{Key: k, DocCount: v})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].DocCount != buckets[j].DocCount {
+			return buckets[i].DocCount > buckets[j].DocCount
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+
+	agg := entities.Aggregation{Buckets: buckets}
+	if len(buckets) > constants.DefaultLimit {
+		for _, bucket := range buckets[constants.DefaultLimit:] {
+			agg.SumOtherDocCount += bucket.DocCount
+		}
+		agg.Buckets = buckets[:constants.DefaultLimit]
+	}
+	return agg
+}
+
+// matchQueries single value entries are filters, entries with several values
+// are should clauses of which one must match
+func matchQueries(id string, source map[string]interface{}, queries map[string][]string, query memoryQuery) bool {
+	hasShould, should := false, false
+	for field, values := range queries {
+		if len(values) == 1 {
+			if !newMemoryTerm(field, values[0]).match(id, source) {
+				return false
+			}
+		} else if len(values) > 1 {
+			hasShould = true
+			for _, v := range values {
+				should = should || newMemoryTerm(field, v).match(id, source)
+			}
+		}
+	}
+	if hasShould && !should {
+		return false
+	}
+	return query == nil || query.match(id, source)
+}
+
+type memorySort struct {
+	field string
+	desc  bool
+}
+
+func parseMemorySort(sortRaw string) []memorySort {
+	sorts := make([]memorySort, 0)
+	for _, s := range strings.Split(sortRaw, ",") {
+		if s == "" {
+			continue
+		}
+		sorts = append(sorts, memorySort{
+			field: strings.TrimPrefix(s, "-"),
+			desc:  strings.HasPrefix(s, "-"),
+		})
+	}
+	return sorts
+}
+
+// lessSource documents missing the field come last in both orders
+func lessSource(a, b map[string]interface{}, sorts []memorySort) bool {
+	for _, s := range sorts {
+		va, vb := leafValues(a, s.field), leafValues(b, s.field)
+		switch {
+		case len(va) == 0 && len(vb) == 0:
+			continue
+		case len(va) == 0:
+			return false
+		case len(vb) == 0:
+			return true
+		}
+		c := compareValues(va[0], vb[0])
+		if c == 0 {
+			continue
+		}
+		return c < 0 != s.desc
+	}
+	return false
+}
+
+func compareValues(a, b interface{}) int {
+	fa, ok1 := a.(float64)
+	fb, ok2 := b.(float64)
+	if ok1 && ok2 {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(valueString(a), valueString(b))
+}
+
+func valueString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// leafValues the scalar values at a dotted path, arrays are flattened
+func leafValues(v interface{}, field string) []interface{} {
+	if field == "" {
+		return flatten(v)
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		parts := strings.Split(field, ".")
+		ret := make([]interface{}, 0)
+		// keys may contain dots themselves, the longest one wins
+		for i := len(parts); i > 0; i-- {
+			if child, found := t[strings.Join(parts[:i], ".")]; found {
+				ret = append(ret, leafValues(child, strings.Join(parts[i:], "."))...)
+				break
+			}
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, 0)
+		for _, item := range t {
+			ret = append(ret, leafValues(item, field)...)
+		}
+		return ret
+	}
+	return nil
+}
+
+func flatten(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		ret := make([]interface{}, 0)
+		for _, child := range t {
+			ret = append(ret, flatten(child)...)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, 0)
+		for _, child := range t {
+			ret = append(ret, flatten(child)...)
+		}
+		return ret
+	}
+	return []interface{}{v}
+}
+
+type memoryQuery interface {
+	match(id string, source map[string]interface{}) bool
+}
+
+type memoryAnd []memoryQuery
+
+func (q memoryAnd) match(id string, source map[string]interface{}) bool {
+	for _, sub := range q {
+		if !sub.match(id, source) {
+			return false
+		}
+	}
+	return true
+}
+
+type memoryOr []memoryQuery
+
+func (q memoryOr) match(id string, source map[string]interface{}) bool {
+	for _, sub := range q {
+		if sub.match(id, source) {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryNot struct {
+	query memoryQuery
+}
+
+func (q memoryNot) match(id string, source map[string]interface{}) bool {
+	return !q.query.match(id, source)
+}
+
+// memoryTerm a .keyword field is compared exactly, other fields like an
+// analyzed text field: case insensitive and on any of its words
+type memoryTerm struct {
+	field   string
+	value   string
+	op      string
+	keyword bool
+}
+
+func newMemoryTerm(field, value string) memoryTerm {
+	term := memoryTerm{field: field, value: value}
+	if strings.HasSuffix(field, ".keyword") {
+		term.field = strings.TrimSuffix(field, ".keyword")
+		term.keyword = true
+	}
+	for _, op := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(value, op) {
+			term.op, term.value = op, strings.TrimPrefix(value, op)
+			break
+		}
+	}
+	return term
+}
+
+func (q memoryTerm) match(id string, source map[string]interface{}) bool {
+	var values []interface{}
+	if q.field == "_id" {
+		values = []interface{}{id}
+	} else {
+		values = leafValues(source, q.field)
+	}
+	if q.value == "*" && q.op == "" {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if q.matchValue(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q memoryTerm) matchValue(v interface{}) bool {
+	if q.op != "" {
+		var c int
+		if f, err := strconv.ParseFloat(q.value, 64); err == nil {
+			c = compareValues(v, f)
+		} else {
+			c = strings.Compare(valueString(v), q.value)
+		}
+		switch q.op {
+		case ">=":
+			return c >= 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c < 0
+	}
+
+	s := valueString(v)
+	if q.keyword || q.field == "_id" {
+		return matchPattern(q.value, s)
+	}
+	pattern := strings.ToLower(q.value)
+	if matchPattern(pattern, strings.ToLower(s)) {
+		return true
+	}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if matchPattern(pattern, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern supports the * and ? wildcards of query_string
+func matchPattern(pattern, s string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return pattern == s
+	}
+	// path.Match stops * at a slash, query_string does not
+	escaped := strings.NewReplacer("[", "\\[", "]", "\\]", "\\", "\\\\", "/", "\x00").Replace(pattern)
+	ok, err := path.Match(escaped, strings.Replace(s, "/", "\x00", -1))
+	return err == nil && ok
+}
+
+const (
+	qsWord = iota
+	qsQuoted
+	qsOpen
+	qsClose
+)
+
+type qsToken struct {
+	kind int
+	text string
+}
+
+type qsParser struct {
+	tokens []qsToken
+	pos    int
+}
+
+var errUnsupportedQuery = errors.New("Unsupported query_string syntax in memory index")
+
+// parseQueryString like ES the default operator between clauses is OR
+func parseQueryString(qs string) (memoryQuery, error) {
+	if strings.TrimSpace(qs) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeQueryString(qs)
+	if err != nil {
+		return nil, err
+	}
+	p := &qsParser{tokens: tokens}
+	query, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedQuery, qs)
+	}
+	return query, nil
+}
+
+func tokenizeQueryString(qs string) ([]qsToken, error) {
+	tokens := make([]qsToken, 0)
+	runes := []rune(qs)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, qsToken{kind: qsOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, qsToken{kind: qsClose})
+			i++
+		case r == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: %s", errUnsupportedQuery, qs)
+			}
+			tokens = append(tokens, qsToken{kind: qsQuoted, text: sb.String()})
+			i++
+		default:
+			// words keep their escapes, the field separator is found later
+			var sb strings.Builder
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					sb.WriteRune(runes[i])
+					i++
+				}
+				sb.WriteRune(runes[i])
+				if runes[i] == ':' && (sb.Len() < 2 || !strings.HasSuffix(sb.String(), "\\:")) {
+					i++
+					break
+				}
+			}
+			tokens = append(tokens, qsToken{kind: qsWord, text: sb.String()})
+		}
+	}
+	return tokens, nil
+}
+
+func (p *qsParser) peek() *qsToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *qsParser) peekWord(words ...string) bool {
+	token := p.peek()
+	if token == nil || token.kind != qsWord {
+		return false
+	}
+	for _, w := range words {
+		if token.text == w {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *qsParser) parseOr(field string) (memoryQuery, error) {
+	ret := make(memoryOr, 0)
+	for {
+		query, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, query)
+
+		if p.peekWord("OR", "||") {
+			p.pos++
+			continue
+		}
+		if token := p.peek(); token == nil || token.kind == qsClose {
+			break
+		}
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *qsParser) parseAnd(field string) (memoryQuery, error) {
+	ret := make(memoryAnd, 0)
+	for {
+		query, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, query)
+
+		if !p.peekWord("AND", "&&") {
+			break
+		}
+		p.pos++
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *qsParser) parseUnary(field string) (memoryQuery, error) {
+	if p.peekWord("NOT", "!") {
+		p.pos++
+		query, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		return memoryNot{query}, nil
+	}
+
+	token := p.peek()
+	if token != nil && token.kind == qsWord && len(token.text) > 1 {
+		switch token.text[0] {
+		case '-', '!':
+			token.text = token.text[1:]
+			query, err := p.parseUnary(field)
+			if err != nil {
+				return nil, err
+			}
+			return memoryNot{query}, nil
+		case '+':
+			token.text = token.text[1:]
+		}
+	}
+	return p.parsePrimary(field)
+}
+
+func (p *qsParser) parsePrimary(field string) (memoryQuery, error) {
+	token := p.peek()
+	if token == nil {
+		return nil, errUnsupportedQuery
+	}
+	p.pos++
+
+	switch token.kind {
+	case qsOpen:
+		query, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if token := p.peek(); token == nil || token.kind != qsClose {
+			return nil, errUnsupportedQuery
+		}
+		p.pos++
+		return query, nil
+	case qsQuoted:
+		return newMemoryTerm(field, token.text), nil
+	case qsWord:
+		if strings.HasSuffix(token.text, ":") && !strings.HasSuffix(token.text, "\\:") {
+			return p.parsePrimary(unescapeQueryString(strings.TrimSuffix(token.text, ":")))
+		}
+		if strings.HasPrefix(token.text, "[") || strings.HasPrefix(token.text, "{") {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedQuery, token.text)
+		}
+		return newMemoryTerm(field, unescapeQueryString(token.text)), nil
+	}
+	return nil, errUnsupportedQuery
+}
+
+func unescapeQueryString(s string) string {
+	var sb strings.Builder
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\\' && i+1 < len(runes) {
+			i++
+		}
+		sb.WriteRune(runes[i])
+	}
+	return sb.String()
+}
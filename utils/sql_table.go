@@ -0,0 +1,637 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vindr-lab-api/entities"
+)
+
+// SQLExecutor is a *sql.DB or a *sql.Tx
+type SQLExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// InSQLTx runs f in a new transaction committed when f succeeds, or in the
+// current one when exec already is a *sql.Tx
+func InSQLTx(exec SQLExecutor, f func(tx *sql.Tx) error) error {
+	if tx, ok := exec.(*sql.Tx); ok {
+		return f(tx)
+	}
+
+	db, ok := exec.(*sql.DB)
+	if !ok {
+		return fmt.Errorf("Cannot begin a transaction on %T", exec)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error beginning transaction: %s", err)
+	}
+	if err := f(tx); err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			LogError(err1)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLTable keeps documents as JSON in a table of a relational database, the
+// listed top level fields are copied to indexed columns. A search whose
+// filters, sort and aggregations are all on columns runs in SQL, with a
+// COUNT for the total and LIMIT/OFFSET for the page; any other search loads
+// the rows having its required terms and is answered by SearchDocuments. The
+// SQL is valid for PostgreSQL and SQLite
+type SQLTable struct {
+	exec    SQLExecutor
+	name    string
+	columns []string
+	// typed the numeric and boolean fields, see WithTypedColumns
+	typed []string
+	types map[string]string
+}
+
+func NewSQLTable(exec SQLExecutor, name string, columns ...string) *SQLTable {
+	return &SQLTable{exec: exec, name: name, columns: columns, types: map[string]string{}}
+}
+
+// WithTypedColumns the table with numeric and boolean top level fields copied
+// to indexed BIGINT columns too, types are "long" or "boolean" like in the ES
+// templates. Documents missing the field have NULL
+func (table *SQLTable) WithTypedColumns(types map[string]string) *SQLTable {
+	typed := make([]string, 0, len(types))
+	for column := range types {
+		typed = append(typed, column)
+	}
+	sort.Strings(typed)
+	return &SQLTable{exec: table.exec, name: table.name, columns: table.columns, typed: typed, types: types}
+}
+
+// WithExecutor the same table, read and written through exec
+func (table *SQLTable) WithExecutor(exec SQLExecutor) *SQLTable {
+	return &SQLTable{exec: exec, name: table.name, columns: table.columns, typed: table.typed, types: table.types}
+}
+
+// InTx runs f with the table bound to a transaction, see InSQLTx
+func (table *SQLTable) InTx(f func(table *SQLTable) error) error {
+	return InSQLTx(table.exec, func(tx *sql.Tx) error {
+		return f(table.WithExecutor(tx))
+	})
+}
+
+// CreateTable creates the table and its indices when missing, the columns
+// missing from an existing table are added and filled from the documents
+func (table *SQLTable) CreateTable() error {
+	definitions := make(map[string]string)
+	columns := make([]string, 0, len(table.columns)+len(table.typed))
+	for _, column := range table.columns {
+		definitions[column] = "TEXT NOT NULL DEFAULT ''"
+		columns = append(columns, fmt.Sprintf("%s %s, ", column, definitions[column]))
+	}
+	for _, column := range table.typed {
+		definitions[column] = "BIGINT"
+		columns = append(columns, fmt.Sprintf("%s %s, ", column, definitions[column]))
+	}
+	_, err := table.exec.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id TEXT PRIMARY KEY,
+		seq_no BIGINT NOT NULL,
+		created BIGINT NOT NULL DEFAULT 0,
+		%sdoc TEXT NOT NULL)`, table.name, strings.Join(columns, "")))
+	if err != nil {
+		return fmt.Errorf("Error creating table %s: %s", table.name, err)
+	}
+
+	if err := table.addColumns(definitions); err != nil {
+		return err
+	}
+
+	for _, column := range append([]string{"created"}, append(table.columns, table.typed...)...) {
+		_, err := table.exec.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_idx ON %s (%s)", table.name, column, table.name, column))
+		if err != nil {
+			return fmt.Errorf("Error creating index on %s.%s: %s", table.name, column, err)
+		}
+	}
+	return nil
+}
+
+// addColumns adds the columns a table created by an older version lacks, then
+// writes every row again so that they hold the values of the documents
+func (table *SQLTable) addColumns(definitions map[string]string) error {
+	rows, err := table.exec.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table.name))
+	if err != nil {
+		return fmt.Errorf("Error reading the columns of %s: %s", table.name, err)
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("Error reading the columns of %s: %s", table.name, err)
+	}
+	found := make(map[string]bool)
+	for _, column := range existing {
+		found[strings.ToLower(column)] = true
+	}
+	missing := make([]string, 0)
+	for _, column := range append(table.columns, table.typed...) {
+		if !found[column] {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return table.InTx(func(table *SQLTable) error {
+		for _, column := range missing {
+			if _, err := table.exec.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table.name, column, definitions[column])); err != nil {
+				return fmt.Errorf("Error adding column %s.%s: %s", table.name, column, err)
+			}
+		}
+		docs, err := table.load(nil, "")
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := table.writeRow(doc.ID, doc.Source, doc.SeqNo); err != nil {
+				return fmt.Errorf("Error filling the columns of %s ID=%s: %s", table.name, doc.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// columnNames the columns written for a document, in the order of row
+func (table *SQLTable) columnNames() []string {
+	columns := append([]string{"created"}, table.columns...)
+	columns = append(columns, table.typed...)
+	return append(columns, "doc")
+}
+
+// row the values written for a document: created, the columns, the typed
+// columns then the JSON
+func (table *SQLTable) row(source map[string]interface{}) ([]interface{}, error) {
+	created, _ := source["created"].(float64)
+	values := []interface{}{int64(created)}
+	for _, column := range table.columns {
+		value, _ := source[column].(string)
+		values = append(values, value)
+	}
+	for _, column := range table.typed {
+		var value interface{}
+		switch v := source[column].(type) {
+		case float64:
+			if table.types[column] == "long" {
+				value = int64(v)
+			}
+		case bool:
+			if table.types[column] == "boolean" {
+				value = boolInt(v)
+			}
+		}
+		values = append(values, value)
+	}
+
+	b, err := json.Marshal(source)
+	if err != nil {
+		return nil, err
+	}
+	return append(values, string(b)), nil
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeRow replaces the document when its stored seq_no is still seqNo
+func (table *SQLTable) writeRow(id string, source map[string]interface{}, seqNo int) error {
+	values, err := table.row(source)
+	if err != nil {
+		return fmt.Errorf("Cannot encode %s: %s", id, err)
+	}
+
+	sets := make([]string, 0, len(values))
+	for i, column := range table.columnNames() {
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, i+1))
+	}
+	n := len(values)
+
+	res, err := table.exec.Exec(fmt.Sprintf("UPDATE %s SET seq_no = seq_no + 1, %s WHERE id = $%d AND seq_no = $%d",
+		table.name, strings.Join(sets, ", "), n+1, n+2), append(values, id, seqNo)...)
+	if err != nil {
+		return fmt.Errorf("Error updating %s ID=%s: %s", table.name, id, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Index creates or replaces a document, a set revision must be the stored one
+func (table *SQLTable) Index(id string, doc interface{}, rev entities.Revision) error {
+	source, err := toSource(doc)
+	if err != nil {
+		return fmt.Errorf("Cannot encode %s: %s", id, err)
+	}
+
+	if rev.IsSet() {
+		if *rev.PrimaryTerm != memoryPrimaryTerm {
+			return ErrVersionConflict
+		}
+		return table.writeRow(id, source, *rev.SeqNo)
+	}
+
+	values, err := table.row(source)
+	if err != nil {
+		return fmt.Errorf("Cannot encode %s: %s", id, err)
+	}
+	columns := table.columnNames()
+	placeholders := []string{"$1"}
+	sets := make([]string, 0, len(columns))
+	for i, column := range columns {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+2))
+		sets = append(sets, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+
+	_, err = table.exec.Exec(fmt.Sprintf(`INSERT INTO %s (id, %s, seq_no) VALUES (%s, 1)
+		ON CONFLICT (id) DO UPDATE SET seq_no = %s.seq_no + 1, %s`,
+		table.name, strings.Join(columns, ", "), strings.Join(placeholders, ", "), table.name, strings.Join(sets, ", ")),
+		append([]interface{}{id}, values...)...)
+	if err != nil {
+		return fmt.Errorf("Error indexing %s ID=%s: %s", table.name, id, err)
+	}
+	return nil
+}
+
+// Update merges a partial document into an existing one
+func (table *SQLTable) Update(id string, doc interface{}, rev entities.Revision) error {
+	partial, err := toSource(doc)
+	if err != nil {
+		return fmt.Errorf("Error encoding query: %s", err)
+	}
+
+	return InSQLTx(table.exec, func(tx *sql.Tx) error {
+		var (
+			seqNo int
+			data  string
+		)
+		err := tx.QueryRow(fmt.Sprintf("SELECT seq_no, doc FROM %s WHERE id = $1", table.name), id).Scan(&seqNo, &data)
+		if err == sql.ErrNoRows {
+			if rev.IsSet() {
+				return ErrVersionConflict
+			}
+			return fmt.Errorf("404 Not Found ERROR updating document ID=%s: %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading %s ID=%s: %s", table.name, id, err)
+		}
+		if rev.IsSet() && (*rev.SeqNo != seqNo || *rev.PrimaryTerm != memoryPrimaryTerm) {
+			return ErrVersionConflict
+		}
+
+		source := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(data), &source); err != nil {
+			return fmt.Errorf("Error parsing %s ID=%s: %s", table.name, id, err)
+		}
+		mergeSource(source, partial)
+		return table.WithExecutor(tx).writeRow(id, source, seqNo)
+	})
+}
+
+// load the documents having the required terms that are columns, in the order they were created
+func (table *SQLTable) load(queries map[string][]string, qs string) ([]Document, error) {
+	terms, err := RequiredTerms(queries, qs)
+	if err != nil {
+		return nil, err
+	}
+
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if id, found := terms["_id"]; found {
+		args = append(args, id)
+		where = append(where, fmt.Sprintf("id = $%d", len(args)))
+	}
+	for _, column := range table.columns {
+		if value, found := terms[column]; found {
+			args = append(args, value)
+			where = append(where, fmt.Sprintf("%s = $%d", column, len(args)))
+		}
+	}
+	query := fmt.Sprintf("SELECT id, seq_no, doc FROM %s", table.name)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return table.scan(query+" ORDER BY created, id", args...)
+}
+
+// scan the documents selected by a query of id, seq_no and doc
+func (table *SQLTable) scan(query string, args ...interface{}) ([]Document, error) {
+	rows, err := table.exec.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying %s: %s", table.name, err)
+	}
+	defer rows.Close()
+
+	docs := make([]Document, 0)
+	for rows.Next() {
+		var (
+			doc  Document
+			data string
+		)
+		if err := rows.Scan(&doc.ID, &doc.SeqNo, &data); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", table.name, err)
+		}
+		if err := json.Unmarshal([]byte(data), &doc.Source); err != nil {
+			return nil, fmt.Errorf("Error parsing %s ID=%s: %s", table.name, doc.ID, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// sqlWhere a WHERE clause and its arguments, numbered from $1
+type sqlWhere struct {
+	table *SQLTable
+	args  []interface{}
+}
+
+func (w *sqlWhere) arg(v interface{}) string {
+	w.args = append(w.args, v)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// where the WHERE clause of the filters like matchQueries reads them, false
+// when one of them is not on a column or would not match the same in SQL, e.g.
+// a wildcard or a text field
+func (table *SQLTable) where(queries map[string][]string, qs string) (*sqlWhere, string, bool, error) {
+	query, err := parseQueryString(qs)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	w := &sqlWhere{table: table}
+	filters, should := make(memoryAnd, 0), make(memoryOr, 0)
+	fields := make([]string, 0, len(queries))
+	for field := range queries {
+		fields = append(fields, field)
+	}
+	// placeholders are numbered in the order they appear, SQLite binds them so
+	sort.Strings(fields)
+	for _, field := range fields {
+		values := queries[field]
+		if len(values) == 1 {
+			filters = append(filters, newMemoryTerm(field, values[0]))
+		}
+		for _, v := range values {
+			if len(values) > 1 {
+				should = append(should, newMemoryTerm(field, v))
+			}
+		}
+	}
+	if len(should) > 0 {
+		filters = append(filters, should)
+	}
+	if query != nil {
+		filters = append(filters, query)
+	}
+	if len(filters) == 0 {
+		return w, "1 = 1", true, nil
+	}
+	clause, ok := w.query(filters)
+	return w, clause, ok, nil
+}
+
+func (w *sqlWhere) query(q memoryQuery) (string, bool) {
+	switch t := q.(type) {
+	case memoryAnd:
+		return w.join(t, " AND ")
+	case memoryOr:
+		return w.join(t, " OR ")
+	case memoryNot:
+		clause, ok := w.query(t.query)
+		return "NOT " + clause, ok
+	case memoryTerm:
+		clause, ok := w.term(t)
+		return "(" + clause + ")", ok
+	}
+	return "", false
+}
+
+func (w *sqlWhere) join(subs []memoryQuery, op string) (string, bool) {
+	if len(subs) == 0 {
+		return "", false
+	}
+	clauses := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		clause, ok := w.query(sub)
+		if !ok {
+			return "", false
+		}
+		clauses = append(clauses, clause)
+	}
+	return "(" + strings.Join(clauses, op) + ")", true
+}
+
+// term the SQL of a term as memoryTerm.match reads it, typed columns are
+// never NULL in the result so that NOT keeps documents missing the field
+func (w *sqlWhere) term(q memoryTerm) (string, bool) {
+	table := w.table
+	if strings.ContainsAny(q.value, "*?") && q.value != "*" {
+		return "", false
+	}
+
+	if q.field == "_id" || q.keyword && contains(table.columns, q.field) {
+		column := q.field
+		if column == "_id" {
+			column = "id"
+		}
+		switch {
+		case q.op != "":
+			return "", false
+		case q.value == "*":
+			return fmt.Sprintf("%s <> ''", column), true
+		}
+		return fmt.Sprintf("%s = %s", column, w.arg(q.value)), true
+	}
+
+	if q.field != "created" && table.types[q.field] == "" {
+		return "", false
+	}
+	column := q.field
+	notNull := fmt.Sprintf("%s IS NOT NULL", column)
+	if q.value == "*" {
+		if q.op != "" {
+			return "", false
+		}
+		return notNull, true
+	}
+	if table.types[column] == "boolean" {
+		if q.op != "" || q.keyword {
+			return "", false
+		}
+		switch strings.ToLower(q.value) {
+		case "true", "false":
+			return fmt.Sprintf("%s AND %s = %s", notNull, column, w.arg(boolInt(strings.ToLower(q.value) == "true"))), true
+		}
+		return "", false
+	}
+	n, err := strconv.ParseInt(q.value, 10, 64)
+	// a number written another way would not match its text in the document
+	if err != nil || q.op == "" && strconv.FormatInt(n, 10) != q.value {
+		return "", false
+	}
+	op := q.op
+	if op == "" {
+		op = "="
+	}
+	return fmt.Sprintf("%s AND %s %s %s", notNull, column, op, w.arg(n)), true
+}
+
+// orderBy the ORDER BY of the sort when every field is a typed column or
+// created, documents missing the field come last in both orders like in
+// lessSource, then in the order they were created
+func (table *SQLTable) orderBy(sortRaw string) (string, bool) {
+	orders := make([]string, 0)
+	for _, s := range parseMemorySort(sortRaw) {
+		if s.field != "created" && table.types[s.field] == "" {
+			return "", false
+		}
+		direction := ""
+		if s.desc {
+			direction = " DESC"
+		}
+		orders = append(orders, fmt.Sprintf("%s IS NULL, %s%s", s.field, s.field, direction))
+	}
+	return strings.Join(append(orders, "created, id"), ", "), true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns the matching documents in the shape of an ES search response
+func (table *SQLTable) Search(queries map[string][]string, qs string, from, size int, sortRaw string, aggs []string) (*entities.ESReturn, error) {
+	w, clause, ok, err := table.where(queries, qs)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, sortable := table.orderBy(sortRaw)
+	for _, agg := range aggs {
+		ok = ok && contains(table.columns, agg)
+	}
+	if !ok || !sortable {
+		docs, err := table.load(queries, qs)
+		if err != nil {
+			return nil, err
+		}
+		return SearchDocuments(table.name, docs, queries, qs, from, size, sortRaw, aggs)
+	}
+
+	if from < 0 {
+		from = 0
+	}
+	if size < 0 {
+		size = 10
+	}
+	esReturn := entities.ESReturn{}
+	var total int
+	if err := table.exec.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table.name, clause), w.args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("Error counting %s: %s", table.name, err)
+	}
+	esReturn.Hits.Total = entities.Total{Value: total, Relation: "eq"}
+
+	docs := make([]Document, 0)
+	if size > 0 && from < total {
+		args := append(append([]interface{}{}, w.args...), size, from)
+		docs, err = table.scan(fmt.Sprintf("SELECT id, seq_no, doc FROM %s WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d",
+			table.name, clause, orderBy, len(args)-1, len(args)), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	esReturn.Hits.Hits = documentHits(table.name, docs)
+
+	if len(aggs) > 0 {
+		aggregations := make(map[string]entities.Aggregation)
+		for _, agg := range aggs {
+			counts, err := table.count(agg, clause, w.args)
+			if err != nil {
+				return nil, err
+			}
+			aggregations[agg] = termsAggregation(counts)
+		}
+		esReturn.Aggregations = &aggregations
+	}
+	return &esReturn, nil
+}
+
+// count the matching documents by value of a column, documents missing the
+// field count as the empty string
+func (table *SQLTable) count(column, clause string, args []interface{}) (map[string]int, error) {
+	rows, err := table.exec.Query(fmt.Sprintf("SELECT %s, COUNT(*) FROM %s WHERE %s GROUP BY %s",
+		column, table.name, clause, column), args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error aggregating %s.%s: %s", table.name, column, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			value string
+			count int
+		)
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", table.name, err)
+		}
+		counts[value] = count
+	}
+	return counts, rows.Err()
+}
+
+// Delete removes every document matching the query
+func (table *SQLTable) Delete(queries map[string][]string, qs string) error {
+	w, clause, ok, err := table.where(queries, qs)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if _, err := table.exec.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table.name, clause), w.args...); err != nil {
+			return fmt.Errorf("Error deleting %s: %s", table.name, err)
+		}
+		return nil
+	}
+
+	query, err := parseQueryString(qs)
+	if err != nil {
+		return err
+	}
+	return InSQLTx(table.exec, func(tx *sql.Tx) error {
+		docs, err := table.WithExecutor(tx).load(queries, qs)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if !matchQueries(doc.ID, doc.Source, queries, query) {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", table.name), doc.ID); err != nil {
+				return fmt.Errorf("Error deleting %s ID=%s: %s", table.name, doc.ID, err)
+			}
+		}
+		return nil
+	})
+}